@@ -722,7 +722,7 @@ deployment-package/
 | \`SERVER_HOST\` | Backend bind address | localhost | ❌ |
 | \`CORS_ALLOWED_ORIGINS\` | Allowed CORS origins | localhost:8090 | ❌ |
 | \`DATA_DIR\` | Data storage directory | ./data | ❌ |
-| \`BACKUP_RETENTION_DAYS\` | Backup retention period | 30 | ❌ |
+| \`BACKUP_RETENTION_DAYS\` | Maximum backup age in days (0 = no limit) | 30 | ❌ |
 | \`LOG_LEVEL\` | Logging level | info | ❌ |
 | \`GIN_MODE\` | Go Gin framework mode | release | ❌ |
 
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"task-api/config"
+	"task-api/storage"
+)
+
+// runCommand runs an administrative command and returns the process exit code
+func runCommand(cfg *config.Config, args []string) int {
+	switch args[0] {
+	case "rotate-key":
+		return rotateKeyCommand(cfg)
+	case "keyring":
+		return keyringCommand(cfg, args[1:])
+	case "recovery":
+		return recoveryCommand(cfg, args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage: task-api [command]")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Without a command the API server is started.")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  rotate-key             move the data file and all backups to the active master key")
+	fmt.Fprintln(os.Stderr, "  keyring list           list the keys in MASTER_KEYRING_FILE")
+	fmt.Fprintln(os.Stderr, "  keyring generate       add a new active master key, retiring the current one")
+	fmt.Fprintln(os.Stderr, "  keyring revoke <id>    destroy a retired master key after rotating away from it")
+	fmt.Fprintln(os.Stderr, "  recovery init [-shares N] [-threshold K]")
+	fmt.Fprintln(os.Stderr, "                         create a recovery key split into N shares, any K of which recover the data")
+	fmt.Fprintln(os.Stderr, "  recovery restore [share...]")
+	fmt.Fprintln(os.Stderr, "                         re-wrap all data under the configured master key using recovery shares")
+	fmt.Fprintln(os.Stderr, "                         (read one per line from stdin if none are given)")
+}
+
+// rotateKeyCommand moves all data to the active master key. The server
+// should be stopped first; use POST /api/admin/rotate-key while it runs.
+func rotateKeyCommand(cfg *config.Config) int {
+	taskRepo, err := openTaskRepository(cfg)
+	if err != nil {
+		log.Printf("Failed to initialize task repository: %v", err)
+		return 1
+	}
+
+	report, rotateErr := taskRepo.RotateEncryptionKey()
+	if err := taskRepo.Close(); err != nil {
+		log.Printf("Failed to persist tasks: %v", err)
+		return 1
+	}
+	if rotateErr != nil {
+		log.Printf("Key rotation failed, run the command again to resume: %v", rotateErr)
+		return 1
+	}
+
+	output, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(output))
+
+	if len(report.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// keyringCommand manages the master keys in the local keyring file. It
+// works on the file directly, so the server has to be restarted to pick up
+// a new key.
+func keyringCommand(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "list":
+		keys, err := storage.ListMasterKeys(cfg.MasterKeyringFile)
+		if err != nil {
+			log.Printf("Failed to read master keyring: %v", err)
+			return 1
+		}
+		output, _ := json.MarshalIndent(keys, "", "  ")
+		fmt.Println(string(output))
+		return 0
+	case "generate":
+		keyID, err := storage.GenerateMasterKey(cfg.MasterKeyringFile)
+		if err != nil {
+			log.Printf("Failed to generate master key: %v", err)
+			return 1
+		}
+		fmt.Printf("Generated master key %s; restart the server and run rotate-key to re-wrap existing data\n", keyID)
+		return 0
+	case "revoke":
+		if len(args) != 2 {
+			printUsage()
+			return 2
+		}
+		if err := storage.RevokeMasterKey(cfg.MasterKeyringFile, args[1]); err != nil {
+			log.Printf("Failed to revoke master key: %v", err)
+			return 1
+		}
+		fmt.Printf("Revoked master key %s\n", args[1])
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown keyring command %q\n\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+// recoveryCommand sets up the recovery key or uses its shares to regain
+// access to the data. The server must be stopped.
+func recoveryCommand(cfg *config.Config, args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+
+	switch args[0] {
+	case "init":
+		return recoveryInitCommand(cfg, args[1:])
+	case "restore":
+		return recoveryRestoreCommand(cfg, args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown recovery command %q\n\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+// recoveryInitCommand creates a new recovery key, re-wraps all data for it
+// and prints the shares. Any previous recovery key stops working once the
+// rotation completes.
+func recoveryInitCommand(cfg *config.Config, args []string) int {
+	flags := flag.NewFlagSet("recovery init", flag.ContinueOnError)
+	shares := flags.Int("shares", 5, "number of recovery shares to create")
+	threshold := flags.Int("threshold", 3, "number of shares needed to recover")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	encryptedStorage, err := openEncryptedStorage(cfg)
+	if err != nil {
+		log.Printf("Failed to initialize encrypted storage: %v", err)
+		return 1
+	}
+	taskRepo, err := openTaskRepositoryWithStorage(cfg, encryptedStorage)
+	if err != nil {
+		log.Printf("Failed to initialize task repository: %v", err)
+		return 1
+	}
+
+	recoveryKey, encodedShares, err := storage.GenerateRecoveryKey(*shares, *threshold)
+	if err != nil {
+		taskRepo.Close()
+		log.Printf("Failed to create recovery key: %v", err)
+		return 1
+	}
+	if err := encryptedStorage.SetupRecovery(recoveryKey); err != nil {
+		taskRepo.Close()
+		log.Printf("Failed to set up recovery key: %v", err)
+		return 1
+	}
+
+	report, rotateErr := taskRepo.RotateEncryptionKey()
+	if err := taskRepo.Close(); err != nil {
+		log.Printf("Failed to persist tasks: %v", err)
+		return 1
+	}
+	if rotateErr != nil {
+		log.Printf("Failed to add the recovery key to existing data, run rotate-key to finish: %v", rotateErr)
+		return 1
+	}
+
+	fmt.Printf("Recovery key %s created. Any %d of these %d shares recover the data;\n", recoveryKey.ID, *threshold, *shares)
+	fmt.Println("give each to a different person and do not store them with the data:")
+	fmt.Println()
+	for _, share := range encodedShares {
+		fmt.Println(share)
+	}
+	fmt.Println()
+
+	if len(report.Failed) > 0 {
+		fmt.Printf("These backups could not be re-wrapped and are not covered by the recovery key: %s\n", strings.Join(report.Failed, ", "))
+		return 1
+	}
+	return 0
+}
+
+// recoveryRestoreCommand reconstructs the recovery key from shares and
+// re-wraps every file under the currently configured master key, e.g. a
+// new TASK_ENCRYPTION_KEY after the old one was lost
+func recoveryRestoreCommand(cfg *config.Config, args []string) int {
+	shares := args
+	if len(shares) == 0 {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				shares = append(shares, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			log.Printf("Failed to read recovery shares: %v", err)
+			return 1
+		}
+	}
+
+	encryptedStorage, err := openEncryptedStorage(cfg)
+	if err != nil {
+		log.Printf("Failed to initialize encrypted storage: %v", err)
+		return 1
+	}
+
+	recoveryKey, err := encryptedStorage.ReadRecoveryKey()
+	if err != nil {
+		log.Printf("Failed to read recovery key: %v", err)
+		return 1
+	}
+	if recoveryKey == nil {
+		log.Printf("No recovery key is set up in %s", cfg.DataDir)
+		return 1
+	}
+	if err := encryptedStorage.CryptoService().StartRecovery(recoveryKey, shares); err != nil {
+		log.Printf("Recovery failed: %v", err)
+		return 1
+	}
+	log.Printf("Recovery key %s reconstructed from %d shares", recoveryKey.ID, len(shares))
+
+	taskRepo, err := openTaskRepositoryWithStorage(cfg, encryptedStorage)
+	if err != nil {
+		log.Printf("Failed to open data with the recovery key: %v", err)
+		return 1
+	}
+
+	report, rotateErr := taskRepo.RotateEncryptionKey()
+	if err := taskRepo.Close(); err != nil {
+		log.Printf("Failed to persist tasks: %v", err)
+		return 1
+	}
+	if rotateErr != nil {
+		log.Printf("Recovery failed, run the command again to resume: %v", rotateErr)
+		return 1
+	}
+
+	output, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(output))
+
+	if len(report.Failed) > 0 {
+		return 1
+	}
+	return 0
+}
@@ -2,10 +2,13 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"task-api/utils"
+	"time"
 )
 
 // Config holds all configuration for the application
@@ -15,11 +18,57 @@ type Config struct {
 	GinMode string
 	
 	// Encryption configuration
-	EncryptionKey string
+	EncryptionKey         string
+	EncryptionKeyID       string
+	RetiredEncryptionKeys []RetiredKey
+	KDFAlgorithm          string
+	KDFIterations         int
+	KDFArgon2MemoryKB     int
+	KDFArgon2Threads      int
+	
+	// Master key configuration for envelope encryption
+	KeyProvider       string
+	MasterKeyringFile string
+	KMSKeyID          string
+	KMSMasterKey      string
+	KMSMasterKeyFile  string
+	KMSRetiredKeys    []RetiredKey
 	
 	// Storage configuration
 	DataDir              string
 	BackupRetentionDays  int
+	BackupKeepLast       int
+	BackupKeepHourly     int
+	BackupKeepDaily      int
+	BackupKeepWeekly     int
+	BackupKeepMonthly    int
+	BackupMaxCount       int
+	BackupMaxSizeMB      int
+	BackupSchedule       string
+	StorageBackend       string
+	StorageFilesystem    string
+	StorageFaults        string
+	StorageCompression   string
+	FlushIntervalMs      int
+	WALCompactThreshold  int
+	CorruptionRecovery   string
+	
+	// Offsite backup replication to S3-compatible object storage
+	ReplicationS3Endpoint  string
+	ReplicationS3Region    string
+	ReplicationS3Bucket    string
+	ReplicationS3AccessKey string
+	ReplicationS3SecretKey string
+	ReplicationS3Prefix    string
+	ReplicationS3PathStyle bool
+	ReplicationMaxAttempts int
+	
+	// Subtask configuration
+	SubtaskMaxDepth     int
+	SubtaskAutoComplete bool
+	
+	// Dependency configuration
+	DependencyBlockCompletion bool
 	
 	// CORS configuration
 	CORSAllowedOrigins []string
@@ -28,29 +77,92 @@ type Config struct {
 	LogLevel string
 }
 
+// RetiredKey is a previous encryption key that is still accepted for
+// decrypting data that has not been rotated yet
+type RetiredKey struct {
+	ID  string
+	Key string
+}
+
 // LoadConfig loads configuration from environment variables with defaults
 func LoadConfig() (*Config, error) {
 	cfg := &Config{
 		Port:                getEnvWithDefault("PORT", "8080"),
+		EncryptionKeyID:     getEnvWithDefault("TASK_ENCRYPTION_KEY_ID", "primary"),
+		KDFAlgorithm:        getEnvWithDefault("KDF_ALGORITHM", "pbkdf2"),
+		KDFIterations:       getEnvIntWithDefault("KDF_ITERATIONS", 0),
+		KDFArgon2MemoryKB:   getEnvIntWithDefault("KDF_ARGON2_MEMORY_KB", 65536),
+		KDFArgon2Threads:    getEnvIntWithDefault("KDF_ARGON2_THREADS", 4),
+		KeyProvider:         getEnvWithDefault("KEY_PROVIDER", "password"),
+		MasterKeyringFile:   getEnvWithDefault("MASTER_KEYRING_FILE", "./keyring.json"),
+		KMSKeyID:            getEnvWithDefault("KMS_KEY_ID", "kms-primary"),
+		KMSMasterKey:        os.Getenv("KMS_MASTER_KEY"),
+		KMSMasterKeyFile:    os.Getenv("KMS_MASTER_KEY_FILE"),
 		GinMode:             getEnvWithDefault("GIN_MODE", "debug"),
 		DataDir:             getEnvWithDefault("DATA_DIR", "./data"),
-		BackupRetentionDays: getEnvIntWithDefault("BACKUP_RETENTION_DAYS", 30),
+		BackupRetentionDays: getEnvIntWithDefault("BACKUP_RETENTION_DAYS", 400),
+		BackupKeepLast:      getEnvIntWithDefault("BACKUP_KEEP_LAST", 10),
+		BackupKeepHourly:    getEnvIntWithDefault("BACKUP_KEEP_HOURLY", 24),
+		BackupKeepDaily:     getEnvIntWithDefault("BACKUP_KEEP_DAILY", 7),
+		BackupKeepWeekly:    getEnvIntWithDefault("BACKUP_KEEP_WEEKLY", 4),
+		BackupKeepMonthly:   getEnvIntWithDefault("BACKUP_KEEP_MONTHLY", 12),
+		BackupMaxCount:      getEnvIntWithDefault("BACKUP_MAX_COUNT", 0),
+		BackupMaxSizeMB:     getEnvIntWithDefault("BACKUP_MAX_TOTAL_SIZE_MB", 0),
+		BackupSchedule:      getEnvWithDefault("BACKUP_SCHEDULE", "@hourly"),
+		StorageBackend:      getEnvWithDefault("STORAGE_BACKEND", "file"),
+		StorageFilesystem:   getEnvWithDefault("STORAGE_FILESYSTEM", "os"),
+		StorageFaults:       os.Getenv("STORAGE_FAULTS"),
+		StorageCompression:  getEnvWithDefault("STORAGE_COMPRESSION", "none"),
+		FlushIntervalMs:     getEnvIntWithDefault("FLUSH_INTERVAL_MS", 1000),
+		WALCompactThreshold: getEnvIntWithDefault("WAL_COMPACT_THRESHOLD", 1000),
+		CorruptionRecovery:  getEnvWithDefault("CORRUPTION_RECOVERY", "auto"),
+		
+		ReplicationS3Endpoint:  os.Getenv("REPLICATION_S3_ENDPOINT"),
+		ReplicationS3Region:    getEnvWithDefault("REPLICATION_S3_REGION", "us-east-1"),
+		ReplicationS3Bucket:    os.Getenv("REPLICATION_S3_BUCKET"),
+		ReplicationS3AccessKey: os.Getenv("REPLICATION_S3_ACCESS_KEY"),
+		ReplicationS3SecretKey: os.Getenv("REPLICATION_S3_SECRET_KEY"),
+		ReplicationS3Prefix:    getEnvWithDefault("REPLICATION_S3_PREFIX", "task-api/"),
+		ReplicationS3PathStyle: getEnvBoolWithDefault("REPLICATION_S3_PATH_STYLE", true),
+		ReplicationMaxAttempts: getEnvIntWithDefault("REPLICATION_MAX_ATTEMPTS", 5),
+		
+		SubtaskMaxDepth:     getEnvIntWithDefault("SUBTASK_MAX_DEPTH", 3),
+		SubtaskAutoComplete: getEnvBoolWithDefault("SUBTASK_AUTO_COMPLETE", false),
+		
+		DependencyBlockCompletion: getEnvBoolWithDefault("DEPENDENCY_BLOCK_COMPLETION", true),
+		
 		CORSAllowedOrigins:  getEnvSliceWithDefault("CORS_ALLOWED_ORIGINS", []string{"http://localhost:5173"}),
 		LogLevel:            getEnvWithDefault("LOG_LEVEL", "info"),
 	}
 	
-	// Encryption key is required
+	// Encryption key is required when it is the master key; with other key
+	// providers it is only used to read data written before envelope
+	// encryption
 	encryptionKey := os.Getenv("TASK_ENCRYPTION_KEY")
-	if encryptionKey == "" {
+	if encryptionKey == "" && cfg.KeyProvider == "password" {
 		return nil, errors.New("TASK_ENCRYPTION_KEY environment variable is required")
 	}
 	
-	if len(encryptionKey) < 32 {
+	if encryptionKey != "" && len(encryptionKey) < 32 {
 		return nil, errors.New("TASK_ENCRYPTION_KEY must be at least 32 characters long")
 	}
 	
 	cfg.EncryptionKey = encryptionKey
 	
+	// Retired keys are optional and given as "id:key,id:key"
+	retiredKeys, err := parseRetiredKeys("TASK_RETIRED_ENCRYPTION_KEYS", os.Getenv("TASK_RETIRED_ENCRYPTION_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.RetiredEncryptionKeys = retiredKeys
+	
+	// Retired KMS master keys are given as "id:base64key,id:base64key"
+	kmsRetiredKeys, err := parseRetiredKeys("KMS_RETIRED_KEYS", os.Getenv("KMS_RETIRED_KEYS"))
+	if err != nil {
+		return nil, err
+	}
+	cfg.KMSRetiredKeys = kmsRetiredKeys
+	
 	// Validate configuration
 	if err := cfg.Validate(); err != nil {
 		return nil, err
@@ -72,14 +184,136 @@ func (c *Config) Validate() error {
 		return errors.New("invalid GIN_MODE, must be one of: debug, release, test")
 	}
 	
+	// Validate encryption key IDs
+	if !validKeyID(c.EncryptionKeyID) {
+		return errors.New("invalid TASK_ENCRYPTION_KEY_ID, must be 1-64 letters, digits, '.', '_' or '-'")
+	}
+	for _, retired := range c.RetiredEncryptionKeys {
+		if retired.ID == c.EncryptionKeyID {
+			return fmt.Errorf("retired key ID %q must differ from TASK_ENCRYPTION_KEY_ID", retired.ID)
+		}
+	}
+	
+	// Validate key derivation settings; ranges are checked by the storage layer
+	validKDFs := []string{"pbkdf2", "argon2id"}
+	if !contains(validKDFs, c.KDFAlgorithm) {
+		return errors.New("invalid KDF_ALGORITHM, must be one of: pbkdf2, argon2id")
+	}
+	if c.KDFIterations < 0 || c.KDFArgon2MemoryKB < 0 || c.KDFArgon2Threads < 0 {
+		return errors.New("KDF parameters cannot be negative")
+	}
+	
+	// Validate master key provider
+	validProviders := []string{"password", "keyring", "kms"}
+	if !contains(validProviders, c.KeyProvider) {
+		return errors.New("invalid KEY_PROVIDER, must be one of: password, keyring, kms")
+	}
+	switch c.KeyProvider {
+	case "keyring":
+		if c.MasterKeyringFile == "" {
+			return errors.New("MASTER_KEYRING_FILE cannot be empty")
+		}
+	case "kms":
+		if !validKeyID(c.KMSKeyID) {
+			return errors.New("invalid KMS_KEY_ID, must be 1-64 letters, digits, '.', '_' or '-'")
+		}
+		if (c.KMSMasterKey == "") == (c.KMSMasterKeyFile == "") {
+			return errors.New("exactly one of KMS_MASTER_KEY or KMS_MASTER_KEY_FILE is required")
+		}
+		for _, retired := range c.KMSRetiredKeys {
+			if retired.ID == c.KMSKeyID {
+				return fmt.Errorf("retired KMS key ID %q must differ from KMS_KEY_ID", retired.ID)
+			}
+		}
+	}
+	
 	// Validate data directory
 	if c.DataDir == "" {
 		return errors.New("data directory cannot be empty")
 	}
 	
-	// Validate backup retention days
-	if c.BackupRetentionDays < 1 {
-		return errors.New("backup retention days must be at least 1")
+	// Validate backup retention; 0 disables an age, count or size limit
+	if c.BackupRetentionDays < 0 {
+		return errors.New("backup retention days cannot be negative")
+	}
+	
+	if c.BackupKeepLast < 1 {
+		return errors.New("BACKUP_KEEP_LAST must be at least 1")
+	}
+	
+	if c.BackupKeepHourly < 0 || c.BackupKeepDaily < 0 || c.BackupKeepWeekly < 0 || c.BackupKeepMonthly < 0 {
+		return errors.New("backup retention tier counts cannot be negative")
+	}
+	
+	if c.BackupMaxCount < 0 || c.BackupMaxSizeMB < 0 {
+		return errors.New("backup count and size limits cannot be negative")
+	}
+	
+	if c.BackupMaxCount > 0 && c.BackupMaxCount < c.BackupKeepLast {
+		return errors.New("BACKUP_MAX_COUNT cannot be less than BACKUP_KEEP_LAST")
+	}
+	
+	// Validate backup schedule; "off" backs up on every write instead
+	if c.BackupSchedule != "off" {
+		if _, err := utils.ParseCronSchedule(c.BackupSchedule); err != nil {
+			return fmt.Errorf("invalid BACKUP_SCHEDULE: %w", err)
+		}
+	}
+	
+	// Validate storage backend
+	validBackends := []string{"file", "sqlite"}
+	if !contains(validBackends, c.StorageBackend) {
+		return errors.New("invalid STORAGE_BACKEND, must be one of: file, sqlite")
+	}
+	
+	// Validate the filesystem storage runs on; SQLite needs a real one
+	validFilesystems := []string{"os", "memory"}
+	if !contains(validFilesystems, c.StorageFilesystem) {
+		return errors.New("invalid STORAGE_FILESYSTEM, must be one of: os, memory")
+	}
+	
+	if c.StorageFilesystem == "memory" && c.StorageBackend != "file" {
+		return errors.New("STORAGE_FILESYSTEM=memory requires STORAGE_BACKEND=file")
+	}
+	
+	// Validate compression of data before encryption
+	validCompressions := []string{"none", "gzip", "zstd"}
+	if !contains(validCompressions, c.StorageCompression) {
+		return errors.New("invalid STORAGE_COMPRESSION, must be one of: none, gzip, zstd")
+	}
+	
+	// Validate write-behind flush interval; zero turns write-behind off
+	if c.FlushIntervalMs != 0 && (c.FlushIntervalMs < 10 || c.FlushIntervalMs > 60000) {
+		return errors.New("flush interval must be 0 or between 10 and 60000 milliseconds")
+	}
+	
+	// Validate write-ahead log compaction threshold
+	if c.WALCompactThreshold < 1 {
+		return errors.New("WAL compaction threshold must be at least 1")
+	}
+	
+	// Validate what to do with a corrupt data file at startup
+	validRecoveryModes := []string{"auto", "refuse", "read-only"}
+	if !contains(validRecoveryModes, c.CorruptionRecovery) {
+		return errors.New("invalid CORRUPTION_RECOVERY, must be one of: auto, refuse, read-only")
+	}
+	
+	// Validate the replication target if replication is enabled
+	if c.ReplicationS3Endpoint != "" {
+		if c.ReplicationS3Bucket == "" {
+			return errors.New("REPLICATION_S3_BUCKET is required when REPLICATION_S3_ENDPOINT is set")
+		}
+		if c.ReplicationS3AccessKey == "" || c.ReplicationS3SecretKey == "" {
+			return errors.New("REPLICATION_S3_ACCESS_KEY and REPLICATION_S3_SECRET_KEY are required when REPLICATION_S3_ENDPOINT is set")
+		}
+		if c.ReplicationMaxAttempts < 1 {
+			return errors.New("REPLICATION_MAX_ATTEMPTS must be at least 1")
+		}
+	}
+	
+	// Validate subtask nesting; 0 disables subtasks
+	if c.SubtaskMaxDepth < 0 {
+		return errors.New("SUBTASK_MAX_DEPTH cannot be negative")
 	}
 	
 	// Validate log level
@@ -97,10 +331,59 @@ func (c *Config) LogConfiguration() {
 	log.Printf("  Port: %s", c.Port)
 	log.Printf("  GIN Mode: %s", c.GinMode)
 	log.Printf("  Data Directory: %s", c.DataDir)
-	log.Printf("  Backup Retention Days: %d", c.BackupRetentionDays)
+	log.Printf("  Backup Retention: last %d, hourly %d, daily %d, weekly %d, monthly %d",
+		c.BackupKeepLast, c.BackupKeepHourly, c.BackupKeepDaily, c.BackupKeepWeekly, c.BackupKeepMonthly)
+	log.Printf("  Backup Limits: %s days, %s backups, %s MB",
+		limitString(c.BackupRetentionDays), limitString(c.BackupMaxCount), limitString(c.BackupMaxSizeMB))
+	log.Printf("  Backup Schedule: %s", c.BackupSchedule)
+	log.Printf("  Storage Backend: %s", c.StorageBackend)
+	log.Printf("  Storage Filesystem: %s", c.StorageFilesystem)
+	if c.StorageFaults != "" {
+		log.Printf("  Storage Faults: %s", c.StorageFaults)
+	}
+	log.Printf("  Storage Compression: %s", c.StorageCompression)
+	if c.FlushIntervalMs == 0 {
+		log.Printf("  Write-Behind: off")
+	} else {
+		log.Printf("  Write-Behind: every %dms", c.FlushIntervalMs)
+	}
+	log.Printf("  WAL Compact Threshold: %d", c.WALCompactThreshold)
+	log.Printf("  Corruption Recovery: %s", c.CorruptionRecovery)
+	if c.ReplicationS3Endpoint != "" {
+		log.Printf("  Backup Replication: s3://%s/%s at %s (%d attempts)",
+			c.ReplicationS3Bucket, c.ReplicationS3Prefix, c.ReplicationS3Endpoint, c.ReplicationMaxAttempts)
+	} else {
+		log.Printf("  Backup Replication: off")
+	}
+	log.Printf("  Subtask Max Depth: %d", c.SubtaskMaxDepth)
+	log.Printf("  Subtask Auto-Complete: %t", c.SubtaskAutoComplete)
+	log.Printf("  Dependency Block Completion: %t", c.DependencyBlockCompletion)
 	log.Printf("  CORS Allowed Origins: %v", c.CORSAllowedOrigins)
 	log.Printf("  Log Level: %s", c.LogLevel)
-	log.Printf("  Encryption Key: [CONFIGURED]")
+	log.Printf("  Key Provider: %s", c.KeyProvider)
+	switch c.KeyProvider {
+	case "keyring":
+		log.Printf("  Master Keyring File: %s", c.MasterKeyringFile)
+	case "kms":
+		log.Printf("  KMS Key ID: %s", c.KMSKeyID)
+		log.Printf("  Retired KMS Keys: %d", len(c.KMSRetiredKeys))
+	}
+	if c.EncryptionKey != "" {
+		log.Printf("  Encryption Key: [CONFIGURED]")
+	} else {
+		log.Printf("  Encryption Key: [NOT SET]")
+	}
+	log.Printf("  Encryption Key ID: %s", c.EncryptionKeyID)
+	log.Printf("  Retired Encryption Keys: %d", len(c.RetiredEncryptionKeys))
+	log.Printf("  KDF Algorithm: %s", c.KDFAlgorithm)
+}
+
+// limitString formats an optional limit where 0 means unlimited
+func limitString(limit int) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(limit)
 }
 
 // getEnvWithDefault returns environment variable value or default if not set
@@ -122,6 +405,17 @@ func getEnvIntWithDefault(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvBoolWithDefault returns environment variable as boolean or default if not set
+func getEnvBoolWithDefault(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if boolValue, err := strconv.ParseBool(value); err == nil {
+			return boolValue
+		}
+		log.Printf("Warning: Invalid boolean value for %s: %s, using default: %t", key, value, defaultValue)
+	}
+	return defaultValue
+}
+
 // getEnvSliceWithDefault returns environment variable as slice or default if not set
 func getEnvSliceWithDefault(key string, defaultValue []string) []string {
 	if value := os.Getenv(key); value != "" {
@@ -140,6 +434,50 @@ func getEnvSliceWithDefault(key string, defaultValue []string) []string {
 	return defaultValue
 }
 
+// parseRetiredKeys parses a comma separated list of id:key pairs from the
+// named environment variable
+func parseRetiredKeys(name, value string) ([]RetiredKey, error) {
+	var keys []RetiredKey
+	seen := map[string]bool{}
+	
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		
+		id, key, ok := strings.Cut(part, ":")
+		if !ok || !validKeyID(id) {
+			return nil, fmt.Errorf("invalid %s, entries must be id:key with a valid key ID", name)
+		}
+		if len(key) < 32 {
+			return nil, fmt.Errorf("retired encryption key %q must be at least 32 characters long", id)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("retired encryption key ID %q is listed more than once", id)
+		}
+		seen[id] = true
+		
+		keys = append(keys, RetiredKey{ID: id, Key: key})
+	}
+	
+	return keys, nil
+}
+
+// validKeyID checks that a key ID fits in a file header: 1-64 letters,
+// digits, '.', '_' or '-'
+func validKeyID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-') {
+			return false
+		}
+	}
+	return true
+}
+
 // contains checks if a slice contains a string
 func contains(slice []string, item string) bool {
 	for _, s := range slice {
@@ -160,6 +498,12 @@ func (c *Config) IsProduction() bool {
 	return c.GinMode == "release"
 }
 
+// GetFlushInterval returns the write-behind flush interval as a duration,
+// zero if every change is written through
+func (c *Config) GetFlushInterval() time.Duration {
+	return time.Duration(c.FlushIntervalMs) * time.Millisecond
+}
+
 // GetServerAddress returns the full server address
 func (c *Config) GetServerAddress() string {
 	return ":" + c.Port
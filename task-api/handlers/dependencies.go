@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"task-api/services"
+	"task-api/utils"
+)
+
+// GetDependencies handles GET /api/tasks/:id/dependencies
+func (h *TaskHandler) GetDependencies(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	graph, err := h.taskService.GetDependencies(id)
+	if err != nil {
+		if strings.Contains(err.Error(), "not found") {
+			utils.NotFoundResponse(c, "Task")
+			return
+		}
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, graph)
+}
+
+// dependencyErrorResponse answers a change rejected because of the
+// dependencies between tasks, reporting whether err was one. Completing a
+// blocked task returns the open blockers in data.
+func dependencyErrorResponse(c *gin.Context, err error) bool {
+	var blocked *services.BlockedError
+	switch {
+	case errors.As(err, &blocked):
+		utils.ConflictResponse(c, err.Error(), map[string]interface{}{
+			"blockedBy": blocked.Blockers,
+		})
+	case errors.Is(err, services.ErrDependencyCycle):
+		utils.ErrorResponseJSON(c, http.StatusConflict, err.Error())
+	case errors.Is(err, services.ErrInvalidDependency):
+		utils.BadRequestResponse(c, err.Error())
+	default:
+		return false
+	}
+	return true
+}
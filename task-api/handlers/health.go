@@ -5,15 +5,20 @@ import (
 	"time"
 	
 	"github.com/gin-gonic/gin"
+	"task-api/storage"
 	"task-api/utils"
 )
 
 // HealthHandler handles health check requests
-type HealthHandler struct{}
+type HealthHandler struct {
+	// incident is the corrupt data file recovered at startup, if any
+	incident *storage.CorruptionIncident
+}
 
-// NewHealthHandler creates a new health handler
-func NewHealthHandler() *HealthHandler {
-	return &HealthHandler{}
+// NewHealthHandler creates a new health handler reporting the given
+// corruption incident, which may be nil
+func NewHealthHandler(incident *storage.CorruptionIncident) *HealthHandler {
+	return &HealthHandler{incident: incident}
 }
 
 // HealthCheck handles GET /api/health
@@ -35,14 +40,25 @@ func (h *HealthHandler) ReadinessCheck(c *gin.Context) {
 	// - External service availability
 	// - File system permissions
 	
+	status, storageCheck := "ready", "ok"
+	if h.incident != nil {
+		storageCheck = "recovered"
+		if h.incident.ReadOnly {
+			status, storageCheck = "degraded", "read-only"
+		}
+	}
+	
 	response := map[string]interface{}{
-		"status": "ready",
+		"status": status,
 		"timestamp": time.Now().UTC().Format(time.RFC3339),
 		"checks": map[string]string{
-			"storage": "ok",
+			"storage": storageCheck,
 			"encryption": "ok",
 		},
 	}
+	if h.incident != nil {
+		response["incident"] = h.incident
+	}
 	
 	utils.SuccessResponse(c, http.StatusOK, response)
 }
\ No newline at end of file
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"task-api/models"
+	"task-api/services"
+	"task-api/utils"
+)
+
+// ListProjects handles GET /api/projects, leaving out archived projects
+// unless includeArchived=true
+func (h *TaskHandler) ListProjects(c *gin.Context) {
+	includeArchived := c.Query("includeArchived") == "true"
+
+	projects, err := h.taskService.ListProjects(includeArchived)
+	if err != nil {
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"projects": projects,
+		"total":    len(projects),
+	}
+	utils.SuccessResponse(c, http.StatusOK, response)
+}
+
+// GetProject handles GET /api/projects/:id
+func (h *TaskHandler) GetProject(c *gin.Context) {
+	project, err := h.taskService.GetProject(strings.TrimSpace(c.Param("id")))
+	if err != nil {
+		h.projectErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, project)
+}
+
+// CreateProject handles POST /api/projects
+func (h *TaskHandler) CreateProject(c *gin.Context) {
+	var formData models.ProjectFormData
+	if err := c.ShouldBindJSON(&formData); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	project, err := h.taskService.CreateProject(formData)
+	if err != nil {
+		h.projectErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusCreated, project)
+}
+
+// UpdateProject handles PUT /api/projects/:id
+func (h *TaskHandler) UpdateProject(c *gin.Context) {
+	var updates models.ProjectUpdate
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	project, err := h.taskService.UpdateProject(strings.TrimSpace(c.Param("id")), updates)
+	if err != nil {
+		h.projectErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, project)
+}
+
+// DeleteProject handles DELETE /api/projects/:id?tasks=cascade|reassign.
+// With reassign the tasks move to the project given by to, or out of every
+// project without it.
+func (h *TaskHandler) DeleteProject(c *gin.Context) {
+	mode := services.ProjectDeleteMode(c.Query("tasks"))
+	affected, err := h.taskService.DeleteProject(strings.TrimSpace(c.Param("id")), mode, strings.TrimSpace(c.Query("to")))
+	if err != nil {
+		h.projectErrorResponse(c, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"tasks": affected,
+		"mode":  mode,
+	}
+	utils.SuccessResponseWithMessage(c, http.StatusOK, response, "Project deleted")
+}
+
+// GetProjectTasks handles GET /api/projects/:id/tasks, which takes the same
+// parameters as GET /api/tasks, such as quadrant for a single quadrant of
+// the project's matrix
+func (h *TaskHandler) GetProjectTasks(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if _, err := h.taskService.GetProject(id); err != nil {
+		h.projectErrorResponse(c, err)
+		return
+	}
+
+	h.listTasks(c, &id)
+}
+
+// MoveTaskToProject handles PATCH /api/tasks/:id/project
+func (h *TaskHandler) MoveTaskToProject(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var request models.ProjectMoveRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	projectID := ""
+	if request.ProjectID != nil {
+		projectID = *request.ProjectID
+	}
+
+	task, err := h.taskService.MoveTaskToProject(id, projectID, version)
+	if err != nil {
+		if versionConflictResponse(c, err) || projectTargetResponse(c, err) {
+			return
+		}
+		if errors.Is(err, services.ErrInvalidHierarchy) {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
+		if strings.Contains(err.Error(), "not found") {
+			utils.NotFoundResponse(c, "Task")
+			return
+		}
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusOK, task)
+}
+
+// projectTargetResponse answers a change that would put a task into a
+// missing or archived project, reporting whether err was one
+func projectTargetResponse(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, services.ErrProjectNotFound):
+		utils.BadRequestResponse(c, err.Error())
+	case errors.Is(err, services.ErrProjectArchived):
+		utils.ErrorResponseJSON(c, http.StatusConflict, err.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+// projectErrorResponse maps errors of project operations to responses
+func (h *TaskHandler) projectErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrProjectNotFound) {
+		utils.NotFoundResponse(c, "Project")
+		return
+	}
+	if errors.Is(err, services.ErrProjectExists) || errors.Is(err, services.ErrProjectNotEmpty) ||
+		errors.Is(err, services.ErrProjectArchived) {
+		utils.ErrorResponseJSON(c, http.StatusConflict, err.Error())
+		return
+	}
+	if strings.Contains(err.Error(), "validation") {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+	utils.InternalErrorResponse(c, err)
+}
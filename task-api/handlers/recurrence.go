@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"task-api/models"
+	"task-api/services"
+	"task-api/utils"
+)
+
+// GetOccurrences handles GET /api/tasks/:id/occurrences?limit=10, listing
+// the upcoming occurrences of a recurring task from the task itself
+func (h *TaskHandler) GetOccurrences(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	limit := 10
+	if limitStr := c.Query("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil {
+			utils.BadRequestResponse(c, "Invalid limit parameter")
+			return
+		}
+	}
+
+	occurrences, err := h.taskService.GetOccurrences(id, limit)
+	if err != nil {
+		h.recurrenceErrorResponse(c, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"occurrences": occurrences,
+		"total":       len(occurrences),
+	}
+	utils.SuccessResponse(c, http.StatusOK, response)
+}
+
+// SkipOccurrence handles POST /api/tasks/:id/recurrence/skip
+func (h *TaskHandler) SkipOccurrence(c *gin.Context) {
+	h.changeRecurrence(c, h.taskService.SkipOccurrence)
+}
+
+// EndRecurrence handles DELETE /api/tasks/:id/recurrence
+func (h *TaskHandler) EndRecurrence(c *gin.Context) {
+	h.changeRecurrence(c, h.taskService.EndRecurrence)
+}
+
+// changeRecurrence applies a change to the series of a task, taking the
+// expected version from If-Match
+func (h *TaskHandler) changeRecurrence(c *gin.Context, change func(id string, expectedVersion *int64) (*models.Task, error)) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	version, err := expectedVersion(c, nil)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := change(id, version)
+	if err != nil {
+		h.recurrenceErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusOK, task)
+}
+
+// recurrenceErrorResponse maps errors of series operations to responses
+func (h *TaskHandler) recurrenceErrorResponse(c *gin.Context, err error) {
+	if versionConflictResponse(c, err) {
+		return
+	}
+	if errors.Is(err, services.ErrNotRecurring) {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+	if errors.Is(err, services.ErrNotCurrentOccurrence) || errors.Is(err, services.ErrSeriesEnded) {
+		utils.ErrorResponseJSON(c, http.StatusConflict, err.Error())
+		return
+	}
+	if strings.Contains(err.Error(), "not found") {
+		utils.NotFoundResponse(c, "Task")
+		return
+	}
+	if strings.Contains(err.Error(), "validation") {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+	utils.InternalErrorResponse(c, err)
+}
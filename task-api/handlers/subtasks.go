@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"task-api/models"
+	"task-api/services"
+	"task-api/utils"
+)
+
+// CreateSubtask handles POST /api/tasks/:id/subtasks
+func (h *TaskHandler) CreateSubtask(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var formData models.TaskFormData
+	if err := c.ShouldBindJSON(&formData); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+	formData.ParentID = &id
+
+	task, err := h.taskService.CreateTask(formData)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusCreated, task)
+}
+
+// ReorderSubtasks handles PUT /api/tasks/:id/subtasks/order. The version
+// is that of the parent task.
+func (h *TaskHandler) ReorderSubtasks(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var request models.ReorderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	subtasks, err := h.taskService.ReorderSubtasks(id, request.IDs, version)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	response := models.TaskCollection{
+		Tasks: subtasks,
+		Total: len(subtasks),
+	}
+	utils.SuccessResponse(c, http.StatusOK, response)
+}
+
+// AddChecklistItem handles POST /api/tasks/:id/checklist
+func (h *TaskHandler) AddChecklistItem(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var request models.ChecklistItemRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := h.taskService.AddChecklistItem(id, request.Text, version)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusCreated, task)
+}
+
+// ReorderChecklist handles PUT /api/tasks/:id/checklist/order
+func (h *TaskHandler) ReorderChecklist(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var request models.ReorderRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := h.taskService.ReorderChecklist(id, request.IDs, version)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusOK, task)
+}
+
+// RenameChecklistItem handles PUT /api/tasks/:id/checklist/:itemId
+func (h *TaskHandler) RenameChecklistItem(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var request models.ChecklistItemRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := h.taskService.RenameChecklistItem(id, c.Param("itemId"), request.Text, version)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusOK, task)
+}
+
+// ToggleChecklistItem handles PATCH /api/tasks/:id/checklist/:itemId/completion
+func (h *TaskHandler) ToggleChecklistItem(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	var request models.CompletionToggleRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		// If no body provided, just toggle
+		request = models.CompletionToggleRequest{}
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := h.taskService.SetChecklistItemCompletion(id, c.Param("itemId"), request.Completed, version)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusOK, task)
+}
+
+// RemoveChecklistItem handles DELETE /api/tasks/:id/checklist/:itemId
+func (h *TaskHandler) RemoveChecklistItem(c *gin.Context) {
+	id := strings.TrimSpace(c.Param("id"))
+	if id == "" {
+		utils.BadRequestResponse(c, "Task ID is required")
+		return
+	}
+
+	version, err := expectedVersion(c, nil)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := h.taskService.RemoveChecklistItem(id, c.Param("itemId"), version)
+	if err != nil {
+		h.subtaskErrorResponse(c, err)
+		return
+	}
+
+	c.Header("ETag", taskETag(task))
+	utils.SuccessResponse(c, http.StatusOK, task)
+}
+
+// subtaskErrorResponse maps errors of subtask and checklist changes to
+// responses
+func (h *TaskHandler) subtaskErrorResponse(c *gin.Context, err error) {
+	if versionConflictResponse(c, err) {
+		return
+	}
+	if errors.Is(err, services.ErrInvalidHierarchy) {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+	if errors.Is(err, models.ErrChecklistItemNotFound) {
+		utils.NotFoundResponse(c, "Checklist item")
+		return
+	}
+	if strings.Contains(err.Error(), "not found") {
+		utils.NotFoundResponse(c, "Task")
+		return
+	}
+	if strings.Contains(err.Error(), "validation") {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+	utils.InternalErrorResponse(c, err)
+}
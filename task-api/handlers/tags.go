@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"task-api/models"
+	"task-api/services"
+	"task-api/utils"
+)
+
+// ListTags handles GET /api/tags
+func (h *TaskHandler) ListTags(c *gin.Context) {
+	tags, err := h.taskService.ListTags()
+	if err != nil {
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"tags":  tags,
+		"total": len(tags),
+	}
+	utils.SuccessResponse(c, http.StatusOK, response)
+}
+
+// GetTag handles GET /api/tags/:name
+func (h *TaskHandler) GetTag(c *gin.Context) {
+	tag, err := h.taskService.GetTag(c.Param("name"))
+	if err != nil {
+		h.tagErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, tag)
+}
+
+// CreateTag handles POST /api/tags
+func (h *TaskHandler) CreateTag(c *gin.Context) {
+	var formData models.TagFormData
+	if err := c.ShouldBindJSON(&formData); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	tag, err := h.taskService.CreateTag(formData)
+	if err != nil {
+		h.tagErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusCreated, tag)
+}
+
+// UpdateTag handles PUT /api/tags/:name
+func (h *TaskHandler) UpdateTag(c *gin.Context) {
+	var updates models.TagUpdate
+	if err := c.ShouldBindJSON(&updates); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	tag, err := h.taskService.UpdateTag(c.Param("name"), updates)
+	if err != nil {
+		h.tagErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, tag)
+}
+
+// DeleteTag handles DELETE /api/tags/:name, removing the tag from every
+// task carrying it
+func (h *TaskHandler) DeleteTag(c *gin.Context) {
+	untagged, err := h.taskService.DeleteTag(c.Param("name"))
+	if err != nil {
+		h.tagErrorResponse(c, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"untagged": untagged,
+	}
+	utils.SuccessResponseWithMessage(c, http.StatusOK, response, "Tag deleted")
+}
+
+// RenameTag handles POST /api/tags/:name/rename
+func (h *TaskHandler) RenameTag(c *gin.Context) {
+	var request models.TagRenameRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	tag, err := h.taskService.RenameTag(c.Param("name"), request.Name)
+	if err != nil {
+		h.tagErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, tag)
+}
+
+// MergeTag handles POST /api/tags/:name/merge
+func (h *TaskHandler) MergeTag(c *gin.Context) {
+	var request models.TagMergeRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	tag, err := h.taskService.MergeTag(c.Param("name"), request.Into)
+	if err != nil {
+		h.tagErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, tag)
+}
+
+// tagErrorResponse maps errors of tag operations to responses
+func (h *TaskHandler) tagErrorResponse(c *gin.Context, err error) {
+	if errors.Is(err, services.ErrTagNotFound) {
+		utils.NotFoundResponse(c, "Tag")
+		return
+	}
+	if errors.Is(err, services.ErrTagExists) {
+		utils.ErrorResponseJSON(c, http.StatusConflict, err.Error())
+		return
+	}
+	if strings.Contains(err.Error(), "validation") {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+	utils.InternalErrorResponse(c, err)
+}
@@ -1,16 +1,25 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 	
 	"github.com/gin-gonic/gin"
 	"task-api/models"
 	"task-api/services"
+	"task-api/storage"
 	"task-api/utils"
 )
 
+// archivePassphraseHeader carries the passphrase of exported and imported
+// archives, keeping it out of URLs and access logs
+const archivePassphraseHeader = "X-Archive-Passphrase"
+
 // TaskHandler handles HTTP requests for task operations
 type TaskHandler struct {
 	taskService *services.TaskService
@@ -23,14 +32,51 @@ func NewTaskHandler(taskService *services.TaskService) *TaskHandler {
 	}
 }
 
-// GetTasks handles GET /api/tasks
+// GetTasks handles GET /api/tasks. The project parameter keeps only the
+// tasks of a project, or of no project if it is "none".
 func (h *TaskHandler) GetTasks(c *gin.Context) {
+	var projectID *string
+	if project, ok := c.GetQuery("project"); ok {
+		if project == "none" {
+			project = ""
+		}
+		projectID = &project
+	}
+
+	h.listTasks(c, projectID)
+}
+
+// listTasks lists tasks according to the query parameters of GET
+// /api/tasks, only those of the given project if projectID is set
+func (h *TaskHandler) listTasks(c *gin.Context, projectID *string) {
 	// Parse query parameters
 	quadrant := c.Query("quadrant")
 	completedStr := c.Query("completed")
 	sortStr := c.Query("sort")
 	limitStr := c.Query("limit")
 	offsetStr := c.Query("offset")
+	view := c.DefaultQuery("view", "flat")
+
+	if view != "flat" && view != "tree" {
+		utils.BadRequestResponse(c, "Invalid view parameter, must be flat or tree")
+		return
+	}
+
+	// Tags to filter by; tasks need all of them unless tagMode is any
+	tags := make([]string, 0, len(c.QueryArray("tag")))
+	for _, tag := range c.QueryArray("tag") {
+		normalized, err := models.NormalizeTag(tag)
+		if err != nil {
+			utils.BadRequestResponse(c, "Invalid tag parameter: "+err.Error())
+			return
+		}
+		tags = append(tags, normalized)
+	}
+	tagMode := c.DefaultQuery("tagMode", "all")
+	if tagMode != "all" && tagMode != "any" {
+		utils.BadRequestResponse(c, "Invalid tagMode parameter, must be all or any")
+		return
+	}
 
 	var tasks []models.Task
 	var err error
@@ -47,19 +93,10 @@ func (h *TaskHandler) GetTasks(c *gin.Context) {
 		tasks, err = h.taskService.GetCompletedTasks()
 	} else if completedStr == "false" {
 		// Get incomplete tasks
-		allTasks, e := h.taskService.GetAllTasks()
-		if e != nil {
-			utils.InternalErrorResponse(c, e)
-			return
-		}
-		for _, task := range allTasks {
-			if !task.Completed {
-				tasks = append(tasks, task)
-			}
-		}
-	} else if sortStr == "priority" {
-		// Get sorted tasks
-		tasks, err = h.taskService.GetTasksSorted()
+		tasks, err = h.taskService.GetIncompleteTasks()
+	} else if sortStr == "priority" || sortStr == "topological" {
+		// Get sorted tasks, with topological after their blockers
+		tasks, err = h.taskService.GetTasksSorted(services.TaskOrder(sortStr))
 	} else {
 		// Get all tasks
 		tasks, err = h.taskService.GetAllTasks()
@@ -70,10 +107,25 @@ func (h *TaskHandler) GetTasks(c *gin.Context) {
 		return
 	}
 
-	// Apply pagination if specified
+	if len(tags) > 0 || projectID != nil {
+		filtered := make([]models.Task, 0, len(tasks))
+		for i := range tasks {
+			if projectID != nil && !tasks[i].InProject(*projectID) {
+				continue
+			}
+			if tasks[i].MatchesTags(tags, tagMode == "any") {
+				filtered = append(filtered, tasks[i])
+			}
+		}
+		tasks = filtered
+	}
+
+	// Parse pagination if specified
+	limit, offset := 0, 0
 	if limitStr != "" || offsetStr != "" {
-		limit, limitErr := strconv.Atoi(limitStr)
-		offset, offsetErr := strconv.Atoi(offsetStr)
+		var limitErr, offsetErr error
+		limit, limitErr = strconv.Atoi(limitStr)
+		offset, offsetErr = strconv.Atoi(offsetStr)
 
 		if limitErr != nil && limitStr != "" {
 			utils.BadRequestResponse(c, "Invalid limit parameter")
@@ -83,38 +135,48 @@ func (h *TaskHandler) GetTasks(c *gin.Context) {
 			utils.BadRequestResponse(c, "Invalid offset parameter")
 			return
 		}
+	}
 
-		// Apply pagination
-		total := len(tasks)
-		if offset > 0 {
-			if offset >= total {
-				tasks = []models.Task{}
-			} else {
-				tasks = tasks[offset:]
-			}
-		}
-
-		if limit > 0 && len(tasks) > limit {
-			tasks = tasks[:limit]
-		}
-
-		// Return paginated response
-		response := models.TaskCollection{
-			Tasks: tasks,
-			Total: total,
+	// Nest subtasks under their parents; pagination then counts top-level
+	// tasks only
+	if view == "tree" {
+		nodes := models.BuildTaskTree(tasks)
+		start, end := pageBounds(len(nodes), limit, offset)
+		response := models.TaskTreeCollection{
+			Tasks: nodes[start:end],
+			Total: len(nodes),
 		}
 		utils.SuccessResponse(c, http.StatusOK, response)
 		return
 	}
 
-	// Return all tasks
+	// Return all tasks, or the requested page of them
+	start, end := pageBounds(len(tasks), limit, offset)
 	response := models.TaskCollection{
-		Tasks: tasks,
+		Tasks: tasks[start:end],
 		Total: len(tasks),
 	}
 	utils.SuccessResponse(c, http.StatusOK, response)
 }
 
+// pageBounds returns the slice bounds of a page of total items, where a
+// limit of 0 means no limit
+func pageBounds(total, limit, offset int) (int, int) {
+	start := 0
+	if offset > 0 {
+		start = offset
+		if start > total {
+			start = total
+		}
+	}
+
+	end := total
+	if limit > 0 && end-start > limit {
+		end = start + limit
+	}
+	return start, end
+}
+
 // GetTask handles GET /api/tasks/:id
 func (h *TaskHandler) GetTask(c *gin.Context) {
 	id := strings.TrimSpace(c.Param("id"))
@@ -133,6 +195,7 @@ func (h *TaskHandler) GetTask(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", taskETag(task))
 	utils.SuccessResponse(c, http.StatusOK, task)
 }
 
@@ -146,6 +209,13 @@ func (h *TaskHandler) CreateTask(c *gin.Context) {
 
 	task, err := h.taskService.CreateTask(formData)
 	if err != nil {
+		if projectTargetResponse(c, err) || dependencyErrorResponse(c, err) {
+			return
+		}
+		if errors.Is(err, services.ErrInvalidHierarchy) {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
 		if strings.Contains(err.Error(), "validation") {
 			utils.ValidationErrorResponse(c, err)
 			return
@@ -154,6 +224,7 @@ func (h *TaskHandler) CreateTask(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", taskETag(task))
 	utils.SuccessResponse(c, http.StatusCreated, task)
 }
 
@@ -174,8 +245,25 @@ func (h *TaskHandler) UpdateTask(c *gin.Context) {
 	// Set the ID from the URL parameter
 	updates.ID = id
 
+	version, err := expectedVersion(c, updates.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+	updates.Version = version
+
 	task, err := h.taskService.UpdateTask(updates)
 	if err != nil {
+		if versionConflictResponse(c, err) {
+			return
+		}
+		if projectTargetResponse(c, err) || dependencyErrorResponse(c, err) {
+			return
+		}
+		if errors.Is(err, services.ErrInvalidHierarchy) {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
 		if strings.Contains(err.Error(), "not found") {
 			utils.NotFoundResponse(c, "Task")
 			return
@@ -188,10 +276,11 @@ func (h *TaskHandler) UpdateTask(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", taskETag(task))
 	utils.SuccessResponse(c, http.StatusOK, task)
 }
 
-// DeleteTask handles DELETE /api/tasks/:id
+// DeleteTask handles DELETE /api/tasks/:id, deleting subtasks with the task
 func (h *TaskHandler) DeleteTask(c *gin.Context) {
 	id := strings.TrimSpace(c.Param("id"))
 	if id == "" {
@@ -226,8 +315,17 @@ func (h *TaskHandler) MoveTaskToQuadrant(c *gin.Context) {
 		return
 	}
 
-	task, err := h.taskService.MoveTaskToQuadrant(id, request.Quadrant)
+	version, err := expectedVersion(c, request.Version)
 	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+
+	task, err := h.taskService.MoveTaskToQuadrant(id, request.Quadrant, version)
+	if err != nil {
+		if versionConflictResponse(c, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "not found") {
 			utils.NotFoundResponse(c, "Task")
 			return
@@ -240,6 +338,7 @@ func (h *TaskHandler) MoveTaskToQuadrant(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", taskETag(task))
 	utils.SuccessResponse(c, http.StatusOK, task)
 }
 
@@ -254,30 +353,28 @@ func (h *TaskHandler) ToggleTaskCompletion(c *gin.Context) {
 	var request models.CompletionToggleRequest
 	if err := c.ShouldBindJSON(&request); err != nil {
 		// If no body provided, just toggle
-		task, err := h.taskService.ToggleTaskCompletion(id)
-		if err != nil {
-			if strings.Contains(err.Error(), "not found") {
-				utils.NotFoundResponse(c, "Task")
-				return
-			}
-			utils.InternalErrorResponse(c, err)
-			return
-		}
-		utils.SuccessResponse(c, http.StatusOK, task)
+		request = models.CompletionToggleRequest{}
+	}
+
+	version, err := expectedVersion(c, request.Version)
+	if err != nil {
+		utils.BadRequestResponse(c, err.Error())
 		return
 	}
 
 	// If specific completion status provided, set it
 	var task *models.Task
-	var err error
 	
 	if request.Completed != nil {
-		task, err = h.taskService.SetTaskCompletion(id, *request.Completed)
+		task, err = h.taskService.SetTaskCompletion(id, *request.Completed, version)
 	} else {
-		task, err = h.taskService.ToggleTaskCompletion(id)
+		task, err = h.taskService.ToggleTaskCompletion(id, version)
 	}
 
 	if err != nil {
+		if versionConflictResponse(c, err) || dependencyErrorResponse(c, err) {
+			return
+		}
 		if strings.Contains(err.Error(), "not found") {
 			utils.NotFoundResponse(c, "Task")
 			return
@@ -286,6 +383,7 @@ func (h *TaskHandler) ToggleTaskCompletion(c *gin.Context) {
 		return
 	}
 
+	c.Header("ETag", taskETag(task))
 	utils.SuccessResponse(c, http.StatusOK, task)
 }
 
@@ -373,13 +471,105 @@ func (h *TaskHandler) ListBackups(c *gin.Context) {
 		"count":   len(backups),
 	}
 
+	// An unreachable replication target does not hide the local backups
+	if h.taskService.ReplicationEnabled() {
+		remote := map[string]interface{}{}
+		remoteBackups, err := h.taskService.ListRemoteBackups()
+		if err != nil {
+			remote["error"] = err.Error()
+		} else {
+			remote["backups"] = remoteBackups
+			remote["count"] = len(remoteBackups)
+		}
+		response["remote"] = remote
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, response)
+}
+
+// VerifyBackup handles GET /api/backups/:name/verify
+func (h *TaskHandler) VerifyBackup(c *gin.Context) {
+	backupName := c.Param("name")
+
+	result, err := h.taskService.VerifyBackup(backupName)
+	if err != nil {
+		h.backupErrorResponse(c, err)
+		return
+	}
+
+	message := "Backup verified successfully"
+	if !result.Valid {
+		message = "Backup failed verification"
+	}
+
+	utils.SuccessResponseWithMessage(c, http.StatusOK, result, message)
+}
+
+// VerifyAllBackups handles GET /api/backups/verify
+func (h *TaskHandler) VerifyAllBackups(c *gin.Context) {
+	results, err := h.taskService.VerifyAllBackups()
+	if err != nil {
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	valid := 0
+	for _, result := range results {
+		if result.Valid {
+			valid++
+		}
+	}
+
+	response := map[string]interface{}{
+		"results": results,
+		"count":   len(results),
+		"valid":   valid,
+		"invalid": len(results) - valid,
+	}
+
+	utils.SuccessResponse(c, http.StatusOK, response)
+}
+
+// DiffBackup handles GET /api/backups/:name/diff
+func (h *TaskHandler) DiffBackup(c *gin.Context) {
+	backupName := c.Param("name")
+
+	diff, err := h.taskService.DiffBackup(backupName)
+	if err != nil {
+		h.backupErrorResponse(c, err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"backup_name": backupName,
+		"diff":        diff,
+	}
+
 	utils.SuccessResponse(c, http.StatusOK, response)
 }
 
-// RestoreFromBackup handles POST /api/restore
+// backupErrorResponse maps errors from reading a named backup to responses
+func (h *TaskHandler) backupErrorResponse(c *gin.Context, err error) {
+	if strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "no such file") {
+		utils.NotFoundResponse(c, "Backup file")
+		return
+	}
+	if strings.Contains(err.Error(), "invalid backup name") || errors.Is(err, services.ErrReplicationDisabled) {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+	utils.InternalErrorResponse(c, err)
+}
+
+// RestoreFromBackup handles POST /api/restore. With dry_run set in the body
+// or query it only returns the changes the restore would make. With source
+// set to "remote" the backup is first downloaded from the replication
+// target.
 func (h *TaskHandler) RestoreFromBackup(c *gin.Context) {
 	var request struct {
 		BackupName string `json:"backup_name" binding:"required"`
+		DryRun     bool   `json:"dry_run"`
+		Source     string `json:"source"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -387,13 +577,38 @@ func (h *TaskHandler) RestoreFromBackup(c *gin.Context) {
 		return
 	}
 
-	err := h.taskService.RestoreFromBackup(request.BackupName)
-	if err != nil {
-		if strings.Contains(err.Error(), "not found") || strings.Contains(err.Error(), "no such file") {
-			utils.NotFoundResponse(c, "Backup file")
+	switch request.Source {
+	case "", "local":
+	case "remote":
+		if err := h.taskService.FetchRemoteBackup(request.BackupName); err != nil {
+			h.backupErrorResponse(c, err)
 			return
 		}
-		utils.InternalErrorResponse(c, err)
+	default:
+		utils.BadRequestResponse(c, "Invalid source. Must be one of: local, remote")
+		return
+	}
+
+	if request.DryRun || c.Query("dry_run") == "true" {
+		diff, err := h.taskService.DiffBackup(request.BackupName)
+		if err != nil {
+			h.backupErrorResponse(c, err)
+			return
+		}
+
+		response := map[string]interface{}{
+			"dry_run":     true,
+			"backup_name": request.BackupName,
+			"diff":        diff,
+		}
+
+		utils.SuccessResponseWithMessage(c, http.StatusOK, response, "Dry run: no data was changed")
+		return
+	}
+
+	err := h.taskService.RestoreFromBackup(request.BackupName)
+	if err != nil {
+		h.backupErrorResponse(c, err)
 		return
 	}
 
@@ -404,8 +619,164 @@ func (h *TaskHandler) RestoreFromBackup(c *gin.Context) {
 	utils.SuccessResponse(c, http.StatusOK, response)
 }
 
+// RestoreTasksFromBackup handles POST /api/restore/tasks
+func (h *TaskHandler) RestoreTasksFromBackup(c *gin.Context) {
+	var request struct {
+		BackupName string   `json:"backup_name" binding:"required"`
+		TaskIDs    []string `json:"task_ids"`
+		Quadrant   *string  `json:"quadrant"`
+		Completed  *bool    `json:"completed"`
+		Conflict   string   `json:"conflict"`
+		DryRun     bool     `json:"dry_run"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		utils.ValidationErrorResponse(c, err)
+		return
+	}
+
+	options := services.SelectiveRestoreOptions{
+		BackupName: request.BackupName,
+		TaskIDs:    request.TaskIDs,
+		Completed:  request.Completed,
+		Conflict:   services.RestoreConflictMode(request.Conflict),
+		DryRun:     request.DryRun || c.Query("dry_run") == "true",
+	}
+
+	if request.Quadrant != nil {
+		if err := utils.ValidateQuadrant(*request.Quadrant); err != nil {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
+		quadrant := models.TaskQuadrant(*request.Quadrant)
+		options.Quadrant = &quadrant
+	}
+
+	result, err := h.taskService.RestoreTasksFromBackup(options)
+	if err != nil {
+		if strings.Contains(err.Error(), "are required") || strings.Contains(err.Error(), "invalid conflict mode") {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
+		h.backupErrorResponse(c, err)
+		return
+	}
+
+	message := "Tasks restored successfully from backup: " + request.BackupName
+	if result.DryRun {
+		message = "Dry run: no data was changed"
+	}
+
+	utils.SuccessResponseWithMessage(c, http.StatusOK, result, message)
+}
+
+// ExportArchive handles GET /api/export/archive
+func (h *TaskHandler) ExportArchive(c *gin.Context) {
+	includeBackups := c.Query("include_backups") == "true"
+	fileName := fmt.Sprintf("tasks_archive_%s.tar.gz", time.Now().Format("20060102_150405"))
+
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fileName))
+
+	err := h.taskService.ExportArchive(c.Writer, c.GetHeader(archivePassphraseHeader), includeBackups)
+	if err == nil {
+		return
+	}
+
+	// Once the archive has started streaming the status is sent, so all
+	// that is left is to cut the download short
+	if c.Writer.Written() {
+		log.Printf("Error: archive export failed: %v", err)
+		c.Abort()
+		return
+	}
+
+	c.Writer.Header().Del("Content-Disposition")
+	if strings.Contains(err.Error(), "passphrase") {
+		utils.BadRequestResponse(c, err.Error())
+		return
+	}
+	utils.InternalErrorResponse(c, err)
+}
+
+// ImportArchive handles POST /api/import/archive
+func (h *TaskHandler) ImportArchive(c *gin.Context) {
+	includeBackups := c.Query("include_backups") != "false"
+	body := http.MaxBytesReader(c.Writer, c.Request.Body, storage.MaxArchiveSize)
+
+	result, err := h.taskService.ImportArchive(body, c.GetHeader(archivePassphraseHeader), includeBackups)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			utils.ErrorResponseJSON(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("archive exceeds %d bytes", tooLarge.Limit))
+			return
+		}
+		if strings.Contains(err.Error(), "invalid archive") || strings.Contains(err.Error(), "passphrase") {
+			utils.BadRequestResponse(c, err.Error())
+			return
+		}
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponseWithMessage(c, http.StatusOK, result, "Archive imported successfully")
+}
+
+// RotateEncryptionKey handles POST /api/admin/rotate-key
+func (h *TaskHandler) RotateEncryptionKey(c *gin.Context) {
+	report, err := h.taskService.RotateEncryptionKey()
+	if err != nil {
+		utils.InternalErrorResponse(c, err)
+		return
+	}
+
+	utils.SuccessResponseWithMessage(c, http.StatusOK, report, "Encryption key rotated to "+report.TargetKeyID)
+}
+
 // GetStorageInfo handles GET /api/info
 func (h *TaskHandler) GetStorageInfo(c *gin.Context) {
 	info := h.taskService.GetStorageInfo()
 	utils.SuccessResponse(c, http.StatusOK, info)
-}
\ No newline at end of file
+}
+
+// taskETag returns the entity tag of a task, which changes with its version
+func taskETag(task *models.Task) string {
+	return fmt.Sprintf(`"%d"`, task.Version)
+}
+
+// expectedVersion returns the version a change is based on, taken from the
+// If-Match header or else from the version in the body, or nil if the
+// change is unconditional. "If-Match: *" only requires the task to exist.
+func expectedVersion(c *gin.Context, bodyVersion *int64) (*int64, error) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" || header == "*" {
+		return bodyVersion, nil
+	}
+
+	invalid := errors.New(`If-Match must be a single ETag such as "3", or *`)
+	if len(header) < 2 || header[0] != '"' || header[len(header)-1] != '"' {
+		return nil, invalid
+	}
+	version, err := strconv.ParseInt(header[1:len(header)-1], 10, 64)
+	if err != nil {
+		return nil, invalid
+	}
+
+	if bodyVersion != nil && *bodyVersion != version {
+		return nil, errors.New("version in the body does not match If-Match")
+	}
+	return &version, nil
+}
+
+// versionConflictResponse answers a change based on an outdated version of
+// a task with 409 and the current task, reporting whether err was one
+func versionConflictResponse(c *gin.Context, err error) bool {
+	var conflict *services.VersionConflictError
+	if !errors.As(err, &conflict) {
+		return false
+	}
+
+	c.Header("ETag", taskETag(&conflict.Current))
+	utils.ConflictResponse(c, "Task was modified since it was read; retry against the current version", conflict.Current)
+	return true
+}
@@ -1,13 +1,24 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+	// Timezones of recurring tasks work without tzdata on the host
+	_ "time/tzdata"
 	
 	"github.com/gin-gonic/gin"
 	"task-api/config"
 	"task-api/handlers"
 	"task-api/middleware"
+	"task-api/repository"
 	"task-api/services"
 	"task-api/storage"
 )
@@ -19,29 +30,119 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 	
+	// Run an administrative command instead of the server if one was given
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+	
 	// Set Gin mode
 	gin.SetMode(cfg.GinMode)
 	
 	// Log configuration
 	cfg.LogConfiguration()
 	
-	// Initialize encrypted storage
-	encryptedStorage := storage.NewEncryptedStorage(cfg.DataDir, cfg.EncryptionKey)
-	encryptedStorage.SetRetentionDays(cfg.BackupRetentionDays)
-	
-	// Initialize storage system
-	if err := encryptedStorage.Initialize(); err != nil {
+	encryptedStorage, err := openEncryptedStorage(cfg)
+	if err != nil {
 		log.Fatalf("Failed to initialize encrypted storage: %v", err)
 	}
-	log.Println("Encrypted storage initialized successfully")
+	taskRepo, err := openTaskRepositoryWithStorage(cfg, encryptedStorage)
+	if err != nil {
+		log.Fatalf("Failed to initialize task repository: %v", err)
+	}
+	
+	// A corrupt data file recovered in read-only mode stays unchanged until
+	// the server is restarted
+	incident := encryptedStorage.CorruptionIncident()
+	readOnly := incident != nil && incident.ReadOnly
 	
 	// Initialize services
-	taskService := services.NewTaskService(encryptedStorage)
+	taskService := services.NewTaskService(taskRepo)
+	taskService.SetSubtaskOptions(services.SubtaskOptions{
+		MaxDepth:     cfg.SubtaskMaxDepth,
+		AutoComplete: cfg.SubtaskAutoComplete,
+	})
+	taskService.SetDependencyOptions(services.DependencyOptions{
+		BlockCompletion: cfg.DependencyBlockCompletion,
+	})
+	
+	var backupScheduler *services.BackupScheduler
+	if cfg.BackupSchedule != "off" && !readOnly {
+		backupScheduler, err = services.NewBackupScheduler(taskRepo, cfg.BackupSchedule)
+		if err != nil {
+			log.Fatalf("Failed to initialize backup scheduler: %v", err)
+		}
+		taskService.SetBackupScheduler(backupScheduler)
+		backupScheduler.Start()
+	}
+	
+	// Copy backups offsite in the background
+	replicator := encryptedStorage.Replicator()
+	if replicator != nil {
+		taskService.SetReplicator(replicator)
+		replicator.Start()
+	}
 	
 	// Initialize handlers
 	taskHandler := handlers.NewTaskHandler(taskService)
-	healthHandler := handlers.NewHealthHandler()
+	healthHandler := handlers.NewHealthHandler(incident)
 	
+	router := newRouter(cfg, taskHandler, healthHandler, readOnly)
+	
+	// Start server
+	serverAddr := cfg.GetServerAddress()
+	log.Printf("Starting server on %s", serverAddr)
+	log.Printf("Environment: %s", cfg.GinMode)
+	log.Printf("Data directory: %s", cfg.DataDir)
+	
+	server := &http.Server{
+		Addr:    serverAddr,
+		Handler: router,
+	}
+	
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+	
+	var runErr error
+	select {
+	case err := <-serverErr:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			runErr = err
+		}
+	case <-ctx.Done():
+		log.Println("Shutting down server...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Warning: server shutdown did not complete cleanly: %v", err)
+		}
+		cancel()
+	}
+	
+	// Let the change being written and a running scheduled backup finish,
+	// then flush pending task changes before exiting
+	taskService.Close()
+	if backupScheduler != nil {
+		backupScheduler.Stop()
+	}
+	if err := taskRepo.Close(); err != nil {
+		log.Fatalf("Failed to persist tasks on shutdown: %v", err)
+	}
+	if replicator != nil {
+		replicator.Stop()
+	}
+	if runErr != nil {
+		log.Fatalf("Failed to start server: %v", runErr)
+	}
+	log.Println("Tasks persisted, server stopped")
+}
+
+// newRouter sets up the middleware and routes of the API. With readOnly
+// set, every change is rejected.
+func newRouter(cfg *config.Config, taskHandler *handlers.TaskHandler, healthHandler *handlers.HealthHandler, readOnly bool) *gin.Engine {
 	// Create Gin router
 	router := gin.New()
 	
@@ -59,6 +160,13 @@ func main() {
 		log.Printf("CORS configured for production, allowed origins: %v", cfg.CORSAllowedOrigins)
 	}
 	
+	// Reject changes, but after CORS so browsers can read the reason
+	if readOnly {
+		router.Use(middleware.ReadOnly(
+			"server is read-only after recovering from a corrupt data file; restart it with CORRUPTION_RECOVERY=auto to accept changes",
+			"/api/tasks/demo"))
+	}
+	
 	// API routes
 	api := router.Group("/api")
 	{
@@ -80,12 +188,67 @@ func main() {
 			tasks.DELETE("/:id", taskHandler.DeleteTask)           // DELETE /api/tasks/:id
 			tasks.PATCH("/:id/quadrant", taskHandler.MoveTaskToQuadrant)     // PATCH /api/tasks/:id/quadrant
 			tasks.PATCH("/:id/completion", taskHandler.ToggleTaskCompletion) // PATCH /api/tasks/:id/completion
+			tasks.PATCH("/:id/project", taskHandler.MoveTaskToProject)       // PATCH /api/tasks/:id/project
+			
+			// Recurring tasks
+			tasks.GET("/:id/occurrences", taskHandler.GetOccurrences)            // GET /api/tasks/:id/occurrences?limit=10
+			tasks.POST("/:id/recurrence/skip", taskHandler.SkipOccurrence)       // POST /api/tasks/:id/recurrence/skip
+			tasks.DELETE("/:id/recurrence", taskHandler.EndRecurrence)           // DELETE /api/tasks/:id/recurrence
+			
+			// Dependencies between tasks
+			tasks.GET("/:id/dependencies", taskHandler.GetDependencies) // GET /api/tasks/:id/dependencies
+			
+			// Subtasks and checklist items
+			tasks.POST("/:id/subtasks", taskHandler.CreateSubtask)                   // POST /api/tasks/:id/subtasks
+			tasks.PUT("/:id/subtasks/order", taskHandler.ReorderSubtasks)            // PUT /api/tasks/:id/subtasks/order
+			tasks.POST("/:id/checklist", taskHandler.AddChecklistItem)               // POST /api/tasks/:id/checklist
+			tasks.PUT("/:id/checklist/order", taskHandler.ReorderChecklist)          // PUT /api/tasks/:id/checklist/order
+			tasks.PUT("/:id/checklist/:itemId", taskHandler.RenameChecklistItem)     // PUT /api/tasks/:id/checklist/:itemId
+			tasks.DELETE("/:id/checklist/:itemId", taskHandler.RemoveChecklistItem)  // DELETE /api/tasks/:id/checklist/:itemId
+			tasks.PATCH("/:id/checklist/:itemId/completion", taskHandler.ToggleChecklistItem) // PATCH /api/tasks/:id/checklist/:itemId/completion
+		}
+		
+		// Tag registry; renaming, merging and deleting rewrite the tasks
+		tags := api.Group("/tags")
+		{
+			tags.GET("", taskHandler.ListTags)                  // GET /api/tags
+			tags.POST("", taskHandler.CreateTag)                // POST /api/tags
+			tags.GET("/:name", taskHandler.GetTag)              // GET /api/tags/:name
+			tags.PUT("/:name", taskHandler.UpdateTag)           // PUT /api/tags/:name
+			tags.DELETE("/:name", taskHandler.DeleteTag)        // DELETE /api/tags/:name
+			tags.POST("/:name/rename", taskHandler.RenameTag)   // POST /api/tags/:name/rename
+			tags.POST("/:name/merge", taskHandler.MergeTag)     // POST /api/tags/:name/merge
+		}
+		
+		// Projects, each with its own matrix of tasks
+		projects := api.Group("/projects")
+		{
+			projects.GET("", taskHandler.ListProjects)              // GET /api/projects?includeArchived=true
+			projects.POST("", taskHandler.CreateProject)            // POST /api/projects
+			projects.GET("/:id", taskHandler.GetProject)            // GET /api/projects/:id
+			projects.PUT("/:id", taskHandler.UpdateProject)         // PUT /api/projects/:id
+			projects.DELETE("/:id", taskHandler.DeleteProject)      // DELETE /api/projects/:id?tasks=cascade|reassign
+			projects.GET("/:id/tasks", taskHandler.GetProjectTasks) // GET /api/projects/:id/tasks?quadrant=DO
 		}
 		
 		// Backup operations
 		api.POST("/backup", taskHandler.CreateBackup)           // POST /api/backup
 		api.GET("/backups", taskHandler.ListBackups)            // GET /api/backups
+		api.GET("/backups/verify", taskHandler.VerifyAllBackups)      // GET /api/backups/verify
+		api.GET("/backups/:name/verify", taskHandler.VerifyBackup)    // GET /api/backups/:name/verify
+		api.GET("/backups/:name/diff", taskHandler.DiffBackup)        // GET /api/backups/:name/diff
 		api.POST("/restore", taskHandler.RestoreFromBackup)     // POST /api/restore
+		api.POST("/restore/tasks", taskHandler.RestoreTasksFromBackup) // POST /api/restore/tasks
+		
+		// Portable archives
+		api.GET("/export/archive", taskHandler.ExportArchive)  // GET /api/export/archive
+		api.POST("/import/archive", taskHandler.ImportArchive) // POST /api/import/archive
+		
+		// Administrative operations
+		admin := api.Group("/admin")
+		{
+			admin.POST("/rotate-key", taskHandler.RotateEncryptionKey) // POST /api/admin/rotate-key
+		}
 	}
 	
 	// Root endpoint
@@ -102,15 +265,255 @@ func main() {
 		})
 	})
 	
-	// Start server
-	serverAddr := cfg.GetServerAddress()
-	log.Printf("Starting server on %s", serverAddr)
-	log.Printf("Environment: %s", cfg.GinMode)
-	log.Printf("Data directory: %s", cfg.DataDir)
+	return router
+}
+
+// openTaskRepository initializes encrypted storage and the configured
+// backend, resumes an interrupted key rotation and wraps the backend in the
+// in-memory task store
+func openTaskRepository(cfg *config.Config) (repository.TaskRepository, error) {
+	encryptedStorage, err := openEncryptedStorage(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return openTaskRepositoryWithStorage(cfg, encryptedStorage)
+}
+
+// openEncryptedStorage builds the encrypted storage with the configured
+// master key provider, without touching the data directory yet
+func openEncryptedStorage(cfg *config.Config) (*storage.EncryptedStorage, error) {
+	// Build the master key provider that wraps per-file data keys
+	cryptoService, err := newCryptoService(cfg)
+	if err != nil {
+		return nil, err
+	}
 	
-	if err := router.Run(serverAddr); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	fsys, err := newFilesystem(cfg)
+	if err != nil {
+		return nil, err
 	}
+	
+	encryptedStorage := storage.NewEncryptedStorageWithCryptoService(cfg.DataDir, cryptoService)
+	encryptedStorage.SetFilesystem(fsys)
+	encryptedStorage.SetBackupOnWrite(cfg.BackupSchedule == "off")
+	encryptedStorage.SetCorruptionRecovery(storage.CorruptionRecoveryMode(cfg.CorruptionRecovery), repository.ValidateBackupTasks)
+	encryptedStorage.SetRetentionPolicy(storage.RetentionPolicy{
+		KeepLast:      cfg.BackupKeepLast,
+		Hourly:        cfg.BackupKeepHourly,
+		Daily:         cfg.BackupKeepDaily,
+		Weekly:        cfg.BackupKeepWeekly,
+		Monthly:       cfg.BackupKeepMonthly,
+		MaxAgeDays:    cfg.BackupRetentionDays,
+		MaxCount:      cfg.BackupMaxCount,
+		MaxTotalBytes: int64(cfg.BackupMaxSizeMB) * 1024 * 1024,
+	})
+	
+	if cfg.ReplicationS3Endpoint != "" {
+		client, err := storage.NewS3Client(storage.S3Config{
+			Endpoint:  cfg.ReplicationS3Endpoint,
+			Region:    cfg.ReplicationS3Region,
+			Bucket:    cfg.ReplicationS3Bucket,
+			AccessKey: cfg.ReplicationS3AccessKey,
+			SecretKey: cfg.ReplicationS3SecretKey,
+			PathStyle: cfg.ReplicationS3PathStyle,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid replication target: %w", err)
+		}
+		encryptedStorage.SetReplicator(storage.NewReplicator(client, cfg.ReplicationS3Prefix, cfg.ReplicationMaxAttempts, time.Second))
+	}
+	return encryptedStorage, nil
+}
+
+// newFilesystem builds the filesystem storage runs on, injecting the
+// configured faults if any
+func newFilesystem(cfg *config.Config) (storage.Filesystem, error) {
+	var fsys storage.Filesystem = storage.OSFilesystem{}
+	if cfg.StorageFilesystem == "memory" {
+		log.Println("Storing data in memory; it is lost when the server stops")
+		fsys = storage.NewMemoryFilesystem()
+	}
+	
+	if cfg.StorageFaults == "" {
+		return fsys, nil
+	}
+	faults, err := storage.ParseFaults(cfg.StorageFaults)
+	if err != nil {
+		return nil, fmt.Errorf("invalid STORAGE_FAULTS: %w", err)
+	}
+	faulty := storage.NewFaultyFilesystem(fsys)
+	for _, fault := range faults {
+		faulty.Inject(fault)
+	}
+	log.Printf("Injecting %d storage faults", len(faults))
+	return faulty, nil
+}
+
+// openTaskRepositoryWithStorage opens the task repository on encrypted
+// storage from openEncryptedStorage
+func openTaskRepositoryWithStorage(cfg *config.Config, encryptedStorage *storage.EncryptedStorage) (repository.TaskRepository, error) {
+	// Initialize storage system
+	if err := encryptedStorage.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize encrypted storage: %w", err)
+	}
+	log.Println("Encrypted storage initialized successfully")
+	
+	// Initialize task repository
+	var taskRepo repository.TaskRepository
+	switch cfg.StorageBackend {
+	case "sqlite":
+		sqliteRepo, err := repository.NewSQLiteRepository(cfg.DataDir, encryptedStorage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open SQLite repository: %w", err)
+		}
+		taskRepo = sqliteRepo
+	default:
+		fileRepo, err := repository.NewFileRepository(encryptedStorage, cfg.WALCompactThreshold)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open file repository: %w", err)
+		}
+		taskRepo = fileRepo
+	}
+	
+	// Finish a key rotation that was interrupted before it completed
+	if encryptedStorage.KeyRotationPending() {
+		log.Println("Found an interrupted key rotation, resuming")
+		if _, err := taskRepo.RotateEncryptionKey(); err != nil {
+			taskRepo.Close()
+			return nil, fmt.Errorf("failed to resume key rotation: %w", err)
+		}
+	}
+	
+	// Keep tasks resident in memory, writing changes behind unless the
+	// flush interval is zero
+	memoryRepo, err := repository.NewMemoryRepository(taskRepo, cfg.GetFlushInterval())
+	if err != nil {
+		taskRepo.Close()
+		return nil, fmt.Errorf("failed to load tasks into memory: %w", err)
+	}
+	log.Printf("Task repository initialized (%s backend)", cfg.StorageBackend)
+	
+	return memoryRepo, nil
+}
+
+// newCryptoService builds the configured master key provider. The password
+// keyring, when a password is set, also serves to read data written before
+// envelope encryption.
+func newCryptoService(cfg *config.Config) (*storage.CryptoService, error) {
+	var keyring *storage.Keyring
+	if cfg.EncryptionKey != "" {
+		var err error
+		keyring, err = storage.NewKeyring(cfg.EncryptionKeyID, cfg.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize keyring: %w", err)
+		}
+		for _, retired := range cfg.RetiredEncryptionKeys {
+			if err := keyring.AddRetiredKey(retired.ID, retired.Key); err != nil {
+				return nil, fmt.Errorf("failed to initialize keyring: %w", err)
+			}
+		}
+	}
+	
+	var provider storage.MasterKeyProvider
+	switch cfg.KeyProvider {
+	case "keyring":
+		keyringProvider, err := storage.LoadKeyringFileProvider(cfg.MasterKeyringFile, true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load master keyring: %w", err)
+		}
+		provider = keyringProvider
+	case "kms":
+		kmsProvider, err := newKMSKeyProvider(cfg)
+		if err != nil {
+			return nil, err
+		}
+		provider = kmsProvider
+	default:
+		kdfParams, err := kdfParamsFromConfig(cfg)
+		if err != nil {
+			return nil, err
+		}
+		passwordProvider, err := storage.NewPasswordKeyProvider(keyring, kdfParams)
+		if err != nil {
+			return nil, fmt.Errorf("invalid KDF configuration: %w", err)
+		}
+		provider = passwordProvider
+		log.Printf("Deriving password master keys with %s", kdfParams)
+	}
+	log.Printf("Wrapping data keys with %s master key %q", provider.Name(), provider.ActiveKeyID())
+	
+	compression, err := storage.ParseCompressionAlgorithm(cfg.StorageCompression)
+	if err != nil {
+		return nil, err
+	}
+	cryptoService := storage.NewEnvelopeCryptoService(provider, keyring)
+	cryptoService.SetCompression(compression)
+	return cryptoService, nil
+}
+
+// newKMSKeyProvider builds the KMS stand-in from master keys given in the
+// environment or a key file
+func newKMSKeyProvider(cfg *config.Config) (*storage.StaticKeyProvider, error) {
+	encoded := cfg.KMSMasterKey
+	if cfg.KMSMasterKeyFile != "" {
+		data, err := os.ReadFile(cfg.KMSMasterKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read KMS master key file: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+	
+	key, err := storage.DecodeMasterKey(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KMS master key: %w", err)
+	}
+	defer storage.SecureWipe(key)
+	
+	provider, err := storage.NewStaticKeyProvider("kms", cfg.KMSKeyID, key)
+	if err != nil {
+		return nil, err
+	}
+	for _, retired := range cfg.KMSRetiredKeys {
+		retiredKey, err := storage.DecodeMasterKey(retired.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid retired KMS key %q: %w", retired.ID, err)
+		}
+		err = provider.AddRetiredKey(retired.ID, retiredKey)
+		storage.SecureWipe(retiredKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+	
+	return provider, nil
+}
+
+// kdfParamsFromConfig builds the key derivation parameters, using the
+// algorithm's defaults for settings that are not configured
+func kdfParamsFromConfig(cfg *config.Config) (storage.KDFParams, error) {
+	algorithm, err := storage.ParseKDFAlgorithm(cfg.KDFAlgorithm)
+	if err != nil {
+		return storage.KDFParams{}, err
+	}
+	
+	params := storage.DefaultKDFParams()
+	if algorithm == storage.KDFArgon2id {
+		params = storage.DefaultArgon2idParams()
+		if cfg.KDFArgon2MemoryKB > 0 {
+			params.MemoryKiB = uint32(cfg.KDFArgon2MemoryKB)
+		}
+		if cfg.KDFArgon2Threads > 0 {
+			if cfg.KDFArgon2Threads > 255 {
+				return storage.KDFParams{}, errors.New("invalid KDF configuration: KDF_ARGON2_THREADS is too large")
+			}
+			params.Threads = uint8(cfg.KDFArgon2Threads)
+		}
+	}
+	if cfg.KDFIterations > 0 {
+		params.Iterations = uint32(cfg.KDFIterations)
+	}
+	
+	return params, nil
 }
 
 func init() {
@@ -118,7 +521,8 @@ func init() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	
 	// Check if we're running with required environment variable
-	if os.Getenv("TASK_ENCRYPTION_KEY") == "" {
+	keyProvider := os.Getenv("KEY_PROVIDER")
+	if os.Getenv("TASK_ENCRYPTION_KEY") == "" && (keyProvider == "" || keyProvider == "password") {
 		log.Println("Warning: TASK_ENCRYPTION_KEY not set. Please set this environment variable before starting the server.")
 		log.Println("Example: export TASK_ENCRYPTION_KEY=\"your-secure-32-character-key-here\"")
 	}
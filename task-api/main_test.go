@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"task-api/config"
+	"task-api/handlers"
+	"task-api/models"
+	"task-api/repository"
+	"task-api/services"
+)
+
+// testServer runs the API on the storage configured in the environment
+type testServer struct {
+	*httptest.Server
+	repo    repository.TaskRepository
+	service *services.TaskService
+}
+
+func startTestServer(t *testing.T, cfg *config.Config) *testServer {
+	t.Helper()
+
+	encryptedStorage, err := openEncryptedStorage(cfg)
+	if err != nil {
+		t.Fatalf("open storage: %v", err)
+	}
+	repo, err := openTaskRepositoryWithStorage(cfg, encryptedStorage)
+	if err != nil {
+		t.Fatalf("open repository: %v", err)
+	}
+	service := services.NewTaskService(repo)
+	router := newRouter(cfg, handlers.NewTaskHandler(service), handlers.NewHealthHandler(nil), false)
+
+	return &testServer{Server: httptest.NewServer(router), repo: repo, service: service}
+}
+
+// stop shuts the server down like main does on a signal
+func (s *testServer) stop(t *testing.T) {
+	t.Helper()
+
+	s.Close()
+	s.service.Close()
+	if err := s.repo.Close(); err != nil {
+		t.Fatalf("close repository: %v", err)
+	}
+}
+
+// do sends a request and decodes the data of a successful response into
+// out, if given
+func (s *testServer) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, s.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Success bool            `json:"success"`
+		Data    json.RawMessage `json:"data"`
+		Error   string          `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil {
+		return fmt.Errorf("%s %s: %d with an unreadable body: %w", method, path, resp.StatusCode, err)
+	}
+	if resp.StatusCode >= 300 || !envelope.Success {
+		return fmt.Errorf("%s %s: %d %s", method, path, resp.StatusCode, envelope.Error)
+	}
+	if out != nil {
+		return json.Unmarshal(envelope.Data, out)
+	}
+	return nil
+}
+
+func (s *testServer) tasks(t *testing.T) map[string]models.Task {
+	t.Helper()
+
+	var list struct {
+		Tasks []models.Task `json:"tasks"`
+	}
+	if err := s.do(http.MethodGet, "/api/tasks", nil, &list); err != nil {
+		t.Fatal(err)
+	}
+	tasks := make(map[string]models.Task, len(list.Tasks))
+	for _, task := range list.Tasks {
+		tasks[task.ID] = task
+	}
+	return tasks
+}
+
+// TestConcurrentRequests sends creates, updates, reads and backups from
+// many clients at once. Run it with -race. Every update must be applied on
+// top of the previous one, so no version is skipped or lost, and the same
+// tasks must be found after a restart.
+func TestConcurrentRequests(t *testing.T) {
+	const (
+		clients        = 8
+		tasksPerClient = 10
+		updatesPerTask = 5
+		sharedUpdates  = 10
+	)
+
+	gin.SetMode(gin.TestMode)
+	output := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(output) })
+
+	for _, tc := range []struct {
+		name          string
+		backend       string
+		flushInterval string
+	}{
+		{"file", "file", "1000"},
+		{"sqlite", "sqlite", "1000"},
+		{"file write-through", "file", "0"},
+		{"sqlite write-through", "sqlite", "0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TASK_ENCRYPTION_KEY", "concurrency-test-key-0123456789abcdef")
+			t.Setenv("DATA_DIR", t.TempDir())
+			t.Setenv("STORAGE_BACKEND", tc.backend)
+			t.Setenv("FLUSH_INTERVAL_MS", tc.flushInterval)
+			t.Setenv("BACKUP_SCHEDULE", "off")
+			t.Setenv("GIN_MODE", "test")
+			cfg, err := config.LoadConfig()
+			if err != nil {
+				t.Fatalf("load config: %v", err)
+			}
+
+			server := startTestServer(t, cfg)
+
+			var shared models.Task
+			if err := server.do(http.MethodPost, "/api/tasks", map[string]interface{}{"title": "shared"}, &shared); err != nil {
+				t.Fatal(err)
+			}
+
+			var wg sync.WaitGroup
+			errs := make(chan error, clients)
+			for client := 0; client < clients; client++ {
+				wg.Add(1)
+				go func(client int) {
+					defer wg.Done()
+					errs <- runClient(server, client, shared.ID, tasksPerClient, updatesPerTask, sharedUpdates)
+				}(client)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			check := func(tasks map[string]models.Task) {
+				t.Helper()
+
+				if len(tasks) != clients*tasksPerClient+1 {
+					t.Fatalf("found %d tasks, want %d", len(tasks), clients*tasksPerClient+1)
+				}
+				for id, task := range tasks {
+					want := int64(1 + updatesPerTask)
+					if id == shared.ID {
+						want = int64(1 + clients*sharedUpdates)
+					}
+					if task.Version != want {
+						t.Errorf("task %q has version %d, want %d", task.Title, task.Version, want)
+					}
+				}
+			}
+			check(server.tasks(t))
+
+			server.stop(t)
+			restarted := startTestServer(t, cfg)
+			defer restarted.stop(t)
+			check(restarted.tasks(t))
+		})
+	}
+}
+
+// runClient creates its tasks and updates each of them and the shared task,
+// reading the task list and taking a backup in between
+func runClient(server *testServer, client int, sharedID string, tasks, updates, sharedUpdates int) error {
+	ids := make([]string, 0, tasks)
+	for i := 0; i < tasks; i++ {
+		var task models.Task
+		title := fmt.Sprintf("client %d task %d", client, i)
+		if err := server.do(http.MethodPost, "/api/tasks", map[string]interface{}{"title": title}, &task); err != nil {
+			return err
+		}
+		ids = append(ids, task.ID)
+	}
+
+	for round := 0; round < updates; round++ {
+		for _, id := range ids {
+			update := map[string]interface{}{"description": fmt.Sprintf("round %d", round)}
+			if err := server.do(http.MethodPut, "/api/tasks/"+id, update, nil); err != nil {
+				return err
+			}
+		}
+		if err := server.do(http.MethodGet, "/api/tasks", nil, nil); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < sharedUpdates; i++ {
+		update := map[string]interface{}{"description": fmt.Sprintf("client %d update %d", client, i)}
+		if err := server.do(http.MethodPut, "/api/tasks/"+sharedID, update, nil); err != nil {
+			return err
+		}
+		if i == sharedUpdates/2 {
+			if err := server.do(http.MethodPost, "/api/backup", nil, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"task-api/utils"
+)
+
+// ReadOnly rejects requests that could change data with 503 Service
+// Unavailable and the given reason. Only GET, HEAD and OPTIONS requests
+// pass, except for GET routes listed in writeRoutes because they change
+// data too.
+func ReadOnly(reason string, writeRoutes ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			if !contains(writeRoutes, c.FullPath()) {
+				c.Next()
+				return
+			}
+		}
+
+		utils.ErrorResponseJSON(c, http.StatusServiceUnavailable, reason)
+		c.Abort()
+	}
+}
+
+// contains reports whether a slice contains a string
+func contains(slice []string, item string) bool {
+	for _, s := range slice {
+		if s == item {
+			return true
+		}
+	}
+	return false
+}
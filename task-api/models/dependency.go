@@ -0,0 +1,82 @@
+package models
+
+import (
+	"errors"
+	"strings"
+)
+
+// maxBlockers is how many tasks can block a single task
+const maxBlockers = 50
+
+// DependencyNode is a task in a dependency graph, Depth steps away from
+// the task the graph is about
+type DependencyNode struct {
+	ID        string       `json:"id"`
+	Title     string       `json:"title"`
+	Quadrant  TaskQuadrant `json:"quadrant"`
+	Completed bool         `json:"completed"`
+	Depth     int          `json:"depth"`
+}
+
+// DependencyEdge says that From blocks To
+type DependencyEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// DependencyGraph is what a task waits for and what waits for it. Upstream
+// holds the tasks blocking it directly or through other tasks, Downstream
+// the tasks it blocks likewise, and Edges the relations among all of them.
+// OpenBlockers are the direct blockers that are not completed yet.
+type DependencyGraph struct {
+	TaskID       string           `json:"taskId"`
+	Blocked      bool             `json:"blocked"`
+	OpenBlockers []string         `json:"openBlockers"`
+	Upstream     []DependencyNode `json:"upstream"`
+	Downstream   []DependencyNode `json:"downstream"`
+	Edges        []DependencyEdge `json:"edges"`
+}
+
+// NormalizeBlockers trims and deduplicates the IDs of blocking tasks,
+// keeping their order
+func NormalizeBlockers(ids []string) ([]string, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	blockers := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			return nil, errors.New("validation failed: Blocking task IDs cannot be empty")
+		}
+		if !seen[id] {
+			seen[id] = true
+			blockers = append(blockers, id)
+		}
+	}
+	if len(blockers) > maxBlockers {
+		return nil, errors.New("validation failed: A task can be blocked by at most 50 tasks")
+	}
+	return blockers, nil
+}
+
+// RemoveBlockers removes the given tasks from the blockers of a task and
+// reports whether it had any of them
+func (t *Task) RemoveBlockers(ids map[string]bool) bool {
+	kept := make([]string, 0, len(t.BlockedBy))
+	for _, id := range t.BlockedBy {
+		if !ids[id] {
+			kept = append(kept, id)
+		}
+	}
+	if len(kept) == len(t.BlockedBy) {
+		return false
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	t.BlockedBy = kept
+	return true
+}
@@ -0,0 +1,135 @@
+package models
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+)
+
+// FieldChange is a single field that differs between two versions of a task
+type FieldChange struct {
+	Field string      `json:"field"`
+	From  interface{} `json:"from"`
+	To    interface{} `json:"to"`
+}
+
+// TaskChange lists the fields that differ between two versions of a task
+type TaskChange struct {
+	ID      string        `json:"id"`
+	Title   string        `json:"title"`
+	Changes []FieldChange `json:"changes"`
+}
+
+// TaskDiff describes how to get from one list of tasks to another. Added
+// tasks only exist in the target, removed tasks only in the source, and
+// modified tasks exist in both with different fields.
+type TaskDiff struct {
+	Added     []Task       `json:"added"`
+	Removed   []Task       `json:"removed"`
+	Modified  []TaskChange `json:"modified"`
+	Unchanged int          `json:"unchanged"`
+}
+
+// HasChanges reports whether the two lists differ
+func (d *TaskDiff) HasChanges() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.Modified) > 0
+}
+
+// DiffTasks compares two lists of tasks by ID. Fields are compared by their
+// JSON representation, so from and to values are reported as they appear in
+// the API.
+func DiffTasks(from, to []Task) (*TaskDiff, error) {
+	diff := &TaskDiff{
+		Added:    []Task{},
+		Removed:  []Task{},
+		Modified: []TaskChange{},
+	}
+
+	fromByID := make(map[string]Task, len(from))
+	for _, task := range from {
+		fromByID[task.ID] = task
+	}
+	toIDs := make(map[string]bool, len(to))
+
+	for _, task := range to {
+		toIDs[task.ID] = true
+
+		old, exists := fromByID[task.ID]
+		if !exists {
+			diff.Added = append(diff.Added, task)
+			continue
+		}
+
+		changes, err := DiffTaskFields(old, task)
+		if err != nil {
+			return nil, err
+		}
+		if len(changes) == 0 {
+			diff.Unchanged++
+			continue
+		}
+		diff.Modified = append(diff.Modified, TaskChange{
+			ID:      task.ID,
+			Title:   task.Title,
+			Changes: changes,
+		})
+	}
+
+	for _, task := range from {
+		if !toIDs[task.ID] {
+			diff.Removed = append(diff.Removed, task)
+		}
+	}
+
+	return diff, nil
+}
+
+// DiffTaskFields returns the fields that differ between two versions of a
+// task, ordered by field name
+func DiffTaskFields(from, to Task) ([]FieldChange, error) {
+	fromFields, err := taskFields(from)
+	if err != nil {
+		return nil, err
+	}
+	toFields, err := taskFields(to)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(fromFields)+len(toFields))
+	for name := range fromFields {
+		names = append(names, name)
+	}
+	for name := range toFields {
+		if _, ok := fromFields[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := []FieldChange{}
+	for _, name := range names {
+		if !reflect.DeepEqual(fromFields[name], toFields[name]) {
+			changes = append(changes, FieldChange{
+				Field: name,
+				From:  fromFields[name],
+				To:    toFields[name],
+			})
+		}
+	}
+	return changes, nil
+}
+
+// taskFields decodes a task's JSON representation into its fields
+func taskFields(task Task) (map[string]interface{}, error) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
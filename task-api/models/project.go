@@ -0,0 +1,171 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Project is a container for tasks that belong together, each with its own
+// Eisenhower matrix. Tasks without a project are in no project at all.
+type Project struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Description *string `json:"description,omitempty"`
+	Color       string  `json:"color,omitempty"`
+	Archived    bool    `json:"archived"`
+	ArchivedAt  *string `json:"archivedAt,omitempty"`
+	CreatedAt   string  `json:"createdAt"`
+	UpdatedAt   string  `json:"updatedAt"`
+}
+
+// ProjectSummary is a project as returned by the API, with counts of its
+// tasks. Quadrants counts the open tasks in each quadrant.
+type ProjectSummary struct {
+	Project
+	TaskCount      int                  `json:"taskCount"`
+	CompletedCount int                  `json:"completedCount"`
+	Quadrants      map[TaskQuadrant]int `json:"quadrants"`
+}
+
+// ProjectFormData represents the data for creating a project
+type ProjectFormData struct {
+	Name        string  `json:"name"`
+	Description *string `json:"description,omitempty"`
+	Color       *string `json:"color,omitempty"`
+}
+
+// ProjectUpdate represents partial updates to a project
+type ProjectUpdate struct {
+	Name        *string `json:"name,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Color       *string `json:"color,omitempty"`
+	Archived    *bool   `json:"archived,omitempty"`
+}
+
+// ProjectMoveRequest represents a request to move a task to another
+// project, or out of every project if ProjectID is empty or null
+type ProjectMoveRequest struct {
+	ProjectID *string `json:"projectId"`
+	Version   *int64  `json:"version,omitempty"`
+}
+
+// validateProjectName trims a project name and checks its length
+func validateProjectName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", errors.New("validation failed: Project name is required")
+	}
+	if len(name) > 100 {
+		return "", errors.New("validation failed: Project name must be 100 characters or less")
+	}
+	return name, nil
+}
+
+// NewProject creates a project from form data
+func NewProject(formData ProjectFormData) (*Project, error) {
+	name, err := validateProjectName(formData.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	project := &Project{
+		ID:        uuid.New().String(),
+		Name:      name,
+		CreatedAt: now,
+	}
+	if err := project.Update(ProjectUpdate{Description: formData.Description, Color: formData.Color}); err != nil {
+		return nil, err
+	}
+	project.UpdatedAt = now
+
+	return project, nil
+}
+
+// Update applies partial updates to a project
+func (p *Project) Update(updates ProjectUpdate) error {
+	name := p.Name
+	if updates.Name != nil {
+		var err error
+		if name, err = validateProjectName(*updates.Name); err != nil {
+			return err
+		}
+	}
+
+	var description *string
+	if updates.Description != nil {
+		desc := strings.TrimSpace(*updates.Description)
+		if len(desc) > 2000 {
+			return errors.New("validation failed: Project description must be 2000 characters or less")
+		}
+		if desc != "" {
+			description = &desc
+		}
+	}
+
+	color := p.Color
+	if updates.Color != nil {
+		color = strings.ToLower(strings.TrimSpace(*updates.Color))
+		if err := validateColor("Project", color); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	p.Name = name
+	if updates.Description != nil {
+		p.Description = description
+	}
+	p.Color = color
+	if updates.Archived != nil && *updates.Archived != p.Archived {
+		p.Archived = *updates.Archived
+		if p.Archived {
+			p.ArchivedAt = &now
+		} else {
+			p.ArchivedAt = nil
+		}
+	}
+	p.UpdatedAt = now
+
+	return nil
+}
+
+// ProjectsFromJSON parses the project registry, checking every entry
+func ProjectsFromJSON(data []byte) ([]Project, error) {
+	var projects []Project
+	if err := json.Unmarshal(data, &projects); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal projects: %w", err)
+	}
+
+	seen := make(map[string]bool, len(projects))
+	for i, project := range projects {
+		if project.ID == "" || seen[project.ID] {
+			return nil, fmt.Errorf("invalid or duplicate project ID at index %d", i)
+		}
+		seen[project.ID] = true
+		if _, err := validateProjectName(project.Name); err != nil {
+			return nil, fmt.Errorf("invalid project at index %d: %w", i, err)
+		}
+	}
+
+	return projects, nil
+}
+
+// ProjectsToJSON converts the project registry to JSON bytes
+func ProjectsToJSON(projects []Project) ([]byte, error) {
+	return json.Marshal(projects)
+}
+
+// InProject reports whether the task belongs to the project with the given
+// ID, or to no project if it is empty
+func (t *Task) InProject(projectID string) bool {
+	if t.ProjectID == nil {
+		return projectID == ""
+	}
+	return *t.ProjectID == projectID
+}
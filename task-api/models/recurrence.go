@@ -0,0 +1,515 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Recurrence repeats a task by an RFC 5545 RRULE. The rule is evaluated in
+// Timezone from Start, the due date of the first occurrence, so an
+// occurrence keeps its local time of day across daylight saving changes.
+// Every occurrence is a task of its own sharing the SeriesID; completing
+// one creates the next, whose ID is then recorded in NextID.
+type Recurrence struct {
+	Rule       string  `json:"rule"`
+	Timezone   string  `json:"timezone"`
+	SeriesID   string  `json:"seriesId"`
+	Start      string  `json:"start"`
+	Occurrence int     `json:"occurrence"`
+	NextID     *string `json:"nextId,omitempty"`
+}
+
+// RecurrenceFormData represents the data for making a task recur
+type RecurrenceFormData struct {
+	Rule     string `json:"rule"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// Occurrence is an occurrence of a series, numbered from 1
+type Occurrence struct {
+	Occurrence int    `json:"occurrence"`
+	DueDate    string `json:"dueDate"`
+}
+
+// NewRecurrence starts a series whose first occurrence is due at dueDate
+func NewRecurrence(formData RecurrenceFormData, dueDate *string) (*Recurrence, error) {
+	if dueDate == nil || *dueDate == "" {
+		return nil, errors.New("validation failed: A recurring task needs a due date")
+	}
+	start, err := time.Parse(time.RFC3339, *dueDate)
+	if err != nil {
+		return nil, errors.New("validation failed: Invalid due date format. Please use a valid date")
+	}
+
+	rule := strings.ToUpper(strings.TrimSpace(formData.Rule))
+	rule = strings.TrimPrefix(rule, "RRULE:")
+	if _, err := ParseRRule(rule); err != nil {
+		return nil, err
+	}
+
+	timezone := strings.TrimSpace(formData.Timezone)
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(timezone); err != nil {
+		return nil, fmt.Errorf("validation failed: Unknown timezone %q", timezone)
+	}
+
+	return &Recurrence{
+		Rule:       rule,
+		Timezone:   timezone,
+		SeriesID:   uuid.New().String(),
+		Start:      start.UTC().Format(time.RFC3339),
+		Occurrence: 1,
+	}, nil
+}
+
+// Upcoming returns up to limit occurrences due at or after from
+func (r *Recurrence) Upcoming(from time.Time, limit int) ([]Occurrence, error) {
+	return r.occurrences(func(t time.Time) bool { return !t.Before(from) }, limit)
+}
+
+// Next returns the first occurrence due after the given time, or nil if the
+// series ends before
+func (r *Recurrence) Next(after time.Time) (*Occurrence, error) {
+	next, err := r.occurrences(func(t time.Time) bool { return t.After(after) }, 1)
+	if err != nil || len(next) == 0 {
+		return nil, err
+	}
+	return &next[0], nil
+}
+
+// occurrences returns up to limit occurrences for which include is true
+func (r *Recurrence) occurrences(include func(t time.Time) bool, limit int) ([]Occurrence, error) {
+	rule, err := ParseRRule(r.Rule)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := time.LoadLocation(r.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", r.Timezone, err)
+	}
+	start, err := time.Parse(time.RFC3339, r.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid series start: %w", err)
+	}
+
+	occurrences := []Occurrence{}
+	if limit <= 0 {
+		return occurrences, nil
+	}
+	rule.iterate(start.In(loc), func(index int, t time.Time) bool {
+		if include(t) {
+			occurrences = append(occurrences, Occurrence{
+				Occurrence: index,
+				DueDate:    t.UTC().Format(time.RFC3339),
+			})
+		}
+		return len(occurrences) < limit
+	})
+	return occurrences, nil
+}
+
+// NextOccurrence creates the task for the next occurrence of a recurring
+// task: a copy in the same quadrant, project and parent with the new due
+// date and the checklist reopened. Subtasks are not copied.
+func (t *Task) NextOccurrence(next Occurrence) *Task {
+	now := time.Now().UTC().Format(time.RFC3339)
+	dueDate := next.DueDate
+
+	task := &Task{
+		ID:          uuid.New().String(),
+		Title:       t.Title,
+		Description: t.Description,
+		DueDate:     &dueDate,
+		Urgent:      t.Urgent,
+		Important:   t.Important,
+		Quadrant:    t.Quadrant,
+		ParentID:    t.ParentID,
+		ProjectID:   t.ProjectID,
+		Tags:        append([]string(nil), t.Tags...),
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Version:     1,
+	}
+	for _, item := range t.Checklist {
+		task.Checklist = append(task.Checklist, ChecklistItem{ID: uuid.New().String(), Text: item.Text})
+	}
+	if t.Recurrence != nil {
+		recurrence := *t.Recurrence
+		recurrence.Occurrence = next.Occurrence
+		recurrence.NextID = nil
+		task.Recurrence = &recurrence
+	}
+
+	return task
+}
+
+// rruleWeekdays maps the weekday codes of RFC 5545 to weekdays
+var rruleWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// maxEmptyPeriods bounds the search for the next occurrence, so rules that
+// never match, such as the 30th of February, end
+const maxEmptyPeriods = 5000
+
+// rruleWeekday is a BYDAY entry: a weekday, and if N is not zero only the
+// Nth of it in the month or year, counted from the end if negative
+type rruleWeekday struct {
+	N   int
+	Day time.Weekday
+}
+
+// RRule is a parsed RFC 5545 recurrence rule. FREQ may be DAILY, WEEKLY,
+// MONTHLY or YEARLY, refined by INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY,
+// BYMONTH and WKST; other parts are not supported.
+type RRule struct {
+	Freq       string
+	Interval   int
+	Count      int
+	Until      *time.Time
+	ByDay      []rruleWeekday
+	ByMonthDay []int
+	ByMonth    []int
+	WeekStart  time.Weekday
+
+	// untilFloating is set if UNTIL has no timezone and is read in the
+	// timezone of the series
+	untilFloating bool
+}
+
+// ruleError is a validation error for a recurrence rule
+func ruleError(format string, args ...interface{}) error {
+	return fmt.Errorf("validation failed: Invalid recurrence rule: "+format, args...)
+}
+
+// ParseRRule parses the value of an RRULE property, such as
+// FREQ=WEEKLY;INTERVAL=2;BYDAY=MO,FR
+func ParseRRule(rule string) (*RRule, error) {
+	rule = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rule)), "RRULE:")
+	if rule == "" {
+		return nil, errors.New("validation failed: Recurrence rule is required")
+	}
+
+	r := &RRule{Interval: 1, WeekStart: time.Monday}
+	seen := make(map[string]bool)
+	for _, part := range strings.Split(rule, ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok || value == "" {
+			return nil, ruleError("%q is not of the form NAME=VALUE", part)
+		}
+		if seen[key] {
+			return nil, ruleError("%s is given twice", key)
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				r.Freq = value
+			default:
+				err = ruleError("FREQ must be DAILY, WEEKLY, MONTHLY or YEARLY")
+			}
+		case "INTERVAL":
+			r.Interval, err = ruleNumber(key, value, 1, 1000)
+		case "COUNT":
+			r.Count, err = ruleNumber(key, value, 1, 10000)
+		case "UNTIL":
+			err = r.parseUntil(value)
+		case "BYDAY":
+			err = r.parseByDay(value)
+		case "BYMONTHDAY":
+			r.ByMonthDay, err = ruleNumbers(key, value, -31, 31)
+		case "BYMONTH":
+			r.ByMonth, err = ruleNumbers(key, value, 1, 12)
+		case "WKST":
+			day, ok := rruleWeekdays[value]
+			if !ok {
+				err = ruleError("unknown weekday %q in WKST", value)
+			}
+			r.WeekStart = day
+		default:
+			err = ruleError("%s is not supported", key)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Freq == "" {
+		return nil, ruleError("FREQ is required")
+	}
+	if r.Count > 0 && r.Until != nil {
+		return nil, ruleError("COUNT and UNTIL cannot be combined")
+	}
+	if r.Freq == "WEEKLY" && len(r.ByMonthDay) > 0 {
+		return nil, ruleError("BYMONTHDAY cannot be used with FREQ=WEEKLY")
+	}
+	for _, day := range r.ByDay {
+		if day.N != 0 && (r.Freq == "DAILY" || r.Freq == "WEEKLY") {
+			return nil, ruleError("numbered BYDAY values need FREQ=MONTHLY or YEARLY")
+		}
+	}
+	return r, nil
+}
+
+// ruleNumber parses a number of a rule part within [min, max]
+func ruleNumber(key, value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, ruleError("%s must be a number from %d to %d", key, min, max)
+	}
+	return n, nil
+}
+
+// ruleNumbers parses a comma-separated list of non-zero numbers
+func ruleNumbers(key, value string, min, max int) ([]int, error) {
+	var numbers []int
+	for _, item := range strings.Split(value, ",") {
+		n, err := ruleNumber(key, item, min, max)
+		if err != nil || n == 0 {
+			return nil, ruleError("%s must be a list of non-zero numbers from %d to %d", key, min, max)
+		}
+		numbers = append(numbers, n)
+	}
+	return numbers, nil
+}
+
+// parseUntil parses UNTIL as a UTC time, a floating local time or a date,
+// which includes the whole day
+func (r *RRule) parseUntil(value string) error {
+	layouts := []struct {
+		layout   string
+		floating bool
+	}{
+		{"20060102T150405Z", false},
+		{"20060102T150405", true},
+		{"20060102", true},
+	}
+	for _, l := range layouts {
+		until, err := time.Parse(l.layout, value)
+		if err != nil {
+			continue
+		}
+		if l.layout == "20060102" {
+			until = until.Add(24*time.Hour - time.Second)
+		}
+		r.Until = &until
+		r.untilFloating = l.floating
+		return nil
+	}
+	return ruleError("UNTIL must be a date such as 20240131 or a time such as 20240131T170000Z")
+}
+
+// parseByDay parses BYDAY entries such as MO, 1MO or -1FR
+func (r *RRule) parseByDay(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if len(item) < 2 {
+			return ruleError("unknown weekday %q in BYDAY", item)
+		}
+		day, ok := rruleWeekdays[item[len(item)-2:]]
+		if !ok {
+			return ruleError("unknown weekday %q in BYDAY", item)
+		}
+
+		weekday := rruleWeekday{Day: day}
+		if prefix := item[:len(item)-2]; prefix != "" {
+			n, err := strconv.Atoi(prefix)
+			if err != nil || n == 0 || n < -53 || n > 53 {
+				return ruleError("invalid weekday number in %q", item)
+			}
+			weekday.N = n
+		}
+		r.ByDay = append(r.ByDay, weekday)
+	}
+	return nil
+}
+
+// iterate calls yield with each occurrence from start on and its number,
+// in order, until yield returns false or the rule ends. The time of day of
+// every occurrence is that of start.
+func (r *RRule) iterate(start time.Time, yield func(index int, t time.Time) bool) {
+	rule := r.withDefaults(start)
+	until := rule.Until
+	if until != nil && rule.untilFloating {
+		local := time.Date(until.Year(), until.Month(), until.Day(), until.Hour(), until.Minute(), until.Second(), 0, start.Location())
+		until = &local
+	}
+
+	index := 0
+	empty := 0
+	for period := 0; empty < maxEmptyPeriods; period++ {
+		days := rule.periodDays(start, period)
+		if len(days) == 0 {
+			empty++
+			continue
+		}
+		empty = 0
+
+		for _, day := range days {
+			t := time.Date(day.Year(), day.Month(), day.Day(), start.Hour(), start.Minute(), start.Second(), 0, start.Location())
+			if t.Before(start) {
+				continue
+			}
+			if until != nil && t.After(*until) {
+				return
+			}
+			index++
+			if !yield(index, t) {
+				return
+			}
+			if rule.Count > 0 && index >= rule.Count {
+				return
+			}
+		}
+	}
+}
+
+// withDefaults fills in the parts RFC 5545 takes from the start: the
+// weekday of weekly rules and the day of monthly and yearly rules
+func (r *RRule) withDefaults(start time.Time) RRule {
+	rule := *r
+	switch rule.Freq {
+	case "WEEKLY":
+		if len(rule.ByDay) == 0 {
+			rule.ByDay = []rruleWeekday{{Day: start.Weekday()}}
+		}
+	case "MONTHLY":
+		if len(rule.ByDay) == 0 && len(rule.ByMonthDay) == 0 {
+			rule.ByMonthDay = []int{start.Day()}
+		}
+	case "YEARLY":
+		if len(rule.ByDay) == 0 && len(rule.ByMonthDay) == 0 {
+			rule.ByMonthDay = []int{start.Day()}
+			if len(rule.ByMonth) == 0 {
+				rule.ByMonth = []int{int(start.Month())}
+			}
+		}
+	}
+	return rule
+}
+
+// periodDays returns the days of the given period after the one containing
+// start that match the rule, in order, as dates in UTC
+func (r *RRule) periodDays(start time.Time, period int) []time.Time {
+	step := period * r.Interval
+	switch r.Freq {
+	case "DAILY":
+		return r.spanDays(time.Date(start.Year(), start.Month(), start.Day()+step, 0, 0, 0, 0, time.UTC), 1)
+	case "WEEKLY":
+		offset := (int(start.Weekday()) - int(r.WeekStart) + 7) % 7
+		return r.spanDays(time.Date(start.Year(), start.Month(), start.Day()-offset+7*step, 0, 0, 0, 0, time.UTC), 7)
+	case "MONTHLY":
+		return r.monthDays(start.Year(), start.Month()+time.Month(step))
+	default:
+		year := start.Year() + step
+		if len(r.ByMonth) == 0 || len(r.ByDay) == 0 {
+			first := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+			return r.spanDays(first, time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC).YearDay())
+		}
+
+		// Numbered weekdays count within each month when months are given
+		var days []time.Time
+		for _, month := range sortedInts(r.ByMonth) {
+			days = append(days, r.monthDays(year, time.Month(month))...)
+		}
+		return days
+	}
+}
+
+// monthDays returns the days of a month that match the rule
+func (r *RRule) monthDays(year int, month time.Month) []time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return r.spanDays(first, daysIn(first))
+}
+
+// spanDays returns the days of the span of n days from first that match
+// the rule. Numbered weekdays count within the span.
+func (r *RRule) spanDays(first time.Time, n int) []time.Time {
+	var days []time.Time
+	for i := 0; i < n; i++ {
+		day := first.AddDate(0, 0, i)
+		if r.matchesMonth(day) && r.matchesMonthDay(day) && r.matchesWeekday(day, i, n) {
+			days = append(days, day)
+		}
+	}
+	return days
+}
+
+// matchesMonth checks BYMONTH
+func (r *RRule) matchesMonth(day time.Time) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, month := range r.ByMonth {
+		if time.Month(month) == day.Month() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesMonthDay checks BYMONTHDAY, where negative days count from the
+// end of the month
+func (r *RRule) matchesMonthDay(day time.Time) bool {
+	if len(r.ByMonthDay) == 0 {
+		return true
+	}
+	for _, monthDay := range r.ByMonthDay {
+		if monthDay < 0 {
+			monthDay += daysIn(day) + 1
+		}
+		if monthDay == day.Day() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWeekday checks BYDAY for the day at index i of a span of n days
+func (r *RRule) matchesWeekday(day time.Time, i, n int) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	for _, weekday := range r.ByDay {
+		if weekday.Day != day.Weekday() {
+			continue
+		}
+		switch {
+		case weekday.N == 0:
+			return true
+		case weekday.N > 0 && i/7+1 == weekday.N:
+			return true
+		case weekday.N < 0 && (n-1-i)/7+1 == -weekday.N:
+			return true
+		}
+	}
+	return false
+}
+
+// daysIn returns the number of days in the month of day
+func daysIn(day time.Time) int {
+	return time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+// sortedInts returns a sorted copy of numbers
+func sortedInts(numbers []int) []int {
+	sorted := append([]int(nil), numbers...)
+	sort.Ints(sorted)
+	return sorted
+}
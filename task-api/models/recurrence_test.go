@@ -0,0 +1,325 @@
+package models
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRRule(t *testing.T) {
+	until := time.Date(2024, time.January, 31, 17, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		rule string
+		want RRule
+	}{
+		{"FREQ=DAILY", RRule{Freq: "DAILY", Interval: 1, WeekStart: time.Monday}},
+		{
+			"rrule:freq=monthly;interval=2;byday=mo,-1fr;wkst=su",
+			RRule{
+				Freq:      "MONTHLY",
+				Interval:  2,
+				ByDay:     []rruleWeekday{{Day: time.Monday}, {N: -1, Day: time.Friday}},
+				WeekStart: time.Sunday,
+			},
+		},
+		{
+			"FREQ=YEARLY;BYMONTH=1,7;BYMONTHDAY=1,-1;COUNT=10",
+			RRule{Freq: "YEARLY", Interval: 1, Count: 10, ByMonth: []int{1, 7}, ByMonthDay: []int{1, -1}, WeekStart: time.Monday},
+		},
+		{"FREQ=WEEKLY;UNTIL=20240131T170000Z", RRule{Freq: "WEEKLY", Interval: 1, Until: &until, WeekStart: time.Monday}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := ParseRRule(tt.rule)
+			if err != nil {
+				t.Fatalf("ParseRRule(%q) failed: %v", tt.rule, err)
+			}
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("ParseRRule(%q) = %+v, want %+v", tt.rule, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRRuleFloatingUntil(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"20240131T170000", time.Date(2024, time.January, 31, 17, 0, 0, 0, time.UTC)},
+		{"20240131", time.Date(2024, time.January, 31, 23, 59, 59, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRRule("FREQ=DAILY;UNTIL=" + tt.value)
+		if err != nil {
+			t.Fatalf("UNTIL=%s failed: %v", tt.value, err)
+		}
+		if !got.untilFloating || !got.Until.Equal(tt.want) {
+			t.Errorf("UNTIL=%s parsed as %v (floating %v), want floating %v", tt.value, got.Until, got.untilFloating, tt.want)
+		}
+	}
+}
+
+func TestParseRRuleInvalid(t *testing.T) {
+	tests := []struct {
+		rule string
+		err  string
+	}{
+		{"", "is required"},
+		{"FREQ", "NAME=VALUE"},
+		{"FREQ=", "NAME=VALUE"},
+		{"INTERVAL=2", "FREQ is required"},
+		{"FREQ=HOURLY", "FREQ must be"},
+		{"FREQ=DAILY;FREQ=WEEKLY", "given twice"},
+		{"FREQ=DAILY;BYSETPOS=1", "not supported"},
+		{"FREQ=DAILY;INTERVAL=0", "INTERVAL must be"},
+		{"FREQ=DAILY;COUNT=0", "COUNT must be"},
+		{"FREQ=DAILY;COUNT=2;UNTIL=20240101", "cannot be combined"},
+		{"FREQ=DAILY;UNTIL=tomorrow", "UNTIL must be"},
+		{"FREQ=MONTHLY;BYMONTHDAY=0", "non-zero"},
+		{"FREQ=MONTHLY;BYMONTHDAY=32", "BYMONTHDAY must be"},
+		{"FREQ=YEARLY;BYMONTH=13", "BYMONTH must be"},
+		{"FREQ=WEEKLY;BYMONTHDAY=1", "cannot be used with FREQ=WEEKLY"},
+		{"FREQ=WEEKLY;BYDAY=XX", "unknown weekday"},
+		{"FREQ=WEEKLY;BYDAY=1MO", "need FREQ=MONTHLY or YEARLY"},
+		{"FREQ=MONTHLY;BYDAY=0MO", "invalid weekday number"},
+		{"FREQ=MONTHLY;BYDAY=54MO", "invalid weekday number"},
+		{"FREQ=WEEKLY;WKST=XX", "unknown weekday"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			_, err := ParseRRule(tt.rule)
+			if err == nil {
+				t.Fatalf("ParseRRule(%q) succeeded", tt.rule)
+			}
+			if !strings.Contains(err.Error(), tt.err) || !strings.Contains(err.Error(), "validation failed") {
+				t.Errorf("ParseRRule(%q) = %q, want a validation error containing %q", tt.rule, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRecurrenceUpcoming(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		timezone string
+		start    string
+		limit    int
+		want     []string
+	}{
+		{
+			name:  "weekly by day",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,WE,FR",
+			start: "2024-01-01T09:00:00Z",
+			limit: 5,
+			want:  []string{"2024-01-01T09:00:00Z", "2024-01-03T09:00:00Z", "2024-01-05T09:00:00Z", "2024-01-08T09:00:00Z", "2024-01-10T09:00:00Z"},
+		},
+		{
+			name:  "weekly by day after a later start",
+			rule:  "FREQ=WEEKLY;BYDAY=MO,FR",
+			start: "2024-01-03T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-01-05T09:00:00Z", "2024-01-08T09:00:00Z", "2024-01-12T09:00:00Z"},
+		},
+		{
+			name:  "every other week",
+			rule:  "FREQ=WEEKLY;INTERVAL=2",
+			start: "2024-01-01T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-01-01T09:00:00Z", "2024-01-15T09:00:00Z", "2024-01-29T09:00:00Z"},
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			rule:  "FREQ=MONTHLY",
+			start: "2024-01-31T09:00:00Z",
+			limit: 4,
+			want:  []string{"2024-01-31T09:00:00Z", "2024-03-31T09:00:00Z", "2024-05-31T09:00:00Z", "2024-07-31T09:00:00Z"},
+		},
+		{
+			name:  "last day of the month",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=-1",
+			start: "2024-01-31T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-01-31T09:00:00Z", "2024-02-29T09:00:00Z", "2024-03-31T09:00:00Z"},
+		},
+		{
+			name:  "second tuesday",
+			rule:  "FREQ=MONTHLY;BYDAY=2TU",
+			start: "2024-01-09T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-01-09T09:00:00Z", "2024-02-13T09:00:00Z", "2024-03-12T09:00:00Z"},
+		},
+		{
+			name:  "last friday",
+			rule:  "FREQ=MONTHLY;BYDAY=-1FR",
+			start: "2024-01-26T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-01-26T09:00:00Z", "2024-02-23T09:00:00Z", "2024-03-29T09:00:00Z"},
+		},
+		{
+			name:  "friday the 13th",
+			rule:  "FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13",
+			start: "2024-09-13T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-09-13T09:00:00Z", "2024-12-13T09:00:00Z", "2025-06-13T09:00:00Z"},
+		},
+		{
+			name:  "fourth thursday of november",
+			rule:  "FREQ=YEARLY;BYMONTH=11;BYDAY=4TH",
+			start: "2024-11-28T09:00:00Z",
+			limit: 3,
+			want:  []string{"2024-11-28T09:00:00Z", "2025-11-27T09:00:00Z", "2026-11-26T09:00:00Z"},
+		},
+		{
+			name:  "yearly on a leap day",
+			rule:  "FREQ=YEARLY",
+			start: "2024-02-29T09:00:00Z",
+			limit: 2,
+			want:  []string{"2024-02-29T09:00:00Z", "2028-02-29T09:00:00Z"},
+		},
+		{
+			name:  "count ends the series",
+			rule:  "FREQ=DAILY;COUNT=3",
+			start: "2024-01-01T09:00:00Z",
+			limit: 10,
+			want:  []string{"2024-01-01T09:00:00Z", "2024-01-02T09:00:00Z", "2024-01-03T09:00:00Z"},
+		},
+		{
+			name:  "until date includes the whole day",
+			rule:  "FREQ=DAILY;UNTIL=20240103",
+			start: "2024-01-01T09:00:00Z",
+			limit: 10,
+			want:  []string{"2024-01-01T09:00:00Z", "2024-01-02T09:00:00Z", "2024-01-03T09:00:00Z"},
+		},
+		{
+			name:  "until time in UTC",
+			rule:  "FREQ=DAILY;UNTIL=20240102T120000Z",
+			start: "2024-01-01T09:00:00Z",
+			limit: 10,
+			want:  []string{"2024-01-01T09:00:00Z", "2024-01-02T09:00:00Z"},
+		},
+		{
+			name:     "floating until in the series timezone",
+			rule:     "FREQ=DAILY;UNTIL=20240102T170000",
+			timezone: "Europe/Berlin",
+			start:    "2024-01-01T16:00:00Z",
+			limit:    10,
+			want:     []string{"2024-01-01T16:00:00Z", "2024-01-02T16:00:00Z"},
+		},
+		{
+			name:     "keeps local time into daylight saving time",
+			rule:     "FREQ=DAILY",
+			timezone: "Europe/Berlin",
+			start:    "2024-03-30T16:00:00Z",
+			limit:    3,
+			want:     []string{"2024-03-30T16:00:00Z", "2024-03-31T15:00:00Z", "2024-04-01T15:00:00Z"},
+		},
+		{
+			name:     "keeps local time out of daylight saving time",
+			rule:     "FREQ=WEEKLY",
+			timezone: "America/New_York",
+			start:    "2024-10-28T13:00:00Z",
+			limit:    2,
+			want:     []string{"2024-10-28T13:00:00Z", "2024-11-04T14:00:00Z"},
+		},
+		{
+			name:     "weekday in the series timezone",
+			rule:     "FREQ=WEEKLY",
+			timezone: "Pacific/Auckland",
+			start:    "2024-01-07T20:00:00Z", // Monday 09:00 in Auckland
+			limit:    2,
+			want:     []string{"2024-01-07T20:00:00Z", "2024-01-14T20:00:00Z"},
+		},
+		{
+			name:  "rule that never matches ends",
+			rule:  "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30",
+			start: "2024-01-01T09:00:00Z",
+			limit: 1,
+			want:  []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timezone := tt.timezone
+			if timezone == "" {
+				timezone = "UTC"
+			}
+			r := &Recurrence{Rule: tt.rule, Timezone: timezone, Start: tt.start}
+			from, _ := time.Parse(time.RFC3339, tt.start)
+
+			occurrences, err := r.Upcoming(from, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for i, occurrence := range occurrences {
+				got = append(got, occurrence.DueDate)
+				if occurrence.Occurrence != i+1 {
+					t.Errorf("occurrence %d is numbered %d", i+1, occurrence.Occurrence)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Upcoming = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	r := &Recurrence{Rule: "FREQ=WEEKLY;COUNT=2", Timezone: "UTC", Start: "2024-01-01T09:00:00Z"}
+
+	tests := []struct {
+		after string
+		want  *Occurrence
+	}{
+		{"2024-01-01T08:00:00Z", &Occurrence{Occurrence: 1, DueDate: "2024-01-01T09:00:00Z"}},
+		{"2024-01-01T09:00:00Z", &Occurrence{Occurrence: 2, DueDate: "2024-01-08T09:00:00Z"}},
+		{"2024-01-08T09:00:00Z", nil},
+	}
+
+	for _, tt := range tests {
+		after, _ := time.Parse(time.RFC3339, tt.after)
+		got, err := r.Next(after)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Next(%s) = %+v, want %+v", tt.after, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateRuleKeepsSeries(t *testing.T) {
+	due := "2024-01-01T09:00:00Z"
+	next := "next-id"
+	task := &Task{
+		ID:        "task-id",
+		Title:     "Review",
+		DueDate:   &due,
+		Completed: true,
+		Recurrence: &Recurrence{
+			Rule: "FREQ=WEEKLY", Timezone: "UTC", SeriesID: "series-id",
+			Start: due, Occurrence: 3, NextID: &next,
+		},
+	}
+
+	if err := task.Update(TaskUpdate{Recurrence: &RecurrenceFormData{Rule: "FREQ=DAILY"}}); err != nil {
+		t.Fatal(err)
+	}
+	if task.Recurrence.Rule != "FREQ=DAILY" {
+		t.Errorf("rule is %q, want FREQ=DAILY", task.Recurrence.Rule)
+	}
+	if task.Recurrence.SeriesID != "series-id" {
+		t.Errorf("series ID is %q, want it kept", task.Recurrence.SeriesID)
+	}
+	if task.Recurrence.NextID == nil || *task.Recurrence.NextID != next {
+		t.Errorf("next ID is %v, want it kept so no second occurrence is created", task.Recurrence.NextID)
+	}
+}
@@ -0,0 +1,258 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrChecklistItemNotFound is returned for operations on a checklist item
+// the task does not have
+var ErrChecklistItemNotFound = errors.New("checklist item not found")
+
+// ChecklistItem is a lightweight step of a task with its own completion
+// state. Unlike a subtask it has no quadrant, dates or checklist of its own.
+type ChecklistItem struct {
+	ID          string  `json:"id" validate:"required"`
+	Text        string  `json:"text" validate:"required,max=200"`
+	Completed   bool    `json:"completed"`
+	CompletedAt *string `json:"completedAt,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05.000Z"`
+}
+
+// TaskProgress counts the finished direct subtasks and checklist items of a
+// task
+type TaskProgress struct {
+	Completed int `json:"completed"`
+	Total     int `json:"total"`
+}
+
+// TaskNode is a task with its subtasks, as returned by tree listings
+type TaskNode struct {
+	Task
+	Subtasks []TaskNode   `json:"subtasks"`
+	Progress TaskProgress `json:"progress"`
+}
+
+// TaskTreeCollection is a collection of task trees with the number of
+// top-level tasks
+type TaskTreeCollection struct {
+	Tasks []TaskNode `json:"tasks"`
+	Total int        `json:"total"`
+}
+
+// ChecklistItemRequest represents a request to add or rename a checklist item
+type ChecklistItemRequest struct {
+	Text    string `json:"text"`
+	Version *int64 `json:"version,omitempty"`
+}
+
+// ReorderRequest represents a request to reorder subtasks or checklist
+// items, listing every one of them by ID in the new order
+type ReorderRequest struct {
+	IDs     []string `json:"ids"`
+	Version *int64   `json:"version,omitempty"`
+}
+
+// validateChecklistText trims checklist item text and checks its length
+func validateChecklistText(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", errors.New("validation failed: Checklist item text is required")
+	}
+	if len(text) > 200 {
+		return "", errors.New("validation failed: Checklist item text must be 200 characters or less")
+	}
+	return text, nil
+}
+
+// checklistIndex returns the index of a checklist item, or -1
+func (t *Task) checklistIndex(itemID string) int {
+	for i := range t.Checklist {
+		if t.Checklist[i].ID == itemID {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddChecklistItem appends an open item to the checklist
+func (t *Task) AddChecklistItem(text string) (*ChecklistItem, error) {
+	text, err := validateChecklistText(text)
+	if err != nil {
+		return nil, err
+	}
+
+	t.Checklist = append(t.Checklist, ChecklistItem{
+		ID:   uuid.New().String(),
+		Text: text,
+	})
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	item := t.Checklist[len(t.Checklist)-1]
+	return &item, nil
+}
+
+// RenameChecklistItem replaces the text of a checklist item
+func (t *Task) RenameChecklistItem(itemID, text string) error {
+	i := t.checklistIndex(itemID)
+	if i < 0 {
+		return ErrChecklistItemNotFound
+	}
+	text, err := validateChecklistText(text)
+	if err != nil {
+		return err
+	}
+
+	t.Checklist[i].Text = text
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+// SetChecklistItemCompletion sets the completion status of a checklist
+// item, or toggles it if completed is nil
+func (t *Task) SetChecklistItemCompletion(itemID string, completed *bool) error {
+	i := t.checklistIndex(itemID)
+	if i < 0 {
+		return ErrChecklistItemNotFound
+	}
+
+	item := &t.Checklist[i]
+	done := !item.Completed
+	if completed != nil {
+		done = *completed
+	}
+	if item.Completed == done {
+		return nil // No change needed
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	item.Completed = done
+	if done {
+		item.CompletedAt = &now
+	} else {
+		item.CompletedAt = nil
+	}
+	t.UpdatedAt = now
+	return nil
+}
+
+// RemoveChecklistItem deletes a checklist item
+func (t *Task) RemoveChecklistItem(itemID string) error {
+	i := t.checklistIndex(itemID)
+	if i < 0 {
+		return ErrChecklistItemNotFound
+	}
+
+	t.Checklist = append(t.Checklist[:i], t.Checklist[i+1:]...)
+	if len(t.Checklist) == 0 {
+		t.Checklist = nil
+	}
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+// ReorderChecklist puts the checklist items in the given order, which must
+// list every item exactly once
+func (t *Task) ReorderChecklist(itemIDs []string) error {
+	if len(itemIDs) != len(t.Checklist) {
+		return errors.New("validation failed: The new order must list every checklist item exactly once")
+	}
+
+	reordered := make([]ChecklistItem, 0, len(itemIDs))
+	seen := make(map[string]bool, len(itemIDs))
+	for _, id := range itemIDs {
+		i := t.checklistIndex(id)
+		if i < 0 {
+			return ErrChecklistItemNotFound
+		}
+		if seen[id] {
+			return errors.New("validation failed: The new order must list every checklist item exactly once")
+		}
+		seen[id] = true
+		reordered = append(reordered, t.Checklist[i])
+	}
+
+	t.Checklist = reordered
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+// Progress counts the finished checklist items of the task together with
+// the given direct subtasks
+func (t *Task) Progress(subtasks []Task) TaskProgress {
+	progress := TaskProgress{Total: len(t.Checklist) + len(subtasks)}
+	for _, item := range t.Checklist {
+		if item.Completed {
+			progress.Completed++
+		}
+	}
+	for _, subtask := range subtasks {
+		if subtask.Completed {
+			progress.Completed++
+		}
+	}
+	return progress
+}
+
+// SortSubtasks orders sibling subtasks by position, keeping the given order
+// for equal positions
+func SortSubtasks(subtasks []Task) {
+	sort.SliceStable(subtasks, func(i, j int) bool {
+		return subtasks[i].Position < subtasks[j].Position
+	})
+}
+
+// BuildTaskTree nests tasks under their parents. Roots keep the order of
+// tasks and subtasks are ordered by position. A task whose parent is not in
+// tasks, for example because a filter left it out, becomes a root, and so
+// does a task on a cycle of parents, which only restored data can contain.
+func BuildTaskTree(tasks []Task) []TaskNode {
+	present := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		present[task.ID] = true
+	}
+
+	children := make(map[string][]Task)
+	var roots []Task
+	for _, task := range tasks {
+		if task.ParentID != nil && present[*task.ParentID] {
+			children[*task.ParentID] = append(children[*task.ParentID], task)
+		} else {
+			roots = append(roots, task)
+		}
+	}
+
+	visited := make(map[string]bool, len(tasks))
+	var build func(task Task) TaskNode
+	build = func(task Task) TaskNode {
+		visited[task.ID] = true
+		subtasks := children[task.ID]
+		SortSubtasks(subtasks)
+
+		node := TaskNode{
+			Task:     task,
+			Subtasks: make([]TaskNode, 0, len(subtasks)),
+			Progress: task.Progress(subtasks),
+		}
+		for _, subtask := range subtasks {
+			if !visited[subtask.ID] {
+				node.Subtasks = append(node.Subtasks, build(subtask))
+			}
+		}
+		return node
+	}
+
+	nodes := make([]TaskNode, 0, len(roots))
+	for _, root := range roots {
+		nodes = append(nodes, build(root))
+	}
+	for _, task := range tasks {
+		if !visited[task.ID] {
+			nodes = append(nodes, build(task))
+		}
+	}
+	return nodes
+}
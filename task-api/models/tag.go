@@ -0,0 +1,289 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// MaxTagsPerTask is how many tags a single task can carry
+const MaxTagsPerTask = 20
+
+// MaxTagLength is how many characters a tag can have
+const MaxTagLength = 50
+
+// colorPattern matches colors such as #1e90ff or #09f
+var colorPattern = regexp.MustCompile(`^#([0-9a-fA-F]{3}|[0-9a-fA-F]{6})$`)
+
+// Tag is an entry of the tag registry, giving a tag a color and a
+// description. Tasks can carry tags that are not registered, which have no
+// timestamps.
+type Tag struct {
+	Name        string `json:"name"`
+	Color       string `json:"color,omitempty"`
+	Description string `json:"description,omitempty"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+	UpdatedAt   string `json:"updatedAt,omitempty"`
+}
+
+// TagSummary is a tag as listed by the API, with the number of tasks
+// carrying it. Registered is false for tags used by tasks that are not in
+// the registry.
+type TagSummary struct {
+	Tag
+	Registered bool `json:"registered"`
+	TaskCount  int  `json:"taskCount"`
+}
+
+// TagFormData represents the data for registering a tag
+type TagFormData struct {
+	Name        string  `json:"name"`
+	Color       *string `json:"color,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// TagUpdate represents partial updates to a registered tag
+type TagUpdate struct {
+	Color       *string `json:"color,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+// TagRenameRequest represents a request to rename a tag
+type TagRenameRequest struct {
+	Name string `json:"name"`
+}
+
+// TagMergeRequest represents a request to merge a tag into another one
+type TagMergeRequest struct {
+	Into string `json:"into"`
+}
+
+// NormalizeTag returns the canonical form of a tag: trimmed, without a
+// leading '#' and in lower case. Tags are 1 to MaxTagLength letters, digits,
+// '-', '_' or '.', so every tag fits a single segment of the /api/tags/:name
+// routes.
+func NormalizeTag(tag string) (string, error) {
+	tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+	if tag == "" {
+		return "", errors.New("validation failed: Tag name is required")
+	}
+	if utf8.RuneCountInString(tag) > MaxTagLength {
+		return "", fmt.Errorf("validation failed: Tag names must be %d characters or less", MaxTagLength)
+	}
+	for _, r := range tag {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && !strings.ContainsRune("-_.", r) {
+			return "", fmt.Errorf("validation failed: Tag %q may only contain letters, digits, '-', '_' and '.'", tag)
+		}
+	}
+	return tag, nil
+}
+
+// validateTags checks that a list of tags is short enough and holds only
+// normalized tags, with the limits of NormalizeTags
+func validateTags(fl validator.FieldLevel) bool {
+	tags, ok := fl.Field().Interface().([]string)
+	if !ok || len(tags) > MaxTagsPerTask {
+		return false
+	}
+	for _, tag := range tags {
+		if normalized, err := NormalizeTag(tag); err != nil || normalized != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// NormalizeTags normalizes a list of tags and drops duplicates, keeping the
+// first occurrence of each
+func NormalizeTags(tags []string) ([]string, error) {
+	if len(tags) == 0 {
+		return nil, nil
+	}
+
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+	for _, tag := range tags {
+		tag, err := NormalizeTag(tag)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+
+	if len(normalized) > MaxTagsPerTask {
+		return nil, fmt.Errorf("validation failed: A task can have at most %d tags", MaxTagsPerTask)
+	}
+	return normalized, nil
+}
+
+// validateColor checks that the color of a tag or project is empty or a
+// hex color like #1e90ff
+func validateColor(owner, color string) error {
+	if color != "" && !colorPattern.MatchString(color) {
+		return fmt.Errorf("validation failed: %s color must be a hex color such as #1e90ff", owner)
+	}
+	return nil
+}
+
+// validateTagDescription checks the length of a tag description
+func validateTagDescription(description string) error {
+	if len(description) > 500 {
+		return errors.New("validation failed: Tag description must be 500 characters or less")
+	}
+	return nil
+}
+
+// NewTag creates a registry entry from form data
+func NewTag(formData TagFormData) (*Tag, error) {
+	name, err := NormalizeTag(formData.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	tag := &Tag{
+		Name:      name,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := tag.Update(TagUpdate{Color: formData.Color, Description: formData.Description}); err != nil {
+		return nil, err
+	}
+	tag.UpdatedAt = now
+
+	return tag, nil
+}
+
+// Update applies partial updates to a registered tag
+func (t *Tag) Update(updates TagUpdate) error {
+	if updates.Color != nil {
+		color := strings.ToLower(strings.TrimSpace(*updates.Color))
+		if err := validateColor("Tag", color); err != nil {
+			return err
+		}
+		t.Color = color
+	}
+
+	if updates.Description != nil {
+		description := strings.TrimSpace(*updates.Description)
+		if err := validateTagDescription(description); err != nil {
+			return err
+		}
+		t.Description = description
+	}
+
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return nil
+}
+
+// HasTag reports whether the task carries a tag
+func (t *Task) HasTag(tag string) bool {
+	for _, existing := range t.Tags {
+		if existing == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchesTags reports whether the task carries all of the given tags, or
+// any of them if matchAny is set. Every task matches an empty list.
+func (t *Task) MatchesTags(tags []string, matchAny bool) bool {
+	if len(tags) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		if t.HasTag(tag) == matchAny {
+			return matchAny
+		}
+	}
+	return !matchAny
+}
+
+// ReplaceTag replaces a tag of the task with another one, dropping it
+// instead if the task already carries the new tag, and reports whether the
+// task changed
+func (t *Task) ReplaceTag(old, replacement string) bool {
+	if !t.HasTag(old) {
+		return false
+	}
+
+	hasReplacement := t.HasTag(replacement)
+	tags := make([]string, 0, len(t.Tags))
+	for _, tag := range t.Tags {
+		switch {
+		case tag != old:
+			tags = append(tags, tag)
+		case !hasReplacement:
+			tags = append(tags, replacement)
+		}
+	}
+
+	t.Tags = tags
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return true
+}
+
+// RemoveTag removes a tag from the task and reports whether it had it
+func (t *Task) RemoveTag(tag string) bool {
+	if !t.HasTag(tag) {
+		return false
+	}
+
+	tags := make([]string, 0, len(t.Tags)-1)
+	for _, existing := range t.Tags {
+		if existing != tag {
+			tags = append(tags, existing)
+		}
+	}
+	if len(tags) == 0 {
+		tags = nil
+	}
+
+	t.Tags = tags
+	t.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+	return true
+}
+
+// SortTags orders registry entries by name
+func SortTags(tags []Tag) {
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].Name < tags[j].Name
+	})
+}
+
+// TagsFromJSON parses the tag registry, checking every entry
+func TagsFromJSON(data []byte) ([]Tag, error) {
+	var tags []Tag
+	if err := json.Unmarshal(data, &tags); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tags: %w", err)
+	}
+
+	for i, tag := range tags {
+		name, err := NormalizeTag(tag.Name)
+		if err != nil || name != tag.Name {
+			return nil, fmt.Errorf("invalid tag name at index %d: %q", i, tag.Name)
+		}
+		if err := validateColor("Tag", tag.Color); err != nil {
+			return nil, fmt.Errorf("invalid color of tag %s: %w", tag.Name, err)
+		}
+	}
+
+	return tags, nil
+}
+
+// TagsToJSON converts the tag registry to JSON bytes
+func TagsToJSON(tags []Tag) ([]byte, error) {
+	return json.Marshal(tags)
+}
@@ -0,0 +1,77 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTag(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want string
+		err  bool
+	}{
+		{tag: "work", want: "work"},
+		{tag: "  #Client-X ", want: "client-x"},
+		{tag: "v1.2_beta", want: "v1.2_beta"},
+		{tag: "Überfällig", want: "überfällig"},
+		{tag: strings.Repeat("a", MaxTagLength), want: strings.Repeat("a", MaxTagLength)},
+		{tag: strings.Repeat("a", MaxTagLength+1), err: true},
+		{tag: "#", err: true},
+		{tag: "team/backend", err: true},
+		{tag: "two words", err: true},
+		{tag: "a?b", err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := NormalizeTag(tt.tag)
+		if tt.err {
+			if err == nil {
+				t.Errorf("NormalizeTag(%q) = %q, want an error", tt.tag, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("NormalizeTag(%q) = %q, %v, want %q", tt.tag, got, err, tt.want)
+		}
+	}
+}
+
+func TestTaskValidateTags(t *testing.T) {
+	tooMany := make([]string, MaxTagsPerTask+1)
+	for i := range tooMany {
+		tooMany[i] = strings.Repeat("t", i+1)
+	}
+
+	tests := []struct {
+		name  string
+		tags  []string
+		valid bool
+	}{
+		{"none", nil, true},
+		{"normalized", []string{"work", "client-x"}, true},
+		{"longest", []string{strings.Repeat("a", MaxTagLength)}, true},
+		{"too long", []string{strings.Repeat("a", MaxTagLength+1)}, false},
+		{"not normalized", []string{"Work"}, false},
+		{"slash", []string{"team/backend"}, false},
+		{"too many", tooMany, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := Task{
+				ID:        "task-id",
+				Title:     "Task",
+				Quadrant:  QuadrantUnassigned,
+				Tags:      tt.tags,
+				CreatedAt: "2024-01-01T09:00:00Z",
+				UpdatedAt: "2024-01-01T09:00:00Z",
+				Version:   1,
+			}
+			err := task.Validate()
+			if (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
@@ -34,8 +34,33 @@ type Task struct {
 	Quadrant    TaskQuadrant `json:"quadrant" validate:"required,oneof=DO SCHEDULE DELEGATE DELETE UNASSIGNED"`
 	Completed   bool         `json:"completed"`
 	CompletedAt *string      `json:"completedAt,omitempty" validate:"omitempty,datetime=2006-01-02T15:04:05.000Z"`
+	
+	// ParentID makes the task a subtask; Position orders it among its
+	// siblings
+	ParentID    *string         `json:"parentId,omitempty"`
+	Position    int             `json:"position,omitempty"`
+	Checklist   []ChecklistItem `json:"checklist,omitempty" validate:"omitempty,dive"`
+	
+	// ProjectID puts the task in a project; subtasks are always in the
+	// project of their parent
+	ProjectID   *string      `json:"projectId,omitempty"`
+	
+	// Tags group tasks across quadrants; they are normalized by NormalizeTag
+	Tags        []string     `json:"tags,omitempty" validate:"omitempty,tags"`
+	
+	// Recurrence makes the task an occurrence of a series; completing it
+	// creates the next occurrence
+	Recurrence  *Recurrence  `json:"recurrence,omitempty"`
+	
+	// BlockedBy lists the tasks that have to be completed before this one
+	BlockedBy   []string     `json:"blockedBy,omitempty"`
+	
 	CreatedAt   string       `json:"createdAt" validate:"required,datetime=2006-01-02T15:04:05.000Z"`
 	UpdatedAt   string       `json:"updatedAt" validate:"required,datetime=2006-01-02T15:04:05.000Z"`
+	
+	// Version is incremented by every change, so a client can tell whether
+	// the task changed since it read it
+	Version     int64        `json:"version"`
 }
 
 // TaskFormData represents the data needed to create or update a task
@@ -47,6 +72,11 @@ type TaskFormData struct {
 	Urgent      bool    `json:"urgent"`
 	Important   bool    `json:"important"`
 	Completed   bool    `json:"completed"`
+	ParentID    *string `json:"parentId,omitempty"`
+	ProjectID   *string `json:"projectId,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Recurrence  *RecurrenceFormData `json:"recurrence,omitempty"`
+	BlockedBy   []string `json:"blockedBy,omitempty"`
 }
 
 // TaskUpdate represents partial updates to a task
@@ -59,16 +89,41 @@ type TaskUpdate struct {
 	Important   *bool        `json:"important,omitempty"`
 	Quadrant    *TaskQuadrant `json:"quadrant,omitempty" validate:"omitempty,oneof=DO SCHEDULE DELEGATE DELETE UNASSIGNED"`
 	Completed   *bool        `json:"completed,omitempty"`
+	
+	// ParentID moves the task under another one, or to the top level if
+	// empty. The service applies it, as it has to check the hierarchy.
+	ParentID    *string      `json:"parentId,omitempty"`
+	
+	// ProjectID moves the task and its subtasks to another project, or out
+	// of every project if empty. The service applies it, as it has to check
+	// the project.
+	ProjectID   *string      `json:"projectId,omitempty"`
+	
+	// Tags, if set, replaces the tags of the task; an empty list removes them
+	Tags        *[]string    `json:"tags,omitempty"`
+	
+	// Recurrence, if set, makes the task recur or changes its rule, which
+	// starts the series again from the task's due date
+	Recurrence  *RecurrenceFormData `json:"recurrence,omitempty"`
+	
+	// BlockedBy, if set, replaces the blockers of the task; an empty list
+	// removes them. The service checks that they exist and form no cycle.
+	BlockedBy   *[]string    `json:"blockedBy,omitempty"`
+	
+	// Version, if set, is the version the update is based on
+	Version     *int64       `json:"version,omitempty"`
 }
 
 // QuadrantMoveRequest represents a request to move a task to a different quadrant
 type QuadrantMoveRequest struct {
 	Quadrant TaskQuadrant `json:"quadrant" validate:"required,oneof=DO SCHEDULE DELEGATE DELETE UNASSIGNED"`
+	Version  *int64       `json:"version,omitempty"`
 }
 
 // CompletionToggleRequest represents a request to toggle task completion
 type CompletionToggleRequest struct {
-	Completed *bool `json:"completed,omitempty"`
+	Completed *bool  `json:"completed,omitempty"`
+	Version   *int64 `json:"version,omitempty"`
 }
 
 // TaskCollection represents a collection of tasks with metadata
@@ -85,6 +140,9 @@ func init() {
 	
 	// Register custom validation for ISO8601 datetime
 	validate.RegisterValidation("datetime", validateISO8601DateTime)
+	
+	// Tags are checked with the limits of NormalizeTags
+	validate.RegisterValidation("tags", validateTags)
 }
 
 // validateISO8601DateTime validates ISO8601 datetime format
@@ -135,6 +193,31 @@ func NewTask(formData TaskFormData) (*Task, error) {
 		}
 	}
 	
+	var parentID *string
+	if formData.ParentID != nil {
+		id := strings.TrimSpace(*formData.ParentID)
+		if id != "" {
+			parentID = &id
+		}
+	}
+	
+	var projectID *string
+	if formData.ProjectID != nil {
+		id := strings.TrimSpace(*formData.ProjectID)
+		if id != "" {
+			projectID = &id
+		}
+	}
+	
+	// Already validated along with the rest of the form
+	tags, _ := NormalizeTags(formData.Tags)
+	
+	var recurrence *Recurrence
+	if formData.Recurrence != nil {
+		recurrence, _ = NewRecurrence(*formData.Recurrence, formData.DueDate)
+	}
+	blockedBy, _ := NormalizeBlockers(formData.BlockedBy)
+	
 	now := time.Now().UTC().Format(time.RFC3339)
 	taskID := uuid.New().String()
 	
@@ -148,8 +231,14 @@ func NewTask(formData TaskFormData) (*Task, error) {
 		Quadrant:    determineQuadrantFromFlags(formData.Urgent, formData.Important),
 		Completed:   false, // New tasks always start as incomplete
 		CompletedAt: nil,
+		ParentID:    parentID,
+		ProjectID:   projectID,
+		Tags:        tags,
+		Recurrence:  recurrence,
+		BlockedBy:   blockedBy,
 		CreatedAt:   now,
 		UpdatedAt:   now,
+		Version:     1,
 	}
 	
 	return task, nil
@@ -162,6 +251,25 @@ func (t *Task) Update(updates TaskUpdate) error {
 		return err
 	}
 	
+	// A recurring task keeps a due date, from which a new rule starts
+	dueDate := t.DueDate
+	if updates.DueDate != nil {
+		dueDate = updates.DueDate
+	}
+	var recurrence *Recurrence
+	if updates.Recurrence != nil {
+		var err error
+		if recurrence, err = NewRecurrence(*updates.Recurrence, dueDate); err != nil {
+			return err
+		}
+		if t.Recurrence != nil {
+			recurrence.SeriesID = t.Recurrence.SeriesID
+			recurrence.NextID = t.Recurrence.NextID
+		}
+	} else if t.Recurrence != nil && (dueDate == nil || *dueDate == "") {
+		return errors.New("validation failed: A recurring task needs a due date; end the series first")
+	}
+	
 	now := time.Now().UTC().Format(time.RFC3339)
 	
 	// Apply updates
@@ -199,6 +307,18 @@ func (t *Task) Update(updates TaskUpdate) error {
 		t.Quadrant = *updates.Quadrant
 	}
 	
+	if updates.Tags != nil {
+		t.Tags, _ = NormalizeTags(*updates.Tags)
+	}
+	
+	if recurrence != nil {
+		t.Recurrence = recurrence
+	}
+	
+	if updates.BlockedBy != nil {
+		t.BlockedBy, _ = NormalizeBlockers(*updates.BlockedBy)
+	}
+	
 	if updates.Completed != nil {
 		wasCompleted := t.Completed
 		t.Completed = *updates.Completed
@@ -372,6 +492,23 @@ func validateTaskFormData(formData TaskFormData) error {
 		}
 	}
 	
+	// Check tags
+	if _, err := NormalizeTags(formData.Tags); err != nil {
+		return err
+	}
+	
+	// Check blockers
+	if _, err := NormalizeBlockers(formData.BlockedBy); err != nil {
+		return err
+	}
+	
+	// Check recurrence, which needs the due date
+	if formData.Recurrence != nil {
+		if _, err := NewRecurrence(*formData.Recurrence, formData.DueDate); err != nil {
+			return err
+		}
+	}
+	
 	return nil
 }
 
@@ -399,5 +536,19 @@ func validateTaskUpdate(update TaskUpdate) error {
 		}
 	}
 	
+	// Check tags if provided
+	if update.Tags != nil {
+		if _, err := NormalizeTags(*update.Tags); err != nil {
+			return err
+		}
+	}
+	
+	// Check blockers if provided
+	if update.BlockedBy != nil {
+		if _, err := NormalizeBlockers(*update.BlockedBy); err != nil {
+			return err
+		}
+	}
+	
 	return nil
 }
\ No newline at end of file
@@ -0,0 +1,406 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"task-api/models"
+	"task-api/storage"
+)
+
+// FileRepository stores all tasks as a single encrypted JSON snapshot plus
+// an append-only write-ahead log of the mutations made since. Writes only
+// append to the log; the snapshot is rewritten when the log is compacted.
+type FileRepository struct {
+	encryptedBackups
+	encryptedDocuments
+
+	storage          *storage.EncryptedStorage
+	wal              *storage.WAL
+	compactThreshold int
+
+	mu    sync.Mutex
+	tasks []models.Task
+}
+
+// NewFileRepository loads the snapshot, replays the write-ahead log over it
+// and compacts the log once it holds compactThreshold records
+func NewFileRepository(encryptedStorage *storage.EncryptedStorage, compactThreshold int) (*FileRepository, error) {
+	if compactThreshold < 1 {
+		return nil, errors.New("compaction threshold must be at least 1")
+	}
+
+	r := &FileRepository{
+		encryptedBackups:   encryptedBackups{encryptedStorage},
+		encryptedDocuments: encryptedDocuments{encryptedStorage},
+
+		storage:          encryptedStorage,
+		compactThreshold: compactThreshold,
+	}
+
+	tasks, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	wal, records, err := encryptedStorage.OpenWAL()
+	if err != nil {
+		return nil, err
+	}
+	r.wal = wal
+
+	store := &sliceStore{tasks: tasks}
+	for _, record := range records {
+		if err := applyWALRecord(store, record); err != nil {
+			wal.Close()
+			return nil, fmt.Errorf("failed to replay write-ahead log record %d: %w", record.Seq, err)
+		}
+	}
+	r.tasks = store.tasks
+
+	if len(records) > 0 {
+		log.Printf("Recovered %d transactions from write-ahead log", len(records))
+	}
+
+	return r, nil
+}
+
+// Get returns the task with the given ID
+func (r *FileRepository) Get(id string) (*models.Task, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return (&sliceStore{tasks: r.tasks}).Get(id)
+}
+
+// List returns all tasks matching the filter
+func (r *FileRepository) List(filter TaskFilter) ([]models.Task, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return (&sliceStore{tasks: r.tasks}).List(filter)
+}
+
+// Create stores a new task
+func (r *FileRepository) Create(task models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.Create(task)
+	})
+}
+
+// Update replaces an existing task
+func (r *FileRepository) Update(task models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.Update(task)
+	})
+}
+
+// Delete removes a task
+func (r *FileRepository) Delete(id string) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.Delete(id)
+	})
+}
+
+// ReplaceAll replaces every stored task
+func (r *FileRepository) ReplaceAll(tasks []models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.ReplaceAll(tasks)
+	})
+}
+
+// Transaction applies fn to a copy of the tasks and appends its changes to
+// the write-ahead log as a single record
+func (r *FileRepository) Transaction(fn func(tx TaskStore) error) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tx := &sliceStore{tasks: append([]models.Task{}, r.tasks...), record: true}
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if !tx.dirty {
+		return nil
+	}
+
+	if err := r.wal.Append(tx.entries...); err != nil {
+		return fmt.Errorf("failed to write task changes: %w", err)
+	}
+	r.tasks = tx.tasks
+
+	if r.wal.Records() >= r.compactThreshold {
+		if err := r.compactLocked(); err != nil {
+			log.Printf("Warning: failed to compact write-ahead log: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// Compact folds the write-ahead log into the snapshot file
+func (r *FileRepository) Compact() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.compactLocked()
+}
+
+// CreateBackup compacts the log and creates a backup of the snapshot
+func (r *FileRepository) CreateBackup(trigger storage.BackupTrigger) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.compactLocked(); err != nil {
+		return "", fmt.Errorf("failed to compact write-ahead log: %w", err)
+	}
+
+	return r.storage.CreateDataFileBackup(trigger)
+}
+
+// RestoreFromBackup restores the snapshot from a backup and reloads it
+func (r *FileRepository) RestoreFromBackup(backupName string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// Compact first so no logged change can be replayed over the restored data
+	if err := r.compactLocked(); err != nil {
+		return fmt.Errorf("failed to compact write-ahead log: %w", err)
+	}
+
+	if err := r.storage.RestoreFromBackup(backupName); err != nil {
+		return err
+	}
+
+	tasks, err := r.load()
+	if err != nil {
+		return err
+	}
+	r.tasks = tasks
+
+	return nil
+}
+
+// RotateEncryptionKey folds the write-ahead log into the snapshot, rotates
+// the snapshot and backups and starts a new log under the active key
+func (r *FileRepository) RotateEncryptionKey() (*storage.KeyRotationReport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.compactLocked(); err != nil {
+		return nil, fmt.Errorf("failed to compact write-ahead log: %w", err)
+	}
+
+	report, err := r.storage.RotateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	// The log is empty after compaction; resetting it rekeys the header
+	if err := r.wal.Reset(); err != nil {
+		return nil, fmt.Errorf("failed to rekey write-ahead log: %w", err)
+	}
+
+	return report, nil
+}
+
+// Info returns information about the underlying storage
+func (r *FileRepository) Info() map[string]interface{} {
+	info := r.storage.GetStorageInfo()
+	info["backend"] = "file"
+	info["wal_records"] = r.wal.Records()
+	info["wal_size_bytes"] = r.wal.Size()
+	info["wal_compact_threshold"] = r.compactThreshold
+	info["wal_key_id"] = r.wal.KeyID()
+	return info
+}
+
+// Close compacts the write-ahead log and closes it
+func (r *FileRepository) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	compactErr := r.compactLocked()
+	if err := r.wal.Close(); err != nil && compactErr == nil {
+		return err
+	}
+	return compactErr
+}
+
+// compactLocked writes the current tasks as the new snapshot and empties
+// the log. Replaying is idempotent, so a crash between the two steps only
+// causes already-applied records to be replayed again.
+func (r *FileRepository) compactLocked() error {
+	if r.wal.Records() == 0 && r.storage.DataFileExists() {
+		return nil
+	}
+
+	if err := r.save(r.tasks); err != nil {
+		return err
+	}
+
+	return r.wal.Reset()
+}
+
+// load reads and parses all tasks from storage
+func (r *FileRepository) load() ([]models.Task, error) {
+	data, err := r.storage.LoadData()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tasks from storage: %w", err)
+	}
+
+	tasks, err := models.TasksFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tasks from storage: %w", err)
+	}
+
+	return tasks, nil
+}
+
+// save serializes and writes all tasks to storage
+func (r *FileRepository) save(tasks []models.Task) error {
+	if tasks == nil {
+		tasks = []models.Task{}
+	}
+
+	data, err := models.TasksToJSON(tasks)
+	if err != nil {
+		return fmt.Errorf("failed to serialize tasks: %w", err)
+	}
+
+	if err := r.storage.SaveData(data); err != nil {
+		return fmt.Errorf("failed to save tasks to storage: %w", err)
+	}
+
+	return nil
+}
+
+// applyWALRecord replays a logged transaction onto the store
+func applyWALRecord(store *sliceStore, record storage.WALRecord) error {
+	for _, entry := range record.Entries {
+		switch entry.Op {
+		case storage.WALOpCreate, storage.WALOpUpdate, storage.WALOpMove, storage.WALOpComplete:
+			task, err := models.FromJSON(entry.Data)
+			if err != nil {
+				return err
+			}
+			if err := store.Update(*task); errors.Is(err, ErrTaskNotFound) {
+				store.Create(*task)
+			}
+		case storage.WALOpDelete:
+			store.Delete(entry.TaskID)
+		case storage.WALOpReplaceAll:
+			tasks, err := models.TasksFromJSON(entry.Data)
+			if err != nil {
+				return err
+			}
+			store.ReplaceAll(tasks)
+		default:
+			return fmt.Errorf("unknown operation %q", entry.Op)
+		}
+	}
+	return nil
+}
+
+// classifyUpdate names the kind of change between two versions of a task
+func classifyUpdate(prev, next *models.Task) storage.WALOp {
+	if prev.Completed != next.Completed {
+		return storage.WALOpComplete
+	}
+	if prev.Quadrant != next.Quadrant && prev.Title == next.Title {
+		return storage.WALOpMove
+	}
+	return storage.WALOpUpdate
+}
+
+// sliceStore implements TaskStore over an in-memory slice of tasks. When
+// record is set, every change is also captured as a write-ahead log entry.
+type sliceStore struct {
+	tasks   []models.Task
+	dirty   bool
+	record  bool
+	entries []storage.WALEntry
+}
+
+// logEntry captures a change for the write-ahead log
+func (s *sliceStore) logEntry(op storage.WALOp, id string, data interface{}) {
+	if !s.record {
+		return
+	}
+
+	entry := storage.WALEntry{Op: op, TaskID: id}
+	if data != nil {
+		// Tasks always marshal cleanly
+		entry.Data, _ = json.Marshal(data)
+	}
+	s.entries = append(s.entries, entry)
+}
+
+func (s *sliceStore) indexOf(id string) int {
+	for i := range s.tasks {
+		if s.tasks[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *sliceStore) Get(id string) (*models.Task, error) {
+	i := s.indexOf(id)
+	if i < 0 {
+		return nil, ErrTaskNotFound
+	}
+	task := s.tasks[i]
+	return &task, nil
+}
+
+func (s *sliceStore) List(filter TaskFilter) ([]models.Task, error) {
+	result := make([]models.Task, 0, len(s.tasks))
+	for i := range s.tasks {
+		if filter.Matches(&s.tasks[i]) {
+			result = append(result, s.tasks[i])
+		}
+	}
+	return result, nil
+}
+
+func (s *sliceStore) Create(task models.Task) error {
+	if s.indexOf(task.ID) >= 0 {
+		return ErrTaskExists
+	}
+	s.tasks = append(s.tasks, task)
+	s.dirty = true
+	s.logEntry(storage.WALOpCreate, task.ID, task)
+	return nil
+}
+
+func (s *sliceStore) Update(task models.Task) error {
+	i := s.indexOf(task.ID)
+	if i < 0 {
+		return ErrTaskNotFound
+	}
+	s.logEntry(classifyUpdate(&s.tasks[i], &task), task.ID, task)
+	s.tasks[i] = task
+	s.dirty = true
+	return nil
+}
+
+func (s *sliceStore) Delete(id string) error {
+	i := s.indexOf(id)
+	if i < 0 {
+		return ErrTaskNotFound
+	}
+	s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+	s.dirty = true
+	s.logEntry(storage.WALOpDelete, id, nil)
+	return nil
+}
+
+func (s *sliceStore) ReplaceAll(tasks []models.Task) error {
+	s.tasks = append([]models.Task{}, tasks...)
+	s.dirty = true
+	s.logEntry(storage.WALOpReplaceAll, "", s.tasks)
+	return nil
+}
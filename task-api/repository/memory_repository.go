@@ -0,0 +1,840 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"task-api/models"
+	"task-api/storage"
+	"time"
+)
+
+// MemoryRepository keeps every task resident in memory with secondary
+// indexes. Reads never touch the backing store, so their latency does not
+// depend on how large the persisted data grows.
+//
+// With a flush interval, changes are written to the backing repository in
+// the background (write-behind): writes return sooner, but those made since
+// the last flush are lost if the process crashes. Without one, every
+// transaction is written to the backing repository before it returns. Reads
+// do not wait for either.
+type MemoryRepository struct {
+	backing       TaskRepository
+	flushInterval time.Duration // zero writes every transaction through
+
+	// txMu serializes transactions and reloads. A write-through transaction
+	// holds it while writing to the backing repository, after releasing mu.
+	txMu sync.Mutex
+
+	mu          sync.RWMutex
+	tasks       map[string]*memEntry
+	nextSeq     uint64
+	byQuadrant  map[models.TaskQuadrant]map[string]struct{}
+	byCompleted map[bool]map[string]struct{}
+	byDue       []dueEntry // sorted by due time, then ID
+
+	// Changes not yet written to the backing repository. A true value means
+	// the task must be upserted, false means it must be deleted.
+	pending    map[string]bool
+	replaceAll bool
+
+	// Documents saved by the running transaction, those a write-through
+	// transaction is writing, and those of committed transactions not yet
+	// written to the backing repository. A nil document is deleted. They
+	// have their own lock since they are saved while mu is held.
+	docMu       sync.Mutex
+	txDocs      map[string][]byte
+	writingDocs map[string][]byte
+	pendingDocs map[string][]byte
+
+	flushMu      sync.Mutex
+	lastFlush    time.Time
+	lastFlushErr error
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// memEntry is a resident task with its insertion sequence number
+type memEntry struct {
+	task models.Task
+	seq  uint64
+}
+
+// dueEntry is an element of the due date index
+type dueEntry struct {
+	due time.Time
+	id  string
+}
+
+// NewMemoryRepository loads all tasks from backing. With a zero
+// flushInterval every transaction is written to backing before it returns;
+// otherwise changes are flushed back to it every flushInterval.
+func NewMemoryRepository(backing TaskRepository, flushInterval time.Duration) (*MemoryRepository, error) {
+	if flushInterval < 0 {
+		return nil, errors.New("flush interval cannot be negative")
+	}
+
+	r := &MemoryRepository{
+		backing:       backing,
+		flushInterval: flushInterval,
+		pending:       make(map[string]bool),
+		pendingDocs:   make(map[string][]byte),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	if r.writeBehind() {
+		go r.flushLoop()
+	} else {
+		close(r.done)
+	}
+
+	return r, nil
+}
+
+// writeBehind reports whether changes are written in the background
+func (r *MemoryRepository) writeBehind() bool {
+	return r.flushInterval > 0
+}
+
+// Get returns the task with the given ID
+func (r *MemoryRepository) Get(id string) (*models.Task, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.getLocked(id)
+}
+
+// List returns all tasks matching the filter in insertion order
+func (r *MemoryRepository) List(filter TaskFilter) ([]models.Task, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.listLocked(filter), nil
+}
+
+// Create stores a new task
+func (r *MemoryRepository) Create(task models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.Create(task)
+	})
+}
+
+// Update replaces an existing task
+func (r *MemoryRepository) Update(task models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.Update(task)
+	})
+}
+
+// Delete removes a task
+func (r *MemoryRepository) Delete(id string) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.Delete(id)
+	})
+}
+
+// ReplaceAll replaces every stored task
+func (r *MemoryRepository) ReplaceAll(tasks []models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.ReplaceAll(tasks)
+	})
+}
+
+// Transaction applies fn to the resident data under an exclusive lock,
+// together with the documents it saves. If fn fails every change it made is
+// rolled back. Otherwise, with write-behind, the changes are queued for the
+// next flush. Without it they are written to the backing repository before
+// returning, and rolled back if that fails; reads are let in meanwhile and
+// already see them.
+func (r *MemoryRepository) Transaction(fn func(tx TaskStore) error) error {
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	r.mu.Lock()
+
+	r.docMu.Lock()
+	r.txDocs = make(map[string][]byte)
+	r.docMu.Unlock()
+
+	tx := &memTx{r: r, touched: make(map[string]struct{})}
+	err := fn(tx)
+
+	r.docMu.Lock()
+	docs := r.txDocs
+	r.txDocs = nil
+	r.docMu.Unlock()
+
+	if err != nil {
+		tx.rollbackLocked()
+		r.mu.Unlock()
+		return err
+	}
+
+	if r.writeBehind() {
+		r.queueLocked(tx, docs)
+		r.mu.Unlock()
+		return nil
+	}
+
+	if !tx.replaced && len(tx.touched) == 0 && len(docs) == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+
+	batch := r.batchLocked(tx.replaced, tx.changesLocked())
+	batch.documents = docs
+	r.docMu.Lock()
+	r.writingDocs = docs
+	r.docMu.Unlock()
+	r.mu.Unlock()
+
+	err = r.writeBatch(batch)
+
+	r.docMu.Lock()
+	r.writingDocs = nil
+	r.docMu.Unlock()
+
+	if err != nil {
+		// No other transaction ran since, so the undo steps still apply
+		r.mu.Lock()
+		tx.rollbackLocked()
+		r.mu.Unlock()
+		return fmt.Errorf("failed to write task changes: %w", err)
+	}
+	return nil
+}
+
+// queueLocked adds the changes of a committed transaction to those the next
+// flush writes
+func (r *MemoryRepository) queueLocked(tx *memTx, docs map[string][]byte) {
+	r.docMu.Lock()
+	for name, data := range docs {
+		r.pendingDocs[name] = data
+	}
+	r.docMu.Unlock()
+
+	if tx.replaced {
+		r.replaceAll = true
+		r.pending = make(map[string]bool)
+		return
+	}
+
+	for id, upsert := range tx.changesLocked() {
+		r.pending[id] = upsert
+	}
+}
+
+// CreateBackup flushes pending changes and backs up the backing repository
+func (r *MemoryRepository) CreateBackup(trigger storage.BackupTrigger) (string, error) {
+	if err := r.Flush(); err != nil {
+		return "", fmt.Errorf("failed to flush pending changes before backup: %w", err)
+	}
+	return r.backing.CreateBackup(trigger)
+}
+
+// ListBackups returns the available backups
+func (r *MemoryRepository) ListBackups() ([]string, error) {
+	return r.backing.ListBackups()
+}
+
+// VerifyBackup verifies a backup of the backing repository
+func (r *MemoryRepository) VerifyBackup(backupName string) (*storage.BackupVerification, error) {
+	return r.backing.VerifyBackup(backupName)
+}
+
+// VerifyAllBackups verifies every backup of the backing repository
+func (r *MemoryRepository) VerifyAllBackups() ([]storage.BackupVerification, error) {
+	return r.backing.VerifyAllBackups()
+}
+
+// LoadBackup reads a backup of the backing repository
+func (r *MemoryRepository) LoadBackup(backupName string) ([]models.Task, error) {
+	return r.backing.LoadBackup(backupName)
+}
+
+// ImportBackup stores a backup in the backing repository
+func (r *MemoryRepository) ImportBackup(backupName string, tasks []models.Task) error {
+	return r.backing.ImportBackup(backupName, tasks)
+}
+
+// RestoreFromBackup restores the backing repository and reloads it
+func (r *MemoryRepository) RestoreFromBackup(backupName string) error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+	r.txMu.Lock()
+	defer r.txMu.Unlock()
+
+	if err := r.flushLocked(); err != nil {
+		return fmt.Errorf("failed to flush pending changes before restore: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.backing.RestoreFromBackup(backupName); err != nil {
+		return err
+	}
+
+	return r.reloadLocked()
+}
+
+// RotateEncryptionKey flushes pending changes and rotates the backing
+// store's encryption key. Cached tasks are plaintext and stay valid.
+func (r *MemoryRepository) RotateEncryptionKey() (*storage.KeyRotationReport, error) {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	if err := r.flushLocked(); err != nil {
+		return nil, fmt.Errorf("failed to flush pending changes before key rotation: %w", err)
+	}
+
+	return r.backing.RotateEncryptionKey()
+}
+
+// LoadDocument reads a document, including changes not yet written to the
+// backing repository
+func (r *MemoryRepository) LoadDocument(name string) ([]byte, error) {
+	r.docMu.Lock()
+	data, ok := r.txDocs[name]
+	if !ok {
+		data, ok = r.writingDocs[name]
+	}
+	if !ok {
+		data, ok = r.pendingDocs[name]
+	}
+	r.docMu.Unlock()
+
+	if ok {
+		return append([]byte(nil), data...), nil
+	}
+	return r.backing.LoadDocument(name)
+}
+
+// SaveDocument saves a document as part of the running transaction, so it
+// is written to the backing repository together with the tasks that
+// transaction changes. Outside a transaction it is saved in one of its own.
+// The service makes one change at a time, so a running transaction is the
+// caller's own.
+func (r *MemoryRepository) SaveDocument(name string, data []byte) error {
+	return r.stageDocument(name, append(make([]byte, 0, len(data)), data...))
+}
+
+// DeleteDocument removes a document as part of the running transaction, or
+// in one of its own outside a transaction
+func (r *MemoryRepository) DeleteDocument(name string) error {
+	return r.stageDocument(name, nil)
+}
+
+// stageDocument saves a document, or deletes it if data is nil, with the
+// running transaction or in one of its own
+func (r *MemoryRepository) stageDocument(name string, data []byte) error {
+	r.docMu.Lock()
+	if r.txDocs != nil {
+		r.txDocs[name] = data
+		r.docMu.Unlock()
+		return nil
+	}
+	r.docMu.Unlock()
+
+	return r.Transaction(func(tx TaskStore) error {
+		return r.stageDocument(name, data)
+	})
+}
+
+// Info returns backing store information along with cache statistics
+func (r *MemoryRepository) Info() map[string]interface{} {
+	info := r.backing.Info()
+
+	r.mu.RLock()
+	cache := map[string]interface{}{
+		"task_count":        len(r.tasks),
+		"write_behind":      r.writeBehind(),
+		"pending_changes":   len(r.pending),
+		"pending_full_save": r.replaceAll,
+		"flush_interval_ms": r.flushInterval.Milliseconds(),
+	}
+	r.mu.RUnlock()
+
+	r.docMu.Lock()
+	cache["pending_documents"] = len(r.pendingDocs)
+	r.docMu.Unlock()
+
+	r.flushMu.Lock()
+	if !r.lastFlush.IsZero() {
+		cache["last_flush"] = r.lastFlush.UTC().Format(time.RFC3339)
+	}
+	if r.lastFlushErr != nil {
+		cache["last_flush_error"] = r.lastFlushErr.Error()
+	}
+	r.flushMu.Unlock()
+
+	info["cache"] = cache
+	return info
+}
+
+// Close stops the background flusher if any, writes any pending changes and closes
+// the backing repository
+func (r *MemoryRepository) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		<-r.done
+
+		if err := r.Flush(); err != nil {
+			r.closeErr = fmt.Errorf("failed to flush pending changes on close: %w", err)
+		}
+
+		if err := r.backing.Close(); err != nil && r.closeErr == nil {
+			r.closeErr = err
+		}
+	})
+	return r.closeErr
+}
+
+// Flush writes all pending changes to the backing repository
+func (r *MemoryRepository) Flush() error {
+	r.flushMu.Lock()
+	defer r.flushMu.Unlock()
+
+	return r.flushLocked()
+}
+
+// flushLoop periodically flushes pending changes until Close is called
+func (r *MemoryRepository) flushLoop() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				log.Printf("Warning: failed to flush task changes: %v", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// flushBatch is a set of changes to write to the backing repository
+type flushBatch struct {
+	replaceAll bool
+	all        []models.Task
+	upserts    []models.Task
+	deletes    []string
+	documents  map[string][]byte
+}
+
+// flushLocked writes pending changes; the caller must hold flushMu
+func (r *MemoryRepository) flushLocked() error {
+	r.mu.Lock()
+	batch := r.takePendingLocked()
+	r.mu.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+
+	err := r.writeBatch(batch)
+
+	r.lastFlush = time.Now()
+	r.lastFlushErr = err
+
+	if err != nil {
+		r.mu.Lock()
+		r.requeueLocked(batch)
+		r.mu.Unlock()
+	}
+
+	return err
+}
+
+// writeBatch writes a batch to the backing repository in one transaction.
+// Its documents are saved inside that transaction, so none is saved if the
+// tasks cannot be applied, and the saved ones are put back, or deleted if
+// they did not exist, if the tasks then fail to commit.
+func (r *MemoryRepository) writeBatch(batch *flushBatch) error {
+	previous := make(map[string][]byte)
+	err := r.backing.Transaction(func(tx TaskStore) error {
+		if batch.replaceAll {
+			if err := tx.ReplaceAll(batch.all); err != nil {
+				return err
+			}
+		}
+
+		for _, task := range batch.upserts {
+			err := tx.Update(task)
+			if errors.Is(err, ErrTaskNotFound) {
+				err = tx.Create(task)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, id := range batch.deletes {
+			if err := tx.Delete(id); err != nil && !errors.Is(err, ErrTaskNotFound) {
+				return err
+			}
+		}
+
+		for name, data := range batch.documents {
+			old, err := r.backing.LoadDocument(name)
+			if err != nil {
+				return err
+			}
+			if err := saveOrDeleteDocument(r.backing, name, data); err != nil {
+				return err
+			}
+			previous[name] = old
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		for name, old := range previous {
+			if restoreErr := saveOrDeleteDocument(r.backing, name, old); restoreErr != nil {
+				log.Printf("Warning: failed to restore document %s after a failed transaction: %v", name, restoreErr)
+			}
+		}
+	}
+	return err
+}
+
+// saveOrDeleteDocument saves a document, or deletes it if data is nil
+func saveOrDeleteDocument(repo DocumentStore, name string, data []byte) error {
+	if data == nil {
+		return repo.DeleteDocument(name)
+	}
+	return repo.SaveDocument(name, data)
+}
+
+// takePendingLocked empties the pending queue into a batch, or returns nil
+// if there is nothing to write
+func (r *MemoryRepository) takePendingLocked() *flushBatch {
+	r.docMu.Lock()
+	docs := r.pendingDocs
+	r.pendingDocs = make(map[string][]byte)
+	r.docMu.Unlock()
+
+	if !r.replaceAll && len(r.pending) == 0 && len(docs) == 0 {
+		return nil
+	}
+
+	batch := r.batchLocked(r.replaceAll, r.pending)
+	batch.documents = docs
+
+	r.replaceAll = false
+	r.pending = make(map[string]bool)
+	return batch
+}
+
+// batchLocked collects changed tasks into a batch: every task if
+// replaceAll is set, otherwise the upserts (true) and deletes (false) of
+// changes
+func (r *MemoryRepository) batchLocked(replaceAll bool, changes map[string]bool) *flushBatch {
+	batch := &flushBatch{replaceAll: replaceAll}
+	if replaceAll {
+		batch.all = r.listLocked(TaskFilter{})
+		return batch
+	}
+
+	var upserts []*memEntry
+	for id, upsert := range changes {
+		if upsert {
+			upserts = append(upserts, r.tasks[id])
+		} else {
+			batch.deletes = append(batch.deletes, id)
+		}
+	}
+
+	// Preserve insertion order for backends that append new tasks
+	sort.Slice(upserts, func(i, j int) bool {
+		return upserts[i].seq < upserts[j].seq
+	})
+	for _, entry := range upserts {
+		batch.upserts = append(batch.upserts, entry.task)
+	}
+	return batch
+}
+
+// requeueLocked puts a failed batch back without overriding newer changes
+func (r *MemoryRepository) requeueLocked(batch *flushBatch) {
+	r.docMu.Lock()
+	for name, data := range batch.documents {
+		if _, ok := r.pendingDocs[name]; !ok {
+			r.pendingDocs[name] = data
+		}
+	}
+	r.docMu.Unlock()
+
+	if batch.replaceAll {
+		r.replaceAll = true
+		return
+	}
+
+	for _, task := range batch.upserts {
+		if _, ok := r.pending[task.ID]; !ok {
+			r.pending[task.ID] = true
+		}
+	}
+	for _, id := range batch.deletes {
+		if _, ok := r.pending[id]; !ok {
+			r.pending[id] = false
+		}
+	}
+}
+
+// reload replaces the resident data with the contents of the backing store
+func (r *MemoryRepository) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.reloadLocked()
+}
+
+func (r *MemoryRepository) reloadLocked() error {
+	tasks, err := r.backing.List(TaskFilter{})
+	if err != nil {
+		return fmt.Errorf("failed to load tasks into memory: %w", err)
+	}
+
+	r.resetLocked()
+	for _, task := range tasks {
+		r.insertLocked(task, r.nextSeq)
+		r.nextSeq++
+	}
+
+	r.pending = make(map[string]bool)
+	r.replaceAll = false
+	return nil
+}
+
+// resetLocked clears the resident data and its indexes
+func (r *MemoryRepository) resetLocked() {
+	r.tasks = make(map[string]*memEntry)
+	r.byQuadrant = make(map[models.TaskQuadrant]map[string]struct{})
+	r.byCompleted = map[bool]map[string]struct{}{
+		true:  {},
+		false: {},
+	}
+	r.byDue = nil
+}
+
+// insertLocked adds a task and its index entries
+func (r *MemoryRepository) insertLocked(task models.Task, seq uint64) {
+	r.tasks[task.ID] = &memEntry{task: task, seq: seq}
+
+	if r.byQuadrant[task.Quadrant] == nil {
+		r.byQuadrant[task.Quadrant] = make(map[string]struct{})
+	}
+	r.byQuadrant[task.Quadrant][task.ID] = struct{}{}
+	r.byCompleted[task.Completed][task.ID] = struct{}{}
+
+	if due, ok := dueTime(&task); ok {
+		entry := dueEntry{due: due, id: task.ID}
+		i := sort.Search(len(r.byDue), func(i int) bool {
+			return !r.byDue[i].less(entry)
+		})
+		r.byDue = append(r.byDue, dueEntry{})
+		copy(r.byDue[i+1:], r.byDue[i:])
+		r.byDue[i] = entry
+	}
+}
+
+// removeLocked deletes a task and its index entries, returning the entry
+func (r *MemoryRepository) removeLocked(id string) *memEntry {
+	entry, ok := r.tasks[id]
+	if !ok {
+		return nil
+	}
+
+	delete(r.tasks, id)
+	delete(r.byQuadrant[entry.task.Quadrant], id)
+	delete(r.byCompleted[entry.task.Completed], id)
+
+	if due, ok := dueTime(&entry.task); ok {
+		key := dueEntry{due: due, id: id}
+		i := sort.Search(len(r.byDue), func(i int) bool {
+			return !r.byDue[i].less(key)
+		})
+		if i < len(r.byDue) && r.byDue[i].id == id {
+			r.byDue = append(r.byDue[:i], r.byDue[i+1:]...)
+		}
+	}
+
+	return entry
+}
+
+func (r *MemoryRepository) getLocked(id string) (*models.Task, error) {
+	entry, ok := r.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	task := entry.task
+	return &task, nil
+}
+
+// listLocked answers a filter from the narrowest available index
+func (r *MemoryRepository) listLocked(filter TaskFilter) []models.Task {
+	var candidates []*memEntry
+
+	switch {
+	case filter.DueBefore != nil:
+		end := sort.Search(len(r.byDue), func(i int) bool {
+			return !r.byDue[i].due.Before(*filter.DueBefore)
+		})
+		for _, e := range r.byDue[:end] {
+			candidates = append(candidates, r.tasks[e.id])
+		}
+	case filter.Quadrant != nil:
+		for id := range r.byQuadrant[*filter.Quadrant] {
+			candidates = append(candidates, r.tasks[id])
+		}
+	case filter.Completed != nil:
+		for id := range r.byCompleted[*filter.Completed] {
+			candidates = append(candidates, r.tasks[id])
+		}
+	default:
+		candidates = make([]*memEntry, 0, len(r.tasks))
+		for _, entry := range r.tasks {
+			candidates = append(candidates, entry)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].seq < candidates[j].seq
+	})
+
+	tasks := make([]models.Task, 0, len(candidates))
+	for _, entry := range candidates {
+		if filter.Matches(&entry.task) {
+			tasks = append(tasks, entry.task)
+		}
+	}
+	return tasks
+}
+
+func (e dueEntry) less(other dueEntry) bool {
+	if !e.due.Equal(other.due) {
+		return e.due.Before(other.due)
+	}
+	return e.id < other.id
+}
+
+// memTx is the TaskStore handed to Transaction callbacks. It mutates the
+// resident data directly and records how to undo each change.
+type memTx struct {
+	r        *MemoryRepository
+	undo     []func()
+	touched  map[string]struct{}
+	replaced bool
+}
+
+// rollbackLocked undoes the changes of the transaction, newest first
+func (tx *memTx) rollbackLocked() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		tx.undo[i]()
+	}
+}
+
+// changesLocked returns the tasks the transaction touched, true for those
+// to upsert and false for those to delete
+func (tx *memTx) changesLocked() map[string]bool {
+	changes := make(map[string]bool, len(tx.touched))
+	for id := range tx.touched {
+		_, exists := tx.r.tasks[id]
+		changes[id] = exists
+	}
+	return changes
+}
+
+func (tx *memTx) Get(id string) (*models.Task, error) {
+	return tx.r.getLocked(id)
+}
+
+func (tx *memTx) List(filter TaskFilter) ([]models.Task, error) {
+	return tx.r.listLocked(filter), nil
+}
+
+func (tx *memTx) Create(task models.Task) error {
+	r := tx.r
+	if _, exists := r.tasks[task.ID]; exists {
+		return ErrTaskExists
+	}
+
+	r.insertLocked(task, r.nextSeq)
+	r.nextSeq++
+
+	tx.touched[task.ID] = struct{}{}
+	tx.undo = append(tx.undo, func() {
+		r.removeLocked(task.ID)
+	})
+	return nil
+}
+
+func (tx *memTx) Update(task models.Task) error {
+	r := tx.r
+	prev := r.removeLocked(task.ID)
+	if prev == nil {
+		return ErrTaskNotFound
+	}
+
+	r.insertLocked(task, prev.seq)
+
+	tx.touched[task.ID] = struct{}{}
+	tx.undo = append(tx.undo, func() {
+		r.removeLocked(task.ID)
+		r.insertLocked(prev.task, prev.seq)
+	})
+	return nil
+}
+
+func (tx *memTx) Delete(id string) error {
+	r := tx.r
+	prev := r.removeLocked(id)
+	if prev == nil {
+		return ErrTaskNotFound
+	}
+
+	tx.touched[id] = struct{}{}
+	tx.undo = append(tx.undo, func() {
+		r.insertLocked(prev.task, prev.seq)
+	})
+	return nil
+}
+
+func (tx *memTx) ReplaceAll(tasks []models.Task) error {
+	r := tx.r
+	previous := make([]*memEntry, 0, len(r.tasks))
+	for _, entry := range r.tasks {
+		previous = append(previous, entry)
+	}
+
+	r.resetLocked()
+	for _, task := range tasks {
+		r.insertLocked(task, r.nextSeq)
+		r.nextSeq++
+	}
+
+	tx.replaced = true
+	tx.undo = append(tx.undo, func() {
+		r.resetLocked()
+		for _, entry := range previous {
+			r.insertLocked(entry.task, entry.seq)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,244 @@
+package repository
+
+import (
+	"errors"
+	"sync"
+	"task-api/models"
+	"testing"
+	"time"
+)
+
+// fakeBacking is a backing repository holding tasks and documents in maps.
+// Its transactions fail to commit after running while commitErr is set.
+type fakeBacking struct {
+	TaskRepository // methods not faked panic
+
+	mu        sync.Mutex
+	tasks     map[string]models.Task
+	docs      map[string][]byte
+	commitErr error
+	commits   int
+}
+
+func newFakeBacking() *fakeBacking {
+	return &fakeBacking{tasks: make(map[string]models.Task), docs: make(map[string][]byte)}
+}
+
+func (b *fakeBacking) List(filter TaskFilter) ([]models.Task, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	tasks := []models.Task{}
+	for _, task := range b.tasks {
+		if filter.Matches(&task) {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+func (b *fakeBacking) Transaction(fn func(tx TaskStore) error) error {
+	tx := &fakeTx{tasks: make(map[string]models.Task)}
+	b.mu.Lock()
+	for id, task := range b.tasks {
+		tx.tasks[id] = task
+	}
+	b.mu.Unlock()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.commitErr != nil {
+		return b.commitErr
+	}
+	b.tasks = tx.tasks
+	b.commits++
+	return nil
+}
+
+func (b *fakeBacking) LoadDocument(name string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.docs[name], nil
+}
+
+func (b *fakeBacking) SaveDocument(name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.docs[name] = data
+	return nil
+}
+
+func (b *fakeBacking) DeleteDocument(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.docs, name)
+	return nil
+}
+
+func (b *fakeBacking) Close() error {
+	return nil
+}
+
+// fakeTx is the TaskStore of a fakeBacking transaction
+type fakeTx struct {
+	tasks map[string]models.Task
+}
+
+func (tx *fakeTx) Get(id string) (*models.Task, error) {
+	task, ok := tx.tasks[id]
+	if !ok {
+		return nil, ErrTaskNotFound
+	}
+	return &task, nil
+}
+
+func (tx *fakeTx) List(filter TaskFilter) ([]models.Task, error) {
+	tasks := []models.Task{}
+	for _, task := range tx.tasks {
+		if filter.Matches(&task) {
+			tasks = append(tasks, task)
+		}
+	}
+	return tasks, nil
+}
+
+func (tx *fakeTx) Create(task models.Task) error {
+	if _, ok := tx.tasks[task.ID]; ok {
+		return ErrTaskExists
+	}
+	tx.tasks[task.ID] = task
+	return nil
+}
+
+func (tx *fakeTx) Update(task models.Task) error {
+	if _, ok := tx.tasks[task.ID]; !ok {
+		return ErrTaskNotFound
+	}
+	tx.tasks[task.ID] = task
+	return nil
+}
+
+func (tx *fakeTx) Delete(id string) error {
+	if _, ok := tx.tasks[id]; !ok {
+		return ErrTaskNotFound
+	}
+	delete(tx.tasks, id)
+	return nil
+}
+
+func (tx *fakeTx) ReplaceAll(tasks []models.Task) error {
+	tx.tasks = make(map[string]models.Task, len(tasks))
+	for _, task := range tasks {
+		tx.tasks[task.ID] = task
+	}
+	return nil
+}
+
+func TestMemoryRepositoryWriteThroughRollsBackFailedCommit(t *testing.T) {
+	backing := newFakeBacking()
+	backing.tasks["kept"] = models.Task{ID: "kept", Title: "kept", Version: 1}
+	backing.docs["old.enc"] = []byte("old")
+
+	repo, err := NewMemoryRepository(backing, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	backing.commitErr = errors.New("disk full")
+	err = repo.Transaction(func(tx TaskStore) error {
+		if err := tx.Create(models.Task{ID: "new", Title: "new", Version: 1}); err != nil {
+			return err
+		}
+		if err := tx.Update(models.Task{ID: "kept", Title: "changed", Version: 2}); err != nil {
+			return err
+		}
+		if err := repo.SaveDocument("old.enc", []byte("changed")); err != nil {
+			return err
+		}
+		return repo.SaveDocument("new.enc", []byte("new"))
+	})
+	if !errors.Is(err, backing.commitErr) {
+		t.Fatalf("transaction returned %v, want the commit error", err)
+	}
+
+	if _, err := repo.Get("new"); !errors.Is(err, ErrTaskNotFound) {
+		t.Errorf("created task is still resident: %v", err)
+	}
+	if task, err := repo.Get("kept"); err != nil || task.Title != "kept" {
+		t.Errorf("updated task was not rolled back: %+v, %v", task, err)
+	}
+	if data := backing.docs["old.enc"]; string(data) != "old" {
+		t.Errorf("existing document is %q, want it restored", data)
+	}
+	if _, ok := backing.docs["new.enc"]; ok {
+		t.Error("document created by the failed transaction was not deleted")
+	}
+	if data, err := repo.LoadDocument("new.enc"); err != nil || data != nil {
+		t.Errorf("LoadDocument(new.enc) = %q, %v, want no document", data, err)
+	}
+}
+
+func TestMemoryRepositoryWriteThroughDoesNotBlockReads(t *testing.T) {
+	backing := newFakeBacking()
+	backing.tasks["a"] = models.Task{ID: "a", Title: "a", Version: 1}
+
+	repo, err := NewMemoryRepository(backing, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	// Hold the backing transaction open until a read got through
+	writing := make(chan struct{})
+	read := make(chan struct{})
+	blocking := &blockingBacking{fakeBacking: backing, writing: writing, release: read}
+	repo.backing = blocking
+
+	done := make(chan error, 1)
+	go func() {
+		done <- repo.Transaction(func(tx TaskStore) error {
+			return tx.Update(models.Task{ID: "a", Title: "b", Version: 2})
+		})
+	}()
+
+	<-writing
+	readDone := make(chan struct{})
+	go func() {
+		if _, err := repo.Get("a"); err != nil {
+			t.Error(err)
+		}
+		close(readDone)
+	}()
+	select {
+	case <-readDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("read waited for the backing transaction")
+	}
+	close(read)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if backing.tasks["a"].Title != "b" {
+		t.Errorf("change was not written through: %+v", backing.tasks["a"])
+	}
+}
+
+// blockingBacking signals writing when a transaction starts and waits for
+// release before running it
+type blockingBacking struct {
+	*fakeBacking
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingBacking) Transaction(fn func(tx TaskStore) error) error {
+	close(b.writing)
+	<-b.release
+	return b.fakeBacking.Transaction(fn)
+}
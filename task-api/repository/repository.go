@@ -0,0 +1,248 @@
+package repository
+
+import (
+	"errors"
+	"fmt"
+	"task-api/models"
+	"task-api/storage"
+	"time"
+)
+
+var (
+	// ErrTaskNotFound is returned when a task does not exist in the repository
+	ErrTaskNotFound = errors.New("task not found")
+
+	// ErrTaskExists is returned when creating a task whose ID is already taken
+	ErrTaskExists = errors.New("task ID already exists")
+)
+
+// TaskFilter narrows the tasks returned by List. Nil fields are not applied.
+type TaskFilter struct {
+	Quadrant  *models.TaskQuadrant
+	Completed *bool
+
+	// DueBefore keeps only tasks with a due date strictly before this time
+	DueBefore *time.Time
+
+	// ParentID keeps only the subtasks of this task, or top-level tasks if
+	// it is empty
+	ParentID *string
+
+	// ProjectID keeps only the tasks of this project, or tasks in no
+	// project if it is empty
+	ProjectID *string
+}
+
+// Matches reports whether the task satisfies the filter
+func (f TaskFilter) Matches(task *models.Task) bool {
+	if f.Quadrant != nil && task.Quadrant != *f.Quadrant {
+		return false
+	}
+	if f.Completed != nil && task.Completed != *f.Completed {
+		return false
+	}
+	if f.DueBefore != nil {
+		due, ok := dueTime(task)
+		if !ok || !due.Before(*f.DueBefore) {
+			return false
+		}
+	}
+	if f.ParentID != nil {
+		if *f.ParentID == "" {
+			if task.ParentID != nil {
+				return false
+			}
+		} else if task.ParentID == nil || *task.ParentID != *f.ParentID {
+			return false
+		}
+	}
+	if f.ProjectID != nil && !task.InProject(*f.ProjectID) {
+		return false
+	}
+	return true
+}
+
+// ValidateBackupTasks checks that decrypted backup data is a list of valid
+// tasks with unique IDs and returns how many there are
+func ValidateBackupTasks(data []byte) (int, error) {
+	tasks, err := models.TasksFromJSON(data)
+	if err != nil {
+		return 0, err
+	}
+
+	seen := make(map[string]bool, len(tasks))
+	for _, task := range tasks {
+		if seen[task.ID] {
+			return 0, fmt.Errorf("duplicate task ID %s", task.ID)
+		}
+		seen[task.ID] = true
+	}
+	return len(tasks), nil
+}
+
+// dueTime parses the task's due date, reporting false if it has none
+func dueTime(task *models.Task) (time.Time, bool) {
+	if task.DueDate == nil {
+		return time.Time{}, false
+	}
+	due, err := time.Parse(time.RFC3339, *task.DueDate)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return due, true
+}
+
+// TaskStore provides the basic task operations shared by repositories and
+// the transactions they open
+type TaskStore interface {
+	// Get returns the task with the given ID or ErrTaskNotFound
+	Get(id string) (*models.Task, error)
+
+	// List returns all tasks matching the filter in insertion order
+	List(filter TaskFilter) ([]models.Task, error)
+
+	// Create stores a new task or returns ErrTaskExists
+	Create(task models.Task) error
+
+	// Update replaces an existing task or returns ErrTaskNotFound
+	Update(task models.Task) error
+
+	// Delete removes a task or returns ErrTaskNotFound
+	Delete(id string) error
+
+	// ReplaceAll discards every stored task and stores the given ones instead
+	ReplaceAll(tasks []models.Task) error
+}
+
+// BackupStore keeps encrypted snapshots of the tasks
+type BackupStore interface {
+	// CreateBackup snapshots the current tasks into a backup recording
+	// trigger and returns the backup name
+	CreateBackup(trigger storage.BackupTrigger) (string, error)
+
+	// ListBackups returns the names of available backups
+	ListBackups() ([]string, error)
+
+	// LoadBackup decrypts the named backup and returns its tasks
+	LoadBackup(backupName string) ([]models.Task, error)
+
+	// ImportBackup stores tasks as a backup under the given name, or
+	// returns storage.ErrBackupExists if the name is taken
+	ImportBackup(backupName string, tasks []models.Task) error
+
+	// RestoreFromBackup replaces the current tasks with the named backup
+	RestoreFromBackup(backupName string) error
+
+	// VerifyBackup checks the named backup against its manifest and
+	// decrypts and validates its contents
+	VerifyBackup(backupName string) (*storage.BackupVerification, error)
+
+	// VerifyAllBackups verifies every backup, newest first
+	VerifyAllBackups() ([]storage.BackupVerification, error)
+}
+
+// DocumentStore keeps named documents alongside the tasks, such as the tag
+// registry
+type DocumentStore interface {
+	// LoadDocument decrypts a named document, returning nil if it does not
+	// exist yet
+	LoadDocument(name string) ([]byte, error)
+
+	// SaveDocument encrypts and atomically replaces a named document
+	SaveDocument(name string, data []byte) error
+
+	// DeleteDocument removes a named document if it exists
+	DeleteDocument(name string) error
+}
+
+// TaskRepository is the persistence boundary used by the service layer. A
+// backend that keeps backups and documents in encrypted storage can embed
+// encryptedBackups and encryptedDocuments, leaving only CreateBackup and
+// RestoreFromBackup to write.
+type TaskRepository interface {
+	TaskStore
+	BackupStore
+	DocumentStore
+
+	// Transaction runs fn against a transactional view of the repository.
+	// Changes are committed only if fn returns nil.
+	Transaction(fn func(tx TaskStore) error) error
+
+	// RotateEncryptionKey re-encrypts stored tasks and backups under the
+	// active key. It is safe to call again after an interruption.
+	RotateEncryptionKey() (*storage.KeyRotationReport, error)
+
+	// Info returns diagnostic information about the backend
+	Info() map[string]interface{}
+
+	// Close releases any resources held by the repository
+	Close() error
+}
+
+// encryptedBackups implements the parts of BackupStore that only read and
+// write backup files. Creating and restoring backups depend on how a
+// backend keeps its tasks, so it implements those itself.
+type encryptedBackups struct {
+	es *storage.EncryptedStorage
+}
+
+// ListBackups returns the available backups
+func (b encryptedBackups) ListBackups() ([]string, error) {
+	return b.es.ListBackups()
+}
+
+// VerifyBackup checks a backup's manifest and contents
+func (b encryptedBackups) VerifyBackup(backupName string) (*storage.BackupVerification, error) {
+	return b.es.VerifyBackup(backupName, ValidateBackupTasks)
+}
+
+// VerifyAllBackups checks the manifest and contents of every backup
+func (b encryptedBackups) VerifyAllBackups() ([]storage.BackupVerification, error) {
+	return b.es.VerifyAllBackups(ValidateBackupTasks)
+}
+
+// LoadBackup decrypts a backup and parses its tasks
+func (b encryptedBackups) LoadBackup(backupName string) ([]models.Task, error) {
+	data, err := b.es.LoadBackupData(backupName)
+	if err != nil {
+		return nil, err
+	}
+	defer storage.SecureWipe(data)
+
+	tasks, err := models.TasksFromJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("backup contains invalid task data: %w", err)
+	}
+	return tasks, nil
+}
+
+// ImportBackup stores tasks as a backup under the given name
+func (b encryptedBackups) ImportBackup(backupName string, tasks []models.Task) error {
+	data, err := models.TasksToJSON(tasks)
+	if err != nil {
+		return fmt.Errorf("failed to serialize tasks: %w", err)
+	}
+	return b.es.ImportBackup(backupName, data)
+}
+
+// encryptedDocuments implements DocumentStore with encrypted files in the
+// data directory. It takes no repository lock, so documents can be saved
+// inside a transaction.
+type encryptedDocuments struct {
+	es *storage.EncryptedStorage
+}
+
+// LoadDocument decrypts a document from the data directory
+func (d encryptedDocuments) LoadDocument(name string) ([]byte, error) {
+	return d.es.LoadDocument(name)
+}
+
+// SaveDocument encrypts a document into the data directory
+func (d encryptedDocuments) SaveDocument(name string, data []byte) error {
+	return d.es.SaveDocument(name, data)
+}
+
+// DeleteDocument removes a document from the data directory
+func (d encryptedDocuments) DeleteDocument(name string) error {
+	return d.es.DeleteDocument(name)
+}
@@ -0,0 +1,629 @@
+package repository
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"sync"
+	"task-api/models"
+	"task-api/storage"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	// DefaultSQLiteFile is the database file name inside the data directory
+	DefaultSQLiteFile = "tasks.db"
+
+	// sqliteKeyCheck is sealed with the record cipher to validate the key on open
+	sqliteKeyCheck = "task-api-key-check"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS meta (
+	key   TEXT PRIMARY KEY,
+	value BLOB NOT NULL
+);
+CREATE TABLE IF NOT EXISTS tasks (
+	id         TEXT PRIMARY KEY,
+	quadrant   TEXT NOT NULL,
+	completed  INTEGER NOT NULL,
+	created_at TEXT NOT NULL,
+	payload    BLOB NOT NULL,
+	parent_id  TEXT,
+	project_id TEXT
+);
+CREATE INDEX IF NOT EXISTS idx_tasks_quadrant ON tasks(quadrant);
+CREATE INDEX IF NOT EXISTS idx_tasks_completed ON tasks(completed);
+`
+
+// sqliteHierarchyIndexes index the parent and project columns. They are
+// created after migrateHierarchyColumns, since databases created before
+// those columns existed do not have them yet.
+const sqliteHierarchyIndexes = `
+CREATE INDEX IF NOT EXISTS idx_tasks_parent_id ON tasks(parent_id);
+CREATE INDEX IF NOT EXISTS idx_tasks_project_id ON tasks(project_id);
+`
+
+// SQLiteRepository stores tasks in an embedded SQLite database. Each task is
+// encrypted individually; only the ID, quadrant, completion flag, creation
+// time, parent ID and project ID are kept in plaintext columns so they can
+// be indexed.
+type SQLiteRepository struct {
+	encryptedBackups
+	encryptedDocuments
+
+	db            *sql.DB
+	path          string
+	fsys          storage.Filesystem
+	backups       *storage.EncryptedStorage
+	cryptoService *storage.CryptoService
+
+	mu         sync.RWMutex
+	cipher     *storage.RecordCipher
+	keyID      string
+	wrappedKey *storage.WrappedDataKey
+}
+
+// NewSQLiteRepository opens (or creates) the SQLite database in dataDir.
+// Tasks are encrypted with the keys of encryptedStorage, and backups are
+// written through it so they share the format of the file backend. The data
+// directory is created on the filesystem of encryptedStorage, which SQLite
+// itself bypasses, so it has to be the real one.
+func NewSQLiteRepository(dataDir string, encryptedStorage *storage.EncryptedStorage) (*SQLiteRepository, error) {
+	fsys := encryptedStorage.Filesystem()
+	if err := fsys.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	path := filepath.Join(dataDir, DefaultSQLiteFile)
+	db, err := sql.Open("sqlite", path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+
+	// A single connection serializes writers and keeps transactions simple
+	db.SetMaxOpenConns(1)
+
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create database schema: %w", err)
+	}
+
+	repo := &SQLiteRepository{
+		encryptedBackups:   encryptedBackups{encryptedStorage},
+		encryptedDocuments: encryptedDocuments{encryptedStorage},
+
+		db:            db,
+		path:          path,
+		fsys:          fsys,
+		backups:       encryptedStorage,
+		cryptoService: encryptedStorage.CryptoService(),
+	}
+
+	if err := repo.initCipher(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := repo.migrateHierarchyColumns(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// migrateHierarchyColumns adds the parent and project columns to a database
+// created without them, filling them in from the encrypted tasks, and
+// indexes them
+func (r *SQLiteRepository) migrateHierarchyColumns() error {
+	var count int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info('tasks') WHERE name = 'parent_id'`).Scan(&count); err != nil {
+		return fmt.Errorf("failed to read database schema: %w", err)
+	}
+
+	if count == 0 {
+		tx, err := r.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+
+		if _, err := tx.Exec(`ALTER TABLE tasks ADD COLUMN parent_id TEXT; ALTER TABLE tasks ADD COLUMN project_id TEXT`); err != nil {
+			return fmt.Errorf("failed to add parent and project columns: %w", err)
+		}
+
+		tasks, err := r.store(tx).List(TaskFilter{})
+		if err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			if _, err := tx.Exec(`UPDATE tasks SET parent_id = ?, project_id = ? WHERE id = ?`, task.ParentID, task.ProjectID, task.ID); err != nil {
+				return fmt.Errorf("failed to fill in parent and project of task %s: %w", task.ID, err)
+			}
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		log.Printf("Added parent and project columns to %s for %d tasks", DefaultSQLiteFile, len(tasks))
+	}
+
+	if _, err := r.db.Exec(sqliteHierarchyIndexes); err != nil {
+		return fmt.Errorf("failed to create database indexes: %w", err)
+	}
+	return nil
+}
+
+// initCipher loads or creates the database's data key and validates it.
+// The data key is stored in the meta table wrapped by a master key and, if
+// set up, the recovery key.
+func (r *SQLiteRepository) initCipher() error {
+	var slots []byte
+	err := r.db.QueryRow(`SELECT value FROM meta WHERE key = 'dek_slots'`).Scan(&slots)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r.writeKeyMeta(r.db)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read database data key: %w", err)
+	}
+	wrappedKey, err := storage.ParseWrappedDataKey(slots)
+	if err != nil {
+		return err
+	}
+
+	var check []byte
+	if err := r.db.QueryRow(`SELECT value FROM meta WHERE key = 'check'`).Scan(&check); err != nil {
+		return fmt.Errorf("failed to read database key check: %w", err)
+	}
+
+	dek, err := r.cryptoService.UnwrapDataKey(wrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap database data key: %w", err)
+	}
+	defer storage.SecureWipe(dek)
+
+	cipher, err := storage.NewRecordCipherFromKey(dek)
+	if err != nil {
+		return err
+	}
+	if _, err := cipher.Open(check, []byte("meta")); err != nil {
+		return errors.New("encryption key validation failed: database key check does not match")
+	}
+
+	r.cipher = cipher
+	r.keyID = wrappedKey.KeyID()
+	r.wrappedKey = wrappedKey
+	if !r.cryptoService.DataKeyIsCurrent(r.wrappedKey) && !r.cryptoService.Recovering() {
+		log.Printf("Warning: database data key is not wrapped by the active master key and recovery key; run key rotation to re-wrap it")
+	}
+	return nil
+}
+
+// storeWrappedKey replaces the wrapped data key in the meta table
+func storeWrappedKey(q sqlQuerier, wrappedKey *storage.WrappedDataKey) error {
+	slots, err := wrappedKey.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(
+		`INSERT INTO meta (key, value) VALUES ('dek_slots', ?)
+		 ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		slots,
+	); err != nil {
+		return fmt.Errorf("failed to store database data key: %w", err)
+	}
+	return nil
+}
+
+// writeKeyMeta stores a new data key, wrapped by the active master key and
+// recovery key, and its key check, and switches the repository to the
+// resulting cipher
+func (r *SQLiteRepository) writeKeyMeta(q sqlQuerier) error {
+	dek, wrappedKey, err := r.cryptoService.GenerateDataKey()
+	if err != nil {
+		return err
+	}
+	defer storage.SecureWipe(dek)
+
+	cipher, err := storage.NewRecordCipherFromKey(dek)
+	if err != nil {
+		return err
+	}
+
+	check, err := cipher.Seal([]byte(sqliteKeyCheck), []byte("meta"))
+	if err != nil {
+		return err
+	}
+
+	if err := storeWrappedKey(q, wrappedKey); err != nil {
+		return err
+	}
+	if _, err := q.Exec(
+		`INSERT INTO meta (key, value) VALUES ('check', ?)
+		 ON CONFLICT(key) DO UPDATE SET value = excluded.value`,
+		check,
+	); err != nil {
+		return fmt.Errorf("failed to store database key check: %w", err)
+	}
+
+	r.cipher = cipher
+	r.keyID = wrappedKey.KeyID()
+	r.wrappedKey = wrappedKey
+	return nil
+}
+
+// store returns a TaskStore over q using the current cipher
+func (r *SQLiteRepository) store(q sqlQuerier) *sqliteStore {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return &sqliteStore{q: q, cipher: r.cipher}
+}
+
+// Get returns the task with the given ID
+func (r *SQLiteRepository) Get(id string) (*models.Task, error) {
+	return r.store(r.db).Get(id)
+}
+
+// List returns all tasks matching the filter
+func (r *SQLiteRepository) List(filter TaskFilter) ([]models.Task, error) {
+	return r.store(r.db).List(filter)
+}
+
+// Create stores a new task
+func (r *SQLiteRepository) Create(task models.Task) error {
+	return r.store(r.db).Create(task)
+}
+
+// Update replaces an existing task
+func (r *SQLiteRepository) Update(task models.Task) error {
+	return r.store(r.db).Update(task)
+}
+
+// Delete removes a task
+func (r *SQLiteRepository) Delete(id string) error {
+	return r.store(r.db).Delete(id)
+}
+
+// ReplaceAll replaces every stored task atomically
+func (r *SQLiteRepository) ReplaceAll(tasks []models.Task) error {
+	return r.Transaction(func(tx TaskStore) error {
+		return tx.ReplaceAll(tasks)
+	})
+}
+
+// Transaction runs fn inside a database transaction
+func (r *SQLiteRepository) Transaction(fn func(tx TaskStore) error) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	if err := fn(&sqliteStore{q: tx, cipher: r.cipher}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// CreateBackup exports all tasks into an encrypted backup file
+func (r *SQLiteRepository) CreateBackup(trigger storage.BackupTrigger) (string, error) {
+	tasks, err := r.List(TaskFilter{})
+	if err != nil {
+		return "", err
+	}
+
+	data, err := models.TasksToJSON(tasks)
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize tasks: %w", err)
+	}
+
+	return r.backups.CreateBackupFromData(data, trigger)
+}
+
+// RestoreFromBackup replaces all tasks with the contents of a backup
+func (r *SQLiteRepository) RestoreFromBackup(backupName string) error {
+	tasks, err := r.LoadBackup(backupName)
+	if err != nil {
+		return err
+	}
+
+	// Create a backup of current data before restoring
+	currentBackup, err := r.CreateBackup(storage.BackupTriggerPreRestore)
+	if err != nil {
+		log.Printf("Warning: failed to backup current data: %v", err)
+	} else {
+		log.Printf("Created backup of current data: %s", currentBackup)
+	}
+
+	return r.ReplaceAll(tasks)
+}
+
+// RotateEncryptionKey re-wraps the database's data key with the active
+// master key, then rotates the backups
+func (r *SQLiteRepository) RotateEncryptionKey() (*storage.KeyRotationReport, error) {
+	rewrapped, err := r.rotateDatabase()
+	if err != nil {
+		return nil, err
+	}
+
+	report, err := r.backups.RotateKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	if rewrapped {
+		report.Rewrapped = append([]string{DefaultSQLiteFile}, report.Rewrapped...)
+	} else {
+		report.Skipped = append([]string{DefaultSQLiteFile}, report.Skipped...)
+	}
+
+	return report, nil
+}
+
+// rotateDatabase re-wraps the database's data key with the active master
+// key and recovery key, reporting whether it had to
+func (r *SQLiteRepository) rotateDatabase() (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cryptoService.DataKeyIsCurrent(r.wrappedKey) {
+		return false, nil
+	}
+
+	wrappedKey, err := r.cryptoService.RewrapDataKey(r.wrappedKey)
+	if err != nil {
+		return false, fmt.Errorf("failed to re-wrap database data key: %w", err)
+	}
+
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := storeWrappedKey(tx, wrappedKey); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	r.keyID, r.wrappedKey = wrappedKey.KeyID(), wrappedKey
+	log.Printf("Re-wrapped %s data key with master key %q", DefaultSQLiteFile, r.keyID)
+	return true, nil
+}
+
+// Info returns information about the database
+func (r *SQLiteRepository) Info() map[string]interface{} {
+	info := map[string]interface{}{
+		"backend":  "sqlite",
+		"database": DefaultSQLiteFile,
+	}
+
+	var count int
+	if err := r.db.QueryRow(`SELECT COUNT(*) FROM tasks`).Scan(&count); err == nil {
+		info["task_count"] = count
+	}
+
+	if stat, err := r.fsys.Stat(r.path); err == nil {
+		info["file_size_bytes"] = stat.Size()
+	}
+
+	r.mu.RLock()
+	info["database_key_id"] = r.keyID
+	if recoveryKeyID := r.wrappedKey.RecoveryKeyID(); recoveryKeyID != "" {
+		info["database_recovery_key_id"] = recoveryKeyID
+	}
+	r.mu.RUnlock()
+	info["encryption"] = r.backups.KeyRotationStatus()
+	info["compression"] = r.backups.CompressionStats()
+
+	backups, err := r.backups.ListBackups()
+	if err != nil {
+		info["backup_count"] = 0
+		info["backup_error"] = err.Error()
+	} else {
+		info["backup_count"] = len(backups)
+	}
+	info["backup_retention"] = r.backups.RetentionPolicy()
+
+	return info
+}
+
+// Close closes the database
+func (r *SQLiteRepository) Close() error {
+	return r.db.Close()
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx
+type sqlQuerier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqliteStore implements TaskStore on top of a database or transaction
+type sqliteStore struct {
+	q      sqlQuerier
+	cipher *storage.RecordCipher
+}
+
+func (s *sqliteStore) Get(id string) (*models.Task, error) {
+	var payload []byte
+	err := s.q.QueryRow(`SELECT payload FROM tasks WHERE id = ?`, id).Scan(&payload)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTaskNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query task: %w", err)
+	}
+
+	return s.decode(id, payload)
+}
+
+func (s *sqliteStore) List(filter TaskFilter) ([]models.Task, error) {
+	var conditions []string
+	var args []interface{}
+
+	if filter.Quadrant != nil {
+		conditions = append(conditions, "quadrant = ?")
+		args = append(args, string(*filter.Quadrant))
+	}
+	if filter.Completed != nil {
+		conditions = append(conditions, "completed = ?")
+		args = append(args, *filter.Completed)
+	}
+	if filter.ParentID != nil {
+		if *filter.ParentID == "" {
+			conditions = append(conditions, "parent_id IS NULL")
+		} else {
+			conditions = append(conditions, "parent_id = ?")
+			args = append(args, *filter.ParentID)
+		}
+	}
+	if filter.ProjectID != nil {
+		if *filter.ProjectID == "" {
+			conditions = append(conditions, "project_id IS NULL")
+		} else {
+			conditions = append(conditions, "project_id = ?")
+			args = append(args, *filter.ProjectID)
+		}
+	}
+
+	query := `SELECT id, payload FROM tasks`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY rowid"
+
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tasks: %w", err)
+	}
+	defer rows.Close()
+
+	tasks := []models.Task{}
+	for rows.Next() {
+		var id string
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			return nil, fmt.Errorf("failed to scan task: %w", err)
+		}
+
+		task, err := s.decode(id, payload)
+		if err != nil {
+			return nil, err
+		}
+		// Due dates are encrypted, so that part of the filter runs here
+		if filter.Matches(task) {
+			tasks = append(tasks, *task)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate tasks: %w", err)
+	}
+
+	return tasks, nil
+}
+
+func (s *sqliteStore) Create(task models.Task) error {
+	payload, err := s.encode(&task)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.q.Exec(
+		`INSERT INTO tasks (id, quadrant, completed, created_at, payload, parent_id, project_id) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT(id) DO NOTHING`,
+		task.ID, string(task.Quadrant), task.Completed, task.CreatedAt, payload, task.ParentID, task.ProjectID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to insert task: %w", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrTaskExists
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Update(task models.Task) error {
+	payload, err := s.encode(&task)
+	if err != nil {
+		return err
+	}
+
+	result, err := s.q.Exec(
+		`UPDATE tasks SET quadrant = ?, completed = ?, created_at = ?, payload = ?, parent_id = ?, project_id = ? WHERE id = ?`,
+		string(task.Quadrant), task.Completed, task.CreatedAt, payload, task.ParentID, task.ProjectID, task.ID,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to update task: %w", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrTaskNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) Delete(id string) error {
+	result, err := s.q.Exec(`DELETE FROM tasks WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete task: %w", err)
+	}
+
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return ErrTaskNotFound
+	}
+
+	return nil
+}
+
+func (s *sqliteStore) ReplaceAll(tasks []models.Task) error {
+	if _, err := s.q.Exec(`DELETE FROM tasks`); err != nil {
+		return fmt.Errorf("failed to clear tasks: %w", err)
+	}
+
+	for _, task := range tasks {
+		if err := s.Create(task); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// encode serializes and encrypts a task, binding the ciphertext to its ID
+func (s *sqliteStore) encode(task *models.Task) ([]byte, error) {
+	data, err := json.Marshal(task)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize task: %w", err)
+	}
+	return s.cipher.Seal(data, []byte(task.ID))
+}
+
+// decode decrypts and validates a stored task
+func (s *sqliteStore) decode(id string, payload []byte) (*models.Task, error) {
+	data, err := s.cipher.Open(payload, []byte(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt task %s: %w", id, err)
+	}
+	return models.FromJSON(data)
+}
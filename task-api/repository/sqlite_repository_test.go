@@ -0,0 +1,149 @@
+package repository
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"task-api/models"
+	"task-api/storage"
+	"testing"
+)
+
+const testEncryptionKey = "test-encryption-key-0123456789abcdef"
+
+// openTestSQLite opens a SQLite repository in dir
+func openTestSQLite(t *testing.T, dir string) *SQLiteRepository {
+	t.Helper()
+
+	repo, err := NewSQLiteRepository(dir, storage.NewEncryptedStorage(dir, testEncryptionKey))
+	if err != nil {
+		t.Fatalf("NewSQLiteRepository: %v", err)
+	}
+	return repo
+}
+
+// hierarchyTask returns a valid task in the given parent and project, where
+// empty means none
+func hierarchyTask(id, parentID, projectID string) models.Task {
+	task := models.Task{
+		ID:        id,
+		Title:     id,
+		Quadrant:  models.QuadrantDo,
+		CreatedAt: "2024-05-01T10:00:00.000Z",
+		UpdatedAt: "2024-05-01T10:00:00.000Z",
+	}
+	if parentID != "" {
+		task.ParentID = &parentID
+	}
+	if projectID != "" {
+		task.ProjectID = &projectID
+	}
+	return task
+}
+
+// listIDs lists the IDs of the tasks matching the filter, in order
+func listIDs(t *testing.T, store TaskStore, filter TaskFilter) string {
+	t.Helper()
+
+	tasks, err := store.List(filter)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	ids := make([]string, 0, len(tasks))
+	for _, task := range tasks {
+		ids = append(ids, task.ID)
+	}
+	return strings.Join(ids, " ")
+}
+
+// createHierarchy stores a and b in project p, c in no project, a1 and a2
+// under a and b1 under b
+func createHierarchy(t *testing.T, store TaskStore) {
+	t.Helper()
+
+	for _, task := range []models.Task{
+		hierarchyTask("a", "", "p"),
+		hierarchyTask("b", "", "p"),
+		hierarchyTask("c", "", ""),
+		hierarchyTask("a1", "a", "p"),
+		hierarchyTask("a2", "a", "p"),
+		hierarchyTask("b1", "b", "p"),
+	} {
+		if err := store.Create(task); err != nil {
+			t.Fatalf("Create(%s): %v", task.ID, err)
+		}
+	}
+}
+
+// checkHierarchyFilters checks List against the tasks of createHierarchy
+func checkHierarchyFilters(t *testing.T, store TaskStore) {
+	t.Helper()
+
+	a, none, p := "a", "", "p"
+	tests := []struct {
+		name   string
+		filter TaskFilter
+		want   string
+	}{
+		{"subtasks", TaskFilter{ParentID: &a}, "a1 a2"},
+		{"top level", TaskFilter{ParentID: &none}, "a b c"},
+		{"project", TaskFilter{ProjectID: &p}, "a b a1 a2 b1"},
+		{"no project", TaskFilter{ProjectID: &none}, "c"},
+		{"top level of a project", TaskFilter{ParentID: &none, ProjectID: &p}, "a b"},
+	}
+
+	for _, tc := range tests {
+		if got := listIDs(t, store, tc.filter); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSQLiteListFiltersByParentAndProject(t *testing.T) {
+	repo := openTestSQLite(t, t.TempDir())
+	defer repo.Close()
+
+	createHierarchy(t, repo)
+	checkHierarchyFilters(t, repo)
+
+	// Moving a task moves it between the indexed parents and projects
+	moved := hierarchyTask("a2", "b", "")
+	if err := repo.Update(moved); err != nil {
+		t.Fatal(err)
+	}
+	b, none := "b", ""
+	if got := listIDs(t, repo, TaskFilter{ParentID: &b}); got != "a2 b1" {
+		t.Errorf("subtasks of b: got %q", got)
+	}
+	if got := listIDs(t, repo, TaskFilter{ProjectID: &none}); got != "c a2" {
+		t.Errorf("tasks in no project: got %q", got)
+	}
+}
+
+func TestSQLiteMigratesHierarchyColumns(t *testing.T) {
+	dir := t.TempDir()
+	repo := openTestSQLite(t, dir)
+	createHierarchy(t, repo)
+	repo.Close()
+
+	// Turn the database back into one created before the columns existed
+	db, err := sql.Open("sqlite", filepath.Join(dir, DefaultSQLiteFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range []string{
+		`DROP INDEX idx_tasks_parent_id`,
+		`DROP INDEX idx_tasks_project_id`,
+		`ALTER TABLE tasks DROP COLUMN parent_id`,
+		`ALTER TABLE tasks DROP COLUMN project_id`,
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("%s: %v", statement, err)
+		}
+	}
+	db.Close()
+
+	repo = openTestSQLite(t, dir)
+	defer repo.Close()
+	checkHierarchyFilters(t, repo)
+}
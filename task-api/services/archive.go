@@ -0,0 +1,235 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"task-api/models"
+	"task-api/repository"
+	"task-api/storage"
+	"time"
+)
+
+// ArchiveImportResult reports what an archive import changed
+type ArchiveImportResult struct {
+	ArchiveCreatedAt time.Time `json:"archive_created_at"`
+	TaskCount        int       `json:"task_count"`
+	PreRestore       string    `json:"pre_restore_backup,omitempty"`
+	BackupsImported  []string  `json:"backups_imported"`
+	BackupsSkipped   []string  `json:"backups_skipped"`
+
+	// RemovedFromProject lists imported tasks taken out of their project
+	// because the archive does not contain it
+	RemovedFromProject []string `json:"removed_from_project"`
+}
+
+// archiveDocuments are the documents exported and imported with the tasks,
+// each with a check of its content
+var archiveDocuments = []struct {
+	name  string
+	check func(data []byte) error
+}{
+	{projectRegistryFile, func(data []byte) error {
+		_, err := models.ProjectsFromJSON(data)
+		return err
+	}},
+	{tagRegistryFile, func(data []byte) error {
+		_, err := models.TagsFromJSON(data)
+		return err
+	}},
+}
+
+// replaceDocument saves a document, or deletes it if data is nil
+func (s *TaskService) replaceDocument(name string, data []byte) error {
+	if data == nil {
+		return s.repo.DeleteDocument(name)
+	}
+	return s.repo.SaveDocument(name, data)
+}
+
+// ExportArchive writes the current tasks, the projects, the tag registry
+// and, if includeBackups is set, every readable backup to w as an archive
+// encrypted with the passphrase. Nothing is written if the passphrase is
+// rejected or the tasks cannot be read.
+func (s *TaskService) ExportArchive(w io.Writer, passphrase string, includeBackups bool) error {
+	if err := storage.ValidateArchivePassphrase(passphrase); err != nil {
+		return err
+	}
+
+	tasks, err := s.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return fmt.Errorf("failed to read tasks: %w", err)
+	}
+	data, err := models.TasksToJSON(tasks)
+	if err != nil {
+		return fmt.Errorf("failed to serialize tasks: %w", err)
+	}
+
+	var backups []string
+	if includeBackups {
+		if backups, err = s.repo.ListBackups(); err != nil {
+			return fmt.Errorf("failed to list backups: %w", err)
+		}
+	}
+
+	archive, err := storage.NewArchiveWriter(w, passphrase)
+	if err != nil {
+		return err
+	}
+	if err := archive.AddTasks(data); err != nil {
+		return err
+	}
+
+	for _, document := range archiveDocuments {
+		documentData, err := s.repo.LoadDocument(document.name)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", document.name, err)
+		}
+		if documentData == nil {
+			continue
+		}
+		if err := archive.AddDocument(document.name, documentData); err != nil {
+			return err
+		}
+	}
+
+	for _, backupName := range backups {
+		backupTasks, err := s.repo.LoadBackup(backupName)
+		if err != nil {
+			log.Printf("Warning: leaving backup %s out of the archive: %v", backupName, err)
+			continue
+		}
+		backupData, err := models.TasksToJSON(backupTasks)
+		if err != nil {
+			return fmt.Errorf("failed to serialize backup %s: %w", backupName, err)
+		}
+		if err := archive.AddBackup(backupName, backupData); err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+// ImportArchive validates an archive and replaces the current tasks,
+// projects and tag registry with its own, after backing up the current
+// data. Tasks in a project the archive does not contain are taken out of
+// it. If includeBackups is set, the archive's backups are added under their
+// original names; backups whose name is already taken are skipped.
+func (s *TaskService) ImportArchive(r io.Reader, passphrase string, includeBackups bool) (*ArchiveImportResult, error) {
+	archive, err := storage.ReadArchive(r, passphrase, repository.ValidateBackupTasks)
+	if err != nil {
+		return nil, err
+	}
+
+	tasks, err := models.TasksFromJSON(archive.Tasks)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %w", err)
+	}
+
+	known := make(map[string]bool, len(archiveDocuments))
+	for _, document := range archiveDocuments {
+		known[document.name] = true
+		if data, ok := archive.Documents[document.name]; ok {
+			if err := document.check(data); err != nil {
+				return nil, fmt.Errorf("invalid archive: %s: %w", document.name, err)
+			}
+		}
+	}
+	for name := range archive.Documents {
+		if !known[name] {
+			return nil, fmt.Errorf("invalid archive: unknown document %s", name)
+		}
+	}
+
+	projects := []models.Project{}
+	if data, ok := archive.Documents[projectRegistryFile]; ok {
+		if projects, err = models.ProjectsFromJSON(data); err != nil {
+			return nil, fmt.Errorf("invalid archive: %s: %w", projectRegistryFile, err)
+		}
+	}
+
+	result := &ArchiveImportResult{
+		ArchiveCreatedAt: archive.Manifest.CreatedAt,
+		TaskCount:        len(tasks),
+		BackupsImported:  []string{},
+		BackupsSkipped:   []string{},
+
+		RemovedFromProject: []string{},
+	}
+
+	// Back up, import and replace in one write, so no change made in
+	// between is left out of the pre-restore backup and then lost
+	err = s.write(func() error {
+		preRestore, err := s.repo.CreateBackup(storage.BackupTriggerPreRestore)
+		if err != nil {
+			log.Printf("Warning: failed to backup current data: %v", err)
+		} else {
+			log.Printf("Created backup of current data: %s", preRestore)
+			result.PreRestore = preRestore
+		}
+
+		if includeBackups {
+			for _, backup := range archive.Backups {
+				backupTasks, err := models.TasksFromJSON(backup.Data)
+				if err != nil {
+					return fmt.Errorf("invalid archive: backup %s: %w", backup.Name, err)
+				}
+
+				err = s.repo.ImportBackup(backup.Name, backupTasks)
+				if errors.Is(err, storage.ErrBackupExists) {
+					result.BackupsSkipped = append(result.BackupsSkipped, backup.Name)
+					continue
+				}
+				if err != nil {
+					return fmt.Errorf("failed to import backup %s: %w", backup.Name, err)
+				}
+				result.BackupsImported = append(result.BackupsImported, backup.Name)
+			}
+		}
+
+		previous := make(map[string][]byte, len(archiveDocuments))
+		for _, document := range archiveDocuments {
+			if previous[document.name], err = s.repo.LoadDocument(document.name); err != nil {
+				return fmt.Errorf("failed to read %s: %w", document.name, err)
+			}
+		}
+		replaceDocuments := func(documents map[string][]byte) error {
+			for _, document := range archiveDocuments {
+				if err := s.replaceDocument(document.name, documents[document.name]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		err = s.transactionWithDocument(
+			func() error { return replaceDocuments(archive.Documents) },
+			func() error { return replaceDocuments(previous) },
+			func(tx repository.TaskStore) error {
+				if err := tx.ReplaceAll(tasks); err != nil {
+					return err
+				}
+				cleared, err := clearMissingProjects(tx, projects)
+				if err != nil {
+					return err
+				}
+				result.RemovedFromProject = cleared
+				return nil
+			})
+		if err != nil {
+			return fmt.Errorf("failed to import tasks: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Imported archive created at %s: %d tasks, %d backups imported, %d skipped",
+		result.ArchiveCreatedAt.Format(time.RFC3339), result.TaskCount,
+		len(result.BackupsImported), len(result.BackupsSkipped))
+
+	return result, nil
+}
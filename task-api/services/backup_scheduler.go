@@ -0,0 +1,223 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"task-api/models"
+	"task-api/repository"
+	"task-api/storage"
+	"task-api/utils"
+	"time"
+)
+
+// BackupScheduler takes backups on a cron schedule instead of on every
+// write. A run only creates a backup if the tasks differ from the newest
+// existing backup, whatever created that one.
+type BackupScheduler struct {
+	repo     repository.TaskRepository
+	schedule *utils.CronSchedule
+
+	mu          sync.Mutex
+	nextRun     time.Time
+	lastRun     time.Time
+	lastResult  string
+	lastBackup  string
+	lastError   string
+	lastErrorAt time.Time
+
+	// newestBackup and newestDigest cache the content digest of the newest
+	// backup so it is only decrypted once
+	newestBackup string
+	newestDigest []byte
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBackupScheduler creates a scheduler for the given cron expression
+func NewBackupScheduler(repo repository.TaskRepository, expression string) (*BackupScheduler, error) {
+	schedule, err := utils.ParseCronSchedule(expression)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BackupScheduler{
+		repo:     repo,
+		schedule: schedule,
+	}, nil
+}
+
+// Start runs the scheduler in the background until Stop is called
+func (b *BackupScheduler) Start() {
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+
+	go b.loop()
+	log.Printf("Backup scheduler started with schedule %q", b.schedule)
+}
+
+// Stop stops the scheduler and waits for a running backup to finish
+func (b *BackupScheduler) Stop() {
+	if b.stop == nil {
+		return
+	}
+	close(b.stop)
+	<-b.done
+	b.stop = nil
+}
+
+func (b *BackupScheduler) loop() {
+	defer close(b.done)
+
+	for {
+		next := b.schedule.Next(time.Now())
+		b.mu.Lock()
+		b.nextRun = next
+		b.mu.Unlock()
+
+		if next.IsZero() {
+			log.Printf("Warning: backup schedule %q never fires", b.schedule)
+			<-b.stop
+			return
+		}
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-b.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+			b.Run()
+		}
+	}
+}
+
+// Run takes a scheduled backup now if the tasks changed since the newest
+// backup
+func (b *BackupScheduler) Run() {
+	backupName, err := b.run()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastRun = time.Now()
+	switch {
+	case err != nil:
+		b.lastResult = "failed"
+		b.lastError = err.Error()
+		b.lastErrorAt = b.lastRun
+		log.Printf("Warning: scheduled backup failed: %v", err)
+	case backupName == "":
+		b.lastResult = "unchanged"
+		log.Printf("Scheduled backup skipped: no changes since the last backup")
+	default:
+		b.lastResult = "created"
+		b.lastBackup = backupName
+		log.Printf("Created scheduled backup: %s", backupName)
+	}
+}
+
+// run creates a backup unless the tasks match the newest backup, returning
+// the new backup's name or an empty string if none was needed
+func (b *BackupScheduler) run() (string, error) {
+	tasks, err := b.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return "", fmt.Errorf("failed to read tasks: %w", err)
+	}
+	digest, err := tasksDigest(tasks)
+	if err != nil {
+		return "", err
+	}
+
+	newestDigest, err := b.newestBackupDigest()
+	if err != nil {
+		log.Printf("Warning: cannot compare with the newest backup, backing up anyway: %v", err)
+	}
+	if newestDigest != nil && bytes.Equal(digest, newestDigest) {
+		return "", nil
+	}
+
+	backupName, err := b.repo.CreateBackup(storage.BackupTriggerScheduled)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+
+	b.newestBackup = backupName
+	b.newestDigest = digest
+	return backupName, nil
+}
+
+// newestBackupDigest returns the content digest of the newest backup, or
+// nil if there are no backups
+func (b *BackupScheduler) newestBackupDigest() ([]byte, error) {
+	backups, err := b.repo.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+	if len(backups) == 0 {
+		return nil, nil
+	}
+
+	newest := backups[len(backups)-1]
+	if newest == b.newestBackup {
+		return b.newestDigest, nil
+	}
+
+	tasks, err := b.repo.LoadBackup(newest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup %s: %w", newest, err)
+	}
+	digest, err := tasksDigest(tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	b.newestBackup = newest
+	b.newestDigest = digest
+	return digest, nil
+}
+
+// tasksDigest hashes the JSON encoding of the tasks ordered by ID, so the
+// order a backend returns them in does not matter
+func tasksDigest(tasks []models.Task) ([]byte, error) {
+	sorted := make([]models.Task, len(tasks))
+	copy(sorted, tasks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ID < sorted[j].ID })
+
+	data, err := models.TasksToJSON(sorted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to serialize tasks: %w", err)
+	}
+
+	sum := sha256.Sum256(data)
+	return sum[:], nil
+}
+
+// Status returns the schedule and the outcome of the last run
+func (b *BackupScheduler) Status() map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := map[string]interface{}{
+		"schedule": b.schedule.String(),
+	}
+	if !b.nextRun.IsZero() {
+		status["next_run"] = b.nextRun.UTC().Format(time.RFC3339)
+	}
+	if !b.lastRun.IsZero() {
+		status["last_run"] = b.lastRun.UTC().Format(time.RFC3339)
+		status["last_result"] = b.lastResult
+	}
+	if b.lastBackup != "" {
+		status["last_backup"] = b.lastBackup
+	}
+	if b.lastError != "" {
+		status["last_error"] = b.lastError
+		status["last_error_at"] = b.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
@@ -0,0 +1,346 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"task-api/models"
+	"task-api/repository"
+	"time"
+)
+
+var (
+	// ErrInvalidDependency is returned when a task would be blocked by
+	// itself or by a task that does not exist
+	ErrInvalidDependency = errors.New("invalid dependency")
+
+	// ErrDependencyCycle is returned when a task would end up waiting for
+	// itself through its blockers
+	ErrDependencyCycle = errors.New("dependency cycle")
+)
+
+// BlockedError is returned when completing a task whose blockers are not
+// all completed while DependencyOptions.BlockCompletion is set
+type BlockedError struct {
+	TaskID   string
+	Blockers []string
+}
+
+func (e *BlockedError) Error() string {
+	if len(e.Blockers) == 1 {
+		return fmt.Sprintf("task %s is blocked by 1 open task", e.TaskID)
+	}
+	return fmt.Sprintf("task %s is blocked by %d open tasks", e.TaskID, len(e.Blockers))
+}
+
+// DependencyOptions configures how dependencies between tasks are enforced
+type DependencyOptions struct {
+	// BlockCompletion stops a task from being completed while one of the
+	// tasks blocking it is open
+	BlockCompletion bool
+}
+
+// DefaultDependencyOptions returns the options used unless others are set
+func DefaultDependencyOptions() DependencyOptions {
+	return DependencyOptions{BlockCompletion: true}
+}
+
+// SetDependencyOptions configures how dependencies are enforced
+func (s *TaskService) SetDependencyOptions(options DependencyOptions) {
+	s.dependencies = options
+}
+
+// TaskOrder is an order of GetTasksSorted
+type TaskOrder string
+
+const (
+	// OrderPriority orders tasks by quadrant, then newest first
+	OrderPriority TaskOrder = "priority"
+
+	// OrderTopological puts every task after the tasks blocking it, and
+	// otherwise keeps the priority order
+	OrderTopological TaskOrder = "topological"
+)
+
+// checkBlockers checks that the blockers of a task exist and that none of
+// them waits for the task, directly or through other tasks
+func checkBlockers(tx repository.TaskStore, id string, blockers []string) error {
+	if len(blockers) == 0 {
+		return nil
+	}
+
+	tasks, err := tx.List(repository.TaskFilter{})
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]models.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+	return checkBlockersIn(byID, id, blockers)
+}
+
+// checkBlockersIn is checkBlockers over tasks already loaded by ID
+func checkBlockersIn(byID map[string]models.Task, id string, blockers []string) error {
+	for _, blocker := range blockers {
+		if blocker == id {
+			return fmt.Errorf("%w: a task cannot block itself", ErrInvalidDependency)
+		}
+		if _, ok := byID[blocker]; !ok {
+			return fmt.Errorf("%w: blocking task %s does not exist", ErrInvalidDependency, blocker)
+		}
+	}
+
+	// Walk up from the new blockers; reaching the task closes a cycle
+	path := map[string]string{}
+	queue := append([]string(nil), blockers...)
+	for _, blocker := range blockers {
+		path[blocker] = id
+	}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		task, ok := byID[current]
+		if !ok {
+			continue
+		}
+		for _, upstream := range task.BlockedBy {
+			if upstream == id {
+				return fmt.Errorf("%w: %s", ErrDependencyCycle, cyclePath(path, id, current))
+			}
+			if _, seen := path[upstream]; !seen {
+				path[upstream] = current
+				queue = append(queue, upstream)
+			}
+		}
+	}
+	return nil
+}
+
+// cyclePath describes the cycle in which id blocks last, given the task
+// each visited blocker was reached from, which it blocks
+func cyclePath(path map[string]string, id, last string) string {
+	ids := []string{id}
+	for current := last; current != id; current = path[current] {
+		ids = append(ids, current)
+	}
+	ids = append(ids, id)
+	return strings.Join(ids, " blocks ")
+}
+
+// openBlockers returns the blockers of a task that are not completed.
+// Blockers that no longer exist do not block.
+func openBlockers(tx repository.TaskStore, task *models.Task) ([]string, error) {
+	open := []string{}
+	for _, id := range task.BlockedBy {
+		blocker, err := tx.Get(id)
+		if errors.Is(err, repository.ErrTaskNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !blocker.Completed {
+			open = append(open, id)
+		}
+	}
+	return open, nil
+}
+
+// checkUnblocked fails with a BlockedError if a task that was just
+// completed has open blockers and completion is blocked by them
+func (s *TaskService) checkUnblocked(tx repository.TaskStore, task *models.Task, wasCompleted bool) error {
+	if wasCompleted || !task.Completed || !s.dependencies.BlockCompletion {
+		return nil
+	}
+
+	open, err := openBlockers(tx, task)
+	if err != nil {
+		return err
+	}
+	if len(open) > 0 {
+		return &BlockedError{TaskID: task.ID, Blockers: open}
+	}
+	return nil
+}
+
+// unblock removes deleted tasks from the blockers of the remaining ones
+func unblock(tx repository.TaskStore, deleted map[string]bool) error {
+	tasks, err := tx.List(repository.TaskFilter{})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	for i := range tasks {
+		if deleted[tasks[i].ID] || !tasks[i].RemoveBlockers(deleted) {
+			continue
+		}
+		tasks[i].UpdatedAt = now
+		tasks[i].Version++
+		if err := tx.Update(tasks[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDependencies returns the tasks a task waits for and the tasks waiting
+// for it, at every distance
+func (s *TaskService) GetDependencies(id string) (*models.DependencyGraph, error) {
+	task, err := s.GetTaskByID(id)
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := s.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]*models.Task, len(tasks))
+	blocks := make(map[string][]string)
+	for i := range tasks {
+		byID[tasks[i].ID] = &tasks[i]
+		for _, blocker := range tasks[i].BlockedBy {
+			blocks[blocker] = append(blocks[blocker], tasks[i].ID)
+		}
+	}
+
+	graph := &models.DependencyGraph{TaskID: task.ID, OpenBlockers: []string{}}
+	for _, blocker := range task.BlockedBy {
+		if b := byID[blocker]; b != nil && !b.Completed {
+			graph.OpenBlockers = append(graph.OpenBlockers, blocker)
+		}
+	}
+	graph.Blocked = len(graph.OpenBlockers) > 0
+
+	upstream := walkDependencies(byID, task.ID, func(t *models.Task) []string { return t.BlockedBy })
+	downstream := walkDependencies(byID, task.ID, func(t *models.Task) []string { return blocks[t.ID] })
+	graph.Upstream = upstream
+	graph.Downstream = downstream
+
+	// Edges within the upstream and within the downstream part, each
+	// including the task itself
+	graph.Edges = []models.DependencyEdge{}
+	for _, part := range [][]models.DependencyNode{upstream, downstream} {
+		ids := []string{task.ID}
+		for _, node := range part {
+			ids = append(ids, node.ID)
+		}
+		members := make(map[string]bool, len(ids))
+		for _, member := range ids {
+			members[member] = true
+		}
+		for _, member := range ids {
+			for _, blocker := range byID[member].BlockedBy {
+				if members[blocker] {
+					graph.Edges = append(graph.Edges, models.DependencyEdge{From: blocker, To: member})
+				}
+			}
+		}
+	}
+	graph.Edges = uniqueEdges(graph.Edges)
+
+	return graph, nil
+}
+
+// walkDependencies visits the tasks reachable from a task through next,
+// breadth first, and returns them with their distance
+func walkDependencies(byID map[string]*models.Task, id string, next func(t *models.Task) []string) []models.DependencyNode {
+	nodes := []models.DependencyNode{}
+	depth := map[string]int{id: 0}
+	queue := []string{id}
+	for len(queue) > 0 {
+		current := byID[queue[0]]
+		queue = queue[1:]
+		for _, neighbor := range next(current) {
+			task := byID[neighbor]
+			if task == nil {
+				continue
+			}
+			if _, seen := depth[neighbor]; seen {
+				continue
+			}
+			depth[neighbor] = depth[current.ID] + 1
+			queue = append(queue, neighbor)
+			nodes = append(nodes, models.DependencyNode{
+				ID:        task.ID,
+				Title:     task.Title,
+				Quadrant:  task.Quadrant,
+				Completed: task.Completed,
+				Depth:     depth[neighbor],
+			})
+		}
+	}
+	return nodes
+}
+
+// uniqueEdges drops repeated edges, keeping the first of each
+func uniqueEdges(edges []models.DependencyEdge) []models.DependencyEdge {
+	seen := make(map[models.DependencyEdge]bool, len(edges))
+	unique := edges[:0]
+	for _, edge := range edges {
+		if !seen[edge] {
+			seen[edge] = true
+			unique = append(unique, edge)
+		}
+	}
+	return unique
+}
+
+// sortTopologically reorders tasks sorted by priority so that every task
+// comes after the tasks blocking it, picking the first task in priority
+// order whenever several are free to go. Blockers that are not among the
+// tasks are ignored.
+func sortTopologically(tasks []models.Task) []models.Task {
+	rank := make(map[string]int, len(tasks))
+	for i := range tasks {
+		rank[tasks[i].ID] = i
+	}
+
+	waiting := make([]int, len(tasks))
+	blocks := make([][]int, len(tasks))
+	for i := range tasks {
+		for _, blocker := range tasks[i].BlockedBy {
+			if j, ok := rank[blocker]; ok {
+				waiting[i]++
+				blocks[j] = append(blocks[j], i)
+			}
+		}
+	}
+
+	var ready []int
+	for i := range tasks {
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	sorted := make([]models.Task, 0, len(tasks))
+	placed := make([]bool, len(tasks))
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		sorted = append(sorted, tasks[i])
+		placed[i] = true
+
+		for _, j := range blocks[i] {
+			waiting[j]--
+			if waiting[j] == 0 {
+				k := sort.SearchInts(ready, j)
+				ready = append(ready, 0)
+				copy(ready[k+1:], ready[k:])
+				ready[k] = j
+			}
+		}
+	}
+
+	// Tasks in a cycle, which updates do not allow, keep the priority order
+	for i := range tasks {
+		if !placed[i] {
+			sorted = append(sorted, tasks[i])
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,99 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"task-api/models"
+	"testing"
+)
+
+// dependencyTasks builds tasks from a map of task IDs to their blockers, in
+// the order given by ids
+func dependencyTasks(ids []string, blockedBy map[string][]string) []models.Task {
+	tasks := make([]models.Task, 0, len(ids))
+	for _, id := range ids {
+		tasks = append(tasks, models.Task{ID: id, Title: id, BlockedBy: blockedBy[id]})
+	}
+	return tasks
+}
+
+func TestCheckBlockers(t *testing.T) {
+	// a blocks b, b blocks c and d, c and d block e
+	tasks := dependencyTasks([]string{"a", "b", "c", "d", "e", "f"}, map[string][]string{
+		"b": {"a"},
+		"c": {"b"},
+		"d": {"b"},
+		"e": {"c", "d"},
+	})
+	byID := make(map[string]models.Task, len(tasks))
+	for _, task := range tasks {
+		byID[task.ID] = task
+	}
+
+	tests := []struct {
+		name     string
+		id       string
+		blockers []string
+		wantErr  error
+		wantPath string
+	}{
+		{"no blockers", "a", nil, nil, ""},
+		{"unrelated task", "f", []string{"e"}, nil, ""},
+		{"upstream task", "e", []string{"a"}, nil, ""},
+		{"several blockers", "f", []string{"a", "c", "e"}, nil, ""},
+		{"itself", "a", []string{"a"}, ErrInvalidDependency, ""},
+		{"missing task", "a", []string{"missing"}, ErrInvalidDependency, ""},
+		{"direct cycle", "a", []string{"b"}, ErrDependencyCycle, "a blocks b blocks a"},
+		{"long cycle", "a", []string{"e"}, ErrDependencyCycle, "a blocks b blocks c blocks e blocks a"},
+		{"cycle through one of several blockers", "b", []string{"f", "d"}, ErrDependencyCycle, "b blocks d blocks b"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkBlockersIn(byID, tc.id, tc.blockers)
+			if tc.wantErr == nil {
+				if err != nil {
+					t.Fatalf("got %v, want no error", err)
+				}
+				return
+			}
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantPath != "" && !strings.HasSuffix(err.Error(), tc.wantPath) {
+				t.Errorf("got %q, want the cycle %q", err, tc.wantPath)
+			}
+		})
+	}
+}
+
+func TestSortTopologically(t *testing.T) {
+	tests := []struct {
+		name      string
+		ids       []string // in priority order
+		blockedBy map[string][]string
+		want      string
+	}{
+		{"no dependencies", []string{"a", "b", "c"}, nil, "a b c"},
+		{"chain against priority", []string{"c", "b", "a"}, map[string][]string{"c": {"b"}, "b": {"a"}}, "a b c"},
+		{"freed task goes first by priority", []string{"a", "b", "c", "d"}, map[string][]string{"a": {"b"}}, "b a c d"},
+		{"freed task waits for higher priority", []string{"a", "b", "c", "d"}, map[string][]string{"b": {"d"}}, "a c d b"},
+		{"waits for every blocker", []string{"e", "a", "b"}, map[string][]string{"e": {"a", "b"}}, "a b e"},
+		{"missing blockers are ignored", []string{"a", "b"}, map[string][]string{"a": {"gone"}}, "a b"},
+		{"cycle keeps priority order at the end", []string{"a", "b", "c"}, map[string][]string{"a": {"b"}, "b": {"a"}}, "c a b"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sorted := sortTopologically(dependencyTasks(tc.ids, tc.blockedBy))
+
+			ids := make([]string, 0, len(sorted))
+			for _, task := range sorted {
+				ids = append(ids, task.ID)
+			}
+			if got := strings.Join(ids, " "); got != tc.want {
+				t.Errorf("got %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
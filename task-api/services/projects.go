@@ -0,0 +1,427 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"task-api/models"
+	"task-api/repository"
+	"time"
+)
+
+// projectRegistryFile is the document holding the projects
+const projectRegistryFile = "projects.enc"
+
+var (
+	// ErrProjectNotFound is returned for a project ID that does not exist
+	ErrProjectNotFound = errors.New("project not found")
+
+	// ErrProjectExists is returned when a project would get the name of
+	// another project
+	ErrProjectExists = errors.New("project already exists")
+
+	// ErrProjectArchived is returned when adding tasks to an archived project
+	ErrProjectArchived = errors.New("project is archived")
+
+	// ErrProjectNotEmpty is returned when deleting a project that has tasks
+	// without saying what should happen to them
+	ErrProjectNotEmpty = errors.New("project has tasks")
+)
+
+// ProjectDeleteMode is what happens to the tasks of a deleted project
+type ProjectDeleteMode string
+
+const (
+	// ProjectDeleteCascade deletes the tasks with the project
+	ProjectDeleteCascade ProjectDeleteMode = "cascade"
+
+	// ProjectDeleteReassign moves the tasks to another project, or out of
+	// every project
+	ProjectDeleteReassign ProjectDeleteMode = "reassign"
+)
+
+// loadProjects reads the projects, of which there are none until one is
+// created
+func (s *TaskService) loadProjects() ([]models.Project, error) {
+	data, err := s.repo.LoadDocument(projectRegistryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load projects: %w", err)
+	}
+	if data == nil {
+		return []models.Project{}, nil
+	}
+	return models.ProjectsFromJSON(data)
+}
+
+// saveProjects replaces the stored projects
+func (s *TaskService) saveProjects(projects []models.Project) error {
+	data, err := models.ProjectsToJSON(projects)
+	if err != nil {
+		return fmt.Errorf("failed to serialize projects: %w", err)
+	}
+	return s.repo.SaveDocument(projectRegistryFile, data)
+}
+
+// projectIndex returns the index of a project, or -1
+func projectIndex(projects []models.Project, id string) int {
+	for i := range projects {
+		if projects[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkProjectName fails if a project other than exceptID has the name,
+// ignoring case
+func checkProjectName(projects []models.Project, name, exceptID string) error {
+	for _, project := range projects {
+		if project.ID != exceptID && strings.EqualFold(project.Name, name) {
+			return fmt.Errorf("%w: %s", ErrProjectExists, project.Name)
+		}
+	}
+	return nil
+}
+
+// checkProjectTarget checks that tasks can be added to a project; an empty
+// ID stands for no project and is always allowed
+func checkProjectTarget(projects []models.Project, projectID string) error {
+	if projectID == "" {
+		return nil
+	}
+	i := projectIndex(projects, projectID)
+	if i < 0 {
+		return fmt.Errorf("%w: %s", ErrProjectNotFound, projectID)
+	}
+	if projects[i].Archived {
+		return fmt.Errorf("%w: %s", ErrProjectArchived, projects[i].Name)
+	}
+	return nil
+}
+
+// summarizeProject counts the tasks of a project
+func summarizeProject(project models.Project, tasks []models.Task) models.ProjectSummary {
+	summary := models.ProjectSummary{
+		Project:   project,
+		Quadrants: make(map[models.TaskQuadrant]int),
+	}
+	for _, task := range tasks {
+		if !task.InProject(project.ID) {
+			continue
+		}
+		summary.TaskCount++
+		if task.Completed {
+			summary.CompletedCount++
+		} else {
+			summary.Quadrants[task.Quadrant]++
+		}
+	}
+	return summary
+}
+
+// projectPtr returns the ProjectID of a task in the given project
+func projectPtr(projectID string) *string {
+	if projectID == "" {
+		return nil
+	}
+	return &projectID
+}
+
+// ListProjects returns the projects by name, leaving out archived ones
+// unless includeArchived is set
+func (s *TaskService) ListProjects(includeArchived bool) ([]models.ProjectSummary, error) {
+	projects, err := s.loadProjects()
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := s.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := make([]models.ProjectSummary, 0, len(projects))
+	for _, project := range projects {
+		if project.Archived && !includeArchived {
+			continue
+		}
+		summaries = append(summaries, summarizeProject(project, tasks))
+	}
+	sort.SliceStable(summaries, func(i, j int) bool {
+		return strings.ToLower(summaries[i].Name) < strings.ToLower(summaries[j].Name)
+	})
+	return summaries, nil
+}
+
+// GetProject returns a project with the counts of its tasks
+func (s *TaskService) GetProject(id string) (*models.ProjectSummary, error) {
+	projects, err := s.loadProjects()
+	if err != nil {
+		return nil, err
+	}
+	i := projectIndex(projects, id)
+	if i < 0 {
+		return nil, ErrProjectNotFound
+	}
+
+	projectID := id
+	tasks, err := s.repo.List(repository.TaskFilter{ProjectID: &projectID})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := summarizeProject(projects[i], tasks)
+	return &summary, nil
+}
+
+// CreateProject creates a project, whose name must not be taken
+func (s *TaskService) CreateProject(formData models.ProjectFormData) (*models.ProjectSummary, error) {
+	project, err := models.NewProject(formData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.write(func() error {
+		projects, err := s.loadProjects()
+		if err != nil {
+			return err
+		}
+		if err := checkProjectName(projects, project.Name, ""); err != nil {
+			return err
+		}
+		return s.saveProjects(append(projects, *project))
+	})
+	if err != nil {
+		return nil, projectError("failed to save project", err)
+	}
+
+	return s.GetProject(project.ID)
+}
+
+// UpdateProject renames, describes, recolors, archives or restores a
+// project
+func (s *TaskService) UpdateProject(id string, update models.ProjectUpdate) (*models.ProjectSummary, error) {
+	err := s.write(func() error {
+		projects, err := s.loadProjects()
+		if err != nil {
+			return err
+		}
+		i := projectIndex(projects, id)
+		if i < 0 {
+			return ErrProjectNotFound
+		}
+
+		if err := projects[i].Update(update); err != nil {
+			return err
+		}
+		if err := checkProjectName(projects, projects[i].Name, id); err != nil {
+			return err
+		}
+		return s.saveProjects(projects)
+	})
+	if err != nil {
+		return nil, projectError("failed to save project", err)
+	}
+
+	return s.GetProject(id)
+}
+
+// DeleteProject deletes a project and returns how many tasks it had. A
+// project with tasks is only deleted if mode says what happens to them:
+// they are deleted with it, or moved to reassignTo, or out of every
+// project if that is empty.
+func (s *TaskService) DeleteProject(id string, mode ProjectDeleteMode, reassignTo string) (int, error) {
+	switch mode {
+	case "", ProjectDeleteCascade, ProjectDeleteReassign:
+	default:
+		return 0, fmt.Errorf("validation failed: Invalid mode %q, must be cascade or reassign", mode)
+	}
+	if reassignTo != "" && mode != ProjectDeleteReassign {
+		return 0, errors.New("validation failed: A target project can only be given when reassigning tasks")
+	}
+
+	var affected int
+	err := s.write(func() error {
+		projects, err := s.loadProjects()
+		if err != nil {
+			return err
+		}
+		if projectIndex(projects, id) < 0 {
+			return ErrProjectNotFound
+		}
+		if reassignTo == id {
+			return errors.New("validation failed: Tasks cannot be reassigned to the project being deleted")
+		}
+		if err := checkProjectTarget(projects, reassignTo); err != nil {
+			if errors.Is(err, ErrProjectNotFound) {
+				return fmt.Errorf("validation failed: Target project %s does not exist", reassignTo)
+			}
+			return err
+		}
+
+		remaining := make([]models.Project, 0, len(projects))
+		for _, project := range projects {
+			if project.ID != id {
+				remaining = append(remaining, project)
+			}
+		}
+
+		return s.transactionWithDocument(
+			func() error { return s.saveProjects(remaining) },
+			func() error { return s.saveProjects(projects) },
+			func(tx repository.TaskStore) error {
+				tasks, err := tx.List(repository.TaskFilter{ProjectID: &id})
+				if err != nil {
+					return err
+				}
+				affected = len(tasks)
+				if affected == 0 {
+					return nil
+				}
+
+				switch mode {
+				case ProjectDeleteCascade:
+					return deleteProjectTasks(tx, tasks)
+				case ProjectDeleteReassign:
+					return reassignProjectTasks(tx, tasks, reassignTo)
+				}
+				return fmt.Errorf("%w: it has %d tasks; choose to cascade or reassign them", ErrProjectNotEmpty, affected)
+			})
+	})
+	if err != nil {
+		return 0, projectError("failed to delete project", err)
+	}
+
+	return affected, nil
+}
+
+// deleteProjectTasks deletes the tasks of a project with their subtasks
+func deleteProjectTasks(tx repository.TaskStore, tasks []models.Task) error {
+	h, err := loadHierarchy(tx)
+	if err != nil {
+		return err
+	}
+
+	deleted := make(map[string]bool)
+	for _, task := range tasks {
+		for _, id := range append([]string{task.ID}, h.descendants(task.ID)...) {
+			if deleted[id] {
+				continue
+			}
+			deleted[id] = true
+			if err := tx.Delete(id); err != nil {
+				return err
+			}
+		}
+	}
+	return unblock(tx, deleted)
+}
+
+// reassignProjectTasks moves the tasks of a project to another one
+func reassignProjectTasks(tx repository.TaskStore, tasks []models.Task, projectID string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, task := range tasks {
+		task.ProjectID = projectPtr(projectID)
+		task.UpdatedAt = now
+		task.Version++
+		if err := tx.Update(task); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearMissingProjects takes every task out of projects that do not exist,
+// as restored or imported tasks may refer to projects deleted since. It
+// returns the IDs of the tasks it changed.
+func clearMissingProjects(tx repository.TaskStore, projects []models.Project) ([]string, error) {
+	tasks, err := tx.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	cleared := []string{}
+	for _, task := range tasks {
+		if task.ProjectID == nil || projectIndex(projects, *task.ProjectID) >= 0 {
+			continue
+		}
+		task.ProjectID = nil
+		if err := tx.Update(task); err != nil {
+			return nil, err
+		}
+		cleared = append(cleared, task.ID)
+	}
+	return cleared, nil
+}
+
+// MoveTaskToProject moves a top-level task and its subtasks to another
+// project, or out of every project if projectID is empty
+func (s *TaskService) MoveTaskToProject(id, projectID string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to move task to project", func(tx repository.TaskStore, task *models.Task) error {
+		return s.assignProject(tx, task, strings.TrimSpace(projectID))
+	})
+}
+
+// assignProject moves a top-level task and its subtasks to a project.
+// Subtasks always share the project of their parent, so they cannot be
+// moved on their own.
+func (s *TaskService) assignProject(tx repository.TaskStore, task *models.Task, projectID string) error {
+	if task.InProject(projectID) {
+		return nil
+	}
+	if task.ParentID != nil {
+		return fmt.Errorf("%w: a subtask is always in the project of its parent; move the top-level task instead", ErrInvalidHierarchy)
+	}
+
+	projects, err := s.loadProjects()
+	if err != nil {
+		return err
+	}
+	if err := checkProjectTarget(projects, projectID); err != nil {
+		return err
+	}
+
+	task.ProjectID = projectPtr(projectID)
+	task.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	h, err := loadHierarchy(tx)
+	if err != nil {
+		return err
+	}
+	return moveDescendantsToProject(tx, h, task.ID, projectID)
+}
+
+// moveDescendantsToProject puts the subtasks of a task at every level into
+// the given project
+func moveDescendantsToProject(tx repository.TaskStore, h *taskHierarchy, id, projectID string) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, descendantID := range h.descendants(id) {
+		descendant := h.tasks[descendantID]
+		if descendant.InProject(projectID) {
+			continue
+		}
+
+		descendant.ProjectID = projectPtr(projectID)
+		descendant.UpdatedAt = now
+		descendant.Version++
+		if err := tx.Update(descendant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// projectError wraps unexpected errors of project changes, passing through
+// the ones the caller is expected to handle
+func projectError(msg string, err error) error {
+	if errors.Is(err, ErrProjectNotFound) || errors.Is(err, ErrProjectExists) ||
+		errors.Is(err, ErrProjectArchived) || errors.Is(err, ErrProjectNotEmpty) ||
+		strings.Contains(err.Error(), "validation failed") {
+		return err
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
@@ -0,0 +1,151 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"task-api/models"
+	"task-api/repository"
+	"time"
+)
+
+// maxOccurrences bounds how many upcoming occurrences are listed at once
+const maxOccurrences = 100
+
+var (
+	// ErrNotRecurring is returned for series operations on a task that does
+	// not recur
+	ErrNotRecurring = errors.New("task does not recur")
+
+	// ErrNotCurrentOccurrence is returned when skipping or ending a series
+	// from an occurrence that was already followed by the next one
+	ErrNotCurrentOccurrence = errors.New("not the current occurrence")
+
+	// ErrSeriesEnded is returned when skipping the last occurrence of a
+	// series
+	ErrSeriesEnded = errors.New("series has no further occurrences")
+)
+
+// currentRecurrence returns the recurrence of a task that is the current
+// occurrence of its series
+func currentRecurrence(task *models.Task) (*models.Recurrence, error) {
+	if task.Recurrence == nil {
+		return nil, ErrNotRecurring
+	}
+	if task.Recurrence.NextID != nil {
+		return nil, fmt.Errorf("%w: task %s is the next one", ErrNotCurrentOccurrence, *task.Recurrence.NextID)
+	}
+	return task.Recurrence, nil
+}
+
+// dueTime parses the due date of a recurring task
+func dueTime(task *models.Task) (time.Time, error) {
+	if task.DueDate == nil {
+		return time.Time{}, fmt.Errorf("recurring task %s has no due date", task.ID)
+	}
+	return time.Parse(time.RFC3339, *task.DueDate)
+}
+
+// GetOccurrences returns up to limit occurrences of the series of a task,
+// starting with the task itself
+func (s *TaskService) GetOccurrences(id string, limit int) ([]models.Occurrence, error) {
+	if limit < 1 || limit > maxOccurrences {
+		return nil, fmt.Errorf("validation failed: limit must be between 1 and %d", maxOccurrences)
+	}
+
+	task, err := s.GetTaskByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if task.Recurrence == nil {
+		return nil, ErrNotRecurring
+	}
+	due, err := dueTime(task)
+	if err != nil {
+		return nil, err
+	}
+
+	return task.Recurrence.Upcoming(due, limit)
+}
+
+// SkipOccurrence moves a recurring task to the next occurrence of its
+// series without completing it
+func (s *TaskService) SkipOccurrence(id string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to save task after skipping occurrence", func(tx repository.TaskStore, task *models.Task) error {
+		recurrence, err := currentRecurrence(task)
+		if err != nil {
+			return err
+		}
+		due, err := dueTime(task)
+		if err != nil {
+			return err
+		}
+
+		next, err := recurrence.Next(due)
+		if err != nil {
+			return err
+		}
+		if next == nil {
+			return fmt.Errorf("%w; end the series or delete the task instead", ErrSeriesEnded)
+		}
+
+		task.DueDate = &next.DueDate
+		recurrence.Occurrence = next.Occurrence
+		task.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+}
+
+// EndRecurrence ends the series of a task, which stays as a task of its own
+func (s *TaskService) EndRecurrence(id string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to save task after ending series", func(tx repository.TaskStore, task *models.Task) error {
+		if _, err := currentRecurrence(task); err != nil {
+			return err
+		}
+
+		task.Recurrence = nil
+		task.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		return nil
+	})
+}
+
+// spawnNextOccurrence creates the next occurrence of a recurring task if it
+// was just completed, unless the next one already exists or the series
+// ended
+func (s *TaskService) spawnNextOccurrence(tx repository.TaskStore, task *models.Task, wasCompleted bool) error {
+	if wasCompleted || !task.Completed || task.Recurrence == nil || task.Recurrence.NextID != nil {
+		return nil
+	}
+	due, err := dueTime(task)
+	if err != nil {
+		return err
+	}
+
+	next, err := task.Recurrence.Next(due)
+	if err != nil || next == nil {
+		return err
+	}
+
+	instance := task.NextOccurrence(*next)
+	if instance.ParentID != nil {
+		h, err := loadHierarchy(tx)
+		if err != nil {
+			return err
+		}
+		instance.Position = h.nextPosition(*instance.ParentID)
+	}
+	if err := tx.Create(*instance); err != nil {
+		return err
+	}
+
+	task.Recurrence.NextID = &instance.ID
+	return nil
+}
@@ -0,0 +1,291 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"task-api/models"
+	"task-api/repository"
+	"task-api/storage"
+
+	"github.com/google/uuid"
+)
+
+// RestoreConflictMode decides what a selective restore does with a backed
+// up task whose ID still exists
+type RestoreConflictMode string
+
+const (
+	// RestoreConflictSkip keeps the current task
+	RestoreConflictSkip RestoreConflictMode = "skip"
+
+	// RestoreConflictOverwrite replaces the current task with the backup's
+	RestoreConflictOverwrite RestoreConflictMode = "overwrite"
+
+	// RestoreConflictDuplicate keeps the current task and restores the
+	// backup's as a new task with a new ID
+	RestoreConflictDuplicate RestoreConflictMode = "duplicate"
+)
+
+// errDryRun rolls back the transaction of a dry run
+var errDryRun = errors.New("dry run")
+
+// SelectiveRestoreOptions selects the tasks to restore from a backup. A task
+// is restored if its ID is listed or it matches the quadrant and completion
+// filter; at least one ID or filter field must be given.
+type SelectiveRestoreOptions struct {
+	BackupName string
+	TaskIDs    []string
+	Quadrant   *models.TaskQuadrant
+	Completed  *bool
+	Conflict   RestoreConflictMode
+	DryRun     bool
+}
+
+// RestoredDuplicate is a backed up task restored under a new ID
+type RestoredDuplicate struct {
+	ID    string `json:"id"`
+	NewID string `json:"new_id"`
+}
+
+// SelectiveRestoreResult reports what happened to each selected task
+type SelectiveRestoreResult struct {
+	BackupName  string              `json:"backup_name"`
+	Conflict    RestoreConflictMode `json:"conflict"`
+	DryRun      bool                `json:"dry_run"`
+	PreRestore  string              `json:"pre_restore_backup,omitempty"`
+	Restored    []string            `json:"restored"`
+	Overwritten []string            `json:"overwritten"`
+	Duplicated  []RestoredDuplicate `json:"duplicated"`
+	Skipped     []string            `json:"skipped"`
+	NotInBackup []string            `json:"not_in_backup"`
+	Selected    int                 `json:"selected"`
+
+	// Reparented lists restored tasks moved to the top level because their
+	// parent is gone or they would be nested too deeply under it
+	Reparented []string `json:"reparented"`
+
+	// DroppedBlockers lists, by restored task, the blockers it was restored
+	// without because they are gone or would close a cycle
+	DroppedBlockers map[string][]string `json:"dropped_blockers"`
+
+	// RemovedFromProject lists restored tasks taken out of their project
+	// because it no longer exists
+	RemovedFromProject []string `json:"removed_from_project"`
+}
+
+// RestoreTasksFromBackup merges selected tasks from a backup into the
+// current tasks, leaving all others untouched. Unless it is a dry run, the
+// current tasks are backed up first.
+func (s *TaskService) RestoreTasksFromBackup(options SelectiveRestoreOptions) (*SelectiveRestoreResult, error) {
+	if len(options.TaskIDs) == 0 && options.Quadrant == nil && options.Completed == nil {
+		return nil, errors.New("task IDs or a filter are required")
+	}
+	if options.Conflict == "" {
+		options.Conflict = RestoreConflictSkip
+	}
+	switch options.Conflict {
+	case RestoreConflictSkip, RestoreConflictOverwrite, RestoreConflictDuplicate:
+	default:
+		return nil, fmt.Errorf("invalid conflict mode %q, must be one of: skip, overwrite, duplicate", options.Conflict)
+	}
+
+	backupTasks, err := s.repo.LoadBackup(options.BackupName)
+	if err != nil {
+		return nil, err
+	}
+
+	selected, notInBackup := selectBackupTasks(backupTasks, options)
+	result := &SelectiveRestoreResult{
+		BackupName:  options.BackupName,
+		Conflict:    options.Conflict,
+		DryRun:      options.DryRun,
+		Restored:    []string{},
+		Overwritten: []string{},
+		Duplicated:  []RestoredDuplicate{},
+		Skipped:     []string{},
+		NotInBackup: notInBackup,
+		Selected:    len(selected),
+
+		Reparented:         []string{},
+		DroppedBlockers:    map[string][]string{},
+		RemovedFromProject: []string{},
+	}
+
+	// Back up and restore in one write, so no change made in between is
+	// left out of the pre-restore backup
+	err = s.write(func() error {
+		if !options.DryRun && len(selected) > 0 {
+			preRestore, err := s.repo.CreateBackup(storage.BackupTriggerPreRestore)
+			if err != nil {
+				log.Printf("Warning: failed to backup current data: %v", err)
+			} else {
+				log.Printf("Created backup of current data: %s", preRestore)
+				result.PreRestore = preRestore
+			}
+		}
+
+		projects, err := s.loadProjects()
+		if err != nil {
+			return err
+		}
+
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			for _, task := range selected {
+				if err := restoreTask(tx, task, options.Conflict, result); err != nil {
+					return err
+				}
+			}
+			if err := s.relinkRestoredTasks(tx, projects, result); err != nil {
+				return err
+			}
+			if options.DryRun {
+				return errDryRun
+			}
+			return nil
+		})
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, fmt.Errorf("failed to restore tasks: %w", err)
+	}
+
+	if !options.DryRun {
+		log.Printf("Restored tasks from backup %s: %d restored, %d overwritten, %d duplicated, %d skipped, %d reparented, %d with dropped blockers, %d removed from projects",
+			options.BackupName, len(result.Restored), len(result.Overwritten), len(result.Duplicated), len(result.Skipped),
+			len(result.Reparented), len(result.DroppedBlockers), len(result.RemovedFromProject))
+	}
+
+	return result, nil
+}
+
+// selectBackupTasks returns the backed up tasks that are listed by ID or
+// match the filter, and the listed IDs that are not in the backup
+func selectBackupTasks(backupTasks []models.Task, options SelectiveRestoreOptions) ([]models.Task, []string) {
+	wanted := make(map[string]bool, len(options.TaskIDs))
+	for _, id := range options.TaskIDs {
+		wanted[id] = true
+	}
+
+	var filter *repository.TaskFilter
+	if options.Quadrant != nil || options.Completed != nil {
+		filter = &repository.TaskFilter{Quadrant: options.Quadrant, Completed: options.Completed}
+	}
+
+	found := make(map[string]bool, len(options.TaskIDs))
+	selected := []models.Task{}
+	for i := range backupTasks {
+		task := backupTasks[i]
+		if wanted[task.ID] || (filter != nil && filter.Matches(&task)) {
+			selected = append(selected, task)
+			found[task.ID] = true
+		}
+	}
+
+	notInBackup := []string{}
+	for _, id := range options.TaskIDs {
+		if !found[id] {
+			notInBackup = append(notInBackup, id)
+			found[id] = true // report duplicates in the request once
+		}
+	}
+
+	return selected, notInBackup
+}
+
+// restoreTask stores a backed up task, resolving an ID conflict as asked
+func restoreTask(tx repository.TaskStore, task models.Task, conflict RestoreConflictMode, result *SelectiveRestoreResult) error {
+	current, err := tx.Get(task.ID)
+	if errors.Is(err, repository.ErrTaskNotFound) {
+		if err := tx.Create(task); err != nil {
+			return err
+		}
+		result.Restored = append(result.Restored, task.ID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch conflict {
+	case RestoreConflictOverwrite:
+		// Keep the version increasing, so clients holding the current one see
+		// the task changed
+		task.Version = current.Version + 1
+		if err := tx.Update(task); err != nil {
+			return err
+		}
+		result.Overwritten = append(result.Overwritten, task.ID)
+	case RestoreConflictDuplicate:
+		duplicate := task
+		duplicate.ID = uuid.New().String()
+		if err := tx.Create(duplicate); err != nil {
+			return err
+		}
+		result.Duplicated = append(result.Duplicated, RestoredDuplicate{ID: task.ID, NewID: duplicate.ID})
+	default:
+		result.Skipped = append(result.Skipped, task.ID)
+	}
+	return nil
+}
+
+// relinkRestoredTasks checks the parent and blockers of each stored task
+// against the tasks around it. A task whose parent is gone, whose parent is
+// now one of its own subtasks, or which would be nested deeper than allowed
+// is moved to the top level, blockers that are gone or would close a cycle
+// are dropped, and a task whose project is gone is taken out of it.
+func (s *TaskService) relinkRestoredTasks(tx repository.TaskStore, projects []models.Project, result *SelectiveRestoreResult) error {
+	ids := append(append([]string(nil), result.Restored...), result.Overwritten...)
+	for _, duplicate := range result.Duplicated {
+		ids = append(ids, duplicate.NewID)
+	}
+
+	h, err := loadHierarchy(tx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		task := h.tasks[id]
+		changed := false
+
+		if task.ParentID != nil {
+			if err := s.checkParent(h, id, *task.ParentID); err != nil {
+				task.ParentID = nil
+				task.Position = 0
+				result.Reparented = append(result.Reparented, id)
+				changed = true
+			}
+		}
+
+		if task.ProjectID != nil && projectIndex(projects, *task.ProjectID) < 0 {
+			task.ProjectID = nil
+			result.RemovedFromProject = append(result.RemovedFromProject, id)
+			changed = true
+		}
+
+		kept := []string{}
+		for _, blocker := range task.BlockedBy {
+			if err := checkBlockersIn(h.tasks, id, []string{blocker}); err != nil {
+				if !errors.Is(err, ErrInvalidDependency) && !errors.Is(err, ErrDependencyCycle) {
+					return err
+				}
+				result.DroppedBlockers[id] = append(result.DroppedBlockers[id], blocker)
+				changed = true
+				continue
+			}
+			kept = append(kept, blocker)
+		}
+
+		if !changed {
+			continue
+		}
+		if len(result.DroppedBlockers[id]) > 0 {
+			task.BlockedBy = kept
+		}
+		if err := tx.Update(task); err != nil {
+			return err
+		}
+		h.update(task)
+	}
+	return nil
+}
@@ -0,0 +1,352 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"task-api/models"
+	"task-api/repository"
+	"time"
+)
+
+// ErrInvalidHierarchy is returned when a change would make a task the
+// subtask of a missing task or of itself, or nest subtasks too deeply
+var ErrInvalidHierarchy = errors.New("invalid task hierarchy")
+
+// SubtaskOptions configures how tasks can be nested
+type SubtaskOptions struct {
+	// MaxDepth is how many levels of subtasks a top-level task can have; 0
+	// disables subtasks
+	MaxDepth int
+
+	// AutoComplete completes a task once all its subtasks and checklist
+	// items are complete, and reopens it when one of them is reopened
+	AutoComplete bool
+}
+
+// DefaultSubtaskOptions returns the options used unless others are set
+func DefaultSubtaskOptions() SubtaskOptions {
+	return SubtaskOptions{MaxDepth: 3}
+}
+
+// SetSubtaskOptions configures how tasks can be nested
+func (s *TaskService) SetSubtaskOptions(options SubtaskOptions) {
+	s.subtasks = options
+}
+
+// SubtaskOptions returns how tasks can be nested
+func (s *TaskService) SubtaskOptions() SubtaskOptions {
+	return s.subtasks
+}
+
+// taskHierarchy indexes the tasks of a transaction by parent
+type taskHierarchy struct {
+	tasks    map[string]models.Task
+	children map[string][]string
+}
+
+func loadHierarchy(tx repository.TaskStore) (*taskHierarchy, error) {
+	tasks, err := tx.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	h := &taskHierarchy{
+		tasks:    make(map[string]models.Task, len(tasks)),
+		children: make(map[string][]string),
+	}
+	for _, task := range tasks {
+		h.tasks[task.ID] = task
+		if task.ParentID != nil {
+			h.children[*task.ParentID] = append(h.children[*task.ParentID], task.ID)
+		}
+	}
+	return h, nil
+}
+
+// depth returns how many ancestors a task has
+func (h *taskHierarchy) depth(id string) int {
+	depth := 0
+	for task, ok := h.tasks[id]; ok && task.ParentID != nil && depth <= len(h.tasks); task, ok = h.tasks[*task.ParentID] {
+		depth++
+	}
+	return depth
+}
+
+// height returns how many levels of subtasks a task has below it
+func (h *taskHierarchy) height(id string) int {
+	height := 0
+	for _, childID := range h.descendants(id) {
+		if d := h.depth(childID) - h.depth(id); d > height {
+			height = d
+		}
+	}
+	return height
+}
+
+// descendants returns the subtasks of a task at every level below it
+func (h *taskHierarchy) descendants(id string) []string {
+	var ids []string
+	seen := map[string]bool{id: true}
+	queue := []string{id}
+	for len(queue) > 0 {
+		for _, childID := range h.children[queue[0]] {
+			if !seen[childID] {
+				seen[childID] = true
+				ids = append(ids, childID)
+				queue = append(queue, childID)
+			}
+		}
+		queue = queue[1:]
+	}
+	return ids
+}
+
+// nextPosition returns the position after the last subtask of a task
+func (h *taskHierarchy) nextPosition(parentID string) int {
+	position := 0
+	for _, childID := range h.children[parentID] {
+		if p := h.tasks[childID].Position; p > position {
+			position = p
+		}
+	}
+	return position + 1
+}
+
+// update replaces a task in the hierarchy, moving it to the subtasks of
+// its new parent
+func (h *taskHierarchy) update(task models.Task) {
+	if old, ok := h.tasks[task.ID]; ok && old.ParentID != nil {
+		siblings := h.children[*old.ParentID]
+		for i, childID := range siblings {
+			if childID == task.ID {
+				h.children[*old.ParentID] = append(siblings[:i:i], siblings[i+1:]...)
+				break
+			}
+		}
+	}
+	h.tasks[task.ID] = task
+	if task.ParentID != nil {
+		h.children[*task.ParentID] = append(h.children[*task.ParentID], task.ID)
+	}
+}
+
+// checkParent checks that the task with the given ID, or a new task if it
+// is empty, can become a subtask of parentID
+func (s *TaskService) checkParent(h *taskHierarchy, id, parentID string) error {
+	if s.subtasks.MaxDepth <= 0 {
+		return fmt.Errorf("%w: subtasks are disabled", ErrInvalidHierarchy)
+	}
+	if _, ok := h.tasks[parentID]; !ok {
+		return fmt.Errorf("%w: parent task %s does not exist", ErrInvalidHierarchy, parentID)
+	}
+
+	if id != "" {
+		if parentID == id {
+			return fmt.Errorf("%w: a task cannot be its own subtask", ErrInvalidHierarchy)
+		}
+		for _, descendant := range h.descendants(id) {
+			if descendant == parentID {
+				return fmt.Errorf("%w: a task cannot be moved under one of its own subtasks", ErrInvalidHierarchy)
+			}
+		}
+	}
+
+	if h.depth(parentID)+1+h.height(id) > s.subtasks.MaxDepth {
+		return fmt.Errorf("%w: subtasks can be nested at most %d levels deep", ErrInvalidHierarchy, s.subtasks.MaxDepth)
+	}
+	return nil
+}
+
+// rollUp completes or reopens a task to match its subtasks and checklist
+// items if auto-completion is enabled, continuing with its parent as long as
+// something changes
+func (s *TaskService) rollUp(tx repository.TaskStore, id string) error {
+	for steps := 0; s.subtasks.AutoComplete && id != "" && steps <= s.subtasks.MaxDepth; steps++ {
+		task, err := tx.Get(id)
+		if errors.Is(err, repository.ErrTaskNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		subtasks, err := tx.List(repository.TaskFilter{ParentID: &id})
+		if err != nil {
+			return err
+		}
+		progress := task.Progress(subtasks)
+		done := progress.Completed == progress.Total
+		if progress.Total == 0 || task.Completed == done {
+			return nil
+		}
+
+		// A task waiting for its blockers is not completed automatically
+		if done && s.dependencies.BlockCompletion {
+			open, err := openBlockers(tx, task)
+			if err != nil {
+				return err
+			}
+			if len(open) > 0 {
+				return nil
+			}
+		}
+
+		// Complete it like a user would, so a recurring task is followed
+		// by its next occurrence; the recurrence is copied since that
+		// records the next one in it
+		if task.Recurrence != nil {
+			recurrence := *task.Recurrence
+			task.Recurrence = &recurrence
+		}
+		wasCompleted := task.Completed
+		task.SetCompletion(done)
+		if err := s.completionChanged(tx, task, wasCompleted); err != nil {
+			return err
+		}
+		task.Version++
+		if err := tx.Update(*task); err != nil {
+			return err
+		}
+
+		id = ""
+		if task.ParentID != nil {
+			id = *task.ParentID
+		}
+	}
+	return nil
+}
+
+// checklistProgress counts finished checklist items without subtasks
+func checklistProgress(task *models.Task) models.TaskProgress {
+	return task.Progress(nil)
+}
+
+// parentOf returns the parent ID of a task, or "" for a top-level task
+func parentOf(task *models.Task) string {
+	if task.ParentID == nil {
+		return ""
+	}
+	return *task.ParentID
+}
+
+// ReorderSubtasks sets the order of the subtasks of a task, which must list
+// every subtask exactly once, and returns them in the new order
+func (s *TaskService) ReorderSubtasks(parentID string, subtaskIDs []string, expectedVersion *int64) ([]models.Task, error) {
+	if strings.TrimSpace(parentID) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	var subtasks []models.Task
+	err := s.write(func() error {
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			parent, err := tx.Get(parentID)
+			if err != nil {
+				return err
+			}
+			if expectedVersion != nil && *expectedVersion != parent.Version {
+				return &VersionConflictError{Current: *parent}
+			}
+
+			current, err := tx.List(repository.TaskFilter{ParentID: &parentID})
+			if err != nil {
+				return err
+			}
+			byID := make(map[string]models.Task, len(current))
+			for _, task := range current {
+				byID[task.ID] = task
+			}
+			if len(subtaskIDs) != len(current) {
+				return errors.New("validation failed: The new order must list every subtask exactly once")
+			}
+
+			now := time.Now().UTC().Format(time.RFC3339)
+			subtasks = make([]models.Task, 0, len(subtaskIDs))
+			for i, id := range subtaskIDs {
+				task, ok := byID[id]
+				if !ok {
+					return errors.New("validation failed: The new order must list every subtask exactly once")
+				}
+				delete(byID, id)
+
+				if task.Position != i+1 {
+					task.Position = i + 1
+					task.UpdatedAt = now
+					task.Version++
+					if err := tx.Update(task); err != nil {
+						return err
+					}
+				}
+				subtasks = append(subtasks, task)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		var conflict *VersionConflictError
+		if errors.As(err, &conflict) || errors.Is(err, repository.ErrTaskNotFound) || strings.Contains(err.Error(), "validation failed") {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to save subtask order: %w", err)
+	}
+
+	return subtasks, nil
+}
+
+// AddChecklistItem appends an item to the checklist of a task
+func (s *TaskService) AddChecklistItem(id, text string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to save checklist item", func(tx repository.TaskStore, task *models.Task) error {
+		_, err := task.AddChecklistItem(text)
+		return err
+	})
+}
+
+// RenameChecklistItem replaces the text of a checklist item
+func (s *TaskService) RenameChecklistItem(id, itemID, text string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to save checklist item", func(tx repository.TaskStore, task *models.Task) error {
+		return task.RenameChecklistItem(itemID, text)
+	})
+}
+
+// SetChecklistItemCompletion sets the completion status of a checklist
+// item, or toggles it if completed is nil
+func (s *TaskService) SetChecklistItemCompletion(id, itemID string, completed *bool, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to save checklist item", func(tx repository.TaskStore, task *models.Task) error {
+		return task.SetChecklistItemCompletion(itemID, completed)
+	})
+}
+
+// RemoveChecklistItem deletes a checklist item
+func (s *TaskService) RemoveChecklistItem(id, itemID string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to remove checklist item", func(tx repository.TaskStore, task *models.Task) error {
+		return task.RemoveChecklistItem(itemID)
+	})
+}
+
+// ReorderChecklist sets the order of the checklist items of a task, which
+// must list every item exactly once
+func (s *TaskService) ReorderChecklist(id string, itemIDs []string, expectedVersion *int64) (*models.Task, error) {
+	if strings.TrimSpace(id) == "" {
+		return nil, errors.New("task ID cannot be empty")
+	}
+
+	return s.modifyTask(id, expectedVersion, "failed to save checklist order", func(tx repository.TaskStore, task *models.Task) error {
+		return task.ReorderChecklist(itemIDs)
+	})
+}
@@ -0,0 +1,369 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"task-api/models"
+	"task-api/repository"
+	"time"
+)
+
+// tagRegistryFile is the document holding the tag registry
+const tagRegistryFile = "tags.enc"
+
+var (
+	// ErrTagNotFound is returned for a tag that is neither registered nor
+	// carried by any task
+	ErrTagNotFound = errors.New("tag not found")
+
+	// ErrTagExists is returned when registering a tag twice or renaming a
+	// tag to one that exists
+	ErrTagExists = errors.New("tag already exists")
+)
+
+// loadTags reads the tag registry, which is empty until a tag is registered
+func (s *TaskService) loadTags() ([]models.Tag, error) {
+	data, err := s.repo.LoadDocument(tagRegistryFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load tag registry: %w", err)
+	}
+	if data == nil {
+		return []models.Tag{}, nil
+	}
+	return models.TagsFromJSON(data)
+}
+
+// saveTags replaces the tag registry
+func (s *TaskService) saveTags(tags []models.Tag) error {
+	models.SortTags(tags)
+	data, err := models.TagsToJSON(tags)
+	if err != nil {
+		return fmt.Errorf("failed to serialize tags: %w", err)
+	}
+	return s.repo.SaveDocument(tagRegistryFile, data)
+}
+
+// tagIndex returns the index of a tag in the registry, or -1
+func tagIndex(registry []models.Tag, name string) int {
+	for i := range registry {
+		if registry[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// summarizeTags lists the registered tags and the tags carried by tasks by
+// name, counting the tasks carrying each
+func summarizeTags(registry []models.Tag, tasks []models.Task) []models.TagSummary {
+	byName := make(map[string]*models.TagSummary, len(registry))
+	for _, tag := range registry {
+		byName[tag.Name] = &models.TagSummary{Tag: tag, Registered: true}
+	}
+	for _, task := range tasks {
+		for _, name := range task.Tags {
+			summary, ok := byName[name]
+			if !ok {
+				summary = &models.TagSummary{Tag: models.Tag{Name: name}}
+				byName[name] = summary
+			}
+			summary.TaskCount++
+		}
+	}
+
+	summaries := make([]models.TagSummary, 0, len(byName))
+	for _, summary := range byName {
+		summaries = append(summaries, *summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Name < summaries[j].Name
+	})
+	return summaries
+}
+
+// findTag returns the summary of a tag, or ErrTagNotFound
+func findTag(summaries []models.TagSummary, name string) (*models.TagSummary, error) {
+	for i := range summaries {
+		if summaries[i].Name == name {
+			return &summaries[i], nil
+		}
+	}
+	return nil, ErrTagNotFound
+}
+
+// ListTags returns the registered tags together with the tags tasks carry,
+// ordered by name
+func (s *TaskService) ListTags() ([]models.TagSummary, error) {
+	registry, err := s.loadTags()
+	if err != nil {
+		return nil, err
+	}
+	tasks, err := s.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	return summarizeTags(registry, tasks), nil
+}
+
+// GetTag returns a registered tag or one carried by tasks
+func (s *TaskService) GetTag(name string) (*models.TagSummary, error) {
+	name, err := models.NormalizeTag(name)
+	if err != nil {
+		return nil, err
+	}
+
+	summaries, err := s.ListTags()
+	if err != nil {
+		return nil, err
+	}
+	return findTag(summaries, name)
+}
+
+// CreateTag registers a tag, which tasks may already carry
+func (s *TaskService) CreateTag(formData models.TagFormData) (*models.TagSummary, error) {
+	tag, err := models.NewTag(formData)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.write(func() error {
+		registry, err := s.loadTags()
+		if err != nil {
+			return err
+		}
+		if tagIndex(registry, tag.Name) >= 0 {
+			return fmt.Errorf("%w: %s", ErrTagExists, tag.Name)
+		}
+
+		return s.saveTags(append(registry, *tag))
+	})
+	if err != nil {
+		return nil, tagError("failed to save tag", err)
+	}
+
+	return s.GetTag(tag.Name)
+}
+
+// UpdateTag changes the color or description of a tag, registering it if
+// it is only carried by tasks so far
+func (s *TaskService) UpdateTag(name string, update models.TagUpdate) (*models.TagSummary, error) {
+	name, err := models.NormalizeTag(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.write(func() error {
+		registry, summaries, err := s.loadTagState()
+		if err != nil {
+			return err
+		}
+		if _, err := findTag(summaries, name); err != nil {
+			return err
+		}
+
+		i := tagIndex(registry, name)
+		if i < 0 {
+			now := time.Now().UTC().Format(time.RFC3339)
+			registry = append(registry, models.Tag{Name: name, CreatedAt: now})
+			i = len(registry) - 1
+		}
+		if err := registry[i].Update(update); err != nil {
+			return err
+		}
+
+		return s.saveTags(registry)
+	})
+	if err != nil {
+		return nil, tagError("failed to save tag", err)
+	}
+
+	return s.GetTag(name)
+}
+
+// RenameTag renames a tag in the registry and on every task carrying it.
+// The new name must not exist yet; use MergeTag to combine two tags.
+func (s *TaskService) RenameTag(name, newName string) (*models.TagSummary, error) {
+	name, err := models.NormalizeTag(name)
+	if err != nil {
+		return nil, err
+	}
+	newName, err = models.NormalizeTag(newName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.write(func() error {
+		registry, summaries, err := s.loadTagState()
+		if err != nil {
+			return err
+		}
+		if _, err := findTag(summaries, name); err != nil {
+			return err
+		}
+		if newName == name {
+			return nil
+		}
+		if _, err := findTag(summaries, newName); err == nil {
+			return fmt.Errorf("%w: %s; merge into it instead", ErrTagExists, newName)
+		}
+
+		renamed := append([]models.Tag(nil), registry...)
+		if i := tagIndex(renamed, name); i >= 0 {
+			renamed[i].Name = newName
+			renamed[i].UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		}
+
+		_, err = s.retag(registry, renamed, func(task *models.Task) bool {
+			return task.ReplaceTag(name, newName)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, tagError("failed to rename tag", err)
+	}
+
+	return s.GetTag(newName)
+}
+
+// MergeTag replaces a tag with another existing one on every task and
+// removes it from the registry. If only the merged tag is registered, its
+// entry moves to the tag it is merged into.
+func (s *TaskService) MergeTag(name, into string) (*models.TagSummary, error) {
+	name, err := models.NormalizeTag(name)
+	if err != nil {
+		return nil, err
+	}
+	into, err = models.NormalizeTag(into)
+	if err != nil {
+		return nil, err
+	}
+	if name == into {
+		return nil, errors.New("validation failed: A tag cannot be merged into itself")
+	}
+
+	err = s.write(func() error {
+		registry, summaries, err := s.loadTagState()
+		if err != nil {
+			return err
+		}
+		if _, err := findTag(summaries, name); err != nil {
+			return err
+		}
+		if _, err := findTag(summaries, into); err != nil {
+			return fmt.Errorf("%w: %s", ErrTagNotFound, into)
+		}
+
+		merged := make([]models.Tag, 0, len(registry))
+		for _, tag := range registry {
+			if tag.Name != name {
+				merged = append(merged, tag)
+			} else if tagIndex(registry, into) < 0 {
+				tag.Name = into
+				tag.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+				merged = append(merged, tag)
+			}
+		}
+
+		_, err = s.retag(registry, merged, func(task *models.Task) bool {
+			return task.ReplaceTag(name, into)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, tagError("failed to merge tags", err)
+	}
+
+	return s.GetTag(into)
+}
+
+// DeleteTag removes a tag from the registry and from every task carrying
+// it, and returns how many tasks carried it
+func (s *TaskService) DeleteTag(name string) (int, error) {
+	name, err := models.NormalizeTag(name)
+	if err != nil {
+		return 0, err
+	}
+
+	var changed int
+	err = s.write(func() error {
+		registry, summaries, err := s.loadTagState()
+		if err != nil {
+			return err
+		}
+		if _, err := findTag(summaries, name); err != nil {
+			return err
+		}
+
+		remaining := make([]models.Tag, 0, len(registry))
+		for _, tag := range registry {
+			if tag.Name != name {
+				remaining = append(remaining, tag)
+			}
+		}
+
+		changed, err = s.retag(registry, remaining, func(task *models.Task) bool {
+			return task.RemoveTag(name)
+		})
+		return err
+	})
+	if err != nil {
+		return 0, tagError("failed to delete tag", err)
+	}
+
+	return changed, nil
+}
+
+// loadTagState reads the registry and summarizes it with the tags of all
+// tasks
+func (s *TaskService) loadTagState() ([]models.Tag, []models.TagSummary, error) {
+	registry, err := s.loadTags()
+	if err != nil {
+		return nil, nil, err
+	}
+	tasks, err := s.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, nil, err
+	}
+	return registry, summarizeTags(registry, tasks), nil
+}
+
+// retag applies change to every task and saves the new registry in a
+// single transaction, and returns how many tasks changed
+func (s *TaskService) retag(previous, registry []models.Tag, change func(task *models.Task) bool) (int, error) {
+	var changed int
+	err := s.transactionWithDocument(
+		func() error { return s.saveTags(registry) },
+		func() error { return s.saveTags(previous) },
+		func(tx repository.TaskStore) error {
+			tasks, err := tx.List(repository.TaskFilter{})
+			if err != nil {
+				return err
+			}
+
+			changed = 0
+			for i := range tasks {
+				if !change(&tasks[i]) {
+					continue
+				}
+				tasks[i].Version++
+				if err := tx.Update(tasks[i]); err != nil {
+					return err
+				}
+				changed++
+			}
+			return nil
+		})
+	return changed, err
+}
+
+// tagError wraps unexpected errors of tag changes, passing through the
+// ones the caller is expected to handle
+func tagError(msg string, err error) error {
+	if errors.Is(err, ErrTagNotFound) || errors.Is(err, ErrTagExists) || strings.Contains(err.Error(), "validation failed") {
+		return err
+	}
+	return fmt.Errorf("%s: %w", msg, err)
+}
@@ -3,37 +3,75 @@ package services
 import (
 	"errors"
 	"fmt"
+	"log"
 	"sort"
 	"strings"
+	"sync"
 	"task-api/models"
+	"task-api/repository"
 	"task-api/storage"
+	"time"
 )
 
 // TaskService handles business logic for task operations
 type TaskService struct {
-	storage *storage.EncryptedStorage
+	repo            repository.TaskRepository
+	backupScheduler *BackupScheduler
+	replicator      *storage.Replicator
+	subtasks        SubtaskOptions
+	dependencies    DependencyOptions
+
+	// writes feeds the single writer goroutine that applies every change
+	writes    chan writeRequest
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
-// NewTaskService creates a new task service instance
-func NewTaskService(encryptedStorage *storage.EncryptedStorage) *TaskService {
-	return &TaskService{
-		storage: encryptedStorage,
-	}
+// ErrReplicationDisabled is returned for remote backup operations when no
+// replication target is configured
+var ErrReplicationDisabled = errors.New("backup replication is not configured")
+
+// VersionConflictError is returned when a change is based on a version of a
+// task other than the current one
+type VersionConflictError struct {
+	Current models.Task
 }
 
-// GetAllTasks retrieves all tasks from storage
-func (s *TaskService) GetAllTasks() ([]models.Task, error) {
-	data, err := s.storage.LoadData()
-	if err != nil {
-		return nil, fmt.Errorf("failed to load tasks from storage: %w", err)
-	}
+func (e *VersionConflictError) Error() string {
+	return fmt.Sprintf("task %s was modified: current version is %d", e.Current.ID, e.Current.Version)
+}
 
-	tasks, err := models.TasksFromJSON(data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse tasks from storage: %w", err)
-	}
+// NewTaskService creates a new task service instance and starts its
+// writer, which runs until Close is called
+func NewTaskService(repo repository.TaskRepository) *TaskService {
+	s := &TaskService{
+		repo:     repo,
+		subtasks:     DefaultSubtaskOptions(),
+		dependencies: DefaultDependencyOptions(),
+		writes:       make(chan writeRequest),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	go s.writeLoop()
+	return s
+}
 
-	return tasks, nil
+// SetBackupScheduler registers the backup scheduler whose status is
+// reported with the storage information
+func (s *TaskService) SetBackupScheduler(scheduler *BackupScheduler) {
+	s.backupScheduler = scheduler
+}
+
+// SetReplicator registers the replicator that copies backups offsite, so
+// remote backups can be listed and restored
+func (s *TaskService) SetReplicator(replicator *storage.Replicator) {
+	s.replicator = replicator
+}
+
+// GetAllTasks retrieves all tasks from storage
+func (s *TaskService) GetAllTasks() ([]models.Task, error) {
+	return s.repo.List(repository.TaskFilter{})
 }
 
 // GetTaskByID retrieves a specific task by ID
@@ -42,18 +80,7 @@ func (s *TaskService) GetTaskByID(id string) (*models.Task, error) {
 		return nil, errors.New("task ID cannot be empty")
 	}
 
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	for _, task := range tasks {
-		if task.ID == id {
-			return &task, nil
-		}
-	}
-
-	return nil, errors.New("task not found")
+	return s.repo.Get(id)
 }
 
 // CreateTask creates a new task and saves it to storage
@@ -68,108 +95,142 @@ func (s *TaskService) CreateTask(formData models.TaskFormData) (*models.Task, er
 		return nil, fmt.Errorf("failed to create task: %w", err)
 	}
 
-	// Load existing tasks
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
+	err = s.write(func() error {
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			if err := checkBlockers(tx, newTask.ID, newTask.BlockedBy); err != nil {
+				return err
+			}
 
-	// Check for duplicate IDs (though UUID collision is extremely unlikely)
-	for _, task := range tasks {
-		if task.ID == newTask.ID {
-			return nil, errors.New("task ID already exists")
-		}
-	}
+			if newTask.ParentID == nil {
+				if newTask.ProjectID != nil {
+					projects, err := s.loadProjects()
+					if err != nil {
+						return err
+					}
+					if err := checkProjectTarget(projects, *newTask.ProjectID); err != nil {
+						return err
+					}
+				}
+				return tx.Create(*newTask)
+			}
 
-	// Add new task to list
-	tasks = append(tasks, *newTask)
+			h, err := loadHierarchy(tx)
+			if err != nil {
+				return err
+			}
+			if err := s.checkParent(h, "", *newTask.ParentID); err != nil {
+				return err
+			}
+			newTask.Position = h.nextPosition(*newTask.ParentID)
+
+			// Subtasks are in the project of their parent
+			parent := h.tasks[*newTask.ParentID]
+			if newTask.ProjectID != nil && !parent.InProject(*newTask.ProjectID) {
+				return fmt.Errorf("%w: a subtask is always in the project of its parent", ErrInvalidHierarchy)
+			}
+			newTask.ProjectID = parent.ProjectID
 
-	// Save updated tasks
-	if err := s.saveTasks(tasks); err != nil {
+			if err := tx.Create(*newTask); err != nil {
+				return err
+			}
+			return s.rollUp(tx, *newTask.ParentID)
+		})
+	})
+	if err != nil {
+		if errors.Is(err, ErrInvalidHierarchy) || errors.Is(err, ErrProjectNotFound) || errors.Is(err, ErrProjectArchived) ||
+			errors.Is(err, ErrInvalidDependency) {
+			return nil, err
+		}
 		return nil, fmt.Errorf("failed to save new task: %w", err)
 	}
 
 	return newTask, nil
 }
 
-// UpdateTask updates an existing task
+// UpdateTask updates an existing task. If update.Version is set the update
+// fails with a VersionConflictError unless it is the current version.
 func (s *TaskService) UpdateTask(update models.TaskUpdate) (*models.Task, error) {
 	if strings.TrimSpace(update.ID) == "" {
 		return nil, errors.New("task ID cannot be empty")
 	}
 
-	// Load existing tasks
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	// Find and update the task
-	var updatedTask *models.Task
-	for i, task := range tasks {
-		if task.ID == update.ID {
-			if err := task.Update(update); err != nil {
-				// Don't wrap validation errors with additional context
-				if strings.Contains(err.Error(), "validation failed") {
-					return nil, err
-				}
-				return nil, fmt.Errorf("failed to apply task updates: %w", err)
+	return s.modifyTask(update.ID, update.Version, "failed to save updated task", func(tx repository.TaskStore, task *models.Task) error {
+		wasCompleted := task.Completed
+		if err := task.Update(update); err != nil {
+			// Don't wrap validation errors with additional context
+			if strings.Contains(err.Error(), "validation failed") {
+				return err
 			}
-			tasks[i] = task
-			updatedTask = &tasks[i]
-			break
+			return fmt.Errorf("failed to apply task updates: %w", err)
 		}
-	}
-
-	if updatedTask == nil {
-		return nil, errors.New("task not found")
-	}
-
-	// Save updated tasks
-	if err := s.saveTasks(tasks); err != nil {
-		return nil, fmt.Errorf("failed to save updated task: %w", err)
-	}
 
-	return updatedTask, nil
+		if update.ParentID != nil {
+			if err := s.moveTask(tx, task, strings.TrimSpace(*update.ParentID)); err != nil {
+				return err
+			}
+		}
+		if update.ProjectID != nil {
+			if err := s.assignProject(tx, task, strings.TrimSpace(*update.ProjectID)); err != nil {
+				return err
+			}
+		}
+		if update.BlockedBy != nil {
+			if err := checkBlockers(tx, task.ID, task.BlockedBy); err != nil {
+				return err
+			}
+		}
+		return s.completionChanged(tx, task, wasCompleted)
+	})
 }
 
-// DeleteTask removes a task from storage
+// DeleteTask removes a task and its subtasks from storage, and from the
+// blockers of other tasks
 func (s *TaskService) DeleteTask(id string) error {
 	if strings.TrimSpace(id) == "" {
 		return errors.New("task ID cannot be empty")
 	}
 
-	// Load existing tasks
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return err
-	}
+	// Subtasks are deleted with their parent
+	err := s.write(func() error {
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			task, err := tx.Get(id)
+			if err != nil {
+				return err
+			}
+			h, err := loadHierarchy(tx)
+			if err != nil {
+				return err
+			}
 
-	// Find and remove the task
-	found := false
-	filteredTasks := make([]models.Task, 0, len(tasks))
-	for _, task := range tasks {
-		if task.ID != id {
-			filteredTasks = append(filteredTasks, task)
-		} else {
-			found = true
+			deleted := map[string]bool{id: true}
+			for _, descendant := range h.descendants(id) {
+				if err := tx.Delete(descendant); err != nil {
+					return err
+				}
+				deleted[descendant] = true
+			}
+			if err := tx.Delete(id); err != nil {
+				return err
+			}
+			if err := unblock(tx, deleted); err != nil {
+				return err
+			}
+			return s.rollUp(tx, parentOf(task))
+		})
+	})
+	if err != nil {
+		if errors.Is(err, repository.ErrTaskNotFound) {
+			return err
 		}
-	}
-
-	if !found {
-		return errors.New("task not found")
-	}
-
-	// Save updated tasks
-	if err := s.saveTasks(filteredTasks); err != nil {
 		return fmt.Errorf("failed to save after deleting task: %w", err)
 	}
 
 	return nil
 }
 
-// MoveTaskToQuadrant moves a task to a specific quadrant
-func (s *TaskService) MoveTaskToQuadrant(id string, quadrant models.TaskQuadrant) (*models.Task, error) {
+// MoveTaskToQuadrant moves a task to a specific quadrant, if set only when
+// expectedVersion is the current version
+func (s *TaskService) MoveTaskToQuadrant(id string, quadrant models.TaskQuadrant, expectedVersion *int64) (*models.Task, error) {
 	if strings.TrimSpace(id) == "" {
 		return nil, errors.New("task ID cannot be empty")
 	}
@@ -195,116 +256,63 @@ func (s *TaskService) MoveTaskToQuadrant(id string, quadrant models.TaskQuadrant
 		return nil, errors.New("invalid quadrant")
 	}
 
-	// Load existing tasks
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	// Find and update the task
-	var updatedTask *models.Task
-	for i, task := range tasks {
-		if task.ID == id {
-			task.MoveToQuadrant(quadrant)
-			tasks[i] = task
-			updatedTask = &tasks[i]
-			break
-		}
-	}
-
-	if updatedTask == nil {
-		return nil, errors.New("task not found")
-	}
-
-	// Save updated tasks
-	if err := s.saveTasks(tasks); err != nil {
-		return nil, fmt.Errorf("failed to save task after quadrant move: %w", err)
-	}
-
-	return updatedTask, nil
+	return s.modifyTask(id, expectedVersion, "failed to save task after quadrant move", func(tx repository.TaskStore, task *models.Task) error {
+		task.MoveToQuadrant(quadrant)
+		return nil
+	})
 }
 
-// ToggleTaskCompletion toggles the completion status of a task
-func (s *TaskService) ToggleTaskCompletion(id string) (*models.Task, error) {
+// ToggleTaskCompletion toggles the completion status of a task, if set only
+// when expectedVersion is the current version. Completing an occurrence of
+// a recurring task creates the next one; completing a task with open
+// blockers may fail with a BlockedError.
+func (s *TaskService) ToggleTaskCompletion(id string, expectedVersion *int64) (*models.Task, error) {
 	if strings.TrimSpace(id) == "" {
 		return nil, errors.New("task ID cannot be empty")
 	}
 
-	// Load existing tasks
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	// Find and toggle the task
-	var updatedTask *models.Task
-	for i, task := range tasks {
-		if task.ID == id {
-			task.ToggleCompletion()
-			tasks[i] = task
-			updatedTask = &tasks[i]
-			break
-		}
-	}
-
-	if updatedTask == nil {
-		return nil, errors.New("task not found")
-	}
-
-	// Save updated tasks
-	if err := s.saveTasks(tasks); err != nil {
-		return nil, fmt.Errorf("failed to save task after completion toggle: %w", err)
-	}
-
-	return updatedTask, nil
+	return s.modifyTask(id, expectedVersion, "failed to save task after completion toggle", func(tx repository.TaskStore, task *models.Task) error {
+		wasCompleted := task.Completed
+		task.ToggleCompletion()
+		return s.completionChanged(tx, task, wasCompleted)
+	})
 }
 
-// SetTaskCompletion sets the completion status of a task
-func (s *TaskService) SetTaskCompletion(id string, completed bool) (*models.Task, error) {
+// SetTaskCompletion sets the completion status of a task, if set only when
+// expectedVersion is the current version. Completing an occurrence of a
+// recurring task creates the next one; completing a task with open
+// blockers may fail with a BlockedError.
+func (s *TaskService) SetTaskCompletion(id string, completed bool, expectedVersion *int64) (*models.Task, error) {
 	if strings.TrimSpace(id) == "" {
 		return nil, errors.New("task ID cannot be empty")
 	}
 
-	// Load existing tasks
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	// Find and update the task
-	var updatedTask *models.Task
-	for i, task := range tasks {
-		if task.ID == id {
-			task.SetCompletion(completed)
-			tasks[i] = task
-			updatedTask = &tasks[i]
-			break
+	return s.modifyTask(id, expectedVersion, "failed to save task after completion update", func(tx repository.TaskStore, task *models.Task) error {
+		if task.Completed == completed {
+			return errUnchanged
 		}
-	}
-
-	if updatedTask == nil {
-		return nil, errors.New("task not found")
-	}
-
-	// Save updated tasks
-	if err := s.saveTasks(tasks); err != nil {
-		return nil, fmt.Errorf("failed to save task after completion update: %w", err)
-	}
-
-	return updatedTask, nil
+		wasCompleted := task.Completed
+		task.SetCompletion(completed)
+		return s.completionChanged(tx, task, wasCompleted)
+	})
 }
 
 // ClearAllTasks removes all tasks from storage
 func (s *TaskService) ClearAllTasks() (int, error) {
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return 0, err
-	}
+	var deletedCount int
 
-	deletedCount := len(tasks)
-	
-	// Save empty task list
-	if err := s.saveTasks([]models.Task{}); err != nil {
+	err := s.write(func() error {
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			tasks, err := tx.List(repository.TaskFilter{})
+			if err != nil {
+				return err
+			}
+			deletedCount = len(tasks)
+
+			return tx.ReplaceAll([]models.Task{})
+		})
+	})
+	if err != nil {
 		return 0, fmt.Errorf("failed to clear all tasks: %w", err)
 	}
 
@@ -313,57 +321,31 @@ func (s *TaskService) ClearAllTasks() (int, error) {
 
 // GetTasksByQuadrant retrieves tasks filtered by quadrant
 func (s *TaskService) GetTasksByQuadrant(quadrant models.TaskQuadrant) ([]models.Task, error) {
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	var filteredTasks []models.Task
-	for _, task := range tasks {
-		if task.Quadrant == quadrant {
-			filteredTasks = append(filteredTasks, task)
-		}
-	}
-
-	return filteredTasks, nil
+	return s.repo.List(repository.TaskFilter{Quadrant: &quadrant})
 }
 
 // GetCompletedTasks retrieves all completed tasks
 func (s *TaskService) GetCompletedTasks() ([]models.Task, error) {
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	var completedTasks []models.Task
-	for _, task := range tasks {
-		if task.Completed {
-			completedTasks = append(completedTasks, task)
-		}
-	}
+	completed := true
+	return s.repo.List(repository.TaskFilter{Completed: &completed})
+}
 
-	return completedTasks, nil
+// GetIncompleteTasks retrieves all tasks that are not completed
+func (s *TaskService) GetIncompleteTasks() ([]models.Task, error) {
+	completed := false
+	return s.repo.List(repository.TaskFilter{Completed: &completed})
 }
 
 // GetOverdueTasks retrieves all overdue tasks
 func (s *TaskService) GetOverdueTasks() ([]models.Task, error) {
-	tasks, err := s.GetAllTasks()
-	if err != nil {
-		return nil, err
-	}
-
-	var overdueTasks []models.Task
-	for _, task := range tasks {
-		if task.IsOverdue() {
-			overdueTasks = append(overdueTasks, task)
-		}
-	}
-
-	return overdueTasks, nil
+	completed := false
+	now := time.Now().UTC()
+	return s.repo.List(repository.TaskFilter{Completed: &completed, DueBefore: &now})
 }
 
-// GetTasksSorted retrieves all tasks sorted by priority and creation date
-func (s *TaskService) GetTasksSorted() ([]models.Task, error) {
+// GetTasksSorted retrieves all tasks sorted by priority and creation date,
+// and with OrderTopological after the tasks blocking them
+func (s *TaskService) GetTasksSorted(order TaskOrder) ([]models.Task, error) {
 	tasks, err := s.GetAllTasks()
 	if err != nil {
 		return nil, err
@@ -383,15 +365,33 @@ func (s *TaskService) GetTasksSorted() ([]models.Task, error) {
 		return tasks[i].CreatedAt > tasks[j].CreatedAt
 	})
 
+	if order == OrderTopological {
+		return sortTopologically(tasks), nil
+	}
 	return tasks, nil
 }
 
-// LoadDemoTasks loads demo tasks into storage
+// LoadDemoTasks loads demo tasks into storage, creating the demo projects
+// they belong to unless projects with those names exist
 func (s *TaskService) LoadDemoTasks() ([]models.Task, error) {
-	demoTasks := s.createDemoTasks()
+	var demoTasks []models.Task
 	
 	// Save demo tasks
-	if err := s.saveTasks(demoTasks); err != nil {
+	err := s.write(func() error {
+		projects, err := s.loadProjects()
+		if err != nil {
+			return err
+		}
+		previous := append([]models.Project(nil), projects...)
+		projects, projectIDs := withDemoProjects(projects)
+		demoTasks = s.createDemoTasks(projectIDs)
+		
+		return s.transactionWithDocument(
+			func() error { return s.saveProjects(projects) },
+			func() error { return s.saveProjects(previous) },
+			func(tx repository.TaskStore) error { return tx.ReplaceAll(demoTasks) })
+	})
+	if err != nil {
 		return nil, fmt.Errorf("failed to save demo tasks: %w", err)
 	}
 
@@ -400,40 +400,321 @@ func (s *TaskService) LoadDemoTasks() ([]models.Task, error) {
 
 // CreateBackup creates a backup of current tasks
 func (s *TaskService) CreateBackup() (string, error) {
-	return s.storage.CreateManualBackup()
+	return s.repo.CreateBackup(storage.BackupTriggerManual)
 }
 
 // ListBackups returns a list of available backups
 func (s *TaskService) ListBackups() ([]string, error) {
-	return s.storage.ListBackups()
+	return s.repo.ListBackups()
+}
+
+// DiffBackup compares the current tasks with a backup. The diff describes
+// what restoring the backup would change: added tasks are only in the
+// backup, removed tasks would be lost.
+func (s *TaskService) DiffBackup(backupName string) (*models.TaskDiff, error) {
+	backupTasks, err := s.repo.LoadBackup(backupName)
+	if err != nil {
+		return nil, err
+	}
+
+	currentTasks, err := s.repo.List(repository.TaskFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read current tasks: %w", err)
+	}
+
+	return models.DiffTasks(currentTasks, backupTasks)
 }
 
-// RestoreFromBackup restores tasks from a backup
+// RestoreFromBackup restores tasks from a backup. Restored tasks in
+// projects that were deleted since are taken out of them.
 func (s *TaskService) RestoreFromBackup(backupName string) error {
-	return s.storage.RestoreFromBackup(backupName)
+	return s.write(func() error {
+		projects, err := s.loadProjects()
+		if err != nil {
+			return err
+		}
+		if err := s.repo.RestoreFromBackup(backupName); err != nil {
+			return err
+		}
+
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			cleared, err := clearMissingProjects(tx, projects)
+			if len(cleared) > 0 {
+				log.Printf("Took %d restored tasks out of projects that no longer exist", len(cleared))
+			}
+			return err
+		})
+	})
+}
+
+// ReplicationEnabled reports whether backups are replicated offsite
+func (s *TaskService) ReplicationEnabled() bool {
+	return s.replicator != nil
+}
+
+// ListRemoteBackups returns the backups in the replication target
+func (s *TaskService) ListRemoteBackups() ([]storage.RemoteBackup, error) {
+	if s.replicator == nil {
+		return nil, ErrReplicationDisabled
+	}
+	return s.replicator.ListRemote()
+}
+
+// FetchRemoteBackup downloads a backup from the replication target into the
+// local backups, after which it can be diffed and restored like any other
+func (s *TaskService) FetchRemoteBackup(backupName string) error {
+	if s.replicator == nil {
+		return ErrReplicationDisabled
+	}
+	return s.replicator.Fetch(backupName)
+}
+
+// VerifyBackup checks a backup's manifest and decrypts and validates it
+func (s *TaskService) VerifyBackup(backupName string) (*storage.BackupVerification, error) {
+	return s.repo.VerifyBackup(backupName)
+}
+
+// VerifyAllBackups verifies every backup
+func (s *TaskService) VerifyAllBackups() ([]storage.BackupVerification, error) {
+	return s.repo.VerifyAllBackups()
+}
+
+// RotateEncryptionKey re-encrypts all stored data under the active key
+func (s *TaskService) RotateEncryptionKey() (*storage.KeyRotationReport, error) {
+	var report *storage.KeyRotationReport
+	err := s.write(func() error {
+		var err error
+		report, err = s.repo.RotateEncryptionKey()
+		return err
+	})
+	return report, err
 }
 
 // GetStorageInfo returns information about the storage system
 func (s *TaskService) GetStorageInfo() map[string]interface{} {
-	return s.storage.GetStorageInfo()
+	info := s.repo.Info()
+	if s.backupScheduler != nil {
+		info["backup_schedule"] = s.backupScheduler.Status()
+	} else {
+		info["backup_schedule"] = map[string]interface{}{"schedule": "off"}
+	}
+	if s.replicator != nil {
+		info["replication"] = s.replicator.Status()
+	} else {
+		info["replication"] = map[string]interface{}{"target": "off"}
+	}
+	return info
 }
 
-// saveTasks is a helper method to save tasks to storage
-func (s *TaskService) saveTasks(tasks []models.Task) error {
-	data, err := models.TasksToJSON(tasks)
+// errUnchanged is returned by the fn of modifyTask when the task already is
+// as requested, so it is returned as stored without a new version
+var errUnchanged = errors.New("task unchanged")
+
+// modifyTask loads a task, applies fn and stores the result with the next
+// version in a single transaction on the writer so concurrent modifications
+// cannot interleave. If expectedVersion is set and the task has another
+// version, nothing is changed and a VersionConflictError is returned.
+// Completion is then rolled up to the parents the change affects.
+func (s *TaskService) modifyTask(id string, expectedVersion *int64, saveErrMsg string, fn func(tx repository.TaskStore, task *models.Task) error) (*models.Task, error) {
+	var updatedTask *models.Task
+	var applyErr error
+
+	err := s.write(func() error {
+		return s.repo.Transaction(func(tx repository.TaskStore) error {
+			task, err := tx.Get(id)
+			if err != nil {
+				return err
+			}
+
+			if expectedVersion != nil && *expectedVersion != task.Version {
+				applyErr = &VersionConflictError{Current: *task}
+				return applyErr
+			}
+
+			// fn may change the checklist and recurrence in place, so the
+			// task gets copies of its own and before keeps the stored ones
+			before := *task
+			task.Checklist = append([]models.ChecklistItem(nil), task.Checklist...)
+			if task.Recurrence != nil {
+				recurrence := *task.Recurrence
+				task.Recurrence = &recurrence
+			}
+			if err := fn(tx, task); err != nil {
+				if errors.Is(err, errUnchanged) {
+					updatedTask = &before
+				}
+				applyErr = err
+				return err
+			}
+			task.Version++
+
+			if err := tx.Update(*task); err != nil {
+				return err
+			}
+
+			if err := s.rollUpChange(tx, &before, task); err != nil {
+				return err
+			}
+
+			// Rolling up may have completed or reopened the task itself
+			updatedTask, err = tx.Get(id)
+			return err
+		})
+	})
+
+	if errors.Is(err, errUnchanged) {
+		return updatedTask, nil
+	}
 	if err != nil {
-		return fmt.Errorf("failed to serialize tasks: %w", err)
+		if applyErr != nil || errors.Is(err, repository.ErrTaskNotFound) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", saveErrMsg, err)
+	}
+
+	return updatedTask, nil
+}
+
+// transactionWithDocument runs fn in a transaction and then saves a
+// document such as the tag registry, so the tasks and the document change
+// together: the tasks are rolled back if saving fails, and the document is
+// restored if the tasks fail to commit after it was saved
+func (s *TaskService) transactionWithDocument(save, restore func() error, fn func(tx repository.TaskStore) error) error {
+	saved := false
+	err := s.repo.Transaction(func(tx repository.TaskStore) error {
+		if err := fn(tx); err != nil {
+			return err
+		}
+		if err := save(); err != nil {
+			return err
+		}
+		saved = true
+		return nil
+	})
+
+	if err != nil && saved {
+		if restoreErr := restore(); restoreErr != nil {
+			log.Printf("Warning: failed to restore document after a failed transaction: %v", restoreErr)
+		}
 	}
+	return err
+}
 
-	if err := s.storage.SaveData(data); err != nil {
-		return fmt.Errorf("failed to save tasks to storage: %w", err)
+// completionChanged enforces the dependency rule on a task that may just
+// have been completed and creates the next occurrence if it recurs
+func (s *TaskService) completionChanged(tx repository.TaskStore, task *models.Task, wasCompleted bool) error {
+	if err := s.checkUnblocked(tx, task, wasCompleted); err != nil {
+		return err
+	}
+	return s.spawnNextOccurrence(tx, task, wasCompleted)
+}
+
+// rollUpChange rolls completion up from a changed task: to the task itself
+// if its checklist progress changed, and to its old and new parent if it
+// moved or its completion changed
+func (s *TaskService) rollUpChange(tx repository.TaskStore, before, after *models.Task) error {
+	if checklistProgress(before) != checklistProgress(after) {
+		if err := s.rollUp(tx, after.ID); err != nil {
+			return err
+		}
 	}
 
+	oldParent, newParent := parentOf(before), parentOf(after)
+	if oldParent != newParent {
+		if err := s.rollUp(tx, oldParent); err != nil {
+			return err
+		}
+		return s.rollUp(tx, newParent)
+	}
+	if before.Completed != after.Completed {
+		return s.rollUp(tx, newParent)
+	}
 	return nil
 }
 
-// createDemoTasks creates a set of demo tasks for testing
-func (s *TaskService) createDemoTasks() []models.Task {
+// moveTask makes a task a subtask of parentID, or a top-level task if it is
+// empty, placing it after the existing subtasks
+func (s *TaskService) moveTask(tx repository.TaskStore, task *models.Task, parentID string) error {
+	if parentID == parentOf(task) {
+		return nil
+	}
+	if parentID == "" {
+		task.ParentID = nil
+		task.Position = 0
+		return nil
+	}
+
+	h, err := loadHierarchy(tx)
+	if err != nil {
+		return err
+	}
+	if err := s.checkParent(h, task.ID, parentID); err != nil {
+		return err
+	}
+
+	task.ParentID = &parentID
+	task.Position = h.nextPosition(parentID)
+
+	// The task and its subtasks join the project of the new parent
+	parent := h.tasks[parentID]
+	task.ProjectID = parent.ProjectID
+	projectID := ""
+	if parent.ProjectID != nil {
+		projectID = *parent.ProjectID
+	}
+	return moveDescendantsToProject(tx, h, task.ID, projectID)
+}
+
+// demoProjects are the projects that keep unrelated demo tasks apart
+var demoProjects = []models.ProjectFormData{
+	{Name: "Engineering", Description: stringPtr("Product and security work"), Color: stringPtr("#1e90ff")},
+	{Name: "Team Management", Description: stringPtr("Planning and team administration"), Color: stringPtr("#f5a623")},
+	{Name: "Personal", Description: stringPtr("Things outside of work"), Color: stringPtr("#7ed321")},
+}
+
+// stringPtr returns a pointer to a copy of s
+func stringPtr(s string) *string {
+	return &s
+}
+
+// nextWeekday returns the first time after now on the given weekday at the
+// given hour
+func nextWeekday(now time.Time, weekday time.Weekday, hour int) time.Time {
+	days := (int(weekday) - int(now.Weekday()) + 7) % 7
+	next := time.Date(now.Year(), now.Month(), now.Day()+days, hour, 0, 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next
+}
+
+// withDemoProjects adds the demo projects that are missing by name and
+// returns the projects with the IDs of the demo projects by name
+func withDemoProjects(projects []models.Project) ([]models.Project, map[string]string) {
+	ids := make(map[string]string, len(demoProjects))
+	for _, formData := range demoProjects {
+		for _, project := range projects {
+			if strings.EqualFold(project.Name, formData.Name) {
+				ids[formData.Name] = project.ID
+				break
+			}
+		}
+		if _, ok := ids[formData.Name]; ok {
+			continue
+		}
+
+		project, err := models.NewProject(formData)
+		if err == nil {
+			projects = append(projects, *project)
+			ids[formData.Name] = project.ID
+		}
+	}
+	return projects, ids
+}
+
+// createDemoTasks creates a set of demo tasks for testing, in the projects
+// with the given IDs by name
+func (s *TaskService) createDemoTasks(projectIDs map[string]string) []models.Task {
 	var demoTasks []models.Task
 	
 	// Sample tasks for different quadrants
@@ -443,22 +724,33 @@ func (s *TaskService) createDemoTasks() []models.Task {
 		quadrant    models.TaskQuadrant
 		urgent      bool
 		important   bool
+		project     string
+		recurrence  string
 	}{
-		{"Fix critical security vulnerability", "Patch the authentication system", models.QuadrantDo, true, true},
-		{"Plan quarterly goals", "Set objectives for next quarter", models.QuadrantSchedule, false, true},
-		{"Review and approve timesheets", "Process team timesheets for payroll", models.QuadrantDelegate, true, false},
-		{"Organize desk drawer", "Clean up cluttered workspace", models.QuadrantDelete, false, false},
-		{"Review project proposal", "Evaluate new client project requirements", models.QuadrantUnassigned, false, true},
+		{"Fix critical security vulnerability", "Patch the authentication system", models.QuadrantDo, true, true, "Engineering", ""},
+		{"Plan quarterly goals", "Set objectives for next quarter", models.QuadrantSchedule, false, true, "Team Management", ""},
+		{"Review and approve timesheets", "Process team timesheets for payroll", models.QuadrantDelegate, true, false, "Team Management", "FREQ=WEEKLY;INTERVAL=2;BYDAY=FR"},
+		{"Organize desk drawer", "Clean up cluttered workspace", models.QuadrantDelete, false, false, "Personal", ""},
+		{"Review project proposal", "Evaluate new client project requirements", models.QuadrantUnassigned, false, true, "Engineering", ""},
 	}
 
 	for _, data := range taskData {
 		desc := &data.description
-		task, err := models.NewTask(models.TaskFormData{
+		formData := models.TaskFormData{
 			Title:       data.title,
 			Description: desc,
 			Urgent:      data.urgent,
 			Important:   data.important,
-		})
+			ProjectID:   projectPtr(projectIDs[data.project]),
+		}
+		
+		// Recurring demo tasks are first due next Friday at 17:00 UTC
+		if data.recurrence != "" {
+			formData.DueDate = stringPtr(nextWeekday(time.Now().UTC(), time.Friday, 17).Format(time.RFC3339))
+			formData.Recurrence = &models.RecurrenceFormData{Rule: data.recurrence}
+		}
+		
+		task, err := models.NewTask(formData)
 		
 		if err == nil {
 			task.MoveToQuadrant(data.quadrant)
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrServiceClosed is returned for changes submitted after Close
+var ErrServiceClosed = errors.New("task service is closed")
+
+// writeRequest is a change waiting for the writer. done receives the error
+// of fn, or the value it panicked with.
+type writeRequest struct {
+	fn   func() error
+	done chan writeResult
+}
+
+type writeResult struct {
+	err      error
+	panicked bool
+	panicVal interface{}
+}
+
+// write runs fn on the writer goroutine and waits for it. Every change of
+// the service goes through here, so changes are applied one at a time in the
+// order they arrive, and the steps of a change spanning several repository
+// calls cannot interleave with another change. Reads do not go through the
+// writer and are only ordered by the repository's own locking.
+func (s *TaskService) write(fn func() error) error {
+	req := writeRequest{fn: fn, done: make(chan writeResult, 1)}
+
+	select {
+	case s.writes <- req:
+	case <-s.stop:
+		return ErrServiceClosed
+	}
+
+	result := <-req.done
+	if result.panicked {
+		panic(result.panicVal)
+	}
+	return result.err
+}
+
+// writeLoop applies submitted changes until Close is called
+func (s *TaskService) writeLoop() {
+	defer close(s.done)
+
+	for {
+		select {
+		case req := <-s.writes:
+			req.done <- runWrite(req.fn)
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// runWrite calls fn, catching a panic so it is raised again in the
+// goroutine that submitted the change instead of killing the writer
+func runWrite(fn func() error) (result writeResult) {
+	defer func() {
+		if r := recover(); r != nil {
+			result = writeResult{err: fmt.Errorf("panic: %v", r), panicked: true, panicVal: r}
+		}
+	}()
+
+	return writeResult{err: fn()}
+}
+
+// Close stops the writer after the change it is applying, if any. Changes
+// submitted afterwards fail with ErrServiceClosed.
+func (s *TaskService) Close() {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+}
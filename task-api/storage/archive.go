@@ -0,0 +1,525 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+const (
+	// ArchiveFormat identifies export archives
+	ArchiveFormat = "task-api-archive"
+
+	// ArchiveVersion is the archive layout written by ArchiveWriter
+	ArchiveVersion = 1
+
+	// MinArchivePassphraseLength is the shortest accepted archive passphrase
+	MinArchivePassphraseLength = 12
+
+	// MaxArchiveSize bounds the size of an archive accepted for import, both
+	// compressed and uncompressed
+	MaxArchiveSize = 256 << 20
+
+	archiveHeaderEntry   = "archive.json"
+	archiveManifestEntry = "manifest.json.enc"
+	archiveTasksEntry    = "tasks.json.enc"
+	archiveBackupDir     = "backups/"
+	archiveDocumentDir   = "documents/"
+
+	// maxArchiveArgon2MemoryKiB keeps an uploaded archive from making the
+	// server allocate more than this to derive its key
+	maxArchiveArgon2MemoryKiB = 256 * 1024
+)
+
+// ArchiveKDF describes how the archive key is derived from the passphrase
+type ArchiveKDF struct {
+	Algorithm  string `json:"algorithm"`
+	Iterations uint32 `json:"iterations"`
+	MemoryKiB  uint32 `json:"memory_kib,omitempty"`
+	Threads    uint8  `json:"threads,omitempty"`
+	Salt       []byte `json:"salt"`
+}
+
+// archiveHeader is the plain text archive.json entry
+type archiveHeader struct {
+	Format    string     `json:"format"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	KDF       ArchiveKDF `json:"kdf"`
+}
+
+// ArchiveEntry describes the tasks or document stored in one archive entry
+type ArchiveEntry struct {
+	Name      string `json:"name"`
+	Size      int    `json:"size"`
+	SHA256    string `json:"sha256"`
+	TaskCount int    `json:"task_count,omitempty"`
+}
+
+// ArchiveManifest lists the contents of an archive
+type ArchiveManifest struct {
+	Format    string         `json:"format"`
+	Version   int            `json:"version"`
+	CreatedAt time.Time      `json:"created_at"`
+	Tasks     ArchiveEntry   `json:"tasks"`
+	Backups   []ArchiveEntry `json:"backups"`
+	Documents []ArchiveEntry `json:"documents"`
+}
+
+// ArchiveBackup is a backup read from an archive
+type ArchiveBackup struct {
+	Name string
+	Data []byte
+}
+
+// Archive is the validated, decrypted content of an archive. Documents
+// maps document names to their content.
+type Archive struct {
+	Manifest  ArchiveManifest
+	Tasks     []byte
+	Backups   []ArchiveBackup
+	Documents map[string][]byte
+}
+
+// ValidateArchivePassphrase checks that a passphrase is long enough
+func ValidateArchivePassphrase(passphrase string) error {
+	if len(passphrase) < MinArchivePassphraseLength {
+		return fmt.Errorf("archive passphrase must be at least %d characters long", MinArchivePassphraseLength)
+	}
+	return nil
+}
+
+// kdfParams converts the description to KDF parameters, rejecting
+// parameters that are out of bounds for an uploaded archive
+func (k ArchiveKDF) kdfParams() (KDFParams, error) {
+	algorithm, err := ParseKDFAlgorithm(k.Algorithm)
+	if err != nil {
+		return KDFParams{}, err
+	}
+	params := KDFParams{Algorithm: algorithm, Iterations: k.Iterations, MemoryKiB: k.MemoryKiB, Threads: k.Threads}
+	if err := params.Validate(); err != nil {
+		return KDFParams{}, err
+	}
+	if algorithm == KDFArgon2id && params.MemoryKiB > maxArchiveArgon2MemoryKiB {
+		return KDFParams{}, fmt.Errorf("Argon2id memory must be at most %d KiB", maxArchiveArgon2MemoryKiB)
+	}
+	if len(k.Salt) != SaltSize {
+		return KDFParams{}, errors.New("bad salt size")
+	}
+	return params, nil
+}
+
+// archiveCipher derives the archive key from the passphrase
+func archiveCipher(passphrase string, params KDFParams, salt []byte) (*RecordCipher, error) {
+	key := params.deriveKey(passphrase, salt)
+	defer SecureWipe(key)
+
+	return NewRecordCipherFromKey(key)
+}
+
+// archiveAdditionalData binds a sealed entry to its name
+func archiveAdditionalData(name string) []byte {
+	return []byte(fmt.Sprintf("%s/v%d/%s", ArchiveFormat, ArchiveVersion, name))
+}
+
+// ArchiveWriter streams an archive to a writer. An archive is a tar.gz that
+// moves tasks, the documents that go with them such as the project list
+// and, optionally, their backup history between servers. It is
+// encrypted with a passphrase instead of the server's master key, so any
+// server can import it given the passphrase:
+//
+//	archive.json         format, version and KDF parameters, in plain text
+//	tasks.json.enc       the tasks
+//	documents/<name>     each document
+//	backups/<backup>     the tasks of each backup
+//	manifest.json.enc    sizes, hashes and task counts of the entries above
+//
+// Every .enc entry, document and backup is sealed with AES-256-GCM under a key derived
+// from the passphrase, with the entry's name as additional data so entries
+// cannot be swapped. The manifest is written last, so an archive can be
+// streamed without holding it in memory, and lists every entry, so entries
+// cannot be dropped either.
+//
+// Add the tasks and any documents and backups, then call Close to write the manifest.
+type ArchiveWriter struct {
+	gz       *gzip.Writer
+	tw       *tar.Writer
+	cipher   *RecordCipher
+	manifest ArchiveManifest
+	hasTasks bool
+	entries  map[string]bool
+}
+
+// NewArchiveWriter starts an archive encrypted with the passphrase
+func NewArchiveWriter(w io.Writer, passphrase string) (*ArchiveWriter, error) {
+	if err := ValidateArchivePassphrase(passphrase); err != nil {
+		return nil, err
+	}
+
+	salt, err := NewSalt()
+	if err != nil {
+		return nil, err
+	}
+	params := DefaultArgon2idParams()
+	cipher, err := archiveCipher(passphrase, params, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Now().UTC()
+	header, err := json.MarshalIndent(archiveHeader{
+		Format:    ArchiveFormat,
+		Version:   ArchiveVersion,
+		CreatedAt: createdAt,
+		KDF: ArchiveKDF{
+			Algorithm:  "argon2id",
+			Iterations: params.Iterations,
+			MemoryKiB:  params.MemoryKiB,
+			Threads:    params.Threads,
+			Salt:       salt,
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	gz := gzip.NewWriter(w)
+	aw := &ArchiveWriter{
+		gz:     gz,
+		tw:     tar.NewWriter(gz),
+		cipher: cipher,
+		manifest: ArchiveManifest{
+			Format:    ArchiveFormat,
+			Version:   ArchiveVersion,
+			CreatedAt: createdAt,
+			Backups:   []ArchiveEntry{},
+			Documents: []ArchiveEntry{},
+		},
+		entries: make(map[string]bool),
+	}
+
+	if err := aw.writeEntry(archiveHeaderEntry, header); err != nil {
+		return nil, err
+	}
+	return aw, nil
+}
+
+// writeEntry adds a file to the tar stream
+func (aw *ArchiveWriter) writeEntry(name string, data []byte) error {
+	if err := aw.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		ModTime:  aw.manifest.CreatedAt,
+	}); err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %w", name, err)
+	}
+	if _, err := aw.tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive entry %s: %w", name, err)
+	}
+	return nil
+}
+
+// addSealed seals a JSON task list and adds it, returning its description
+func (aw *ArchiveWriter) addSealed(name string, data []byte) (ArchiveEntry, error) {
+	count, err := countTasks(data)
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+
+	entry, err := aw.addSealedData(name, data)
+	entry.TaskCount = count
+	return entry, err
+}
+
+// addSealedData seals any data and adds it, returning its description
+func (aw *ArchiveWriter) addSealedData(name string, data []byte) (ArchiveEntry, error) {
+	if aw.entries[name] {
+		return ArchiveEntry{}, fmt.Errorf("archive already contains %s", name)
+	}
+
+	sealed, err := aw.cipher.Seal(data, archiveAdditionalData(name))
+	if err != nil {
+		return ArchiveEntry{}, err
+	}
+	if err := aw.writeEntry(name, sealed); err != nil {
+		return ArchiveEntry{}, err
+	}
+	aw.entries[name] = true
+
+	sum := sha256.Sum256(data)
+	return ArchiveEntry{
+		Name:   name,
+		Size:   len(data),
+		SHA256: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+// AddTasks adds the current tasks as a JSON task list
+func (aw *ArchiveWriter) AddTasks(data []byte) error {
+	entry, err := aw.addSealed(archiveTasksEntry, data)
+	if err != nil {
+		return err
+	}
+	aw.manifest.Tasks = entry
+	aw.hasTasks = true
+	return nil
+}
+
+// AddBackup adds the decrypted tasks of a backup
+func (aw *ArchiveWriter) AddBackup(backupName string, data []byte) error {
+	if err := validateBackupName(backupName); err != nil {
+		return err
+	}
+
+	entry, err := aw.addSealed(archiveBackupDir+backupName, data)
+	if err != nil {
+		return err
+	}
+	aw.manifest.Backups = append(aw.manifest.Backups, entry)
+	return nil
+}
+
+// AddDocument adds a document under its name in the data directory. Its
+// content is not checked; that is up to whoever imports it.
+func (aw *ArchiveWriter) AddDocument(name string, data []byte) error {
+	if err := validateArchiveDocumentName(name); err != nil {
+		return err
+	}
+
+	entry, err := aw.addSealedData(archiveDocumentDir+name, data)
+	if err != nil {
+		return err
+	}
+	aw.manifest.Documents = append(aw.manifest.Documents, entry)
+	return nil
+}
+
+// validateArchiveDocumentName accepts the names of documents in the data
+// directory
+func validateArchiveDocumentName(name string) error {
+	if name == "" || path.Base(name) != name || strings.HasPrefix(name, ".") || path.Ext(name) != ".enc" {
+		return fmt.Errorf("invalid document name %q", name)
+	}
+	return nil
+}
+
+// Close writes the manifest and finishes the archive. It does not close
+// the underlying writer.
+func (aw *ArchiveWriter) Close() error {
+	if !aw.hasTasks {
+		return errors.New("archive has no tasks")
+	}
+
+	manifest, err := json.Marshal(aw.manifest)
+	if err != nil {
+		return err
+	}
+	sealed, err := aw.cipher.Seal(manifest, archiveAdditionalData(archiveManifestEntry))
+	if err != nil {
+		return err
+	}
+	if err := aw.writeEntry(archiveManifestEntry, sealed); err != nil {
+		return err
+	}
+
+	if err := aw.tw.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	if err := aw.gz.Close(); err != nil {
+		return fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return nil
+}
+
+// ReadArchive reads, decrypts and checks an archive against its manifest.
+// validate checks the tasks of every entry. All errors start with
+// "invalid archive".
+func ReadArchive(r io.Reader, passphrase string, validate BackupValidator) (*Archive, error) {
+	archive, err := readArchive(r, passphrase, validate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid archive: %w", err)
+	}
+	return archive, nil
+}
+
+func readArchive(r io.Reader, passphrase string, validate BackupValidator) (*Archive, error) {
+	entries, err := readArchiveEntries(r)
+	if err != nil {
+		return nil, err
+	}
+
+	rawHeader, ok := entries[archiveHeaderEntry]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", archiveHeaderEntry)
+	}
+	var header archiveHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil {
+		return nil, fmt.Errorf("bad %s: %w", archiveHeaderEntry, err)
+	}
+	if header.Format != ArchiveFormat {
+		return nil, fmt.Errorf("unknown format %q", header.Format)
+	}
+	if header.Version != ArchiveVersion {
+		return nil, fmt.Errorf("unsupported version %d", header.Version)
+	}
+	params, err := header.KDF.kdfParams()
+	if err != nil {
+		return nil, fmt.Errorf("bad key derivation parameters: %w", err)
+	}
+
+	sealedManifest, ok := entries[archiveManifestEntry]
+	if !ok {
+		return nil, fmt.Errorf("missing %s", archiveManifestEntry)
+	}
+
+	cipher, err := archiveCipher(passphrase, params, header.KDF.Salt)
+	if err != nil {
+		return nil, err
+	}
+	rawManifest, err := cipher.Open(sealedManifest, archiveAdditionalData(archiveManifestEntry))
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted manifest")
+	}
+
+	var manifest ArchiveManifest
+	if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+		return nil, fmt.Errorf("bad manifest: %w", err)
+	}
+	if manifest.Tasks.Name != archiveTasksEntry {
+		return nil, errors.New("manifest does not list the tasks")
+	}
+
+	archive := &Archive{Manifest: manifest, Documents: make(map[string][]byte)}
+	listed := map[string]bool{archiveHeaderEntry: true, archiveManifestEntry: true}
+
+	openData := func(entry ArchiveEntry) ([]byte, error) {
+		if listed[entry.Name] {
+			return nil, fmt.Errorf("manifest lists %s twice", entry.Name)
+		}
+		listed[entry.Name] = true
+
+		sealed, ok := entries[entry.Name]
+		if !ok {
+			return nil, fmt.Errorf("missing %s", entry.Name)
+		}
+		data, err := cipher.Open(sealed, archiveAdditionalData(entry.Name))
+		if err != nil {
+			return nil, fmt.Errorf("%s is corrupted", entry.Name)
+		}
+
+		sum := sha256.Sum256(data)
+		if len(data) != entry.Size || hex.EncodeToString(sum[:]) != entry.SHA256 {
+			return nil, fmt.Errorf("%s does not match the manifest", entry.Name)
+		}
+		return data, nil
+	}
+	open := func(entry ArchiveEntry) ([]byte, error) {
+		data, err := openData(entry)
+		if err != nil {
+			return nil, err
+		}
+		count, err := validate(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s contains invalid tasks: %w", entry.Name, err)
+		}
+		if count != entry.TaskCount {
+			return nil, fmt.Errorf("%s has %d tasks, manifest records %d", entry.Name, count, entry.TaskCount)
+		}
+		return data, nil
+	}
+
+	if archive.Tasks, err = open(manifest.Tasks); err != nil {
+		return nil, err
+	}
+
+	for _, entry := range manifest.Backups {
+		backupName := strings.TrimPrefix(entry.Name, archiveBackupDir)
+		if backupName == entry.Name || validateBackupName(backupName) != nil {
+			return nil, fmt.Errorf("bad backup entry %q", entry.Name)
+		}
+		data, err := open(entry)
+		if err != nil {
+			return nil, err
+		}
+		archive.Backups = append(archive.Backups, ArchiveBackup{Name: backupName, Data: data})
+	}
+
+	for _, entry := range manifest.Documents {
+		name := strings.TrimPrefix(entry.Name, archiveDocumentDir)
+		if name == entry.Name || validateArchiveDocumentName(name) != nil {
+			return nil, fmt.Errorf("bad document entry %q", entry.Name)
+		}
+		data, err := openData(entry)
+		if err != nil {
+			return nil, err
+		}
+		archive.Documents[name] = data
+	}
+
+	for name := range entries {
+		if !listed[name] {
+			return nil, fmt.Errorf("%s is not listed in the manifest", name)
+		}
+	}
+
+	return archive, nil
+}
+
+// readArchiveEntries reads every regular file of a tar.gz into memory,
+// reading at most MaxArchiveSize bytes after decompression
+func readArchiveEntries(r io.Reader) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a gzip file: %w", err)
+	}
+	defer gz.Close()
+
+	limited := &io.LimitedReader{R: gz, N: MaxArchiveSize + 1}
+	tr := tar.NewReader(limited)
+
+	entries := make(map[string][]byte)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if limited.N <= 0 {
+				return nil, fmt.Errorf("archive exceeds %d bytes", MaxArchiveSize)
+			}
+			return nil, fmt.Errorf("bad tar stream: %w", err)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %q", header.Name)
+		}
+		if path.Clean(header.Name) != header.Name || strings.HasPrefix(header.Name, "/") {
+			return nil, fmt.Errorf("bad entry name %q", header.Name)
+		}
+		if _, ok := entries[header.Name]; ok {
+			return nil, fmt.Errorf("duplicate entry %q", header.Name)
+		}
+
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, tr); err != nil {
+			if limited.N <= 0 {
+				return nil, fmt.Errorf("archive exceeds %d bytes", MaxArchiveSize)
+			}
+			return nil, fmt.Errorf("bad tar stream: %w", err)
+		}
+		entries[header.Name] = buf.Bytes()
+	}
+
+	return entries, nil
+}
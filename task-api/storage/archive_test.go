@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+)
+
+const (
+	testArchivePassphrase = "correct horse battery"
+	testArchiveTasks      = `[{"id":"a"},{"id":"b"}]`
+	testArchiveBackup     = "tasks_backup_20240315_120000_000.enc"
+	testArchiveBackupData = `[{"id":"a"}]`
+)
+
+// testArchiveDocuments are the documents written to the test archive
+var testArchiveDocuments = map[string]string{
+	"projects.enc": `[{"id":"p"}]`,
+	"tags.enc":     `[{"name":"home"}]`,
+}
+
+// writeTestArchive writes an archive with tasks, one backup and the test
+// documents
+func writeTestArchive(t *testing.T) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	aw, err := NewArchiveWriter(&buf, testArchivePassphrase)
+	if err != nil {
+		t.Fatalf("NewArchiveWriter: %v", err)
+	}
+	if err := aw.AddTasks([]byte(testArchiveTasks)); err != nil {
+		t.Fatalf("AddTasks: %v", err)
+	}
+	if err := aw.AddBackup(testArchiveBackup, []byte(testArchiveBackupData)); err != nil {
+		t.Fatalf("AddBackup: %v", err)
+	}
+	for _, name := range []string{"projects.enc", "tags.enc"} {
+		if err := aw.AddDocument(name, []byte(testArchiveDocuments[name])); err != nil {
+			t.Fatalf("AddDocument(%s): %v", name, err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// rewriteArchive changes the entries of an archive as a tar.gz, without
+// touching their encryption
+func rewriteArchive(t *testing.T, data []byte, modify func(entries map[string][]byte)) []byte {
+	t.Helper()
+
+	entries, err := readArchiveEntries(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("readArchiveEntries: %v", err)
+	}
+	modify(entries)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range entries {
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0600, Size: int64(len(content))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	archive, err := ReadArchive(bytes.NewReader(writeTestArchive(t)), testArchivePassphrase, countTasks)
+	if err != nil {
+		t.Fatalf("ReadArchive: %v", err)
+	}
+
+	if string(archive.Tasks) != testArchiveTasks || archive.Manifest.Tasks.TaskCount != 2 {
+		t.Errorf("got tasks %s (%d in the manifest)", archive.Tasks, archive.Manifest.Tasks.TaskCount)
+	}
+	if len(archive.Backups) != 1 || archive.Backups[0].Name != testArchiveBackup || string(archive.Backups[0].Data) != testArchiveBackupData {
+		t.Errorf("got backups %+v", archive.Backups)
+	}
+	if len(archive.Documents) != len(testArchiveDocuments) {
+		t.Errorf("got %d documents, want %d", len(archive.Documents), len(testArchiveDocuments))
+	}
+	for name, want := range testArchiveDocuments {
+		if got := string(archive.Documents[name]); got != want {
+			t.Errorf("document %s: got %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReadArchiveRejectsTampering(t *testing.T) {
+	original := writeTestArchive(t)
+	backupEntry := archiveBackupDir + testArchiveBackup
+
+	tests := []struct {
+		name   string
+		modify func(entries map[string][]byte)
+		want   string
+	}{
+		{
+			name:   "flipped bit",
+			modify: func(entries map[string][]byte) { entries[archiveTasksEntry][len(entries[archiveTasksEntry])-1] ^= 1 },
+			want:   "tasks.json.enc is corrupted",
+		},
+		{
+			name: "swapped documents",
+			modify: func(entries map[string][]byte) {
+				projects, tags := archiveDocumentDir+"projects.enc", archiveDocumentDir+"tags.enc"
+				entries[projects], entries[tags] = entries[tags], entries[projects]
+			},
+			want: "documents/projects.enc is corrupted",
+		},
+		{
+			name:   "backup in place of the tasks",
+			modify: func(entries map[string][]byte) { entries[archiveTasksEntry] = entries[backupEntry] },
+			want:   "tasks.json.enc is corrupted",
+		},
+		{
+			name:   "missing manifest",
+			modify: func(entries map[string][]byte) { delete(entries, archiveManifestEntry) },
+			want:   "missing manifest.json.enc",
+		},
+		{
+			name:   "tampered manifest",
+			modify: func(entries map[string][]byte) { entries[archiveManifestEntry][0] ^= 1 },
+			want:   "wrong passphrase or corrupted manifest",
+		},
+		{
+			name:   "missing header",
+			modify: func(entries map[string][]byte) { delete(entries, archiveHeaderEntry) },
+			want:   "missing archive.json",
+		},
+		{
+			name:   "dropped backup",
+			modify: func(entries map[string][]byte) { delete(entries, backupEntry) },
+			want:   "missing " + backupEntry,
+		},
+		{
+			name:   "unlisted entry",
+			modify: func(entries map[string][]byte) { entries[archiveDocumentDir+"extra.enc"] = entries[backupEntry] },
+			want:   "documents/extra.enc is not listed in the manifest",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := rewriteArchive(t, original, tc.modify)
+
+			_, err := ReadArchive(bytes.NewReader(data), testArchivePassphrase, countTasks)
+			if err == nil || !strings.HasPrefix(err.Error(), "invalid archive: ") || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("got %v, want an invalid archive error about %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadArchiveWrongPassphrase(t *testing.T) {
+	_, err := ReadArchive(bytes.NewReader(writeTestArchive(t)), "wrong horse battery", countTasks)
+	if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Errorf("got %v, want a wrong passphrase error", err)
+	}
+}
+
+func TestArchiveWriterRejectsInvalidInput(t *testing.T) {
+	if _, err := NewArchiveWriter(&bytes.Buffer{}, "too short"); err == nil {
+		t.Error("NewArchiveWriter accepted a short passphrase")
+	}
+
+	aw, err := NewArchiveWriter(&bytes.Buffer{}, testArchivePassphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err == nil {
+		t.Error("Close accepted an archive without tasks")
+	}
+	if err := aw.AddTasks([]byte(`{"id":"a"}`)); err == nil {
+		t.Error("AddTasks accepted data that is not a task list")
+	}
+	if err := aw.AddBackup("../"+testArchiveBackup, []byte(testArchiveBackupData)); err == nil {
+		t.Error("AddBackup accepted a path")
+	}
+	if err := aw.AddBackup(testArchiveBackup, []byte(testArchiveBackupData)); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.AddBackup(testArchiveBackup, []byte(testArchiveBackupData)); err == nil {
+		t.Error("AddBackup accepted the same backup twice")
+	}
+	for _, name := range []string{"", ".hidden.enc", "sub/projects.enc", "projects.json"} {
+		if err := aw.AddDocument(name, []byte("{}")); err == nil {
+			t.Errorf("AddDocument accepted %q", name)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// BackupManifestKeyFile holds the wrapped key that signs backup
+	// manifests in the data directory
+	BackupManifestKeyFile = "manifest.key"
+
+	// backupManifestSuffix is appended to a backup's name for its manifest
+	backupManifestSuffix = ".manifest.json"
+
+	backupManifestVersion = 1
+)
+
+// BackupTrigger records why a backup was taken
+type BackupTrigger string
+
+const (
+	// BackupTriggerAuto is a backup taken before the data file is replaced
+	BackupTriggerAuto BackupTrigger = "auto"
+
+	// BackupTriggerManual is a backup requested through the API
+	BackupTriggerManual BackupTrigger = "manual"
+
+	// BackupTriggerPreRestore is a backup of the current data taken before
+	// a restore overwrites it
+	BackupTriggerPreRestore BackupTrigger = "pre-restore"
+
+	// BackupTriggerScheduled is a backup taken by the backup scheduler
+	BackupTriggerScheduled BackupTrigger = "scheduled"
+
+	// BackupTriggerImport is a backup brought over in an imported archive
+	BackupTriggerImport BackupTrigger = "import"
+)
+
+// BackupManifest describes a backup file. It is stored next to the backup
+// and signed with an HMAC key that is wrapped like a data key, so only
+// someone holding the master key can produce a manifest that verifies.
+type BackupManifest struct {
+	Version   int           `json:"version"`
+	Backup    string        `json:"backup"`
+	SHA256    string        `json:"sha256"`
+	Size      int64         `json:"size"`
+	TaskCount int           `json:"task_count"`
+	CreatedAt string        `json:"created_at"`
+	KeyID     string        `json:"key_id"`
+	Trigger   BackupTrigger `json:"trigger"`
+	HMAC      string        `json:"hmac"`
+}
+
+// BackupValidator checks decrypted backup contents and returns the number of
+// tasks they hold
+type BackupValidator func(data []byte) (int, error)
+
+// BackupVerification is the outcome of verifying a single backup
+type BackupVerification struct {
+	Backup     string          `json:"backup"`
+	Valid      bool            `json:"valid"`
+	Manifest   *BackupManifest `json:"manifest,omitempty"`
+	Size       int64           `json:"size"`
+	SHA256     string          `json:"sha256"`
+	KeyID      string          `json:"key_id,omitempty"`
+	TaskCount  int             `json:"task_count"`
+	Errors     []string        `json:"errors,omitempty"`
+	Warnings   []string        `json:"warnings,omitempty"`
+	VerifiedAt string          `json:"verified_at"`
+}
+
+// backupManifestPath returns the manifest path of a backup relative to the
+// data directory
+func backupManifestPath(backupName string) string {
+	return filepath.Join("backups", backupName+backupManifestSuffix)
+}
+
+// validateBackupName rejects names that are not plain backup file names
+func validateBackupName(backupName string) error {
+	if backupName == "" {
+		return errors.New("backup name cannot be empty")
+	}
+	if filepath.Base(backupName) != backupName || strings.HasPrefix(backupName, ".") || filepath.Ext(backupName) != ".enc" {
+		return fmt.Errorf("invalid backup name %q", backupName)
+	}
+	return nil
+}
+
+// countTasks returns the number of entries in a JSON task array
+func countTasks(data []byte) (int, error) {
+	var tasks []json.RawMessage
+	if err := json.Unmarshal(data, &tasks); err != nil {
+		return 0, fmt.Errorf("backup does not contain a task list: %w", err)
+	}
+	return len(tasks), nil
+}
+
+// errNoManifestKey means no backup manifest has been signed yet
+var errNoManifestKey = errors.New("backup manifest key does not exist")
+
+// manifestKey returns the key that signs backup manifests, or
+// errNoManifestKey if it has not been created yet. Initialize creates it, so
+// that callers holding only the shared lock never write it.
+func (es *EncryptedStorage) manifestKey() ([]byte, error) {
+	return es.loadManifestKey(false)
+}
+
+// createManifestKey returns the key that signs backup manifests, generating
+// and storing one if there is none yet. The caller must hold the exclusive
+// lock, so that concurrent callers cannot each store a different key.
+func (es *EncryptedStorage) createManifestKey() ([]byte, error) {
+	return es.loadManifestKey(true)
+}
+
+// initManifestKey creates the manifest signing key under the exclusive lock
+func (es *EncryptedStorage) initManifestKey() error {
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	_, err := es.createManifestKey()
+	return err
+}
+
+func (es *EncryptedStorage) loadManifestKey(create bool) ([]byte, error) {
+	es.manifestMu.Lock()
+	defer es.manifestMu.Unlock()
+
+	if es.manifestMACKey != nil {
+		return es.manifestMACKey, nil
+	}
+
+	raw, err := es.fileManager.ReadFile(BackupManifestKeyFile)
+	if err == nil {
+		wrapped, err := ParseWrappedDataKey(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid backup manifest key: %w", err)
+		}
+		key, err := es.cryptoService.UnwrapDataKey(wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap backup manifest key: %w", err)
+		}
+		es.manifestMACKey = key
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read backup manifest key: %w", err)
+	}
+	if !create {
+		return nil, errNoManifestKey
+	}
+
+	key, wrapped, err := es.cryptoService.GenerateDataKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate backup manifest key: %w", err)
+	}
+	raw, err = wrapped.MarshalBinary()
+	if err != nil {
+		SecureWipe(key)
+		return nil, err
+	}
+	if err := es.fileManager.WriteFile(BackupManifestKeyFile, raw); err != nil {
+		SecureWipe(key)
+		return nil, fmt.Errorf("failed to save backup manifest key: %w", err)
+	}
+
+	es.manifestMACKey = key
+	return key, nil
+}
+
+// rewrapManifestKey re-wraps the manifest signing key with the active master
+// key and recovery key, reporting whether it was out of date
+func (es *EncryptedStorage) rewrapManifestKey() (bool, error) {
+	raw, err := es.fileManager.ReadFile(BackupManifestKeyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read backup manifest key: %w", err)
+	}
+
+	wrapped, err := ParseWrappedDataKey(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid backup manifest key: %w", err)
+	}
+	if es.cryptoService.DataKeyIsCurrent(wrapped) {
+		return false, nil
+	}
+
+	rewrapped, err := es.cryptoService.RewrapDataKey(wrapped)
+	if err != nil {
+		return false, fmt.Errorf("failed to re-wrap backup manifest key: %w", err)
+	}
+	raw, err = rewrapped.MarshalBinary()
+	if err != nil {
+		return false, err
+	}
+	if err := es.fileManager.WriteFile(BackupManifestKeyFile, raw); err != nil {
+		return false, fmt.Errorf("failed to save backup manifest key: %w", err)
+	}
+	return true, nil
+}
+
+// signature computes the manifest's HMAC-SHA256 over its JSON encoding
+// without the HMAC field
+func (m BackupManifest) signature(key []byte) ([]byte, error) {
+	m.HMAC = ""
+	payload, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(nil), nil
+}
+
+// writeBackupManifest signs and stores the manifest of a backup
+func (es *EncryptedStorage) writeBackupManifest(manifest *BackupManifest) error {
+	key, err := es.createManifestKey()
+	if err != nil {
+		return err
+	}
+
+	sum, err := manifest.signature(key)
+	if err != nil {
+		return fmt.Errorf("failed to sign backup manifest: %w", err)
+	}
+	manifest.HMAC = hex.EncodeToString(sum)
+
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize backup manifest: %w", err)
+	}
+	if err := es.fileManager.WriteFile(backupManifestPath(manifest.Backup), raw); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %w", err)
+	}
+
+	// A new or changed manifest means a backup to replicate
+	es.replicateBackup(manifest.Backup)
+	return nil
+}
+
+// createBackupManifest writes a manifest for a backup that was just created
+// from the given encrypted data and plaintext
+func (es *EncryptedStorage) createBackupManifest(backupName string, encryptedData, plaintext []byte, trigger BackupTrigger) error {
+	taskCount, err := countTasks(plaintext)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(encryptedData)
+	return es.writeBackupManifest(&BackupManifest{
+		Version:   backupManifestVersion,
+		Backup:    backupName,
+		SHA256:    hex.EncodeToString(sum[:]),
+		Size:      int64(len(encryptedData)),
+		TaskCount: taskCount,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+		KeyID:     KeyID(encryptedData),
+		Trigger:   trigger,
+	})
+}
+
+// createBackup copies the data file into a new backup and writes its
+// manifest. The caller must hold the file lock.
+func (es *EncryptedStorage) createBackup(trigger BackupTrigger) (string, error) {
+	backupName, err := es.fileManager.CreateBackup(es.dataFile)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedData, err := es.fileManager.ReadFile(filepath.Join("backups", backupName))
+	if err != nil {
+		return backupName, fmt.Errorf("failed to read backup %s: %w", backupName, err)
+	}
+	plaintext, err := es.cryptoService.Decrypt(encryptedData)
+	if err != nil {
+		return backupName, fmt.Errorf("failed to decrypt backup %s: %w", backupName, err)
+	}
+	defer SecureWipe(plaintext)
+
+	if err := es.createBackupManifest(backupName, encryptedData, plaintext, trigger); err != nil {
+		return backupName, fmt.Errorf("failed to create manifest for backup %s: %w", backupName, err)
+	}
+	return backupName, nil
+}
+
+// ReadBackupManifest returns the manifest of a backup without verifying it,
+// or nil if the backup has none
+func (es *EncryptedStorage) ReadBackupManifest(backupName string) (*BackupManifest, error) {
+	if err := validateBackupName(backupName); err != nil {
+		return nil, err
+	}
+
+	raw, err := es.fileManager.ReadFile(backupManifestPath(backupName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read backup manifest: %w", err)
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(raw, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+// refreshBackupManifest updates the hash, size and key ID of a backup's
+// manifest after a key rotation rewrote the file, keeping the rest
+func (es *EncryptedStorage) refreshBackupManifest(backupName string) error {
+	manifest, err := es.ReadBackupManifest(backupName)
+	if err != nil || manifest == nil {
+		return err
+	}
+
+	encryptedData, err := es.fileManager.ReadFile(filepath.Join("backups", backupName))
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(encryptedData)
+	manifest.SHA256 = hex.EncodeToString(sum[:])
+	manifest.Size = int64(len(encryptedData))
+	manifest.KeyID = KeyID(encryptedData)
+	return es.writeBackupManifest(manifest)
+}
+
+// VerifyBackup checks a backup against its manifest, decrypts it and runs
+// validate over the contents. Problems with the backup itself are reported
+// in the result; an error is only returned if the backup cannot be read.
+func (es *EncryptedStorage) VerifyBackup(backupName string, validate BackupValidator) (*BackupVerification, error) {
+	if err := validateBackupName(backupName); err != nil {
+		return nil, err
+	}
+
+	if err := es.fileManager.RLock(); err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.RUnlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	encryptedData, err := es.fileManager.ReadFile(filepath.Join("backups", backupName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("backup %s not found", backupName)
+		}
+		return nil, fmt.Errorf("failed to read backup file: %w", err)
+	}
+
+	sum := sha256.Sum256(encryptedData)
+	result := &BackupVerification{
+		Backup:     backupName,
+		Size:       int64(len(encryptedData)),
+		SHA256:     hex.EncodeToString(sum[:]),
+		KeyID:      KeyID(encryptedData),
+		VerifiedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	fail := func(format string, args ...interface{}) {
+		result.Errors = append(result.Errors, fmt.Sprintf(format, args...))
+	}
+
+	manifest, err := es.ReadBackupManifest(backupName)
+	switch {
+	case err != nil:
+		fail("%v", err)
+	case manifest == nil:
+		result.Warnings = append(result.Warnings, "backup has no manifest")
+	default:
+		result.Manifest = manifest
+		es.checkBackupManifest(result, manifest, fail)
+	}
+
+	plaintext, err := es.cryptoService.Decrypt(encryptedData)
+	if err != nil {
+		fail("backup cannot be decrypted: %v", err)
+	} else {
+		defer SecureWipe(plaintext)
+
+		if validate == nil {
+			validate = countTasks
+		}
+		taskCount, err := validate(plaintext)
+		if err != nil {
+			fail("backup contents are invalid: %v", err)
+		} else {
+			result.TaskCount = taskCount
+			if manifest != nil && manifest.TaskCount != taskCount {
+				fail("task count %d does not match manifest (%d)", taskCount, manifest.TaskCount)
+			}
+		}
+	}
+
+	result.Valid = len(result.Errors) == 0
+	return result, nil
+}
+
+// checkBackupManifest compares a verified backup with its manifest
+func (es *EncryptedStorage) checkBackupManifest(result *BackupVerification, manifest *BackupManifest, fail func(string, ...interface{})) {
+	key, err := es.manifestKey()
+	if err != nil {
+		fail("manifest signature cannot be checked: %v", err)
+	} else {
+		expected, err := manifest.signature(key)
+		actual, decodeErr := hex.DecodeString(manifest.HMAC)
+		if err != nil || decodeErr != nil || !hmac.Equal(expected, actual) {
+			fail("manifest signature is invalid")
+		}
+	}
+
+	if manifest.Backup != result.Backup {
+		fail("manifest belongs to backup %s", manifest.Backup)
+	}
+	if manifest.Size != result.Size {
+		fail("size %d does not match manifest (%d)", result.Size, manifest.Size)
+	}
+	if manifest.SHA256 != result.SHA256 {
+		fail("SHA-256 does not match manifest")
+	}
+	if manifest.KeyID != result.KeyID {
+		fail("key ID %q does not match manifest (%q)", result.KeyID, manifest.KeyID)
+	}
+}
+
+// VerifyAllBackups verifies every backup, newest first
+func (es *EncryptedStorage) VerifyAllBackups(validate BackupValidator) ([]BackupVerification, error) {
+	backups, err := es.fileManager.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BackupVerification, 0, len(backups))
+	for i := len(backups) - 1; i >= 0; i-- {
+		result, err := es.VerifyBackup(backups[i], validate)
+		if err != nil && !es.fileManager.FileExists(filepath.Join("backups", backups[i])) {
+			continue // Pruned since the backups were listed
+		}
+		if err != nil {
+			log.Printf("Warning: failed to verify backup %s: %v", backups[i], err)
+			results = append(results, BackupVerification{
+				Backup:     backups[i],
+				Errors:     []string{err.Error()},
+				VerifiedAt: time.Now().UTC().Format(time.RFC3339),
+			})
+			continue
+		}
+		results = append(results, *result)
+	}
+	return results, nil
+}
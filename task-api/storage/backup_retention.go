@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupTimeLayout is the timestamp in backup file names, in local time
+const backupTimeLayout = "20060102_150405"
+
+// RetentionPolicy decides which backups are kept. It is a grandfather-
+// father-son scheme: besides the newest KeepLast backups, the newest backup
+// of each of the last Hourly hours, Daily days, Weekly ISO weeks and Monthly
+// months that have backups is kept. Everything else is pruned, and the
+// remaining backups are then pruned oldest first until they are within
+// MaxAgeDays, MaxCount and MaxTotalBytes. Zero disables a tier or limit.
+type RetentionPolicy struct {
+	KeepLast      int   `json:"keep_last"`
+	Hourly        int   `json:"hourly"`
+	Daily         int   `json:"daily"`
+	Weekly        int   `json:"weekly"`
+	Monthly       int   `json:"monthly"`
+	MaxAgeDays    int   `json:"max_age_days"`
+	MaxCount      int   `json:"max_count"`
+	MaxTotalBytes int64 `json:"max_total_bytes"`
+}
+
+// DefaultRetentionPolicy returns the policy used unless one is configured.
+// The age limit lies beyond the monthly tier, so it only prunes backups
+// that no tier keeps any more, such as the newest few after a long pause.
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		KeepLast: 10,
+		Hourly:   24,
+		Daily:    7,
+		Weekly:   4,
+		Monthly:  12,
+
+		MaxAgeDays: 400,
+	}
+}
+
+// RetentionDecision explains why a backup is kept or pruned
+type RetentionDecision struct {
+	Backup  string    `json:"backup"`
+	Time    time.Time `json:"time"`
+	Size    int64     `json:"size"`
+	Keep    bool      `json:"keep"`
+	Reasons []string  `json:"reasons"`
+}
+
+// retentionTier groups backups into periods and keeps the newest backup of
+// each of the most recent periods
+type retentionTier struct {
+	name   string
+	keep   int
+	period func(t time.Time) string
+}
+
+func (p RetentionPolicy) tiers() []retentionTier {
+	return []retentionTier{
+		{"hourly", p.Hourly, func(t time.Time) string { return t.Format("2006-01-02 15:00") }},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+}
+
+// backupTime returns when a backup was taken from its name, falling back to
+// the file's modification time for names without a timestamp
+func backupTime(backup BackupFile) time.Time {
+	if i := strings.LastIndex(backup.Name, "_backup_"); i >= 0 {
+		stamp := backup.Name[i+len("_backup_"):]
+		if len(stamp) >= len(backupTimeLayout) {
+			t, err := time.ParseInLocation(backupTimeLayout, stamp[:len(backupTimeLayout)], time.Local)
+			if err == nil {
+				return t
+			}
+		}
+	}
+	return backup.ModTime
+}
+
+// Plan decides for every backup whether it is kept, newest first
+func (p RetentionPolicy) Plan(backups []BackupFile, now time.Time) []RetentionDecision {
+	decisions := make([]RetentionDecision, len(backups))
+	for i, backup := range backups {
+		decisions[i] = RetentionDecision{
+			Backup: backup.Name,
+			Time:   backupTime(backup),
+			Size:   backup.Size,
+		}
+	}
+	sort.SliceStable(decisions, func(i, j int) bool {
+		if !decisions[i].Time.Equal(decisions[j].Time) {
+			return decisions[i].Time.After(decisions[j].Time)
+		}
+		return decisions[i].Backup > decisions[j].Backup
+	})
+
+	for i := range decisions {
+		if i < p.KeepLast {
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, fmt.Sprintf("one of the newest %d", p.KeepLast))
+		}
+	}
+
+	for _, tier := range p.tiers() {
+		seen := map[string]bool{}
+		for i := range decisions {
+			if len(seen) >= tier.keep {
+				break
+			}
+			period := tier.period(decisions[i].Time)
+			if seen[period] {
+				continue
+			}
+			seen[period] = true
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, fmt.Sprintf("newest %s backup for %s", tier.name, period))
+		}
+	}
+
+	for i := range decisions {
+		if !decisions[i].Keep {
+			decisions[i].Reasons = []string{fmt.Sprintf("not among the newest %d or the newest of a kept hourly, daily, weekly or monthly period", p.KeepLast)}
+		}
+	}
+
+	// Limits prune the oldest kept backups first but never the newest one
+	if p.MaxAgeDays > 0 {
+		cutoff := now.AddDate(0, 0, -p.MaxAgeDays)
+		for i := 1; i < len(decisions); i++ {
+			if decisions[i].Keep && decisions[i].Time.Before(cutoff) {
+				decisions[i].prune(fmt.Sprintf("older than the maximum age of %d days", p.MaxAgeDays))
+			}
+		}
+	}
+
+	count, total := 0, int64(0)
+	for _, decision := range decisions {
+		if decision.Keep {
+			count++
+			total += decision.Size
+		}
+	}
+	for i := len(decisions) - 1; i > 0; i-- {
+		if !decisions[i].Keep {
+			continue
+		}
+		switch {
+		case p.MaxCount > 0 && count > p.MaxCount:
+			decisions[i].prune(fmt.Sprintf("%d backups exceed the maximum count of %d", count, p.MaxCount))
+		case p.MaxTotalBytes > 0 && total > p.MaxTotalBytes:
+			decisions[i].prune(fmt.Sprintf("%d bytes of backups exceed the maximum total size of %d bytes", total, p.MaxTotalBytes))
+		default:
+			continue
+		}
+		count--
+		total -= decisions[i].Size
+	}
+
+	return decisions
+}
+
+// prune overrides a keep decision, recording why
+func (d *RetentionDecision) prune(reason string) {
+	d.Keep = false
+	d.Reasons = []string{reason}
+}
+
+// SetRetentionPolicy sets the backup retention policy
+func (es *EncryptedStorage) SetRetentionPolicy(policy RetentionPolicy) {
+	es.retention = policy
+}
+
+// RetentionPolicy returns the backup retention policy
+func (es *EncryptedStorage) RetentionPolicy() RetentionPolicy {
+	return es.retention
+}
+
+// pruneBackups deletes the backups the retention policy does not keep and
+// logs why each one was removed. The caller must hold the file lock.
+func (es *EncryptedStorage) pruneBackups() error {
+	backups, err := es.fileManager.BackupFiles()
+	if err != nil {
+		return err
+	}
+
+	pruned, failed := 0, 0
+	for _, decision := range es.retention.Plan(backups, time.Now()) {
+		if decision.Keep {
+			continue
+		}
+
+		if err := es.fileManager.DeleteBackup(decision.Backup); err != nil {
+			log.Printf("Warning: failed to prune backup %s: %v", decision.Backup, err)
+			failed++
+			continue
+		}
+		log.Printf("Pruned backup %s: %s", decision.Backup, strings.Join(decision.Reasons, "; "))
+		pruned++
+	}
+
+	if pruned > 0 || failed > 0 {
+		log.Printf("Backup retention: %d of %d backups pruned, %d failed", pruned, len(backups), failed)
+	}
+	return nil
+}
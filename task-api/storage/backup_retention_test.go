@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// retentionNow is the time plans are made at in the retention tests
+var retentionNow = time.Date(2024, 3, 15, 12, 30, 0, 0, time.Local)
+
+// backupAt describes a backup taken at the given local time
+func backupAt(year int, month time.Month, day, hour, min int, size int64) BackupFile {
+	t := time.Date(year, month, day, hour, min, 0, 0, time.Local)
+	return BackupFile{Name: "tasks_backup_" + t.Format(backupTimeLayout) + "_000.enc", Size: size, ModTime: t}
+}
+
+func TestRetentionPolicyPlan(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetentionPolicy
+		backups []BackupFile
+		keep    []int // indexes into backups
+	}{
+		{
+			name:   "keep last",
+			policy: RetentionPolicy{KeepLast: 2},
+			backups: []BackupFile{
+				backupAt(2024, 3, 15, 9, 0, 1),
+				backupAt(2024, 3, 15, 10, 0, 1),
+				backupAt(2024, 3, 15, 11, 0, 1),
+				backupAt(2024, 3, 15, 12, 0, 1),
+			},
+			keep: []int{2, 3},
+		},
+		{
+			name:   "hourly keeps the newest of each hour",
+			policy: RetentionPolicy{Hourly: 2},
+			backups: []BackupFile{
+				backupAt(2024, 3, 15, 10, 40, 1),
+				backupAt(2024, 3, 15, 11, 10, 1),
+				backupAt(2024, 3, 15, 11, 50, 1),
+				backupAt(2024, 3, 15, 12, 20, 1),
+			},
+			keep: []int{2, 3},
+		},
+		{
+			name:   "daily keeps the newest of each day",
+			policy: RetentionPolicy{Daily: 3},
+			backups: []BackupFile{
+				backupAt(2024, 3, 12, 10, 0, 1),
+				backupAt(2024, 3, 13, 10, 0, 1),
+				backupAt(2024, 3, 14, 9, 0, 1),
+				backupAt(2024, 3, 14, 20, 0, 1),
+				backupAt(2024, 3, 15, 8, 0, 1),
+				backupAt(2024, 3, 15, 12, 0, 1),
+			},
+			keep: []int{1, 3, 5},
+		},
+		{
+			name:   "weekly keeps the newest of each ISO week",
+			policy: RetentionPolicy{Weekly: 2},
+			backups: []BackupFile{
+				backupAt(2024, 3, 1, 10, 0, 1),  // W09
+				backupAt(2024, 3, 5, 10, 0, 1),  // W10
+				backupAt(2024, 3, 8, 10, 0, 1),  // W10
+				backupAt(2024, 3, 13, 10, 0, 1), // W11
+				backupAt(2024, 3, 15, 10, 0, 1), // W11
+			},
+			keep: []int{2, 4},
+		},
+		{
+			name:   "monthly keeps the newest of each month",
+			policy: RetentionPolicy{Monthly: 3},
+			backups: []BackupFile{
+				backupAt(2023, 12, 5, 10, 0, 1),
+				backupAt(2024, 1, 10, 10, 0, 1),
+				backupAt(2024, 2, 1, 10, 0, 1),
+				backupAt(2024, 2, 20, 10, 0, 1),
+				backupAt(2024, 3, 2, 10, 0, 1),
+				backupAt(2024, 3, 15, 10, 0, 1),
+			},
+			keep: []int{1, 3, 5},
+		},
+		{
+			name:   "tiers add up",
+			policy: RetentionPolicy{KeepLast: 1, Daily: 2, Monthly: 2},
+			backups: []BackupFile{
+				backupAt(2024, 2, 10, 10, 0, 1),
+				backupAt(2024, 2, 20, 10, 0, 1),
+				backupAt(2024, 3, 14, 10, 0, 1),
+				backupAt(2024, 3, 15, 9, 0, 1),
+				backupAt(2024, 3, 15, 10, 0, 1),
+			},
+			keep: []int{1, 2, 4},
+		},
+		{
+			name:   "max age prunes old kept backups",
+			policy: RetentionPolicy{KeepLast: 10, MaxAgeDays: 7},
+			backups: []BackupFile{
+				backupAt(2024, 2, 24, 10, 0, 1),
+				backupAt(2024, 3, 5, 10, 0, 1),
+				backupAt(2024, 3, 10, 10, 0, 1),
+				backupAt(2024, 3, 14, 10, 0, 1),
+			},
+			keep: []int{2, 3},
+		},
+		{
+			name:    "max age never prunes the newest backup",
+			policy:  RetentionPolicy{KeepLast: 10, MaxAgeDays: 7},
+			backups: []BackupFile{backupAt(2023, 12, 1, 10, 0, 1), backupAt(2023, 11, 1, 10, 0, 1)},
+			keep:    []int{0},
+		},
+		{
+			name:   "max count prunes oldest first",
+			policy: RetentionPolicy{KeepLast: 10, MaxCount: 2},
+			backups: []BackupFile{
+				backupAt(2024, 3, 15, 9, 0, 1),
+				backupAt(2024, 3, 15, 10, 0, 1),
+				backupAt(2024, 3, 15, 11, 0, 1),
+				backupAt(2024, 3, 15, 12, 0, 1),
+			},
+			keep: []int{2, 3},
+		},
+		{
+			name:   "max total size prunes oldest first",
+			policy: RetentionPolicy{KeepLast: 10, MaxTotalBytes: 250},
+			backups: []BackupFile{
+				backupAt(2024, 3, 15, 9, 0, 100),
+				backupAt(2024, 3, 15, 10, 0, 100),
+				backupAt(2024, 3, 15, 11, 0, 100),
+				backupAt(2024, 3, 15, 12, 0, 100),
+			},
+			keep: []int{2, 3},
+		},
+		{
+			name:    "max total size never prunes the newest backup",
+			policy:  RetentionPolicy{KeepLast: 10, MaxTotalBytes: 10},
+			backups: []BackupFile{backupAt(2024, 3, 15, 11, 0, 100), backupAt(2024, 3, 15, 12, 0, 100)},
+			keep:    []int{1},
+		},
+		{
+			name:   "limits only count kept backups",
+			policy: RetentionPolicy{KeepLast: 2, MaxCount: 2, MaxTotalBytes: 200},
+			backups: []BackupFile{
+				backupAt(2024, 3, 15, 10, 0, 100),
+				backupAt(2024, 3, 15, 11, 0, 100),
+				backupAt(2024, 3, 15, 12, 0, 100),
+			},
+			keep: []int{1, 2},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			want := make(map[string]bool, len(tc.keep))
+			for _, i := range tc.keep {
+				want[tc.backups[i].Name] = true
+			}
+
+			decisions := tc.policy.Plan(tc.backups, retentionNow)
+			if len(decisions) != len(tc.backups) {
+				t.Fatalf("got %d decisions for %d backups", len(decisions), len(tc.backups))
+			}
+			if !sort.SliceIsSorted(decisions, func(i, j int) bool { return decisions[i].Time.After(decisions[j].Time) }) {
+				t.Error("decisions are not ordered newest first")
+			}
+			for _, decision := range decisions {
+				if decision.Keep != want[decision.Backup] {
+					t.Errorf("%s: keep = %v, want %v (%s)", decision.Backup, decision.Keep, want[decision.Backup], strings.Join(decision.Reasons, "; "))
+				}
+				if len(decision.Reasons) == 0 {
+					t.Errorf("%s: no reason given", decision.Backup)
+				}
+			}
+		})
+	}
+}
+
+func TestRetentionPolicyPlanLimitReasons(t *testing.T) {
+	policy := RetentionPolicy{KeepLast: 10, MaxAgeDays: 7, MaxCount: 1}
+	backups := []BackupFile{
+		backupAt(2024, 3, 1, 10, 0, 1),
+		backupAt(2024, 3, 14, 10, 0, 1),
+		backupAt(2024, 3, 15, 10, 0, 1),
+	}
+
+	reasons := map[string]string{}
+	for _, decision := range policy.Plan(backups, retentionNow) {
+		reasons[decision.Backup] = strings.Join(decision.Reasons, "; ")
+	}
+
+	for i, want := range []string{"maximum age of 7 days", "maximum count of 1", "one of the newest 10"} {
+		if got := reasons[backups[i].Name]; !strings.Contains(got, want) {
+			t.Errorf("%s: reason %q, want it to mention %q", backups[i].Name, got, want)
+		}
+	}
+}
+
+// The default age limit must not undo the monthly tier
+func TestDefaultRetentionPolicyKeepsMonthlyBackups(t *testing.T) {
+	policy := DefaultRetentionPolicy()
+
+	var backups []BackupFile
+	for month := 0; month < policy.Monthly; month++ {
+		backups = append(backups, backupAt(2024, time.March-time.Month(month), 1, 10, 0, 1))
+	}
+
+	for _, decision := range policy.Plan(backups, retentionNow) {
+		if !decision.Keep {
+			t.Errorf("%s pruned: %s", decision.Backup, strings.Join(decision.Reasons, "; "))
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionAlgorithm identifies how the plaintext of a container was
+// compressed before encryption
+type CompressionAlgorithm uint8
+
+const (
+	CompressionNone CompressionAlgorithm = 0
+	CompressionGzip CompressionAlgorithm = 1
+	CompressionZstd CompressionAlgorithm = 2
+)
+
+// maxUncompressedSize bounds the size a compressed container may declare,
+// so a tampered header cannot make the server allocate unbounded memory
+const maxUncompressedSize = 1 << 30
+
+// ParseCompressionAlgorithm converts a configuration name to a compression
+// algorithm
+func ParseCompressionAlgorithm(name string) (CompressionAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "", "none", "off":
+		return CompressionNone, nil
+	case "gzip":
+		return CompressionGzip, nil
+	case "zstd":
+		return CompressionZstd, nil
+	default:
+		return 0, fmt.Errorf("unknown compression algorithm %q", name)
+	}
+}
+
+// String returns the configuration name of the algorithm
+func (a CompressionAlgorithm) String() string {
+	switch a {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return fmt.Sprintf("unknown(%d)", a)
+	}
+}
+
+// zstd encoders and decoders are expensive to create but safe for
+// concurrent use, so one of each is shared
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(maxUncompressedSize))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// compress compresses data with the algorithm
+func compress(algorithm CompressionAlgorithm, data []byte) ([]byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		encoder, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		return encoder.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %s", algorithm)
+	}
+}
+
+// decompress reverses compress, failing unless the result is exactly size
+// bytes long
+func decompress(algorithm CompressionAlgorithm, data []byte, size uint64) ([]byte, error) {
+	if size > maxUncompressedSize {
+		return nil, fmt.Errorf("uncompressed size %d exceeds the limit of %d bytes", size, maxUncompressedSize)
+	}
+
+	var plaintext []byte
+	switch algorithm {
+	case CompressionGzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+		plaintext, err = io.ReadAll(io.LimitReader(r, int64(size)+1))
+		if err != nil {
+			SecureWipe(plaintext)
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+	case CompressionZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err = decoder.DecodeAll(data, make([]byte, 0, size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress data: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported compression algorithm %s", algorithm)
+	}
+
+	if uint64(len(plaintext)) != size {
+		SecureWipe(plaintext)
+		return nil, errors.New("failed to decompress data: size does not match the header")
+	}
+	return plaintext, nil
+}
+
+// FileCompression describes how much compression saves on a single file
+type FileCompression struct {
+	Compression       string  `json:"compression"`
+	StoredBytes       int64   `json:"stored_bytes"`
+	UncompressedBytes int64   `json:"uncompressed_bytes"`
+	Ratio             float64 `json:"ratio"`
+}
+
+// BackupCompression sums up how much compression saves on the backups
+type BackupCompression struct {
+	Count             int     `json:"count"`
+	Compressed        int     `json:"compressed"`
+	StoredBytes       int64   `json:"stored_bytes"`
+	UncompressedBytes int64   `json:"uncompressed_bytes"`
+	SavedBytes        int64   `json:"saved_bytes"`
+	Ratio             float64 `json:"ratio"`
+}
+
+// CompressionStats reports the configured compression and its effect on
+// the data file and the backups. Ratios are stored bytes per uncompressed
+// byte, including the header and authentication tag.
+type CompressionStats struct {
+	Algorithm string            `json:"algorithm"`
+	DataFile  *FileCompression  `json:"data_file,omitempty"`
+	Backups   BackupCompression `json:"backups"`
+}
+
+// compressionRatio rounds stored/uncompressed to three decimals
+func compressionRatio(stored, uncompressed int64) float64 {
+	if uncompressed == 0 {
+		return 0
+	}
+	return float64(stored*1000/uncompressed) / 1000
+}
+
+// CompressionStats inspects the headers of the data file and the backups
+// to report how much compression saves
+func (es *EncryptedStorage) CompressionStats() CompressionStats {
+	stats := CompressionStats{Algorithm: es.cryptoService.Compression().String()}
+
+	if data, err := es.fileManager.ReadFile(es.dataFile); err == nil {
+		info := InspectEncrypted(data)
+		stats.DataFile = &FileCompression{
+			Compression:       info.Compression,
+			StoredBytes:       int64(len(data)),
+			UncompressedBytes: info.PlaintextSize,
+			Ratio:             compressionRatio(int64(len(data)), info.PlaintextSize),
+		}
+	}
+
+	backups, err := es.fileManager.ListBackups()
+	if err != nil {
+		return stats
+	}
+	for _, backupName := range backups {
+		data, err := es.fileManager.ReadFile(filepath.Join("backups", backupName))
+		if err != nil {
+			continue
+		}
+		info := InspectEncrypted(data)
+		stats.Backups.Count++
+		if info.Compression != "" && info.Compression != CompressionNone.String() {
+			stats.Backups.Compressed++
+		}
+		stats.Backups.StoredBytes += int64(len(data))
+		stats.Backups.UncompressedBytes += info.PlaintextSize
+	}
+	stats.Backups.SavedBytes = stats.Backups.UncompressedBytes - stats.Backups.StoredBytes
+	stats.Backups.Ratio = compressionRatio(stats.Backups.StoredBytes, stats.Backups.UncompressedBytes)
+	return stats
+}
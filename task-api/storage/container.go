@@ -0,0 +1,600 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	// containerMagic starts every file written in the versioned format
+	containerMagic = "TENC"
+
+	// ContainerVersion is the container format written by Encrypt
+	ContainerVersion = 2
+
+	// CompressedContainerVersion is the container format Encrypt writes
+	// when it compresses the plaintext
+	CompressedContainerVersion = 3
+)
+
+// KDFAlgorithm identifies the function that turns a password into a key
+type KDFAlgorithm uint8
+
+const (
+	KDFPBKDF2SHA256 KDFAlgorithm = 1
+	KDFArgon2id     KDFAlgorithm = 2
+)
+
+// CipherAlgorithm identifies the authenticated cipher used for the payload
+type CipherAlgorithm uint8
+
+const (
+	CipherAES256GCM CipherAlgorithm = 1
+)
+
+// Bounds on KDF parameters. They are enforced when reading headers too, so
+// a tampered file cannot make the server spend unbounded time or memory.
+const (
+	minPBKDF2Iterations = 10000
+	maxPBKDF2Iterations = 10000000
+	maxArgon2Time       = 64
+	minArgon2MemoryKiB  = 8 * 1024
+	maxArgon2MemoryKiB  = 4 * 1024 * 1024
+	maxArgon2Threads    = 64
+)
+
+// KDFParams describes how a key is derived from a password. For PBKDF2 only
+// Iterations is used; for Argon2id Iterations is the time cost.
+type KDFParams struct {
+	Algorithm  KDFAlgorithm
+	Iterations uint32
+	MemoryKiB  uint32
+	Threads    uint8
+}
+
+// DefaultKDFParams returns the PBKDF2-SHA256 parameters used by files
+// written before the container format existed
+func DefaultKDFParams() KDFParams {
+	return KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: PBKDF2Iters}
+}
+
+// DefaultArgon2idParams returns the recommended Argon2id parameters
+func DefaultArgon2idParams() KDFParams {
+	return KDFParams{Algorithm: KDFArgon2id, Iterations: 3, MemoryKiB: 64 * 1024, Threads: 4}
+}
+
+// ParseKDFAlgorithm converts a configuration name to a KDF algorithm
+func ParseKDFAlgorithm(name string) (KDFAlgorithm, error) {
+	switch strings.ToLower(name) {
+	case "pbkdf2", "pbkdf2-sha256":
+		return KDFPBKDF2SHA256, nil
+	case "argon2id":
+		return KDFArgon2id, nil
+	default:
+		return 0, fmt.Errorf("unknown KDF algorithm %q", name)
+	}
+}
+
+// Validate checks that the parameters are supported and within bounds
+func (p KDFParams) Validate() error {
+	switch p.Algorithm {
+	case KDFPBKDF2SHA256:
+		if p.Iterations < minPBKDF2Iterations || p.Iterations > maxPBKDF2Iterations {
+			return fmt.Errorf("PBKDF2 iterations must be between %d and %d", minPBKDF2Iterations, maxPBKDF2Iterations)
+		}
+	case KDFArgon2id:
+		if p.Iterations < 1 || p.Iterations > maxArgon2Time {
+			return fmt.Errorf("Argon2id time cost must be between 1 and %d", maxArgon2Time)
+		}
+		if p.MemoryKiB < minArgon2MemoryKiB || p.MemoryKiB > maxArgon2MemoryKiB {
+			return fmt.Errorf("Argon2id memory must be between %d and %d KiB", minArgon2MemoryKiB, maxArgon2MemoryKiB)
+		}
+		if p.Threads < 1 || p.Threads > maxArgon2Threads {
+			return fmt.Errorf("Argon2id threads must be between 1 and %d", maxArgon2Threads)
+		}
+	default:
+		return fmt.Errorf("unsupported KDF algorithm %d", p.Algorithm)
+	}
+	return nil
+}
+
+// String describes the parameters for logs and diagnostics
+func (p KDFParams) String() string {
+	switch p.Algorithm {
+	case KDFPBKDF2SHA256:
+		return fmt.Sprintf("pbkdf2-sha256(iterations=%d)", p.Iterations)
+	case KDFArgon2id:
+		return fmt.Sprintf("argon2id(time=%d,memory=%dKiB,threads=%d)", p.Iterations, p.MemoryKiB, p.Threads)
+	default:
+		return fmt.Sprintf("unknown(%d)", p.Algorithm)
+	}
+}
+
+// deriveKey derives a KeySize key from password and salt
+func (p KDFParams) deriveKey(password string, salt []byte) []byte {
+	if p.Algorithm == KDFArgon2id {
+		return argon2.IDKey([]byte(password), salt, p.Iterations, p.MemoryKiB, p.Threads, KeySize)
+	}
+	return pbkdf2.Key([]byte(password), salt, int(p.Iterations), KeySize, sha256.New)
+}
+
+// MarshalBinary encodes the parameters in the form used by file headers
+func (p KDFParams) MarshalBinary() ([]byte, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	return appendKDFParams(nil, p), nil
+}
+
+// UnmarshalBinary decodes parameters encoded by MarshalBinary
+func (p *KDFParams) UnmarshalBinary(data []byte) error {
+	params, n, err := readKDFParams(data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return errors.New("unexpected data after KDF parameters")
+	}
+	*p = params
+	return nil
+}
+
+// appendKDFParams encodes the parameters used by the algorithm
+func appendKDFParams(buf []byte, p KDFParams) []byte {
+	buf = append(buf, byte(p.Algorithm))
+	buf = binary.BigEndian.AppendUint32(buf, p.Iterations)
+	if p.Algorithm == KDFArgon2id {
+		buf = binary.BigEndian.AppendUint32(buf, p.MemoryKiB)
+		buf = append(buf, p.Threads)
+	}
+	return buf
+}
+
+// readKDFParams decodes parameters written by appendKDFParams and returns
+// the number of bytes consumed
+func readKDFParams(data []byte) (KDFParams, int, error) {
+	var p KDFParams
+	if len(data) < 5 {
+		return p, 0, errors.New("truncated KDF parameters")
+	}
+
+	p.Algorithm = KDFAlgorithm(data[0])
+	p.Iterations = binary.BigEndian.Uint32(data[1:5])
+	n := 5
+
+	if p.Algorithm == KDFArgon2id {
+		if len(data) < n+5 {
+			return p, 0, errors.New("truncated KDF parameters")
+		}
+		p.MemoryKiB = binary.BigEndian.Uint32(data[n : n+4])
+		p.Threads = data[n+4]
+		n += 5
+	}
+
+	if err := p.Validate(); err != nil {
+		return p, 0, err
+	}
+
+	return p, n, nil
+}
+
+// containerHeader is the self-describing prefix of an encrypted file.
+//
+// Version 2 (envelope encryption, written by Encrypt):
+//
+//	magic "TENC" | version (1) | cipher (1) | key slot count (1) | key slots |
+//	IV length (1) | IV
+//
+// where each key slot is
+//
+//	provider length (1) | provider | master key ID length (1) |
+//	master key ID | wrapped DEK length (uint16 BE) | wrapped DEK
+//
+// The payload is encrypted with a random data encryption key (DEK) that is
+// stored once per key slot, wrapped by a master key. Only magic, version
+// and cipher are authenticated as additional data, so the DEK can be
+// re-wrapped under a new master key without touching the payload; a
+// tampered wrapped DEK simply fails to unwrap.
+//
+// Version 3 (compressed envelope encryption) is version 2 with the
+// plaintext compressed before encryption:
+//
+//	magic "TENC" | version (1) | cipher (1) | compression (1) |
+//	uncompressed size (uint64 BE) | key slot count (1) | key slots |
+//	IV length (1) | IV
+//
+// Compression and uncompressed size are authenticated along with magic,
+// version and cipher.
+//
+// Version 1 (password-derived key):
+//
+//	magic "TENC" | version (1) | KDF algorithm (1) | KDF params |
+//	salt length (1) | salt | cipher (1) | key ID length (1) | key ID |
+//	IV length (1) | IV
+//
+// KDF params are iterations (uint32 BE) for PBKDF2, or time (uint32 BE),
+// memory in KiB (uint32 BE) and threads (1) for Argon2id. The whole header
+// is authenticated as additional data.
+type containerHeader struct {
+	Version uint8
+	Cipher  CipherAlgorithm
+	KeyID   string
+	IV      []byte
+
+	// Version 1
+	KDF  KDFParams
+	Salt []byte
+
+	// Version 2 and 3
+	KeySlots []keySlot
+
+	// Version 3
+	Compression      CompressionAlgorithm
+	UncompressedSize uint64
+}
+
+// envelope reports whether the header is of a version with wrapped data keys
+func (h *containerHeader) envelope() bool {
+	return h.Version == ContainerVersion || h.Version == CompressedContainerVersion
+}
+
+// keySlot is one wrapped copy of a file's data encryption key
+type keySlot struct {
+	Provider   string
+	KeyID      string
+	WrappedKey []byte
+}
+
+// findSlot returns the key slot for a provider, or nil
+func findSlot(slots []keySlot, provider string) *keySlot {
+	for i := range slots {
+		if slots[i].Provider == provider {
+			return &slots[i]
+		}
+	}
+	return nil
+}
+
+// appendKeySlots encodes key slots as count (1) followed by the slots
+func appendKeySlots(buf []byte, slots []keySlot) []byte {
+	buf = append(buf, byte(len(slots)))
+	for _, slot := range slots {
+		buf = append(buf, byte(len(slot.Provider)))
+		buf = append(buf, slot.Provider...)
+		buf = append(buf, byte(len(slot.KeyID)))
+		buf = append(buf, slot.KeyID...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(slot.WrappedKey)))
+		buf = append(buf, slot.WrappedKey...)
+	}
+	return buf
+}
+
+// errKeySlotsTruncated is returned by readKeySlots when data ends early
+var errKeySlotsTruncated = errors.New("key slots are truncated")
+
+// readKeySlots decodes key slots written by appendKeySlots, returning the
+// number of bytes consumed
+func readKeySlots(data []byte) ([]keySlot, int, error) {
+	offset := 0
+	next := func(n int) ([]byte, error) {
+		if len(data) < offset+n {
+			return nil, errKeySlotsTruncated
+		}
+		b := data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	lengthPrefixed := func() ([]byte, error) {
+		n, err := next(1)
+		if err != nil {
+			return nil, err
+		}
+		return next(int(n[0]))
+	}
+
+	count, err := next(1)
+	if err != nil {
+		return nil, 0, err
+	}
+	if count[0] == 0 {
+		return nil, 0, errors.New("no key slots")
+	}
+
+	slots := make([]keySlot, 0, count[0])
+	for i := 0; i < int(count[0]); i++ {
+		provider, err := lengthPrefixed()
+		if err != nil {
+			return nil, 0, err
+		}
+		keyID, err := lengthPrefixed()
+		if err != nil {
+			return nil, 0, err
+		}
+		if !ValidKeyID(string(keyID)) {
+			return nil, 0, errors.New("bad key ID")
+		}
+		wrappedLen, err := next(2)
+		if err != nil {
+			return nil, 0, err
+		}
+		wrapped, err := next(int(binary.BigEndian.Uint16(wrappedLen)))
+		if err != nil {
+			return nil, 0, err
+		}
+		slots = append(slots, keySlot{Provider: string(provider), KeyID: string(keyID), WrappedKey: wrapped})
+	}
+
+	return slots, offset, nil
+}
+
+// WrappedDataKey is a data encryption key stored wrapped by one or more
+// master keys, one key slot each, for data kept outside the container
+// format (the WAL and the SQLite database)
+type WrappedDataKey struct {
+	slots []keySlot
+}
+
+// ParseWrappedDataKey decodes a data key encoded with MarshalBinary
+func ParseWrappedDataKey(data []byte) (*WrappedDataKey, error) {
+	slots, n, err := readKeySlots(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped data key: %w", err)
+	}
+	if n != len(data) {
+		return nil, errors.New("invalid wrapped data key: trailing data")
+	}
+	return &WrappedDataKey{slots: slots}, nil
+}
+
+// MarshalBinary encodes the key slots
+func (w *WrappedDataKey) MarshalBinary() ([]byte, error) {
+	return appendKeySlots(nil, w.slots), nil
+}
+
+// KeyID returns the ID of the master key in the first (primary) slot
+func (w *WrappedDataKey) KeyID() string {
+	return w.slots[0].KeyID
+}
+
+// RecoveryKeyID returns the ID of the recovery key slot, if any
+func (w *WrappedDataKey) RecoveryKeyID() string {
+	if slot := findSlot(w.slots, RecoveryProviderName); slot != nil {
+		return slot.KeyID
+	}
+	return ""
+}
+
+// envelopePrefixSize is the authenticated part of a version 2 header
+const envelopePrefixSize = len(containerMagic) + 2
+
+// compressedPrefixSize is the authenticated part of a version 3 header
+const compressedPrefixSize = envelopePrefixSize + 1 + 8
+
+// marshal encodes the header
+func (h *containerHeader) marshal() []byte {
+	buf := make([]byte, 0, 256)
+	buf = append(buf, containerMagic...)
+	buf = append(buf, h.Version)
+
+	if h.Version == 1 {
+		buf = appendKDFParams(buf, h.KDF)
+		buf = append(buf, byte(len(h.Salt)))
+		buf = append(buf, h.Salt...)
+		buf = append(buf, byte(h.Cipher))
+		buf = append(buf, byte(len(h.KeyID)))
+		buf = append(buf, h.KeyID...)
+	} else {
+		buf = append(buf, byte(h.Cipher))
+		if h.Version == CompressedContainerVersion {
+			buf = append(buf, byte(h.Compression))
+			buf = binary.BigEndian.AppendUint64(buf, h.UncompressedSize)
+		}
+		buf = appendKeySlots(buf, h.KeySlots)
+	}
+
+	buf = append(buf, byte(len(h.IV)))
+	buf = append(buf, h.IV...)
+	return buf
+}
+
+// additionalData returns the part of the raw header that is authenticated
+// together with the payload
+func (h *containerHeader) additionalData(raw []byte) []byte {
+	if h.Version == 1 {
+		return raw
+	}
+	if h.Version == CompressedContainerVersion {
+		return raw[:compressedPrefixSize]
+	}
+	return raw[:envelopePrefixSize]
+}
+
+// parseContainer splits a versioned file into its header, the raw header
+// bytes and the ciphertext. ok is false when the data is not a container.
+func parseContainer(data []byte) (header *containerHeader, raw, body []byte, ok bool, err error) {
+	if !bytes.HasPrefix(data, []byte(containerMagic)) {
+		return nil, nil, nil, false, nil
+	}
+
+	offset := len(containerMagic)
+	next := func(n int) ([]byte, error) {
+		if n < 0 || len(data) < offset+n {
+			return nil, errors.New("encrypted file header is truncated")
+		}
+		b := data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	lengthPrefixed := func() ([]byte, error) {
+		n, err := next(1)
+		if err != nil {
+			return nil, err
+		}
+		return next(int(n[0]))
+	}
+	readCipher := func(h *containerHeader) error {
+		cipherID, err := next(1)
+		if err != nil {
+			return err
+		}
+		h.Cipher = CipherAlgorithm(cipherID[0])
+		if h.Cipher != CipherAES256GCM {
+			return fmt.Errorf("unsupported cipher %d", h.Cipher)
+		}
+		return nil
+	}
+	readKeyID := func() (string, error) {
+		keyID, err := lengthPrefixed()
+		if err != nil {
+			return "", err
+		}
+		if !ValidKeyID(string(keyID)) {
+			return "", errors.New("invalid encrypted file header: bad key ID")
+		}
+		return string(keyID), nil
+	}
+
+	version, err := next(1)
+	if err != nil {
+		return nil, nil, nil, true, err
+	}
+
+	h := &containerHeader{Version: version[0]}
+
+	switch h.Version {
+	case 1:
+		kdf, n, err := readKDFParams(data[offset:])
+		if err != nil {
+			return nil, nil, nil, true, fmt.Errorf("invalid encrypted file header: %w", err)
+		}
+		h.KDF = kdf
+		offset += n
+
+		if h.Salt, err = lengthPrefixed(); err != nil {
+			return nil, nil, nil, true, err
+		}
+		if len(h.Salt) != SaltSize {
+			return nil, nil, nil, true, errors.New("invalid encrypted file header: bad salt size")
+		}
+		if err := readCipher(h); err != nil {
+			return nil, nil, nil, true, err
+		}
+		if h.KeyID, err = readKeyID(); err != nil {
+			return nil, nil, nil, true, err
+		}
+	case ContainerVersion, CompressedContainerVersion:
+		if err := readCipher(h); err != nil {
+			return nil, nil, nil, true, err
+		}
+		if h.Version == CompressedContainerVersion {
+			compression, err := next(9)
+			if err != nil {
+				return nil, nil, nil, true, err
+			}
+			h.Compression = CompressionAlgorithm(compression[0])
+			if h.Compression != CompressionGzip && h.Compression != CompressionZstd {
+				return nil, nil, nil, true, fmt.Errorf("unsupported compression %d", h.Compression)
+			}
+			h.UncompressedSize = binary.BigEndian.Uint64(compression[1:])
+			if h.UncompressedSize > maxUncompressedSize {
+				return nil, nil, nil, true, errors.New("invalid encrypted file header: bad uncompressed size")
+			}
+		}
+		slots, n, err := readKeySlots(data[offset:])
+		if errors.Is(err, errKeySlotsTruncated) {
+			return nil, nil, nil, true, errors.New("encrypted file header is truncated")
+		}
+		if err != nil {
+			return nil, nil, nil, true, fmt.Errorf("invalid encrypted file header: %w", err)
+		}
+		h.KeySlots = slots
+		offset += n
+	default:
+		return nil, nil, nil, true, fmt.Errorf("unsupported encrypted file version %d", h.Version)
+	}
+
+	if h.IV, err = lengthPrefixed(); err != nil {
+		return nil, nil, nil, true, err
+	}
+	if len(h.IV) != IVSize {
+		return nil, nil, nil, true, errors.New("invalid encrypted file header: bad IV size")
+	}
+
+	if len(data) < offset+TagSize {
+		return nil, nil, nil, true, errors.New("encrypted data too short")
+	}
+
+	return h, data[:offset], data[offset:], true, nil
+}
+
+// EncryptedFileInfo describes the format of an encrypted file
+type EncryptedFileInfo struct {
+	Format        string `json:"format"`
+	KeyID         string `json:"key_id,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+	RecoveryKeyID string `json:"recovery_key_id,omitempty"`
+	KDF           string `json:"kdf,omitempty"`
+	Cipher        string `json:"cipher"`
+	Compression   string `json:"compression,omitempty"`
+
+	// PlaintextSize is the size of the data before compression and
+	// encryption
+	PlaintextSize int64 `json:"plaintext_size,omitempty"`
+}
+
+// InspectEncrypted reports how data was encrypted without decrypting it
+func InspectEncrypted(data []byte) EncryptedFileInfo {
+	if header, _, body, ok, err := parseContainer(data); ok {
+		if err != nil {
+			return EncryptedFileInfo{Format: "invalid"}
+		}
+		info := EncryptedFileInfo{
+			Format:        fmt.Sprintf("v%d", header.Version),
+			KeyID:         header.KeyID,
+			Cipher:        "aes-256-gcm",
+			Compression:   header.Compression.String(),
+			PlaintextSize: int64(len(body) - TagSize),
+		}
+		if header.Version == CompressedContainerVersion {
+			info.PlaintextSize = int64(header.UncompressedSize)
+		}
+		if header.Version == 1 {
+			info.KDF = header.KDF.String()
+		} else {
+			primary := header.KeySlots[0]
+			info.KeyID = primary.KeyID
+			info.Provider = primary.Provider
+			info.RecoveryKeyID = (&WrappedDataKey{slots: header.KeySlots}).RecoveryKeyID()
+			if primary.Provider == "password" {
+				if kdf, _, err := readKDFParams(primary.WrappedKey); err == nil {
+					info.KDF = kdf.String()
+				}
+			}
+		}
+		return info
+	}
+
+	info := EncryptedFileInfo{
+		Format:      "legacy",
+		KDF:         DefaultKDFParams().String(),
+		Cipher:      "aes-256-gcm",
+		Compression: CompressionNone.String(),
+	}
+	body := data
+	if keyID, keyedBody, ok := decodeKeyHeader(data); ok {
+		info.Format = "legacy-keyed"
+		info.KeyID = keyID
+		body = keyedBody
+	}
+	if size := len(body) - SaltSize - IVSize - TagSize; size > 0 {
+		info.PlaintextSize = int64(size)
+	}
+	return info
+}
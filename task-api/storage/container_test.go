@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testHeaders returns one header of each container version
+func testHeaders() map[string]*containerHeader {
+	iv := bytes.Repeat([]byte{0x11}, IVSize)
+	slots := []keySlot{
+		{Provider: "local", KeyID: "key-2024", WrappedKey: bytes.Repeat([]byte{0x22}, 60)},
+		{Provider: RecoveryProviderName, KeyID: "recovery.1", WrappedKey: bytes.Repeat([]byte{0x33}, 300)},
+	}
+
+	return map[string]*containerHeader{
+		"password": {
+			Version: 1,
+			Cipher:  CipherAES256GCM,
+			KeyID:   "primary",
+			IV:      iv,
+			KDF:     DefaultArgon2idParams(),
+			Salt:    bytes.Repeat([]byte{0x44}, SaltSize),
+		},
+		"envelope": {
+			Version:  ContainerVersion,
+			Cipher:   CipherAES256GCM,
+			IV:       iv,
+			KeySlots: slots,
+		},
+		"compressed": {
+			Version:          CompressedContainerVersion,
+			Cipher:           CipherAES256GCM,
+			IV:               iv,
+			KeySlots:         slots[:1],
+			Compression:      CompressionZstd,
+			UncompressedSize: 1 << 20,
+		},
+	}
+}
+
+func TestContainerHeaderRoundTrip(t *testing.T) {
+	for name, header := range testHeaders() {
+		t.Run(name, func(t *testing.T) {
+			raw := header.marshal()
+			payload := bytes.Repeat([]byte{0x55}, TagSize+10)
+
+			got, gotRaw, body, ok, err := parseContainer(append(append([]byte(nil), raw...), payload...))
+			if !ok || err != nil {
+				t.Fatalf("parseContainer: ok = %v, err = %v", ok, err)
+			}
+			if !reflect.DeepEqual(got, header) {
+				t.Errorf("got header %+v, want %+v", got, header)
+			}
+			if !bytes.Equal(gotRaw, raw) {
+				t.Error("raw header differs from the marshalled one")
+			}
+			if !bytes.Equal(body, payload) {
+				t.Error("body differs from the payload")
+			}
+		})
+	}
+}
+
+func TestParseContainerTruncated(t *testing.T) {
+	for name, header := range testHeaders() {
+		data := append(header.marshal(), make([]byte, TagSize)...)
+
+		for n := len(containerMagic); n < len(data); n++ {
+			if _, _, _, ok, err := parseContainer(data[:n]); !ok || err == nil {
+				t.Errorf("%s cut to %d of %d bytes: ok = %v, err = %v", name, n, len(data), ok, err)
+			}
+		}
+	}
+}
+
+func TestParseContainerNotAContainer(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("TEN"), []byte("not a container at all")} {
+		if _, _, _, ok, err := parseContainer(data); ok || err != nil {
+			t.Errorf("%q: ok = %v, err = %v", data, ok, err)
+		}
+	}
+}
+
+func TestParseContainerRejectsInvalidHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(h *containerHeader)
+		want   string
+	}{
+		{"unknown version", func(h *containerHeader) { h.Version = 9 }, "unsupported encrypted file version"},
+		{"unknown cipher", func(h *containerHeader) { h.Cipher = 7 }, "unsupported cipher"},
+		{"unknown compression", func(h *containerHeader) { h.Compression = 9 }, "unsupported compression"},
+		{"oversized plaintext", func(h *containerHeader) { h.UncompressedSize = maxUncompressedSize + 1 }, "bad uncompressed size"},
+		{"no key slots", func(h *containerHeader) { h.KeySlots = nil }, "no key slots"},
+		{"bad key ID", func(h *containerHeader) { h.KeySlots[0].KeyID = "bad/id" }, "bad key ID"},
+		{"short IV", func(h *containerHeader) { h.IV = h.IV[:8] }, "bad IV size"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			header := testHeaders()["compressed"]
+			header.KeySlots = append([]keySlot(nil), header.KeySlots...)
+			tc.modify(header)
+
+			data := append(header.marshal(), make([]byte, TagSize)...)
+			if _, _, _, ok, err := parseContainer(data); !ok || err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("ok = %v, err = %v, want an error about %q", ok, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseContainerRejectsInvalidPasswordHeaders(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(h *containerHeader)
+	}{
+		{"unknown KDF", func(h *containerHeader) { h.KDF.Algorithm = 9 }},
+		{"too few iterations", func(h *containerHeader) { h.KDF = KDFParams{Algorithm: KDFPBKDF2SHA256, Iterations: 1} }},
+		{"too much memory", func(h *containerHeader) { h.KDF.MemoryKiB = maxArgon2MemoryKiB + 1 }},
+		{"short salt", func(h *containerHeader) { h.Salt = h.Salt[:8] }},
+		{"bad key ID", func(h *containerHeader) { h.KeyID = "" }},
+	}
+
+	for _, tc := range tests {
+		header := testHeaders()["password"]
+		tc.modify(header)
+
+		data := append(header.marshal(), make([]byte, TagSize)...)
+		if _, _, _, ok, err := parseContainer(data); !ok || err == nil {
+			t.Errorf("%s: ok = %v, err = %v", tc.name, ok, err)
+		}
+	}
+}
+
+func TestKDFParamsBinaryRoundTrip(t *testing.T) {
+	for _, params := range []KDFParams{DefaultKDFParams(), DefaultArgon2idParams()} {
+		data, err := params.MarshalBinary()
+		if err != nil {
+			t.Fatalf("%s: MarshalBinary: %v", params, err)
+		}
+
+		var got KDFParams
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%s: UnmarshalBinary: %v", params, err)
+		}
+		if got != params {
+			t.Errorf("got %s, want %s", got, params)
+		}
+
+		for n := 0; n < len(data); n++ {
+			if err := got.UnmarshalBinary(data[:n]); err == nil {
+				t.Errorf("%s: UnmarshalBinary accepted %d of %d bytes", params, n, len(data))
+			}
+		}
+		if err := got.UnmarshalBinary(append(data, 0)); err == nil {
+			t.Errorf("%s: UnmarshalBinary accepted trailing data", params)
+		}
+	}
+
+	if _, err := (KDFParams{Algorithm: KDFArgon2id, Iterations: 1, MemoryKiB: 1, Threads: 1}).MarshalBinary(); err == nil {
+		t.Error("MarshalBinary accepted parameters out of bounds")
+	}
+}
+
+func TestWrappedDataKeyRoundTrip(t *testing.T) {
+	slots := testHeaders()["envelope"].KeySlots
+	data, err := (&WrappedDataKey{slots: slots}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseWrappedDataKey(data)
+	if err != nil {
+		t.Fatalf("ParseWrappedDataKey: %v", err)
+	}
+	if !reflect.DeepEqual(key.slots, slots) {
+		t.Errorf("got slots %+v, want %+v", key.slots, slots)
+	}
+	if key.KeyID() != "key-2024" || key.RecoveryKeyID() != "recovery.1" {
+		t.Errorf("got key IDs %q and %q", key.KeyID(), key.RecoveryKeyID())
+	}
+
+	for n := 0; n < len(data); n++ {
+		if _, err := ParseWrappedDataKey(data[:n]); err == nil {
+			t.Errorf("ParseWrappedDataKey accepted %d of %d bytes", n, len(data))
+		}
+	}
+	if _, err := ParseWrappedDataKey(append(data, 0)); err == nil {
+		t.Error("ParseWrappedDataKey accepted trailing data")
+	}
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// QuarantineDir holds data files that were found corrupt, inside the data
+// directory
+const QuarantineDir = "quarantine"
+
+// CorruptionRecoveryMode decides what happens at startup when the data file
+// cannot be decrypted or does not contain valid tasks
+type CorruptionRecoveryMode string
+
+const (
+	// CorruptionRecoveryAuto quarantines the data file and restores the
+	// newest valid backup
+	CorruptionRecoveryAuto CorruptionRecoveryMode = "auto"
+
+	// CorruptionRecoveryRefuse fails startup and leaves everything as is
+	CorruptionRecoveryRefuse CorruptionRecoveryMode = "refuse"
+
+	// CorruptionRecoveryReadOnly recovers like auto, but the server rejects
+	// changes until it is restarted so the recovered data can be reviewed
+	CorruptionRecoveryReadOnly CorruptionRecoveryMode = "read-only"
+)
+
+// RejectedBackup is a backup that could not be used for recovery
+type RejectedBackup struct {
+	Backup string `json:"backup"`
+	Error  string `json:"error"`
+}
+
+// CorruptionIncident describes a recovery from a corrupt data file. It is
+// written as report.json next to the quarantined files.
+type CorruptionIncident struct {
+	DetectedAt        string                 `json:"detected_at"`
+	Mode              CorruptionRecoveryMode `json:"mode"`
+	DataFile          string                 `json:"data_file"`
+	Error             string                 `json:"error"`
+	Size              int64                  `json:"size"`
+	SHA256            string                 `json:"sha256"`
+	QuarantineDir     string                 `json:"quarantine_dir"`
+	Quarantined       []string               `json:"quarantined"`
+	RestoredFrom      string                 `json:"restored_from"`
+	RestoredTaskCount int                    `json:"restored_task_count"`
+	RejectedBackups   []RejectedBackup       `json:"rejected_backups,omitempty"`
+	ReadOnly          bool                   `json:"read_only"`
+}
+
+// SetCorruptionRecovery sets how Initialize handles a corrupt data file.
+// validate checks decrypted data, both of the data file and of backups
+// considered for restoring. Without a call corrupt data fails Initialize.
+func (es *EncryptedStorage) SetCorruptionRecovery(mode CorruptionRecoveryMode, validate BackupValidator) {
+	es.corruptionMode = mode
+	es.validateData = validate
+}
+
+// CorruptionIncident returns the recovery Initialize performed, or nil if
+// the data file was fine
+func (es *EncryptedStorage) CorruptionIncident() *CorruptionIncident {
+	return es.incident
+}
+
+// checkDataFile reads, decrypts and validates the data file. corrupt is
+// true if the file could be read but its contents are unusable.
+func (es *EncryptedStorage) checkDataFile() (corrupt bool, err error) {
+	if !es.fileManager.FileExists(es.dataFile) {
+		return false, nil // No existing data to validate against
+	}
+
+	encryptedData, err := es.fileManager.ReadFile(es.dataFile)
+	if err != nil {
+		return false, fmt.Errorf("failed to read data file for validation: %w", err)
+	}
+	if len(encryptedData) == 0 {
+		return true, errors.New("data file is empty")
+	}
+
+	plaintext, err := es.cryptoService.Decrypt(encryptedData)
+	if err != nil {
+		return true, err
+	}
+	defer SecureWipe(plaintext)
+
+	if es.validateData != nil {
+		if _, err := es.validateData(plaintext); err != nil {
+			return true, fmt.Errorf("data file contains invalid tasks: %w", err)
+		}
+	}
+	return false, nil
+}
+
+// recoverCorruptDataFile moves a corrupt data file and the write-ahead log
+// that builds on it to a new quarantine directory and restores the newest
+// backup that decrypts and validates. A data file that fails to decrypt
+// looks the same as a wrong key, so nothing is changed unless some backup
+// decrypts with the current key.
+func (es *EncryptedStorage) recoverCorruptDataFile(cause error) error {
+	mode := es.corruptionMode
+	if mode != CorruptionRecoveryAuto && mode != CorruptionRecoveryReadOnly {
+		return cause
+	}
+
+	log.Printf("Data file %s is corrupted: %v", es.dataFile, cause)
+
+	incident := &CorruptionIncident{
+		DetectedAt:  time.Now().UTC().Format(time.RFC3339),
+		Mode:        mode,
+		DataFile:    es.dataFile,
+		Error:       cause.Error(),
+		Quarantined: []string{},
+		ReadOnly:    mode == CorruptionRecoveryReadOnly,
+	}
+
+	backupName, backupData := es.newestValidBackup(incident)
+	if backupName == "" {
+		return fmt.Errorf("%w; no backup can be decrypted and validated either, which points to a wrong key rather than corruption, so nothing was changed", cause)
+	}
+
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	corruptData, err := es.fileManager.ReadFile(es.dataFile)
+	if err != nil {
+		return fmt.Errorf("failed to read corrupt data file: %w", err)
+	}
+	sum := sha256.Sum256(corruptData)
+	incident.Size = int64(len(corruptData))
+	incident.SHA256 = hex.EncodeToString(sum[:])
+
+	dir, err := es.newQuarantineDir()
+	if err != nil {
+		return err
+	}
+	incident.QuarantineDir = filepath.Join(QuarantineDir, filepath.Base(dir))
+
+	// Copy rather than move the data file, so it is only replaced once the
+	// backup is in place
+	if err := writeDurable(es.fileManager.fs, filepath.Join(dir, es.dataFile), corruptData, false); err != nil {
+		return fmt.Errorf("failed to quarantine data file: %w", err)
+	}
+	incident.Quarantined = append(incident.Quarantined, es.dataFile)
+
+	// The log records changes made after the corrupt snapshot and cannot be
+	// replayed over an older backup
+	walPath := filepath.Join(es.fileManager.dataDir, DefaultWALFile)
+	if _, err := es.fileManager.fs.Stat(walPath); err == nil {
+		if err := es.fileManager.fs.Rename(walPath, filepath.Join(dir, DefaultWALFile)); err != nil {
+			return fmt.Errorf("failed to quarantine write-ahead log: %w", err)
+		}
+		incident.Quarantined = append(incident.Quarantined, DefaultWALFile)
+	}
+
+	if err := es.fileManager.WriteFile(es.dataFile, backupData); err != nil {
+		return fmt.Errorf("failed to restore backup %s: %w", backupName, err)
+	}
+	incident.RestoredFrom = backupName
+
+	report, err := json.MarshalIndent(incident, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeDurable(es.fileManager.fs, filepath.Join(dir, "report.json"), report, false); err != nil {
+		log.Printf("Warning: failed to write quarantine report: %v", err)
+	}
+
+	es.incident = incident
+	log.Printf("Quarantined corrupt data in %s and restored %d tasks from backup %s",
+		incident.QuarantineDir, incident.RestoredTaskCount, backupName)
+	if incident.ReadOnly {
+		log.Printf("Starting read-only: review the recovered data, then restart with CORRUPTION_RECOVERY=auto to accept changes again")
+	}
+
+	return nil
+}
+
+// newestValidBackup returns the name and encrypted contents of the newest
+// backup that decrypts and validates, recording the task count and the
+// backups rejected on the way in the incident
+func (es *EncryptedStorage) newestValidBackup(incident *CorruptionIncident) (string, []byte) {
+	backups, err := es.fileManager.ListBackups()
+	if err != nil {
+		log.Printf("Warning: cannot list backups to recover from: %v", err)
+		return "", nil
+	}
+
+	reject := func(backupName string, err error) {
+		log.Printf("Backup %s cannot be used for recovery: %v", backupName, err)
+		incident.RejectedBackups = append(incident.RejectedBackups, RejectedBackup{Backup: backupName, Error: err.Error()})
+	}
+
+	validate := es.validateData
+	if validate == nil {
+		validate = countTasks
+	}
+
+	for i := len(backups) - 1; i >= 0; i-- {
+		backupName := backups[i]
+
+		encryptedData, err := es.fileManager.ReadFile(filepath.Join("backups", backupName))
+		if err != nil {
+			reject(backupName, err)
+			continue
+		}
+		plaintext, err := es.cryptoService.Decrypt(encryptedData)
+		if err != nil {
+			reject(backupName, err)
+			continue
+		}
+		taskCount, err := validate(plaintext)
+		SecureWipe(plaintext)
+		if err != nil {
+			reject(backupName, fmt.Errorf("invalid tasks: %w", err))
+			continue
+		}
+
+		incident.RestoredTaskCount = taskCount
+		return backupName, encryptedData
+	}
+
+	return "", nil
+}
+
+// newQuarantineDir creates a directory for one incident, named after the
+// current time
+func (es *EncryptedStorage) newQuarantineDir() (string, error) {
+	parent := filepath.Join(es.fileManager.dataDir, QuarantineDir)
+	if err := es.fileManager.fs.MkdirAll(parent, 0700); err != nil {
+		return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+
+	baseName := time.Now().Format(backupTimeLayout)
+	for attempt := 1; attempt <= 100; attempt++ {
+		name := baseName
+		if attempt > 1 {
+			name = fmt.Sprintf("%s_%d", baseName, attempt)
+		}
+		dir := filepath.Join(parent, name)
+		err := es.fileManager.fs.Mkdir(dir, 0700)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		return dir, nil
+	}
+
+	return "", errors.New("failed to find a free quarantine directory name")
+}
@@ -1,13 +1,14 @@
 package storage
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
 	"crypto/rand"
-	"crypto/sha256"
 	"errors"
+	"fmt"
 	"math/big"
-	"golang.org/x/crypto/pbkdf2"
 )
 
 const (
@@ -17,32 +18,105 @@ const (
 	TagSize      = 16   // 128-bit authentication tag
 	KeySize      = 32   // 256-bit key
 	PBKDF2Iters  = 100000 // PBKDF2 iterations for key derivation
+	
+	// Key header of files written before the container format
+	keyHeaderMagic = "TKEY"
 )
 
-// CryptoService handles encryption and decryption operations
+// CryptoService handles encryption and decryption operations. Data is
+// encrypted with a random data key per file, wrapped by the master key
+// provider and, once recovery is set up, by the recovery key. The password
+// keyring, when present, also decrypts files written before envelope
+// encryption.
 type CryptoService struct {
-	password string
+	provider MasterKeyProvider
+	keyring  *Keyring
+
+	recoveryKey        *RecoveryKey
+	recoveryPrivateKey *ecdh.PrivateKey
+
+	// compression is applied to plaintext before encryption
+	compression CompressionAlgorithm
 }
 
 // NewCryptoService creates a new crypto service with the given password
+// registered under DefaultKeyID
 func NewCryptoService(password string) *CryptoService {
+	return NewCryptoServiceWithKeyring(&Keyring{
+		activeID: DefaultKeyID,
+		keys:     map[string]string{DefaultKeyID: password},
+		order:    []string{DefaultKeyID},
+	})
+}
+
+// NewCryptoServiceWithKeyring creates a crypto service that wraps data keys
+// with the keyring's active password and unwraps them with any password it
+// holds
+func NewCryptoServiceWithKeyring(keyring *Keyring) *CryptoService {
+	provider, _ := NewPasswordKeyProvider(keyring, DefaultKDFParams())
+	return NewEnvelopeCryptoService(provider, keyring)
+}
+
+// NewEnvelopeCryptoService creates a crypto service that wraps data keys
+// with provider. legacyKeyring may be nil; it is only needed to read data
+// written before envelope encryption.
+func NewEnvelopeCryptoService(provider MasterKeyProvider, legacyKeyring *Keyring) *CryptoService {
 	return &CryptoService{
-		password: password,
+		provider: provider,
+		keyring:  legacyKeyring,
 	}
 }
 
-// deriveKey derives an encryption key from password and salt using PBKDF2
-func (c *CryptoService) deriveKey(salt []byte) []byte {
-	return pbkdf2.Key([]byte(c.password), salt, PBKDF2Iters, KeySize, sha256.New)
+// Provider returns the master key provider
+func (c *CryptoService) Provider() MasterKeyProvider {
+	return c.provider
 }
 
-// generateSalt generates a random salt for key derivation
-func (c *CryptoService) generateSalt() ([]byte, error) {
-	salt := make([]byte, SaltSize)
-	if _, err := rand.Read(salt); err != nil {
-		return nil, errors.New("failed to generate salt")
+// Keyring returns the password keyring, or nil if none is configured
+func (c *CryptoService) Keyring() *Keyring {
+	return c.keyring
+}
+
+// RecoveryKey returns the recovery key, or nil if recovery is not set up
+func (c *CryptoService) RecoveryKey() *RecoveryKey {
+	return c.recoveryKey
+}
+
+// setRecoveryKey wraps every data key written from now on for the recovery
+// key as well
+func (c *CryptoService) setRecoveryKey(key *RecoveryKey) {
+	c.recoveryKey = key
+}
+
+// StartRecovery reconstructs the recovery private key from shares so data
+// keys can be unwrapped without the master key. While recovering, every
+// data key counts as out of date, so a key rotation re-wraps all data under
+// the (new) active master key.
+func (c *CryptoService) StartRecovery(key *RecoveryKey, shares []string) error {
+	privateKey, err := key.combineShares(shares)
+	if err != nil {
+		return err
 	}
-	return salt, nil
+	c.recoveryKey = key
+	c.recoveryPrivateKey = privateKey
+	return nil
+}
+
+// Recovering reports whether StartRecovery was called
+func (c *CryptoService) Recovering() bool {
+	return c.recoveryPrivateKey != nil
+}
+
+// legacyPassword returns the password for a key ID in the keyring
+func (c *CryptoService) legacyPassword(keyID string) (string, error) {
+	if c.keyring == nil {
+		return "", errors.New("data was encrypted with a password; set TASK_ENCRYPTION_KEY to read it")
+	}
+	password, ok := c.keyring.password(keyID)
+	if !ok {
+		return "", fmt.Errorf("data is encrypted with unknown key ID %q", keyID)
+	}
+	return password, nil
 }
 
 // generateIV generates a random IV for AES-GCM encryption
@@ -54,31 +128,36 @@ func (c *CryptoService) generateIV() ([]byte, error) {
 	return iv, nil
 }
 
-// Encrypt encrypts plaintext using AES-256-GCM with random salt and IV
-// Returns: salt + iv + ciphertext + tag
+// SetCompression sets the algorithm that compresses plaintext before it is
+// encrypted. Decrypt reads every algorithm regardless.
+func (c *CryptoService) SetCompression(algorithm CompressionAlgorithm) {
+	c.compression = algorithm
+}
+
+// Compression returns the algorithm Encrypt compresses plaintext with
+func (c *CryptoService) Compression() CompressionAlgorithm {
+	return c.compression
+}
+
+// Encrypt encrypts plaintext using AES-256-GCM with a random data key and IV
+// and wraps the data key with the active master key. With compression set,
+// the plaintext is compressed first unless that would not make it smaller.
+// Returns: container header + ciphertext + tag (see containerHeader)
 func (c *CryptoService) Encrypt(plaintext []byte) ([]byte, error) {
 	if len(plaintext) == 0 {
 		return nil, errors.New("plaintext cannot be empty")
 	}
 
-	// Generate random salt and derive key
-	salt, err := c.generateSalt()
+	// Generate and wrap a data key for this file
+	dek, wrapped, err := c.GenerateDataKey()
 	if err != nil {
 		return nil, err
 	}
+	defer SecureWipe(dek)
 	
-	key := c.deriveKey(salt)
-	
-	// Create AES cipher
-	block, err := aes.NewCipher(key)
+	gcm, err := newGCM(dek)
 	if err != nil {
-		return nil, errors.New("failed to create AES cipher")
-	}
-	
-	// Create GCM mode
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, errors.New("failed to create GCM cipher")
+		return nil, err
 	}
 	
 	// Generate random IV
@@ -87,21 +166,198 @@ func (c *CryptoService) Encrypt(plaintext []byte) ([]byte, error) {
 		return nil, err
 	}
 	
-	// Encrypt data
-	ciphertext := gcm.Seal(nil, iv, plaintext, nil)
+	header := &containerHeader{
+		Version:  ContainerVersion,
+		Cipher:   CipherAES256GCM,
+		KeySlots: wrapped.slots,
+		IV:       iv,
+	}
 	
-	// Combine: salt + iv + ciphertext (includes tag)
-	result := make([]byte, 0, SaltSize+IVSize+len(ciphertext))
-	result = append(result, salt...)
-	result = append(result, iv...)
-	result = append(result, ciphertext...)
+	if c.compression != CompressionNone {
+		compressed, err := compress(c.compression, plaintext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compress data: %w", err)
+		}
+		defer SecureWipe(compressed)
+		if len(compressed) < len(plaintext) {
+			header.Version = CompressedContainerVersion
+			header.Compression = c.compression
+			header.UncompressedSize = uint64(len(plaintext))
+			plaintext = compressed
+		}
+	}
+	raw := header.marshal()
 	
-	return result, nil
+	// Encrypt data; the result is header + ciphertext (includes tag)
+	return gcm.Seal(raw, iv, plaintext, header.additionalData(raw)), nil
 }
 
 // Decrypt decrypts ciphertext using AES-256-GCM
-// Expects: salt + iv + ciphertext + tag format
+// Expects a container, or one of the legacy layouts: key header + salt + iv +
+// ciphertext + tag, or plain salt + iv + ciphertext + tag. Legacy data always
+// used PBKDF2 with the default parameters; headerless data predates key IDs
+// and is tried against every key in the keyring.
 func (c *CryptoService) Decrypt(encrypted []byte) ([]byte, error) {
+	header, raw, body, ok, err := parseContainer(encrypted)
+	if ok {
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		return c.decryptContainer(header, raw, body)
+	}
+	
+	if keyID, body, ok := decodeKeyHeader(encrypted); ok {
+		password, err := c.legacyPassword(keyID)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		return decryptWithPassword(password, body)
+	}
+	
+	if c.keyring == nil {
+		_, err := c.legacyPassword("")
+		return nil, fmt.Errorf("decryption failed: %w", err)
+	}
+	
+	// Legacy headerless data: try the active key first, then retired keys
+	var lastErr error
+	for _, keyID := range c.keyring.IDs() {
+		password, _ := c.keyring.password(keyID)
+		plaintext, err := decryptWithPassword(password, encrypted)
+		if err == nil {
+			return plaintext, nil
+		}
+		lastErr = err
+	}
+	
+	return nil, lastErr
+}
+
+// decryptContainer decrypts the body of a versioned file
+func (c *CryptoService) decryptContainer(header *containerHeader, raw, body []byte) ([]byte, error) {
+	var key []byte
+	if header.Version == 1 {
+		password, err := c.legacyPassword(header.KeyID)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		key = header.KDF.deriveKey(password, header.Salt)
+	} else {
+		dek, err := c.unwrapSlots(header.KeySlots)
+		if err != nil {
+			return nil, fmt.Errorf("decryption failed: %w", err)
+		}
+		key = dek
+	}
+	defer SecureWipe(key)
+	
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	
+	plaintext, err := gcm.Open(nil, header.IV, body, header.additionalData(raw))
+	if err != nil {
+		return nil, errors.New("decryption failed: invalid data or wrong password")
+	}
+	
+	if header.Version == CompressedContainerVersion {
+		compressed := plaintext
+		defer SecureWipe(compressed)
+		return decompress(header.Compression, compressed, header.UncompressedSize)
+	}
+	
+	return plaintext, nil
+}
+
+// wrapSlots wraps a data key with the active master key and, if set up,
+// the recovery key. The master key slot always comes first.
+func (c *CryptoService) wrapSlots(dek []byte) ([]keySlot, error) {
+	keyID, wrapped, err := c.provider.WrapKey(dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	slots := []keySlot{{Provider: c.provider.Name(), KeyID: keyID, WrappedKey: wrapped}}
+
+	if c.recoveryKey != nil {
+		recoveryWrapped, err := c.recoveryKey.wrap(dek)
+		if err != nil {
+			return nil, fmt.Errorf("failed to wrap data key for recovery: %w", err)
+		}
+		slots = append(slots, keySlot{Provider: RecoveryProviderName, KeyID: c.recoveryKey.ID, WrappedKey: recoveryWrapped})
+	}
+
+	return slots, nil
+}
+
+// unwrapSlot unwraps a key slot of this service's provider, or a password
+// slot with the legacy keyring after switching away from passwords
+func (c *CryptoService) unwrapSlot(slot *keySlot) ([]byte, error) {
+	if slot.Provider == c.provider.Name() {
+		return c.provider.UnwrapKey(slot.KeyID, slot.WrappedKey)
+	}
+	if slot.Provider == "password" && c.keyring != nil {
+		passwordProvider := &PasswordKeyProvider{keyring: c.keyring, kdf: DefaultKDFParams()}
+		return passwordProvider.UnwrapKey(slot.KeyID, slot.WrappedKey)
+	}
+	return nil, fmt.Errorf("data key is not wrapped for the %s key provider", c.provider.Name())
+}
+
+// unwrapSlots recovers a data key from the slot of this service's provider,
+// or a password slot the legacy keyring can open, falling back to the
+// recovery slot while recovering
+func (c *CryptoService) unwrapSlots(slots []keySlot) ([]byte, error) {
+	slot := findSlot(slots, c.provider.Name())
+	if slot == nil && c.keyring != nil {
+		slot = findSlot(slots, "password")
+	}
+
+	err := fmt.Errorf("data key is not wrapped for the %s key provider", c.provider.Name())
+	if slot != nil {
+		var dek []byte
+		if dek, err = c.unwrapSlot(slot); err == nil {
+			return dek, nil
+		}
+	}
+
+	if c.recoveryPrivateKey != nil {
+		slot := findSlot(slots, RecoveryProviderName)
+		if slot == nil {
+			return nil, fmt.Errorf("%w, and it has no recovery key slot", err)
+		}
+		if slot.KeyID != c.recoveryKey.ID {
+			return nil, fmt.Errorf("%w, and its recovery slot is for recovery key %q", err, slot.KeyID)
+		}
+		return unwrapRecoveryKey(c.recoveryPrivateKey, slot.KeyID, slot.WrappedKey)
+	}
+
+	return nil, err
+}
+
+// slotsAreCurrent reports whether key slots match what wrapSlots would
+// write: the active master key and the current recovery key
+func (c *CryptoService) slotsAreCurrent(slots []keySlot) bool {
+	if c.recoveryPrivateKey != nil {
+		return false
+	}
+
+	slot := findSlot(slots, c.provider.Name())
+	if slot == nil || !c.provider.IsCurrent(slot.KeyID, slot.WrappedKey) {
+		return false
+	}
+
+	if c.recoveryKey != nil {
+		recoverySlot := findSlot(slots, RecoveryProviderName)
+		if recoverySlot == nil || recoverySlot.KeyID != c.recoveryKey.ID {
+			return false
+		}
+	}
+
+	return true
+}
+
+// decryptWithPassword decrypts a legacy salt + iv + ciphertext + tag blob
+func decryptWithPassword(password string, encrypted []byte) ([]byte, error) {
 	if len(encrypted) < SaltSize+IVSize+TagSize {
 		return nil, errors.New("encrypted data too short")
 	}
@@ -112,7 +368,7 @@ func (c *CryptoService) Decrypt(encrypted []byte) ([]byte, error) {
 	ciphertext := encrypted[SaltSize+IVSize:]
 	
 	// Derive key from salt
-	key := c.deriveKey(salt)
+	key := DefaultKDFParams().deriveKey(password, salt)
 	
 	// Create AES cipher
 	block, err := aes.NewCipher(key)
@@ -135,6 +391,115 @@ func (c *CryptoService) Decrypt(encrypted []byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// KeyID returns the ID of the key that encrypted the data, or an empty
+// string for legacy data written without a key ID
+func KeyID(encrypted []byte) string {
+	return InspectEncrypted(encrypted).KeyID
+}
+
+// IsCurrent reports whether data is already in the current container format
+// with its data key wrapped by the active master key and recovery key, so
+// rewriting it would change nothing
+func (c *CryptoService) IsCurrent(encrypted []byte) bool {
+	header, _, _, ok, err := parseContainer(encrypted)
+	if !ok || err != nil || !header.envelope() {
+		return false
+	}
+	return c.slotsAreCurrent(header.KeySlots)
+}
+
+// Rewrap re-wraps the data key of an envelope-encrypted file with the
+// active master key and recovery key, leaving the payload untouched. ok is
+// false if the data is in an older format and has to be re-encrypted
+// instead.
+func (c *CryptoService) Rewrap(encrypted []byte) (rewrapped []byte, ok bool, err error) {
+	header, _, body, isContainer, err := parseContainer(encrypted)
+	if !isContainer || err != nil || !header.envelope() {
+		return nil, false, nil
+	}
+
+	dek, err := c.unwrapSlots(header.KeySlots)
+	if err != nil {
+		return nil, true, err
+	}
+	defer SecureWipe(dek)
+
+	if header.KeySlots, err = c.wrapSlots(dek); err != nil {
+		return nil, true, err
+	}
+
+	newRaw := header.marshal()
+	result := make([]byte, 0, len(newRaw)+len(body))
+	result = append(result, newRaw...)
+	result = append(result, body...)
+	return result, true, nil
+}
+
+// GenerateDataKey generates a data key and wraps it with the active master
+// key and recovery key
+func (c *CryptoService) GenerateDataKey() ([]byte, *WrappedDataKey, error) {
+	dek, err := NewDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	slots, err := c.wrapSlots(dek)
+	if err != nil {
+		SecureWipe(dek)
+		return nil, nil, err
+	}
+
+	return dek, &WrappedDataKey{slots: slots}, nil
+}
+
+// UnwrapDataKey recovers a wrapped data key
+func (c *CryptoService) UnwrapDataKey(wrapped *WrappedDataKey) ([]byte, error) {
+	return c.unwrapSlots(wrapped.slots)
+}
+
+// RewrapDataKey unwraps a data key and wraps it again with the active
+// master key and recovery key
+func (c *CryptoService) RewrapDataKey(wrapped *WrappedDataKey) (*WrappedDataKey, error) {
+	dek, err := c.unwrapSlots(wrapped.slots)
+	if err != nil {
+		return nil, err
+	}
+	defer SecureWipe(dek)
+
+	slots, err := c.wrapSlots(dek)
+	if err != nil {
+		return nil, err
+	}
+	return &WrappedDataKey{slots: slots}, nil
+}
+
+// DataKeyIsCurrent reports whether a wrapped data key uses the active
+// master key and recovery key
+func (c *CryptoService) DataKeyIsCurrent(wrapped *WrappedDataKey) bool {
+	return c.slotsAreCurrent(wrapped.slots)
+}
+
+// decodeKeyHeader splits a legacy key header (magic "TKEY" + key ID length
+// (1 byte) + key ID) from the encrypted body
+func decodeKeyHeader(encrypted []byte) (string, []byte, bool) {
+	if !bytes.HasPrefix(encrypted, []byte(keyHeaderMagic)) || len(encrypted) < len(keyHeaderMagic)+1 {
+		return "", nil, false
+	}
+	
+	idLen := int(encrypted[len(keyHeaderMagic)])
+	start := len(keyHeaderMagic) + 1
+	if idLen == 0 || len(encrypted) < start+idLen+SaltSize+IVSize+TagSize {
+		return "", nil, false
+	}
+	
+	keyID := string(encrypted[start : start+idLen])
+	if !ValidKeyID(keyID) {
+		return "", nil, false
+	}
+	
+	return keyID, encrypted[start+idLen:], true
+}
+
 // ValidatePassword checks if the password can decrypt existing encrypted data
 func (c *CryptoService) ValidatePassword(encryptedData []byte) error {
 	if len(encryptedData) == 0 {
@@ -172,4 +537,60 @@ func GenerateSecurePassword(length int) (string, error) {
 	}
 	
 	return string(password), nil
-}
\ No newline at end of file
+}
+// RecordCipher encrypts many small records under a single derived key.
+// Deriving the key once avoids paying the KDF cost for every record.
+type RecordCipher struct {
+	gcm cipher.AEAD
+}
+
+// NewSalt generates a random salt for key derivation
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.New("failed to generate salt")
+	}
+	return salt, nil
+}
+
+// NewRecordCipherFromKey returns a cipher for encrypting individual records
+// with a data key
+func NewRecordCipherFromKey(dek []byte) (*RecordCipher, error) {
+	if len(dek) != DataKeySize {
+		return nil, errors.New("invalid data key size")
+	}
+
+	gcm, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RecordCipher{gcm: gcm}, nil
+}
+
+// Seal encrypts a record, binding it to the additional data
+// Returns: iv + ciphertext + tag
+func (rc *RecordCipher) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	iv := make([]byte, IVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.New("failed to generate IV")
+	}
+
+	result := make([]byte, 0, IVSize+len(plaintext)+TagSize)
+	result = append(result, iv...)
+	return rc.gcm.Seal(result, iv, plaintext, additionalData), nil
+}
+
+// Open decrypts a record produced by Seal with the same additional data
+func (rc *RecordCipher) Open(sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < IVSize+TagSize {
+		return nil, errors.New("encrypted record too short")
+	}
+
+	plaintext, err := rc.gcm.Open(nil, sealed[:IVSize], sealed[IVSize:], additionalData)
+	if err != nil {
+		return nil, errors.New("record decryption failed: invalid data or wrong password")
+	}
+
+	return plaintext, nil
+}
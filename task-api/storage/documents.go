@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Documents are small encrypted files kept in the data directory next to the
+// data file, such as the tag registry. They are encrypted like the data file
+// and move to a new key with it, but are not part of backups.
+
+// checkDocumentName rejects names that are not plain .enc files of the data
+// directory or that belong to the data file
+func (es *EncryptedStorage) checkDocumentName(name string) error {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") ||
+		filepath.Ext(name) != ".enc" || name == es.dataFile {
+		return fmt.Errorf("invalid document name %q", name)
+	}
+	return nil
+}
+
+// LoadDocument decrypts the named document, returning nil if it does not
+// exist yet
+func (es *EncryptedStorage) LoadDocument(name string) ([]byte, error) {
+	if err := es.checkDocumentName(name); err != nil {
+		return nil, err
+	}
+
+	if err := es.fileManager.RLock(); err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.RUnlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	if !es.fileManager.FileExists(name) {
+		return nil, nil
+	}
+
+	encryptedData, err := es.fileManager.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read document %s: %w", name, err)
+	}
+
+	data, err := es.cryptoService.Decrypt(encryptedData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt document %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// SaveDocument encrypts data and atomically replaces the named document
+func (es *EncryptedStorage) SaveDocument(name string, data []byte) error {
+	if err := es.checkDocumentName(name); err != nil {
+		return err
+	}
+
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	encryptedData, err := es.cryptoService.Encrypt(data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt document %s: %w", name, err)
+	}
+
+	if err := es.fileManager.WriteFile(name, encryptedData); err != nil {
+		return fmt.Errorf("failed to write document %s: %w", name, err)
+	}
+	return nil
+}
+
+// DeleteDocument removes the named document; a missing one is not an error
+func (es *EncryptedStorage) DeleteDocument(name string) error {
+	if err := es.checkDocumentName(name); err != nil {
+		return err
+	}
+
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	path := filepath.Join(es.fileManager.dataDir, name)
+	if err := es.fileManager.fs.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to delete document %s: %w", name, err)
+	}
+
+	// Make the removal survive a power loss like a write would
+	if err := es.fileManager.fs.SyncDir(es.fileManager.dataDir); err != nil {
+		return fmt.Errorf("failed to sync data directory: %w", err)
+	}
+	return nil
+}
+
+// documentFiles returns the names of the documents in the data directory
+func (es *EncryptedStorage) documentFiles() ([]string, error) {
+	entries, err := es.fileManager.fs.ReadDir(es.fileManager.dataDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && es.checkDocumentName(entry.Name()) == nil {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
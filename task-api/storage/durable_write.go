@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempFileSuffix ends the name of every temporary file a durable write
+// creates, so leftovers can be found after a crash
+const tempFileSuffix = ".tmp"
+
+// writeDurable replaces path with data so that after a crash at any point
+// the file holds either its old or its new contents. The data goes to a
+// uniquely named temporary file in the same directory, which is synced and
+// renamed over path before the directory itself is synced. If exclusive is
+// set, the temporary file is linked instead of renamed, failing with an
+// error satisfying os.IsExist if path exists.
+func writeDurable(fsys Filesystem, path string, data []byte, exclusive bool) (err error) {
+	dir := filepath.Dir(path)
+
+	tmp, err := fsys.CreateTemp(dir, "."+filepath.Base(path)+".*"+tempFileSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	tempPath := tmp.Name()
+	closed := false
+	defer func() {
+		if !closed {
+			tmp.Close()
+		}
+		fsys.Remove(tempPath)
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	closed = true
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	}
+
+	if exclusive {
+		if err := linkNoReplace(fsys, tempPath, path); err != nil {
+			return err
+		}
+	} else if err := fsys.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+
+	if err := fsys.SyncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// linkNoReplace gives the file at oldPath the additional name newPath,
+// failing with an error satisfying os.IsExist if newPath exists. The
+// caller removes oldPath.
+func linkNoReplace(fsys Filesystem, oldPath, newPath string) error {
+	err := fsys.Link(oldPath, newPath)
+	if err == nil || os.IsExist(err) {
+		return err
+	}
+
+	// Some filesystems have no hard links; fall back to a rename, which is
+	// only exclusive against other writers holding the data lock
+	if _, statErr := fsys.Stat(newPath); statErr == nil {
+		return &os.LinkError{Op: "link", Old: oldPath, New: newPath, Err: os.ErrExist}
+	}
+	if err := fsys.Rename(oldPath, newPath); err != nil {
+		return fmt.Errorf("failed to rename temporary file: %w", err)
+	}
+	return nil
+}
+
+// removeStaleTempFiles deletes the temporary files that writes interrupted
+// by a crash left in dir and returns their names. The files never replaced
+// anything, so removing them loses no data.
+func removeStaleTempFiles(fsys Filesystem, dir string) ([]string, error) {
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	var removed []string
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || !strings.HasSuffix(entry.Name(), tempFileSuffix) {
+			continue
+		}
+		if err := fsys.Remove(filepath.Join(dir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: failed to remove stale temporary file %s: %v", entry.Name(), err)
+			continue
+		}
+		removed = append(removed, entry.Name())
+	}
+	return removed, nil
+}
@@ -0,0 +1,406 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// errPowerLoss is returned by every operation of a powerLossFilesystem once
+// the power is gone
+var errPowerLoss = errors.New("power loss")
+
+// powerLossFilesystem is a MemoryFilesystem that tracks what would survive
+// a power loss: file contents as of their last Sync, and directory entries
+// as of the last SyncDir of their directory. The power goes out after a
+// chosen number of operations, after which every operation fails, so the
+// interrupted process cleans nothing up. Directories are taken to be
+// durable once created.
+type powerLossFilesystem struct {
+	*MemoryFilesystem
+
+	// entries maps the durable paths of files to their nodes
+	entries map[string]*memNode
+
+	// synced holds the durable contents of nodes that were synced, and
+	// dirty the nodes written since
+	synced map[*memNode][]byte
+	dirty  map[*memNode]bool
+
+	ops        []string
+	crashAfter int
+	crashed    bool
+}
+
+func newPowerLossFilesystem() *powerLossFilesystem {
+	return &powerLossFilesystem{
+		MemoryFilesystem: NewMemoryFilesystem(),
+		entries:          make(map[string]*memNode),
+		synced:           make(map[*memNode][]byte),
+		dirty:            make(map[*memNode]bool),
+		crashAfter:       -1,
+	}
+}
+
+// checkpoint makes everything durable, forgets the operations so far and
+// cuts the power after the next crashAfter operations, or never if it is
+// negative
+func (p *powerLossFilesystem) checkpoint(crashAfter int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.entries = make(map[string]*memNode)
+	for path, node := range p.nodes {
+		if !node.dir {
+			p.entries[path] = node
+			p.synced[node] = append([]byte(nil), node.data...)
+		}
+	}
+	p.dirty = make(map[*memNode]bool)
+	p.ops = nil
+	p.crashAfter = crashAfter
+}
+
+// do runs an operation unless the power is gone, and counts it
+func (p *powerLossFilesystem) do(op string, fn func() error) error {
+	if p.crashed {
+		return errPowerLoss
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	p.ops = append(p.ops, op)
+	if len(p.ops) == p.crashAfter {
+		p.crashed = true
+	}
+	return nil
+}
+
+// restart returns the filesystem a machine sees after the power came back.
+// If entriesPersisted is set, directory changes since their last sync are
+// kept, which a filesystem may do; otherwise they are lost. Files never
+// synced keep half of their data.
+func (p *powerLossFilesystem) restart(entriesPersisted bool) *MemoryFilesystem {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := p.entries
+	if entriesPersisted {
+		entries = make(map[string]*memNode)
+		for path, node := range p.nodes {
+			if !node.dir {
+				entries[path] = node
+			}
+		}
+	}
+
+	restarted := NewMemoryFilesystem()
+	for path, node := range p.nodes {
+		if node.dir {
+			restarted.nodes[path] = &memNode{dir: true, mode: node.mode, modTime: node.modTime}
+		}
+	}
+	survivors := make(map[*memNode]*memNode)
+	for path, node := range entries {
+		survivor, ok := survivors[node]
+		if !ok {
+			data, synced := p.synced[node]
+			if !synced {
+				data = node.data[:len(node.data)/2]
+			}
+			survivor = &memNode{mode: node.mode, modTime: node.modTime, data: append([]byte(nil), data...)}
+			survivors[node] = survivor
+		}
+		restarted.nodes[path] = survivor
+	}
+	return restarted
+}
+
+func (p *powerLossFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	var file File
+	err := p.do("open", func() (err error) {
+		file, err = p.MemoryFilesystem.OpenFile(name, flag, perm)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &powerLossFile{memFile: file.(*memFile), fs: p}, nil
+}
+
+func (p *powerLossFilesystem) CreateTemp(dir, pattern string) (File, error) {
+	var file File
+	err := p.do("create-temp", func() (err error) {
+		file, err = p.MemoryFilesystem.CreateTemp(dir, pattern)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &powerLossFile{memFile: file.(*memFile), fs: p}, nil
+}
+
+func (p *powerLossFilesystem) Mkdir(name string, perm os.FileMode) error {
+	return p.do("mkdir", func() error { return p.MemoryFilesystem.Mkdir(name, perm) })
+}
+
+func (p *powerLossFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	return p.do("mkdir", func() error { return p.MemoryFilesystem.MkdirAll(path, perm) })
+}
+
+func (p *powerLossFilesystem) Remove(name string) error {
+	return p.do("remove", func() error { return p.MemoryFilesystem.Remove(name) })
+}
+
+func (p *powerLossFilesystem) Rename(oldpath, newpath string) error {
+	return p.do("rename", func() error { return p.MemoryFilesystem.Rename(oldpath, newpath) })
+}
+
+func (p *powerLossFilesystem) Link(oldname, newname string) error {
+	return p.do("link", func() error { return p.MemoryFilesystem.Link(oldname, newname) })
+}
+
+// SyncDir makes the entries of a directory durable
+func (p *powerLossFilesystem) SyncDir(name string) error {
+	return p.do("sync-dir", func() error {
+		if err := p.MemoryFilesystem.SyncDir(name); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		dir := cleanPath(name)
+		for path := range p.entries {
+			if filepath.Dir(path) == dir {
+				delete(p.entries, path)
+			}
+		}
+		for path, node := range p.nodes {
+			if !node.dir && filepath.Dir(path) == dir {
+				p.entries[path] = node
+			}
+		}
+		return nil
+	})
+}
+
+// powerLossFile is an open file of a powerLossFilesystem
+type powerLossFile struct {
+	*memFile
+	fs *powerLossFilesystem
+}
+
+func (f *powerLossFile) Write(b []byte) (n int, err error) {
+	err = f.fs.do("write", func() (err error) {
+		n, err = f.memFile.Write(b)
+		f.fs.dirty[f.node] = true
+		return err
+	})
+	return n, err
+}
+
+func (f *powerLossFile) WriteAt(b []byte, off int64) (n int, err error) {
+	err = f.fs.do("write", func() (err error) {
+		n, err = f.memFile.WriteAt(b, off)
+		f.fs.dirty[f.node] = true
+		return err
+	})
+	return n, err
+}
+
+func (f *powerLossFile) Truncate(size int64) error {
+	return f.fs.do("truncate", func() error {
+		f.fs.dirty[f.node] = true
+		return f.memFile.Truncate(size)
+	})
+}
+
+// Sync makes the contents of the file durable
+func (f *powerLossFile) Sync() error {
+	return f.fs.do("sync", func() error {
+		if err := f.memFile.Sync(); err != nil {
+			return err
+		}
+
+		f.fs.mu.Lock()
+		defer f.fs.mu.Unlock()
+
+		f.fs.synced[f.node] = append([]byte(nil), f.node.data...)
+		delete(f.fs.dirty, f.node)
+		return nil
+	})
+}
+
+// durableWriteTarget is a kind of durable write interrupted by a power
+// loss. Targets without old contents are created by the write.
+type durableWriteTarget struct {
+	name  string
+	path  string
+	old   []byte
+	write func(fm *FileManager, data []byte) error
+}
+
+var (
+	oldContents = bytes.Repeat([]byte("old contents "), 4096)
+	newContents = bytes.Repeat([]byte("new contents!"), 6144)
+)
+
+var durableWriteTargets = []durableWriteTarget{
+	{
+		name:  "data file",
+		path:  DefaultDataFile,
+		old:   oldContents,
+		write: func(fm *FileManager, data []byte) error { return fm.WriteFile(DefaultDataFile, data) },
+	},
+	{
+		name: "backup manifest",
+		path: backupManifestPath("tasks_backup.enc"),
+		old:  oldContents,
+		write: func(fm *FileManager, data []byte) error {
+			return fm.WriteFile(backupManifestPath("tasks_backup.enc"), data)
+		},
+	},
+	{
+		name:  "backup",
+		path:  filepath.Join("backups", "tasks_backup.enc"),
+		write: func(fm *FileManager, data []byte) error { return fm.WriteBackup("tasks_backup.enc", data) },
+	},
+}
+
+// powerLoss is the outcome of a write interrupted by a power loss
+type powerLoss struct {
+	// ops are the operations of the write before the power went out
+	ops []string
+
+	// found is what the restarted process finds at the target: "old" or
+	// "new" contents, or "none" for a backup that was never written
+	found string
+}
+
+// simulatePowerLoss cuts the power after crashAfter operations of a
+// durable write, or never if it is negative, then restarts on the files
+// left behind and checks that the target holds either its old or its new
+// contents in full and that no temporary file survives the startup cleanup
+func simulatePowerLoss(t *testing.T, target durableWriteTarget, crashAfter int, entriesPersisted bool) powerLoss {
+	t.Helper()
+
+	const dataDir = "/data"
+	fsys := newPowerLossFilesystem()
+	fm := NewFileManagerWithFilesystem(dataDir, fsys)
+	if err := fm.ensureDataDir(); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	if target.old != nil {
+		if err := target.write(fm, target.old); err != nil {
+			t.Fatalf("setup: %v", err)
+		}
+	}
+
+	fsys.checkpoint(crashAfter)
+	err := target.write(fm, newContents)
+	if err != nil && !errors.Is(err, errPowerLoss) {
+		t.Fatalf("write: %v", err)
+	}
+	if err != nil && !fsys.crashed {
+		t.Fatalf("write failed without a power loss: %v", err)
+	}
+	result := powerLoss{ops: fsys.ops}
+
+	restarted := NewFileManagerWithFilesystem(dataDir, fsys.restart(entriesPersisted))
+	if _, err := restarted.RemoveStaleTempFiles(); err != nil {
+		t.Fatalf("restart: %v", err)
+	}
+	for _, dir := range []string{dataDir, filepath.Join(dataDir, "backups")} {
+		entries, err := restarted.fs.ReadDir(dir)
+		if err != nil {
+			t.Fatalf("restart: %v", err)
+		}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), tempFileSuffix) {
+				t.Errorf("temporary file %s survived the restart", entry.Name())
+			}
+		}
+	}
+
+	data, err := restarted.fs.ReadFile(filepath.Join(dataDir, target.path))
+	switch {
+	case os.IsNotExist(err) && target.old == nil:
+		result.found = "none"
+	case err != nil:
+		t.Fatalf("target unreadable: %v", err)
+	case target.old != nil && bytes.Equal(data, target.old):
+		result.found = "old"
+	case bytes.Equal(data, newContents):
+		result.found = "new"
+	default:
+		t.Fatalf("target is half-written: %d bytes match neither the old nor the new contents", len(data))
+	}
+
+	if target.old == nil {
+		backups, err := restarted.ListBackups()
+		if err != nil {
+			t.Fatalf("restart: %v", err)
+		}
+		if len(backups) > 1 || (len(backups) == 1) != (result.found == "new") {
+			t.Errorf("backup list %v does not match the backups on disk", backups)
+		}
+	}
+	return result
+}
+
+func TestDurableWriteSurvivesPowerLoss(t *testing.T) {
+	for _, target := range durableWriteTargets {
+		t.Run(target.name, func(t *testing.T) {
+			complete := simulatePowerLoss(t, target, -1, false)
+			if complete.found != "new" {
+				t.Fatalf("uninterrupted write left %s contents", complete.found)
+			}
+
+			for crashAfter := 0; crashAfter <= len(complete.ops); crashAfter++ {
+				for _, persisted := range []bool{false, true} {
+					result := simulatePowerLoss(t, target, crashAfter, persisted)
+					if crashAfter == len(complete.ops) && result.found != "new" {
+						t.Errorf("power loss after the write returned left %s contents", result.found)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDurableWriteRenameLostOnPowerLoss(t *testing.T) {
+	for _, target := range durableWriteTargets {
+		t.Run(target.name, func(t *testing.T) {
+			ops := simulatePowerLoss(t, target, -1, false).ops
+
+			replaced := -1
+			for i, op := range ops {
+				if op == "rename" || op == "link" {
+					replaced = i + 1
+					break
+				}
+			}
+			if replaced < 0 || replaced >= len(ops) || ops[replaced] != "sync-dir" {
+				t.Fatalf("write does not sync the directory right after replacing the target: %v", ops)
+			}
+
+			// The new name is not durable until the directory is synced, so
+			// the entry rolls back to the old file
+			want := "old"
+			if target.old == nil {
+				want = "none"
+			}
+			if found := simulatePowerLoss(t, target, replaced, false).found; found != want {
+				t.Errorf("power loss before the directory sync left %s contents, want %s", found, want)
+			}
+
+			if found := simulatePowerLoss(t, target, replaced+1, false).found; found != "new" {
+				t.Errorf("power loss after the directory sync left %s contents, want new", found)
+			}
+		})
+	}
+}
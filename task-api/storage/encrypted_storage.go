@@ -5,20 +5,38 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"os"
+	"sync"
 )
 
 const (
 	// Default configuration
-	DefaultDataFile      = "tasks.enc"
-	DefaultRetentionDays = 30
+	DefaultDataFile = "tasks.enc"
 )
 
+// ErrBackupExists is returned when importing a backup whose name is taken
+var ErrBackupExists = errors.New("backup already exists")
+
 // EncryptedStorage provides encrypted file storage for tasks
 type EncryptedStorage struct {
 	fileManager   *FileManager
 	cryptoService *CryptoService
 	dataFile      string
-	retentionDays int
+	retention     RetentionPolicy
+	backupOnWrite bool
+
+	// corruptionMode and validateData decide how Initialize handles a
+	// corrupt data file; incident records the recovery it performed
+	corruptionMode CorruptionRecoveryMode
+	validateData   BackupValidator
+	incident       *CorruptionIncident
+
+	// manifestMACKey signs backup manifests once loaded
+	manifestMu     sync.Mutex
+	manifestMACKey []byte
+
+	// replicator copies new backups offsite if set
+	replicator *Replicator
 }
 
 // NewEncryptedStorage creates a new encrypted storage instance
@@ -27,24 +45,65 @@ func NewEncryptedStorage(dataDir, encryptionKey string) *EncryptedStorage {
 		fileManager:   NewFileManager(dataDir),
 		cryptoService: NewCryptoService(encryptionKey),
 		dataFile:      DefaultDataFile,
-		retentionDays: DefaultRetentionDays,
+		retention:     DefaultRetentionPolicy(),
+		backupOnWrite: true,
 	}
 }
 
-// SetRetentionDays sets the backup retention period
-func (es *EncryptedStorage) SetRetentionDays(days int) {
-	if days > 0 {
-		es.retentionDays = days
+// NewEncryptedStorageWithKeyring creates an encrypted storage instance that
+// encrypts with the keyring's active key and decrypts with any of its keys
+func NewEncryptedStorageWithKeyring(dataDir string, keyring *Keyring) *EncryptedStorage {
+	return &EncryptedStorage{
+		fileManager:   NewFileManager(dataDir),
+		cryptoService: NewCryptoServiceWithKeyring(keyring),
+		dataFile:      DefaultDataFile,
+		retention:     DefaultRetentionPolicy(),
+		backupOnWrite: true,
 	}
 }
 
+// CryptoService returns the crypto service used by the storage
+func (es *EncryptedStorage) CryptoService() *CryptoService {
+	return es.cryptoService
+}
+
+// NewEncryptedStorageWithCryptoService creates an encrypted storage instance
+// that uses the given crypto service, e.g. one backed by a master key
+// provider other than passwords
+func NewEncryptedStorageWithCryptoService(dataDir string, cryptoService *CryptoService) *EncryptedStorage {
+	return &EncryptedStorage{
+		fileManager:   NewFileManager(dataDir),
+		cryptoService: cryptoService,
+		dataFile:      DefaultDataFile,
+		retention:     DefaultRetentionPolicy(),
+		backupOnWrite: true,
+	}
+}
+
+// SetBackupOnWrite sets whether SaveData backs up the data file before
+// replacing it. It is turned off when backups are taken on a schedule.
+func (es *EncryptedStorage) SetBackupOnWrite(enabled bool) {
+	es.backupOnWrite = enabled
+}
+
+// Filesystem returns the filesystem the storage runs on
+func (es *EncryptedStorage) Filesystem() Filesystem {
+	return es.fileManager.Filesystem()
+}
+
+// SetFilesystem moves the storage onto another filesystem, e.g. an
+// in-memory one. It has to be called before Initialize.
+func (es *EncryptedStorage) SetFilesystem(fsys Filesystem) {
+	es.fileManager = NewFileManagerWithFilesystem(es.fileManager.dataDir, fsys)
+}
+
 // LoadData loads and decrypts data from the storage file
 func (es *EncryptedStorage) LoadData() ([]byte, error) {
-	if err := es.fileManager.Lock(); err != nil {
+	if err := es.fileManager.RLock(); err != nil {
 		return nil, fmt.Errorf("failed to acquire lock: %w", err)
 	}
 	defer func() {
-		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+		if unlockErr := es.fileManager.RUnlock(); unlockErr != nil {
 			log.Printf("Warning: failed to release lock: %v", unlockErr)
 		}
 	}()
@@ -91,8 +150,8 @@ func (es *EncryptedStorage) SaveData(data []byte) error {
 	}()
 
 	// Create backup before saving new data
-	if es.fileManager.FileExists(es.dataFile) {
-		backupName, err := es.fileManager.CreateBackup(es.dataFile)
+	if es.backupOnWrite && es.fileManager.FileExists(es.dataFile) {
+		backupName, err := es.createBackup(BackupTriggerAuto)
 		if err != nil {
 			log.Printf("Warning: failed to create backup: %v", err)
 		} else {
@@ -111,16 +170,17 @@ func (es *EncryptedStorage) SaveData(data []byte) error {
 		return fmt.Errorf("failed to write encrypted data: %w", err)
 	}
 
-	// Clean up old backups
-	if err := es.fileManager.DeleteOldBackups(es.retentionDays); err != nil {
+	// Prune backups the retention policy no longer keeps
+	if err := es.pruneBackups(); err != nil {
 		log.Printf("Warning: failed to clean up old backups: %v", err)
 	}
 
 	return nil
 }
 
-// CreateManualBackup creates a manual backup of the current data
-func (es *EncryptedStorage) CreateManualBackup() (string, error) {
+// CreateDataFileBackup backs up the current data file, recording trigger in
+// its manifest
+func (es *EncryptedStorage) CreateDataFileBackup(trigger BackupTrigger) (string, error) {
 	if err := es.fileManager.Lock(); err != nil {
 		return "", fmt.Errorf("failed to acquire lock: %w", err)
 	}
@@ -134,14 +194,134 @@ func (es *EncryptedStorage) CreateManualBackup() (string, error) {
 		return "", errors.New("no data file exists to backup")
 	}
 
-	backupName, err := es.fileManager.CreateBackup(es.dataFile)
+	backupName, err := es.createBackup(trigger)
+	if err != nil {
+		return "", fmt.Errorf("failed to create %s backup: %w", trigger, err)
+	}
+
+	// Prune backups the retention policy no longer keeps
+	if err := es.pruneBackups(); err != nil {
+		log.Printf("Warning: failed to clean up old backups: %v", err)
+	}
+
+	return backupName, nil
+}
+
+// CreateBackupFromData encrypts the given data and stores it as a backup
+// with a manifest recording trigger. Backends that do not keep their data in
+// the encrypted data file use this so their backups share the same format
+// and location.
+func (es *EncryptedStorage) CreateBackupFromData(data []byte, trigger BackupTrigger) (string, error) {
+	if len(data) == 0 {
+		return "", errors.New("data cannot be empty")
+	}
+
+	encryptedData, err := es.cryptoService.Encrypt(data)
 	if err != nil {
-		return "", fmt.Errorf("failed to create manual backup: %w", err)
+		return "", fmt.Errorf("failed to encrypt backup data: %w", err)
+	}
+
+	if err := es.fileManager.Lock(); err != nil {
+		return "", fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	backupName, err := es.fileManager.CreateBackupFromData(es.dataFile, encryptedData)
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+
+	if err := es.createBackupManifest(backupName, encryptedData, data, trigger); err != nil {
+		return "", fmt.Errorf("failed to create manifest for backup %s: %w", backupName, err)
+	}
+
+	// Prune backups the retention policy no longer keeps
+	if err := es.pruneBackups(); err != nil {
+		log.Printf("Warning: failed to clean up old backups: %v", err)
 	}
 
 	return backupName, nil
 }
 
+// ImportBackup encrypts the given data and stores it as a backup under its
+// original name, so its age is kept. It returns ErrBackupExists if a backup
+// with that name exists.
+func (es *EncryptedStorage) ImportBackup(backupName string, data []byte) error {
+	if err := validateBackupName(backupName); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return errors.New("data cannot be empty")
+	}
+
+	encryptedData, err := es.cryptoService.Encrypt(data)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt backup data: %w", err)
+	}
+
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	if err := es.fileManager.ensureDataDir(); err != nil {
+		return err
+	}
+
+	if err := es.fileManager.WriteBackup(backupName, encryptedData); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("%w: %s", ErrBackupExists, backupName)
+		}
+		return fmt.Errorf("failed to import backup: %w", err)
+	}
+
+	if err := es.createBackupManifest(backupName, encryptedData, data, BackupTriggerImport); err != nil {
+		return fmt.Errorf("failed to create manifest for backup %s: %w", backupName, err)
+	}
+
+	return nil
+}
+
+// LoadBackupData reads and decrypts the specified backup file
+func (es *EncryptedStorage) LoadBackupData(backupName string) ([]byte, error) {
+	if err := validateBackupName(backupName); err != nil {
+		return nil, err
+	}
+
+	if err := es.fileManager.RLock(); err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.RUnlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	backupPath := fmt.Sprintf("backups/%s", backupName)
+	backupData, err := es.fileManager.ReadFile(backupPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("backup %s not found", backupName)
+		}
+		return nil, fmt.Errorf("failed to read backup file: %w", err)
+	}
+
+	decryptedData, err := es.cryptoService.Decrypt(backupData)
+	if err != nil {
+		return nil, fmt.Errorf("backup file is corrupted or encrypted with different key: %w", err)
+	}
+
+	return decryptedData, nil
+}
+
 // ListBackups returns a list of available backup files
 func (es *EncryptedStorage) ListBackups() ([]string, error) {
 	return es.fileManager.ListBackups()
@@ -149,8 +329,8 @@ func (es *EncryptedStorage) ListBackups() ([]string, error) {
 
 // RestoreFromBackup restores data from a specified backup file
 func (es *EncryptedStorage) RestoreFromBackup(backupName string) error {
-	if backupName == "" {
-		return errors.New("backup name cannot be empty")
+	if err := validateBackupName(backupName); err != nil {
+		return err
 	}
 
 	if err := es.fileManager.Lock(); err != nil {
@@ -166,6 +346,9 @@ func (es *EncryptedStorage) RestoreFromBackup(backupName string) error {
 	backupPath := fmt.Sprintf("backups/%s", backupName)
 	backupData, err := es.fileManager.ReadFile(backupPath)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("backup %s not found", backupName)
+		}
 		return fmt.Errorf("failed to read backup file: %w", err)
 	}
 
@@ -177,7 +360,7 @@ func (es *EncryptedStorage) RestoreFromBackup(backupName string) error {
 
 	// Create a backup of current data before restoring
 	if es.fileManager.FileExists(es.dataFile) {
-		currentBackup, err := es.fileManager.CreateBackup(es.dataFile)
+		currentBackup, err := es.createBackup(BackupTriggerPreRestore)
 		if err != nil {
 			log.Printf("Warning: failed to backup current data: %v", err)
 		} else {
@@ -193,6 +376,11 @@ func (es *EncryptedStorage) RestoreFromBackup(backupName string) error {
 	return nil
 }
 
+// DataFileExists reports whether the encrypted data file has been written
+func (es *EncryptedStorage) DataFileExists() bool {
+	return es.fileManager.FileExists(es.dataFile)
+}
+
 // ValidateEncryptionKey checks if the provided key can decrypt existing data
 func (es *EncryptedStorage) ValidateEncryptionKey() error {
 	if !es.fileManager.FileExists(es.dataFile) {
@@ -211,7 +399,8 @@ func (es *EncryptedStorage) ValidateEncryptionKey() error {
 func (es *EncryptedStorage) GetStorageInfo() map[string]interface{} {
 	info := map[string]interface{}{
 		"data_file_exists": es.fileManager.FileExists(es.dataFile),
-		"retention_days":   es.retentionDays,
+		"backup_retention": es.retention,
+		"filesystem":       FilesystemName(es.fileManager.fs),
 	}
 
 	// Get backup count
@@ -223,6 +412,13 @@ func (es *EncryptedStorage) GetStorageInfo() map[string]interface{} {
 		info["backup_count"] = len(backups)
 	}
 
+	info["encryption"] = es.KeyRotationStatus()
+	info["compression"] = es.CompressionStats()
+
+	if es.incident != nil {
+		info["corruption_incident"] = es.incident
+	}
+
 	// Get file size if exists
 	if es.fileManager.FileExists(es.dataFile) {
 		encryptedData, err := es.fileManager.ReadFile(es.dataFile)
@@ -236,6 +432,11 @@ func (es *EncryptedStorage) GetStorageInfo() map[string]interface{} {
 
 // Initialize prepares the storage system for first use
 func (es *EncryptedStorage) Initialize() error {
+	// Wrap new data keys for the recovery key too, if one is set up
+	if err := es.loadRecoveryKey(); err != nil {
+		return err
+	}
+
 	// Test encryption key by attempting to encrypt/decrypt test data
 	testData := []byte(`{"test": true}`)
 	encrypted, err := es.cryptoService.Encrypt(testData)
@@ -252,10 +453,46 @@ func (es *EncryptedStorage) Initialize() error {
 		return errors.New("encryption/decryption test failed")
 	}
 
-	// Validate existing data if present
-	if err := es.ValidateEncryptionKey(); err != nil {
-		return fmt.Errorf("encryption key validation failed: %w", err)
+	if err := es.removeStaleTempFiles(); err != nil {
+		return err
+	}
+
+	if err := es.initManifestKey(); err != nil {
+		return err
 	}
 
+	// Validate existing data if present, recovering from a backup if it is
+	// corrupt
+	if corrupt, err := es.checkDataFile(); err != nil {
+		if !corrupt {
+			return fmt.Errorf("encryption key validation failed: %w", err)
+		}
+		if err := es.recoverCorruptDataFile(err); err != nil {
+			return fmt.Errorf("encryption key validation failed: %w", err)
+		}
+	}
+
+	return nil
+}
+// removeStaleTempFiles deletes the temporary files of writes that a crash
+// interrupted. Those writes never replaced their target, so the data file
+// and backups still hold their previous contents.
+func (es *EncryptedStorage) removeStaleTempFiles() error {
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	removed, err := es.fileManager.RemoveStaleTempFiles()
+	if err != nil {
+		return fmt.Errorf("failed to remove stale temporary files: %w", err)
+	}
+	for _, name := range removed {
+		log.Printf("Removed temporary file %s left by an interrupted write", name)
+	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,364 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// FaultOp names the filesystem operations a fault applies to
+type FaultOp string
+
+const (
+	FaultOpAny    FaultOp = "*"      // every operation
+	FaultOpOpen   FaultOp = "open"   // OpenFile, CreateTemp
+	FaultOpRead   FaultOp = "read"   // ReadFile, File.Read
+	FaultOpWrite  FaultOp = "write"  // File.Write, File.WriteAt, File.Truncate
+	FaultOpSync   FaultOp = "sync"   // File.Sync, SyncDir
+	FaultOpStat   FaultOp = "stat"   // Stat, ReadDir
+	FaultOpMkdir  FaultOp = "mkdir"  // Mkdir, MkdirAll
+	FaultOpRemove FaultOp = "remove" // Remove
+	FaultOpRename FaultOp = "rename" // Rename, Link
+	FaultOpLock   FaultOp = "lock"   // TryLock, TryRLock
+)
+
+// faultErrors are the errors a fault spec can name
+var faultErrors = map[string]syscall.Errno{
+	"ENOSPC": syscall.ENOSPC,
+	"EIO":    syscall.EIO,
+	"EACCES": syscall.EACCES,
+	"EROFS":  syscall.EROFS,
+	"EDQUOT": syscall.EDQUOT,
+}
+
+// Fault makes matching operations of a FaultyFilesystem slow, fail, or
+// both
+type Fault struct {
+	// Op is the operation to match, or FaultOpAny
+	Op FaultOp
+
+	// Path is matched with filepath.Match against the base name of the
+	// file; empty or "*" matches every file. The temporary file of a
+	// durable write also matches the name of the file it replaces.
+	Path string
+
+	// Err is returned by matching operations, e.g. syscall.ENOSPC
+	Err error
+
+	// Delay is waited before matching operations
+	Delay time.Duration
+
+	// Count is how many operations the fault applies to; 0 is unlimited
+	Count int
+}
+
+// matches reports whether the fault applies to an operation on path
+func (f *Fault) matches(op FaultOp, path string) bool {
+	if f.Op != FaultOpAny && f.Op != "" && f.Op != op {
+		return false
+	}
+	if f.Path == "" || f.Path == "*" {
+		return true
+	}
+	for _, name := range faultNames(path) {
+		if matched, err := filepath.Match(f.Path, name); err == nil && matched {
+			return true
+		}
+	}
+	return false
+}
+
+// faultNames returns the names a fault pattern is matched against: the
+// base name and, for a temporary file ".<name>.<random>.tmp" of a durable
+// write, the name of the file it replaces
+func faultNames(path string) []string {
+	base := filepath.Base(path)
+	names := []string{base}
+	if strings.HasPrefix(base, ".") && strings.HasSuffix(base, tempFileSuffix) {
+		target := strings.TrimSuffix(strings.TrimPrefix(base, "."), tempFileSuffix)
+		if i := strings.LastIndex(target, "."); i > 0 {
+			names = append(names, target[:i])
+		}
+	}
+	return names
+}
+
+// ParseFaults parses a comma-separated list of faults of the form
+// op:pattern:effect[:count], where op is a FaultOp, pattern matches file
+// base names and effect is ENOSPC, EIO, EACCES, EROFS, EDQUOT or
+// delay=<duration>. For example "write:tasks.enc:ENOSPC,*:*:delay=50ms".
+func ParseFaults(spec string) ([]Fault, error) {
+	var faults []Fault
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.Split(entry, ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid fault %q, expected op:pattern:effect[:count]", entry)
+		}
+
+		fault := Fault{Op: FaultOp(parts[0]), Path: parts[1]}
+		switch fault.Op {
+		case FaultOpAny, FaultOpOpen, FaultOpRead, FaultOpWrite, FaultOpSync, FaultOpStat,
+			FaultOpMkdir, FaultOpRemove, FaultOpRename, FaultOpLock:
+		default:
+			return nil, fmt.Errorf("invalid fault %q: unknown operation %q", entry, parts[0])
+		}
+		if _, err := filepath.Match(fault.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid fault %q: %w", entry, err)
+		}
+
+		if delay, ok := strings.CutPrefix(parts[2], "delay="); ok {
+			d, err := time.ParseDuration(delay)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("invalid fault %q: invalid delay %q", entry, delay)
+			}
+			fault.Delay = d
+		} else if errno, ok := faultErrors[strings.ToUpper(parts[2])]; ok {
+			fault.Err = errno
+		} else {
+			return nil, fmt.Errorf("invalid fault %q: unknown effect %q", entry, parts[2])
+		}
+
+		if len(parts) == 4 {
+			count, err := strconv.Atoi(parts[3])
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("invalid fault %q: count must be a positive number", entry)
+			}
+			fault.Count = count
+		}
+
+		faults = append(faults, fault)
+	}
+	return faults, nil
+}
+
+// FaultyFilesystem wraps a Filesystem and injects errors and delays into
+// the operations that match its faults, to exercise storage error paths
+type FaultyFilesystem struct {
+	fs     Filesystem
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+// NewFaultyFilesystem wraps fs with no faults injected yet
+func NewFaultyFilesystem(fs Filesystem) *FaultyFilesystem {
+	return &FaultyFilesystem{fs: fs}
+}
+
+// Inject adds a fault. Faults apply in the order they were added; all
+// matching delays are waited, and the first matching error is returned.
+func (f *FaultyFilesystem) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = append(f.faults, &fault)
+}
+
+// Clear removes all faults
+func (f *FaultyFilesystem) Clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+// fault applies the faults matching an operation on path and returns the
+// error to fail it with, if any
+func (f *FaultyFilesystem) fault(op FaultOp, path string) error {
+	f.mu.Lock()
+	var delay time.Duration
+	var err error
+	remaining := f.faults[:0]
+	for _, fault := range f.faults {
+		if fault.matches(op, path) && (err == nil || fault.Err == nil) {
+			delay += fault.Delay
+			if err == nil {
+				err = fault.Err
+			}
+			if fault.Count > 0 {
+				fault.Count--
+				if fault.Count == 0 {
+					continue
+				}
+			}
+		}
+		remaining = append(remaining, fault)
+	}
+	f.faults = remaining
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if err != nil {
+		return &os.PathError{Op: string(op), Path: path, Err: err}
+	}
+	return nil
+}
+
+// OpenFile opens a file whose reads, writes and syncs are subject to faults
+func (f *FaultyFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if err := f.fault(FaultOpOpen, name); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+// CreateTemp creates a file whose writes and syncs are subject to faults
+func (f *FaultyFilesystem) CreateTemp(dir, pattern string) (File, error) {
+	if err := f.fault(FaultOpOpen, filepath.Join(dir, pattern)); err != nil {
+		return nil, err
+	}
+	file, err := f.fs.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &faultyFile{File: file, fs: f}, nil
+}
+
+// ReadFile reads a file unless a fault applies
+func (f *FaultyFilesystem) ReadFile(name string) ([]byte, error) {
+	if err := f.fault(FaultOpRead, name); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadFile(name)
+}
+
+// ReadDir lists a directory unless a fault applies
+func (f *FaultyFilesystem) ReadDir(name string) ([]os.DirEntry, error) {
+	if err := f.fault(FaultOpStat, name); err != nil {
+		return nil, err
+	}
+	return f.fs.ReadDir(name)
+}
+
+// Stat describes a file unless a fault applies
+func (f *FaultyFilesystem) Stat(name string) (os.FileInfo, error) {
+	if err := f.fault(FaultOpStat, name); err != nil {
+		return nil, err
+	}
+	return f.fs.Stat(name)
+}
+
+// Mkdir creates a directory unless a fault applies
+func (f *FaultyFilesystem) Mkdir(name string, perm os.FileMode) error {
+	if err := f.fault(FaultOpMkdir, name); err != nil {
+		return err
+	}
+	return f.fs.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and its parents unless a fault applies
+func (f *FaultyFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	if err := f.fault(FaultOpMkdir, path); err != nil {
+		return err
+	}
+	return f.fs.MkdirAll(path, perm)
+}
+
+// Remove removes a file unless a fault applies
+func (f *FaultyFilesystem) Remove(name string) error {
+	if err := f.fault(FaultOpRemove, name); err != nil {
+		return err
+	}
+	return f.fs.Remove(name)
+}
+
+// Rename renames a file unless a fault applies to the new name
+func (f *FaultyFilesystem) Rename(oldpath, newpath string) error {
+	if err := f.fault(FaultOpRename, newpath); err != nil {
+		return err
+	}
+	return f.fs.Rename(oldpath, newpath)
+}
+
+// Link links a file unless a fault applies to the new name
+func (f *FaultyFilesystem) Link(oldname, newname string) error {
+	if err := f.fault(FaultOpRename, newname); err != nil {
+		return err
+	}
+	return f.fs.Link(oldname, newname)
+}
+
+// SyncDir syncs a directory unless a fault applies
+func (f *FaultyFilesystem) SyncDir(name string) error {
+	if err := f.fault(FaultOpSync, name); err != nil {
+		return err
+	}
+	return f.fs.SyncDir(name)
+}
+
+// TryLock takes a lock unless a fault applies
+func (f *FaultyFilesystem) TryLock(name string) (FileLock, error) {
+	if err := f.fault(FaultOpLock, name); err != nil {
+		return nil, err
+	}
+	return f.fs.TryLock(name)
+}
+
+// TryRLock takes a shared lock unless a fault applies
+func (f *FaultyFilesystem) TryRLock(name string) (FileLock, error) {
+	if err := f.fault(FaultOpLock, name); err != nil {
+		return nil, err
+	}
+	return f.fs.TryRLock(name)
+}
+
+// faultyFile is a file of a FaultyFilesystem
+type faultyFile struct {
+	File
+	fs *FaultyFilesystem
+}
+
+// Read reads unless a fault applies
+func (f *faultyFile) Read(p []byte) (int, error) {
+	if err := f.fs.fault(FaultOpRead, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+// Write writes unless a fault applies, in which case nothing is written
+func (f *faultyFile) Write(p []byte) (int, error) {
+	if err := f.fs.fault(FaultOpWrite, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+// WriteAt writes unless a fault applies, in which case nothing is written
+func (f *faultyFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.fs.fault(FaultOpWrite, f.Name()); err != nil {
+		return 0, err
+	}
+	return f.File.WriteAt(p, off)
+}
+
+// Truncate truncates unless a fault applies
+func (f *faultyFile) Truncate(size int64) error {
+	if err := f.fs.fault(FaultOpWrite, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+// Sync syncs unless a fault applies
+func (f *faultyFile) Sync() error {
+	if err := f.fs.fault(FaultOpSync, f.Name()); err != nil {
+		return err
+	}
+	return f.File.Sync()
+}
@@ -5,71 +5,87 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
-	"syscall"
 	"time"
 )
 
 // FileManager handles file operations with proper locking
 type FileManager struct {
+	fs         Filesystem
 	dataDir    string
 	lockFile   string
-	mu         sync.RWMutex
-	fileLock   *os.File
+	
+	// rw is held from Lock to Unlock, or RLock to RUnlock, so goroutines
+	// of this process exclude each other the same way the flock excludes
+	// other processes
+	rw         sync.RWMutex
+	mu         sync.Mutex
+	fileLock   FileLock
+	sharedLock FileLock
+	readers    int
 }
 
 // NewFileManager creates a new file manager for the specified data directory
 func NewFileManager(dataDir string) *FileManager {
+	return NewFileManagerWithFilesystem(dataDir, OSFilesystem{})
+}
+
+// NewFileManagerWithFilesystem creates a file manager for a data directory
+// on the given filesystem
+func NewFileManagerWithFilesystem(dataDir string, fsys Filesystem) *FileManager {
 	return &FileManager{
+		fs:       fsys,
 		dataDir:  dataDir,
 		lockFile: filepath.Join(dataDir, ".lock"),
 	}
 }
 
+// Filesystem returns the filesystem the files are stored on
+func (fm *FileManager) Filesystem() Filesystem {
+	return fm.fs
+}
+
 // ensureDataDir creates the data directory if it doesn't exist
 func (fm *FileManager) ensureDataDir() error {
-	if err := os.MkdirAll(fm.dataDir, 0755); err != nil {
+	if err := fm.fs.MkdirAll(fm.dataDir, 0755); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
 	
 	backupDir := filepath.Join(fm.dataDir, "backups")
-	if err := os.MkdirAll(backupDir, 0755); err != nil {
+	if err := fm.fs.MkdirAll(backupDir, 0755); err != nil {
 		return fmt.Errorf("failed to create backup directory: %w", err)
 	}
 	
 	return nil
 }
 
-// Lock acquires a file lock to prevent concurrent access
+// Lock acquires an exclusive file lock for writing. It blocks until
+// every other holder of the lock in this process has released it, and must
+// be paired with Unlock.
 func (fm *FileManager) Lock() error {
+	fm.rw.Lock()
+	
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
 	
 	if err := fm.ensureDataDir(); err != nil {
+		fm.rw.Unlock()
 		return err
 	}
 	
-	if fm.fileLock != nil {
-		return nil // Already locked
-	}
-	
-	lockFile, err := os.OpenFile(fm.lockFile, os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open lock file: %w", err)
-	}
-	
 	// Try to acquire exclusive lock with timeout
-	err = fm.acquireLockWithTimeout(lockFile, 5*time.Second)
+	fileLock, err := fm.acquireLockWithTimeout(fm.fs.TryLock, 5*time.Second)
 	if err != nil {
-		lockFile.Close()
+		fm.rw.Unlock()
 		return err
 	}
 	
-	fm.fileLock = lockFile
+	fm.fileLock = fileLock
 	return nil
 }
 
-// Unlock releases the file lock
+// Unlock releases the exclusive file lock
 func (fm *FileManager) Unlock() error {
 	fm.mu.Lock()
 	defer fm.mu.Unlock()
@@ -79,39 +95,85 @@ func (fm *FileManager) Unlock() error {
 	}
 	
 	// Release the lock
-	err := syscall.Flock(int(fm.fileLock.Fd()), syscall.LOCK_UN)
+	err := fm.fileLock.Unlock()
+	fm.fileLock = nil
+	fm.rw.Unlock()
 	if err != nil {
-		fm.fileLock.Close()
-		fm.fileLock = nil
 		return fmt.Errorf("failed to release file lock: %w", err)
 	}
 	
-	// Close the lock file
-	err = fm.fileLock.Close()
-	fm.fileLock = nil
+	return nil
+}
+
+// RLock acquires a shared file lock for reading. Readers in this process
+// share one flock, taken by the first and released by the last, and must
+// pair RLock with RUnlock.
+func (fm *FileManager) RLock() error {
+	fm.rw.RLock()
 	
-	return err
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	
+	if fm.readers == 0 {
+		if err := fm.ensureDataDir(); err != nil {
+			fm.rw.RUnlock()
+			return err
+		}
+		
+		sharedLock, err := fm.acquireLockWithTimeout(fm.fs.TryRLock, 5*time.Second)
+		if err != nil {
+			fm.rw.RUnlock()
+			return err
+		}
+		fm.sharedLock = sharedLock
+	}
+	
+	fm.readers++
+	return nil
+}
+
+// RUnlock releases a shared file lock
+func (fm *FileManager) RUnlock() error {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	
+	if fm.readers == 0 {
+		return nil // Not locked
+	}
+	
+	fm.readers--
+	var err error
+	if fm.readers == 0 {
+		err = fm.sharedLock.Unlock()
+		fm.sharedLock = nil
+	}
+	fm.rw.RUnlock()
+	if err != nil {
+		return fmt.Errorf("failed to release file lock: %w", err)
+	}
+	
+	return nil
 }
 
 // acquireLockWithTimeout attempts to acquire a file lock with timeout
-func (fm *FileManager) acquireLockWithTimeout(file *os.File, timeout time.Duration) error {
+func (fm *FileManager) acquireLockWithTimeout(tryLock func(name string) (FileLock, error), timeout time.Duration) (FileLock, error) {
 	deadline := time.Now().Add(timeout)
 	
 	for time.Now().Before(deadline) {
-		err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		fileLock, err := tryLock(fm.lockFile)
 		if err == nil {
-			return nil // Lock acquired
+			return fileLock, nil // Lock acquired
 		}
 		
-		if err != syscall.EWOULDBLOCK {
-			return fmt.Errorf("failed to acquire file lock: %w", err)
+		if !errors.Is(err, ErrLockHeld) {
+			return nil, fmt.Errorf("failed to acquire file lock: %w", err)
 		}
 		
 		// Wait a bit before retrying
 		time.Sleep(10 * time.Millisecond)
 	}
 	
-	return errors.New("timeout acquiring file lock")
+	return nil, errors.New("timeout acquiring file lock")
 }
 
 // ReadFile reads data from a file with proper error handling
@@ -123,11 +185,11 @@ func (fm *FileManager) ReadFile(filename string) ([]byte, error) {
 	filePath := filepath.Join(fm.dataDir, filename)
 	
 	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+	if _, err := fm.fs.Stat(filePath); os.IsNotExist(err) {
 		return nil, os.ErrNotExist
 	}
 	
-	data, err := os.ReadFile(filePath)
+	data, err := fm.fs.ReadFile(filePath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read file %s: %w", filename, err)
 	}
@@ -135,7 +197,8 @@ func (fm *FileManager) ReadFile(filename string) ([]byte, error) {
 	return data, nil
 }
 
-// WriteFile writes data to a file atomically with proper permissions
+// WriteFile writes data to a file atomically and durably, readable only by
+// the owner
 func (fm *FileManager) WriteFile(filename string, data []byte) error {
 	if filename == "" {
 		return errors.New("filename cannot be empty")
@@ -146,22 +209,10 @@ func (fm *FileManager) WriteFile(filename string, data []byte) error {
 	}
 	
 	filePath := filepath.Join(fm.dataDir, filename)
-	tempPath := filePath + ".tmp"
-	
-	// Write to temporary file first
-	err := os.WriteFile(tempPath, data, 0600) // Restrictive permissions for encrypted data
-	if err != nil {
-		return fmt.Errorf("failed to write temporary file: %w", err)
-	}
-	
-	// Atomically rename to final name
-	err = os.Rename(tempPath, filePath)
-	if err != nil {
-		os.Remove(tempPath) // Clean up temp file on failure
-		return fmt.Errorf("failed to rename temporary file: %w", err)
-	}
 	
-	return nil
+	// Write to a synced temporary file and rename it over the old one, so
+	// the file is never half-written, even after a power loss
+	return writeDurable(fm.fs, filePath, data, false)
 }
 
 // CreateBackup creates a backup of the specified file with timestamp
@@ -173,37 +224,100 @@ func (fm *FileManager) CreateBackup(filename string) (string, error) {
 	sourceFile := filepath.Join(fm.dataDir, filename)
 	
 	// Check if source file exists
-	if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
+	if _, err := fm.fs.Stat(sourceFile); os.IsNotExist(err) {
 		return "", errors.New("source file does not exist")
 	}
 	
-	// Create backup filename with timestamp
-	timestamp := time.Now().Format("20060102_150405")
-	backupName := fmt.Sprintf("%s_backup_%s.enc", 
-		filename[:len(filename)-4], // Remove .enc extension
-		timestamp)
-	backupPath := filepath.Join(fm.dataDir, "backups", backupName)
-	
 	// Read source file
-	data, err := os.ReadFile(sourceFile)
+	data, err := fm.fs.ReadFile(sourceFile)
 	if err != nil {
 		return "", fmt.Errorf("failed to read source file: %w", err)
 	}
 	
-	// Write backup file
-	err = os.WriteFile(backupPath, data, 0600)
-	if err != nil {
-		return "", fmt.Errorf("failed to write backup file: %w", err)
+	return fm.writeNewBackup(filename, data)
+}
+
+// CreateBackupFromData writes already-encrypted data as a timestamped backup
+// named after the specified file, without requiring the file to exist
+func (fm *FileManager) CreateBackupFromData(filename string, data []byte) (string, error) {
+	if filename == "" {
+		return "", errors.New("filename cannot be empty")
+	}
+	
+	if err := fm.ensureDataDir(); err != nil {
+		return "", err
+	}
+	
+	return fm.writeNewBackup(filename, data)
+}
+
+// writeNewBackup writes data to a new backup file named after filename and
+// the current time in milliseconds. The file is created exclusively, so two
+// backups in the same millisecond get distinct names instead of one
+// overwriting the other.
+func (fm *FileManager) writeNewBackup(filename string, data []byte) (string, error) {
+	now := time.Now()
+	baseName := fmt.Sprintf("%s_backup_%s_%03d",
+		strings.TrimSuffix(filename, filepath.Ext(filename)),
+		now.Format(backupTimeLayout),
+		now.Nanosecond()/int(time.Millisecond))
+	
+	for attempt := 1; attempt <= 100; attempt++ {
+		backupName := baseName + ".enc"
+		if attempt > 1 {
+			backupName = fmt.Sprintf("%s_%d.enc", baseName, attempt)
+		}
+		
+		err := fm.WriteBackup(backupName, data)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		
+		return backupName, nil
+	}
+	
+	return "", errors.New("failed to find a free backup file name")
+}
+
+// WriteBackup atomically and durably writes already-encrypted data as a
+// new backup with the given name. It fails with an error satisfying
+// os.IsExist if the backup exists.
+func (fm *FileManager) WriteBackup(backupName string, data []byte) error {
+	backupPath := filepath.Join(fm.dataDir, "backups", backupName)
+	
+	err := writeDurable(fm.fs, backupPath, data, true)
+	if err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	return err
+}
+
+// RemoveStaleTempFiles deletes temporary files left in the data and backup
+// directories by writes that a crash interrupted, and returns their paths
+// relative to the data directory
+func (fm *FileManager) RemoveStaleTempFiles() ([]string, error) {
+	var removed []string
+	for _, dir := range []string{"", "backups"} {
+		names, err := removeStaleTempFiles(fm.fs, filepath.Join(fm.dataDir, dir))
+		if err != nil {
+			return removed, err
+		}
+		for _, name := range names {
+			removed = append(removed, filepath.Join(dir, name))
+		}
 	}
 	
-	return backupName, nil
+	return removed, nil
 }
 
 // ListBackups returns a list of backup files
 func (fm *FileManager) ListBackups() ([]string, error) {
 	backupDir := filepath.Join(fm.dataDir, "backups")
 	
-	entries, err := os.ReadDir(backupDir)
+	entries, err := fm.fs.ReadDir(backupDir)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return []string{}, nil // No backup directory yet
@@ -221,24 +335,26 @@ func (fm *FileManager) ListBackups() ([]string, error) {
 	return backups, nil
 }
 
-// DeleteOldBackups removes backup files older than the specified number of days
-func (fm *FileManager) DeleteOldBackups(retentionDays int) error {
-	if retentionDays <= 0 {
-		return errors.New("retention days must be positive")
-	}
-	
+// BackupFile describes a backup file on disk
+type BackupFile struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// BackupFiles returns the backup files with their size and modification time
+func (fm *FileManager) BackupFiles() ([]BackupFile, error) {
 	backupDir := filepath.Join(fm.dataDir, "backups")
-	cutoffTime := time.Now().AddDate(0, 0, -retentionDays)
 	
-	entries, err := os.ReadDir(backupDir)
+	entries, err := fm.fs.ReadDir(backupDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil // No backup directory
+			return []BackupFile{}, nil // No backup directory yet
 		}
-		return fmt.Errorf("failed to read backup directory: %w", err)
+		return nil, fmt.Errorf("failed to read backup directory: %w", err)
 	}
 	
-	var deletedCount int
+	var backups []BackupFile
 	for _, entry := range entries {
 		if entry.IsDir() || filepath.Ext(entry.Name()) != ".enc" {
 			continue
@@ -246,15 +362,28 @@ func (fm *FileManager) DeleteOldBackups(retentionDays int) error {
 		
 		info, err := entry.Info()
 		if err != nil {
-			continue
+			continue // Removed while listing
 		}
 		
-		if info.ModTime().Before(cutoffTime) {
-			filePath := filepath.Join(backupDir, entry.Name())
-			if err := os.Remove(filePath); err == nil {
-				deletedCount++
-			}
-		}
+		backups = append(backups, BackupFile{
+			Name:    entry.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+	
+	return backups, nil
+}
+
+// DeleteBackup removes a backup file together with its manifest
+func (fm *FileManager) DeleteBackup(backupName string) error {
+	backupPath := filepath.Join(fm.dataDir, "backups", backupName)
+	if err := fm.fs.Remove(backupPath); err != nil {
+		return fmt.Errorf("failed to delete backup %s: %w", backupName, err)
+	}
+	
+	if err := fm.fs.Remove(backupPath + backupManifestSuffix); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete manifest of backup %s: %w", backupName, err)
 	}
 	
 	return nil
@@ -267,6 +396,6 @@ func (fm *FileManager) FileExists(filename string) bool {
 	}
 	
 	filePath := filepath.Join(fm.dataDir, filename)
-	_, err := os.Stat(filePath)
+	_, err := fm.fs.Stat(filePath)
 	return !os.IsNotExist(err)
 }
\ No newline at end of file
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ErrLockHeld is returned by TryLock if someone else holds the lock
+var ErrLockHeld = errors.New("lock is held")
+
+// File is an open file of a Filesystem
+type File interface {
+	io.Reader
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FileLock is a held lock of a Filesystem
+type FileLock interface {
+	Unlock() error
+}
+
+// Filesystem is what the storage layer needs from a filesystem. Errors
+// follow the os package, so os.IsNotExist and os.IsExist work on them.
+type Filesystem interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+
+	// CreateTemp creates a new file in dir, named after pattern with the
+	// last "*" replaced by a random string, opened for reading and writing
+	CreateTemp(dir, pattern string) (File, error)
+
+	ReadFile(name string) ([]byte, error)
+	ReadDir(name string) ([]os.DirEntry, error)
+	Stat(name string) (os.FileInfo, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(path string, perm os.FileMode) error
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+
+	// SyncDir makes changes to the entries of a directory durable
+	SyncDir(name string) error
+
+	// TryLock takes an exclusive lock named after a file without waiting,
+	// failing with ErrLockHeld if it is taken
+	TryLock(name string) (FileLock, error)
+
+	// TryRLock takes a shared lock named after a file without waiting,
+	// failing with ErrLockHeld if an exclusive lock is held
+	TryRLock(name string) (FileLock, error)
+}
+
+// FilesystemName describes a filesystem for logs and status output
+func FilesystemName(fsys Filesystem) string {
+	switch fsys := fsys.(type) {
+	case OSFilesystem:
+		return "os"
+	case *MemoryFilesystem:
+		return "memory"
+	case *FaultyFilesystem:
+		return "faulty " + FilesystemName(fsys.fs)
+	default:
+		return fmt.Sprintf("%T", fsys)
+	}
+}
+
+// OSFilesystem is the real filesystem
+type OSFilesystem struct{}
+
+// OpenFile opens a file with os.OpenFile
+func (OSFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	file, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// CreateTemp creates a file with os.CreateTemp
+func (OSFilesystem) CreateTemp(dir, pattern string) (File, error) {
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// ReadFile reads a file with os.ReadFile
+func (OSFilesystem) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
+// ReadDir lists a directory with os.ReadDir
+func (OSFilesystem) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(name)
+}
+
+// Stat describes a file with os.Stat
+func (OSFilesystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+// Mkdir creates a directory with os.Mkdir
+func (OSFilesystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+// MkdirAll creates a directory and its parents with os.MkdirAll
+func (OSFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+// Remove removes a file or empty directory with os.Remove
+func (OSFilesystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+// Rename renames a file with os.Rename
+func (OSFilesystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// Link creates a hard link with os.Link
+func (OSFilesystem) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+// SyncDir opens a directory and fsyncs it
+func (OSFilesystem) SyncDir(name string) error {
+	dir, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
+// TryLock takes an exclusive flock on the file, creating it if needed
+func (OSFilesystem) TryLock(name string) (FileLock, error) {
+	return flock(name, syscall.LOCK_EX)
+}
+
+// TryRLock takes a shared flock on the file, creating it if needed
+func (OSFilesystem) TryRLock(name string) (FileLock, error) {
+	return flock(name, syscall.LOCK_SH)
+}
+
+// flock opens the file and takes an flock of the given kind on it
+func flock(name string, how int) (FileLock, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %w", err)
+	}
+
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		file.Close()
+		return nil, ErrLockHeld
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &osFileLock{file: file}, nil
+}
+
+// osFileLock is an flock held on an open file
+type osFileLock struct {
+	file *os.File
+}
+
+// Unlock releases the flock and closes the file
+func (l *osFileLock) Unlock() error {
+	if err := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
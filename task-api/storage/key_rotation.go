@@ -0,0 +1,278 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// keyRotationStateFile records an in-progress rotation so it can be resumed
+const keyRotationStateFile = ".key_rotation.json"
+
+// KeyRotationReport describes the outcome of a key rotation
+type KeyRotationReport struct {
+	TargetKeyID string   `json:"target_key_id"`
+	Resumed     bool     `json:"resumed"`
+	Rotated     []string `json:"rotated"`
+	Rewrapped   []string `json:"rewrapped"`
+	Skipped     []string `json:"skipped"`
+	Failed      []string `json:"failed,omitempty"`
+	StartedAt   string   `json:"started_at"`
+	CompletedAt string   `json:"completed_at"`
+}
+
+// keyRotationState is persisted while a rotation is running
+type keyRotationState struct {
+	TargetKeyID string   `json:"target_key_id"`
+	StartedAt   string   `json:"started_at"`
+	Completed   []string `json:"completed"`
+}
+
+// RotateKeys moves the data file, documents and every backup to the active master key
+// and recovery key. Envelope files only have their data key re-wrapped,
+// leaving the encrypted body untouched; legacy files are fully re-encrypted into the current
+// container format. Each file is replaced atomically and files that are
+// already current are skipped, so an interrupted rotation can simply be run again; the
+// progress file left behind makes the restart visible in KeyRotationStatus.
+// Backups that cannot be decrypted with any key are left untouched and
+// reported as failed.
+func (es *EncryptedStorage) RotateKeys() (*KeyRotationReport, error) {
+	if err := es.fileManager.Lock(); err != nil {
+		return nil, fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	targetKeyID := es.cryptoService.Provider().ActiveKeyID()
+	report := &KeyRotationReport{
+		TargetKeyID: targetKeyID,
+		Rotated:     []string{},
+		Rewrapped:   []string{},
+		Skipped:     []string{},
+	}
+
+	state, err := es.loadKeyRotationState()
+	if err != nil {
+		return nil, err
+	}
+	if state != nil {
+		report.Resumed = true
+		log.Printf("Resuming key rotation started at %s (%d files done)", state.StartedAt, len(state.Completed))
+	}
+	if state == nil || state.TargetKeyID != targetKeyID {
+		state = &keyRotationState{
+			TargetKeyID: targetKeyID,
+			StartedAt:   time.Now().UTC().Format(time.RFC3339),
+		}
+	}
+	report.StartedAt = state.StartedAt
+
+	if err := es.saveKeyRotationState(state); err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	if es.fileManager.FileExists(es.dataFile) {
+		files = append(files, es.dataFile)
+	}
+	documents, err := es.documentFiles()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, documents...)
+	backups, err := es.fileManager.ListBackups()
+	if err != nil {
+		return nil, err
+	}
+	for _, backup := range backups {
+		files = append(files, filepath.Join("backups", backup))
+	}
+
+	for _, file := range files {
+		isBackup := filepath.Dir(file) == "backups"
+		result, err := es.rotateFile(file)
+		if err != nil {
+			if !isBackup {
+				return nil, fmt.Errorf("failed to rotate %s: %w", file, err)
+			}
+			log.Printf("Warning: failed to rotate backup %s: %v", file, err)
+			report.Failed = append(report.Failed, file)
+			continue
+		}
+
+		switch result {
+		case fileRotated:
+			report.Rotated = append(report.Rotated, file)
+		case fileRewrapped:
+			report.Rewrapped = append(report.Rewrapped, file)
+		default:
+			report.Skipped = append(report.Skipped, file)
+		}
+
+		if result != fileCurrent && isBackup {
+			if err := es.refreshBackupManifest(filepath.Base(file)); err != nil {
+				log.Printf("Warning: failed to update manifest of backup %s: %v", file, err)
+			}
+		}
+
+		state.Completed = append(state.Completed, file)
+		if err := es.saveKeyRotationState(state); err != nil {
+			return nil, err
+		}
+	}
+
+	rebound, err := es.rebindRecoveryKey()
+	if err != nil {
+		return nil, err
+	}
+	if rebound {
+		report.Rewrapped = append(report.Rewrapped, RecoveryKeyFile)
+	}
+
+	rewrapped, err := es.rewrapManifestKey()
+	if err != nil {
+		return nil, err
+	}
+	if rewrapped {
+		report.Rewrapped = append(report.Rewrapped, BackupManifestKeyFile)
+	}
+
+	if err := es.fileManager.fs.Remove(filepath.Join(es.fileManager.dataDir, keyRotationStateFile)); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove key rotation state: %w", err)
+	}
+
+	report.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	log.Printf("Key rotation to %q complete: %d re-encrypted, %d re-wrapped, %d already current, %d failed",
+		targetKeyID, len(report.Rotated), len(report.Rewrapped), len(report.Skipped), len(report.Failed))
+
+	return report, nil
+}
+
+// rotateResult is what rotateFile did to a file
+type rotateResult int
+
+const (
+	fileCurrent rotateResult = iota
+	fileRewrapped
+	fileRotated
+)
+
+// rotateFile moves a single file to the active master key, re-wrapping its
+// data key when possible and re-encrypting it otherwise
+func (es *EncryptedStorage) rotateFile(file string) (rotateResult, error) {
+	encryptedData, err := es.fileManager.ReadFile(file)
+	if err != nil {
+		return fileCurrent, err
+	}
+
+	if es.cryptoService.IsCurrent(encryptedData) {
+		return fileCurrent, nil
+	}
+
+	rewrapped, ok, err := es.cryptoService.Rewrap(encryptedData)
+	if err != nil {
+		return fileCurrent, err
+	}
+	if ok {
+		if err := es.fileManager.WriteFile(file, rewrapped); err != nil {
+			return fileCurrent, err
+		}
+		return fileRewrapped, nil
+	}
+
+	plaintext, err := es.cryptoService.Decrypt(encryptedData)
+	if err != nil {
+		return fileCurrent, err
+	}
+	defer SecureWipe(plaintext)
+
+	reencrypted, err := es.cryptoService.Encrypt(plaintext)
+	if err != nil {
+		return fileCurrent, err
+	}
+
+	if err := es.fileManager.WriteFile(file, reencrypted); err != nil {
+		return fileCurrent, err
+	}
+
+	return fileRotated, nil
+}
+
+// KeyRotationPending reports whether a previous rotation was interrupted
+func (es *EncryptedStorage) KeyRotationPending() bool {
+	return es.fileManager.FileExists(keyRotationStateFile)
+}
+
+// KeyRotationStatus returns key information for diagnostics
+func (es *EncryptedStorage) KeyRotationStatus() map[string]interface{} {
+	status := es.cryptoService.Provider().Info()
+	status["key_ids"] = es.cryptoService.Provider().KeyIDs()
+	status["format_version"] = ContainerVersion
+	if keyring := es.cryptoService.Keyring(); keyring != nil && es.cryptoService.Provider().Name() != "password" {
+		status["legacy_key_ids"] = keyring.IDs()
+	}
+	if recoveryKey := es.cryptoService.RecoveryKey(); recoveryKey != nil {
+		status["recovery"] = recoveryKey.Info()
+	}
+	if es.cryptoService.Recovering() {
+		status["recovering"] = true
+	}
+
+	if state, err := es.loadKeyRotationState(); err == nil && state != nil {
+		status["rotation_in_progress"] = true
+		status["rotation_target_key_id"] = state.TargetKeyID
+		status["rotation_started_at"] = state.StartedAt
+		status["rotation_files_done"] = len(state.Completed)
+	} else {
+		status["rotation_in_progress"] = false
+	}
+
+	if es.fileManager.FileExists(es.dataFile) {
+		if data, err := es.fileManager.ReadFile(es.dataFile); err == nil {
+			fileInfo := InspectEncrypted(data)
+			status["data_file_key_id"] = fileInfo.KeyID
+			status["data_file_key_provider"] = fileInfo.Provider
+			status["data_file_recovery_key_id"] = fileInfo.RecoveryKeyID
+			status["data_file_format"] = fileInfo.Format
+			status["data_file_kdf"] = fileInfo.KDF
+		}
+	}
+
+	return status
+}
+
+func (es *EncryptedStorage) loadKeyRotationState() (*keyRotationState, error) {
+	data, err := es.fileManager.ReadFile(keyRotationStateFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read key rotation state: %w", err)
+	}
+
+	var state keyRotationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse key rotation state: %w", err)
+	}
+
+	return &state, nil
+}
+
+func (es *EncryptedStorage) saveKeyRotationState(state *keyRotationState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to serialize key rotation state: %w", err)
+	}
+
+	if err := es.fileManager.WriteFile(keyRotationStateFile, data); err != nil {
+		return fmt.Errorf("failed to save key rotation state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// DefaultKeyID identifies the encryption key when none is configured
+	DefaultKeyID = "primary"
+
+	// MaxKeyIDLength is the longest key ID that fits in a key header
+	MaxKeyIDLength = 64
+)
+
+// Keyring holds the passwords that data may be encrypted with. New data is
+// always encrypted with the active key; retired keys are kept only so that
+// existing data can still be decrypted until it has been rotated.
+type Keyring struct {
+	mu       sync.RWMutex
+	activeID string
+	keys     map[string]string
+	order    []string
+}
+
+// NewKeyring creates a keyring whose active key is the given password
+func NewKeyring(activeID, password string) (*Keyring, error) {
+	if !ValidKeyID(activeID) {
+		return nil, fmt.Errorf("invalid key ID %q", activeID)
+	}
+	if password == "" {
+		return nil, errors.New("encryption key cannot be empty")
+	}
+
+	return &Keyring{
+		activeID: activeID,
+		keys:     map[string]string{activeID: password},
+		order:    []string{activeID},
+	}, nil
+}
+
+// AddRetiredKey registers a key that can decrypt but is never used to encrypt
+func (k *Keyring) AddRetiredKey(keyID, password string) error {
+	if !ValidKeyID(keyID) {
+		return fmt.Errorf("invalid key ID %q", keyID)
+	}
+	if password == "" {
+		return fmt.Errorf("key %q cannot be empty", keyID)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, exists := k.keys[keyID]; exists {
+		return fmt.Errorf("key ID %q is already in the keyring", keyID)
+	}
+
+	k.keys[keyID] = password
+	k.order = append(k.order, keyID)
+	return nil
+}
+
+// ActiveID returns the ID of the key used for encryption
+func (k *Keyring) ActiveID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.activeID
+}
+
+// IDs returns all key IDs, active key first
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return append([]string{}, k.order...)
+}
+
+// Has reports whether the keyring holds the given key
+func (k *Keyring) Has(keyID string) bool {
+	_, ok := k.password(keyID)
+	return ok
+}
+
+// password returns the password for a key ID
+func (k *Keyring) password(keyID string) (string, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	password, ok := k.keys[keyID]
+	return password, ok
+}
+
+// ValidKeyID checks that a key ID is non-empty, short enough for the header
+// and limited to letters, digits, '.', '_' and '-'
+func ValidKeyID(keyID string) bool {
+	if keyID == "" || len(keyID) > MaxKeyIDLength {
+		return false
+	}
+	for _, r := range keyID {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '_', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
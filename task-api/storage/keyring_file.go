@@ -0,0 +1,239 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// keyringFileVersion is the format version of the master keyring file
+const keyringFileVersion = 1
+
+// keyringFileData is the JSON layout of a local master keyring file. Keys
+// are base64 encoded; revoked entries keep only their ID and history.
+type keyringFileData struct {
+	Version int                `json:"version"`
+	Keys    []keyringFileEntry `json:"keys"`
+}
+
+type keyringFileEntry struct {
+	ID        string          `json:"id"`
+	Key       string          `json:"key,omitempty"`
+	Status    MasterKeyStatus `json:"status"`
+	CreatedAt string          `json:"created_at"`
+	RevokedAt string          `json:"revoked_at,omitempty"`
+}
+
+// MasterKeyInfo describes a key in the keyring file without its material
+type MasterKeyInfo struct {
+	ID        string          `json:"id"`
+	Status    MasterKeyStatus `json:"status"`
+	CreatedAt string          `json:"created_at"`
+	RevokedAt string          `json:"revoked_at,omitempty"`
+}
+
+// LoadKeyringFileProvider loads the master keys from a keyring file. When
+// the file does not exist and create is set, a new keyring with one
+// generated key is written first.
+func LoadKeyringFileProvider(path string, create bool) (*StaticKeyProvider, error) {
+	data, err := readKeyringFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) || !create {
+			return nil, err
+		}
+
+		data = &keyringFileData{Version: keyringFileVersion}
+		if _, err := data.generate(); err != nil {
+			return nil, err
+		}
+		if err := writeKeyringFile(path, data); err != nil {
+			return nil, err
+		}
+		log.Printf("Warning: created new master keyring %s; back it up, data cannot be decrypted without it", path)
+	}
+
+	provider := &StaticKeyProvider{
+		name:   "keyring",
+		keys:   map[string][]byte{},
+		status: map[string]MasterKeyStatus{},
+	}
+
+	for _, entry := range data.Keys {
+		if entry.Status == MasterKeyRevoked {
+			provider.status[entry.ID] = MasterKeyRevoked
+			continue
+		}
+
+		key, err := DecodeMasterKey(entry.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key %q in %s: %w", entry.ID, path, err)
+		}
+		if err := provider.addKey(entry.ID, key, entry.Status); err != nil {
+			return nil, fmt.Errorf("invalid master keyring %s: %w", path, err)
+		}
+		SecureWipe(key)
+	}
+
+	if provider.activeID == "" {
+		return nil, fmt.Errorf("master keyring %s has no active key", path)
+	}
+
+	return provider, nil
+}
+
+// GenerateMasterKey adds a new active key to the keyring file and retires
+// the previous active key. Existing data stays readable; run a key rotation
+// to re-wrap it under the new key.
+func GenerateMasterKey(path string) (string, error) {
+	data, err := readKeyringFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		data = &keyringFileData{Version: keyringFileVersion}
+	}
+
+	keyID, err := data.generate()
+	if err != nil {
+		return "", err
+	}
+
+	if err := writeKeyringFile(path, data); err != nil {
+		return "", err
+	}
+
+	return keyID, nil
+}
+
+// RevokeMasterKey removes the material of a retired key from the keyring
+// file. Data whose DEK is still wrapped by it can no longer be decrypted,
+// so only revoke a key after a completed rotation.
+func RevokeMasterKey(path, keyID string) error {
+	data, err := readKeyringFile(path)
+	if err != nil {
+		return err
+	}
+
+	for i := range data.Keys {
+		entry := &data.Keys[i]
+		if entry.ID != keyID {
+			continue
+		}
+
+		switch entry.Status {
+		case MasterKeyActive:
+			return errors.New("cannot revoke the active master key, generate a new key first")
+		case MasterKeyRevoked:
+			return nil
+		}
+
+		entry.Status = MasterKeyRevoked
+		entry.Key = ""
+		entry.RevokedAt = time.Now().UTC().Format(time.RFC3339)
+		return writeKeyringFile(path, data)
+	}
+
+	return fmt.Errorf("master key %q not found", keyID)
+}
+
+// ListMasterKeys returns the keys in the keyring file without their material
+func ListMasterKeys(path string) ([]MasterKeyInfo, error) {
+	data, err := readKeyringFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]MasterKeyInfo, 0, len(data.Keys))
+	for _, entry := range data.Keys {
+		keys = append(keys, MasterKeyInfo{
+			ID:        entry.ID,
+			Status:    entry.Status,
+			CreatedAt: entry.CreatedAt,
+			RevokedAt: entry.RevokedAt,
+		})
+	}
+	return keys, nil
+}
+
+// generate appends a new random active key, retiring the current one
+func (d *keyringFileData) generate() (string, error) {
+	key, err := NewDataKey()
+	if err != nil {
+		return "", err
+	}
+	defer SecureWipe(key)
+
+	now := time.Now().UTC()
+	keyID := "mk-" + now.Format("20060102-150405")
+	for suffix := 2; d.has(keyID); suffix++ {
+		keyID = fmt.Sprintf("mk-%s-%d", now.Format("20060102-150405"), suffix)
+	}
+
+	for i := range d.Keys {
+		if d.Keys[i].Status == MasterKeyActive {
+			d.Keys[i].Status = MasterKeyRetired
+		}
+	}
+
+	d.Keys = append(d.Keys, keyringFileEntry{
+		ID:        keyID,
+		Key:       base64.StdEncoding.EncodeToString(key),
+		Status:    MasterKeyActive,
+		CreatedAt: now.Format(time.RFC3339),
+	})
+	return keyID, nil
+}
+
+func (d *keyringFileData) has(keyID string) bool {
+	for _, entry := range d.Keys {
+		if entry.ID == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+func readKeyringFile(path string) (*keyringFileData, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to read master keyring: %w", err)
+	}
+
+	var data keyringFileData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse master keyring: %w", err)
+	}
+	if data.Version != keyringFileVersion {
+		return nil, fmt.Errorf("unsupported master keyring version %d", data.Version)
+	}
+
+	return &data, nil
+}
+
+// writeKeyringFile atomically replaces the keyring file, readable only by
+// the owner
+func writeKeyringFile(path string, data *keyringFileData) error {
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to serialize master keyring: %w", err)
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create master keyring directory: %w", err)
+	}
+
+	if err := writeDurable(OSFilesystem{}, path, raw, false); err != nil {
+		return fmt.Errorf("failed to write master keyring: %w", err)
+	}
+
+	return nil
+}
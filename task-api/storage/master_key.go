@@ -0,0 +1,376 @@
+package storage
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// DataKeySize is the size of the random per-file data encryption keys
+const DataKeySize = KeySize
+
+// MasterKeyProvider wraps and unwraps data encryption keys (DEKs) with
+// master keys it holds. Data is encrypted with a random DEK and only the
+// wrapped DEK is stored next to it, so master keys can be rotated or
+// revoked by re-wrapping DEKs instead of re-encrypting the data. The
+// interface mirrors the encrypt/decrypt calls of a key management service.
+type MasterKeyProvider interface {
+	// Name identifies the provider type, e.g. "password" or "keyring"
+	Name() string
+
+	// ActiveKeyID returns the master key used to wrap new DEKs
+	ActiveKeyID() string
+
+	// KeyIDs returns every master key that can unwrap, active key first
+	KeyIDs() []string
+
+	// WrapKey wraps a DEK with the active master key
+	WrapKey(dek []byte) (keyID string, wrapped []byte, err error)
+
+	// UnwrapKey recovers a DEK wrapped by the given master key
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+
+	// IsCurrent reports whether a wrapped DEK already uses the active
+	// master key and current wrapping parameters
+	IsCurrent(keyID string, wrapped []byte) bool
+
+	// Info returns diagnostic information without any key material
+	Info() map[string]interface{}
+}
+
+// NewDataKey generates a random data encryption key
+func NewDataKey() ([]byte, error) {
+	dek := make([]byte, DataKeySize)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, errors.New("failed to generate data key")
+	}
+	return dek, nil
+}
+
+// sealWithKey encrypts plaintext with a raw AES-256 key
+// Returns: iv + ciphertext + tag
+func sealWithKey(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, IVSize)
+	if _, err := rand.Read(iv); err != nil {
+		return nil, errors.New("failed to generate IV")
+	}
+
+	result := make([]byte, 0, IVSize+len(plaintext)+TagSize)
+	result = append(result, iv...)
+	return gcm.Seal(result, iv, plaintext, additionalData), nil
+}
+
+// openWithKey decrypts data produced by sealWithKey
+func openWithKey(key, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < IVSize+TagSize {
+		return nil, errors.New("wrapped key too short")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return gcm.Open(nil, sealed[:IVSize], sealed[IVSize:], additionalData)
+}
+
+// newGCM creates an AES-GCM cipher for a raw key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("failed to create AES cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.New("failed to create GCM cipher")
+	}
+
+	return gcm, nil
+}
+
+// PasswordKeyProvider wraps DEKs with keys derived from the passwords in a
+// Keyring. Wrapped keys carry their own salt and KDF parameters.
+//
+// Wrapped key layout: KDF parameters | salt (16) | iv (12) | ciphertext + tag
+type PasswordKeyProvider struct {
+	keyring *Keyring
+	kdf     KDFParams
+}
+
+// NewPasswordKeyProvider creates a provider over the keyring that derives
+// wrapping keys with the given KDF parameters
+func NewPasswordKeyProvider(keyring *Keyring, kdf KDFParams) (*PasswordKeyProvider, error) {
+	if err := kdf.Validate(); err != nil {
+		return nil, err
+	}
+	return &PasswordKeyProvider{keyring: keyring, kdf: kdf}, nil
+}
+
+// Name returns the provider type
+func (p *PasswordKeyProvider) Name() string {
+	return "password"
+}
+
+// ActiveKeyID returns the ID of the active password
+func (p *PasswordKeyProvider) ActiveKeyID() string {
+	return p.keyring.ActiveID()
+}
+
+// KeyIDs returns all password IDs, active first
+func (p *PasswordKeyProvider) KeyIDs() []string {
+	return p.keyring.IDs()
+}
+
+// KDFParams returns the parameters used to derive new wrapping keys
+func (p *PasswordKeyProvider) KDFParams() KDFParams {
+	return p.kdf
+}
+
+// WrapKey wraps a DEK with a key derived from the active password
+func (p *PasswordKeyProvider) WrapKey(dek []byte) (string, []byte, error) {
+	keyID := p.keyring.ActiveID()
+	password, _ := p.keyring.password(keyID)
+
+	salt, err := NewSalt()
+	if err != nil {
+		return "", nil, err
+	}
+
+	kek := p.kdf.deriveKey(password, salt)
+	defer SecureWipe(kek)
+
+	sealed, err := sealWithKey(kek, dek, []byte(keyID))
+	if err != nil {
+		return "", nil, err
+	}
+
+	wrapped := appendKDFParams(nil, p.kdf)
+	wrapped = append(wrapped, salt...)
+	wrapped = append(wrapped, sealed...)
+	return keyID, wrapped, nil
+}
+
+// UnwrapKey recovers a DEK wrapped under one of the keyring's passwords
+func (p *PasswordKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	password, ok := p.keyring.password(keyID)
+	if !ok {
+		return nil, fmt.Errorf("unknown master key ID %q", keyID)
+	}
+
+	kdf, n, err := readKDFParams(wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("invalid wrapped key: %w", err)
+	}
+	if len(wrapped) < n+SaltSize {
+		return nil, errors.New("invalid wrapped key: truncated")
+	}
+
+	kek := kdf.deriveKey(password, wrapped[n:n+SaltSize])
+	defer SecureWipe(kek)
+
+	dek, err := openWithKey(kek, wrapped[n+SaltSize:], []byte(keyID))
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key: invalid data or wrong password")
+	}
+	return dek, nil
+}
+
+// IsCurrent reports whether the DEK is wrapped by the active password with
+// the current KDF parameters
+func (p *PasswordKeyProvider) IsCurrent(keyID string, wrapped []byte) bool {
+	if keyID != p.keyring.ActiveID() {
+		return false
+	}
+	kdf, _, err := readKDFParams(wrapped)
+	return err == nil && kdf == p.kdf
+}
+
+// Info returns diagnostic information
+func (p *PasswordKeyProvider) Info() map[string]interface{} {
+	return map[string]interface{}{
+		"provider":      p.Name(),
+		"active_key_id": p.ActiveKeyID(),
+		"key_ids":       p.KeyIDs(),
+		"kdf":           p.kdf.String(),
+	}
+}
+
+// MasterKeyStatus is the lifecycle state of a raw master key
+type MasterKeyStatus string
+
+const (
+	// MasterKeyActive wraps new DEKs
+	MasterKeyActive MasterKeyStatus = "active"
+
+	// MasterKeyRetired only unwraps existing DEKs until they are re-wrapped
+	MasterKeyRetired MasterKeyStatus = "retired"
+
+	// MasterKeyRevoked can no longer unwrap anything
+	MasterKeyRevoked MasterKeyStatus = "revoked"
+)
+
+// StaticKeyProvider wraps DEKs directly with raw 256-bit master keys held in
+// memory. It backs both the local keyring file and the environment-based
+// KMS stand-in.
+//
+// Wrapped key layout: iv (12) | ciphertext + tag
+type StaticKeyProvider struct {
+	mu       sync.RWMutex
+	name     string
+	activeID string
+	keys     map[string][]byte
+	status   map[string]MasterKeyStatus
+}
+
+// NewStaticKeyProvider creates a provider whose active master key is key
+func NewStaticKeyProvider(name, activeID string, key []byte) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{
+		name:   name,
+		keys:   map[string][]byte{},
+		status: map[string]MasterKeyStatus{},
+	}
+	if err := p.addKey(activeID, key, MasterKeyActive); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// AddRetiredKey registers a master key that can unwrap but never wraps
+func (p *StaticKeyProvider) AddRetiredKey(keyID string, key []byte) error {
+	return p.addKey(keyID, key, MasterKeyRetired)
+}
+
+// addKey validates and registers a master key
+func (p *StaticKeyProvider) addKey(keyID string, key []byte, status MasterKeyStatus) error {
+	if !ValidKeyID(keyID) {
+		return fmt.Errorf("invalid master key ID %q", keyID)
+	}
+	if len(key) != KeySize {
+		return fmt.Errorf("master key %q must be %d bytes", keyID, KeySize)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.keys[keyID]; exists {
+		return fmt.Errorf("master key ID %q is already registered", keyID)
+	}
+	if status == MasterKeyActive {
+		if p.activeID != "" {
+			return errors.New("only one master key can be active")
+		}
+		p.activeID = keyID
+	}
+
+	p.keys[keyID] = append([]byte{}, key...)
+	p.status[keyID] = status
+	return nil
+}
+
+// Name returns the provider type
+func (p *StaticKeyProvider) Name() string {
+	return p.name
+}
+
+// ActiveKeyID returns the ID of the active master key
+func (p *StaticKeyProvider) ActiveKeyID() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.activeID
+}
+
+// KeyIDs returns the IDs of all keys that can unwrap, active first
+func (p *StaticKeyProvider) KeyIDs() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ids := []string{p.activeID}
+	var retired []string
+	for id, status := range p.status {
+		if status == MasterKeyRetired {
+			retired = append(retired, id)
+		}
+	}
+	sort.Strings(retired)
+	return append(ids, retired...)
+}
+
+// WrapKey wraps a DEK with the active master key
+func (p *StaticKeyProvider) WrapKey(dek []byte) (string, []byte, error) {
+	p.mu.RLock()
+	keyID := p.activeID
+	key := p.keys[keyID]
+	p.mu.RUnlock()
+
+	wrapped, err := sealWithKey(key, dek, []byte(keyID))
+	if err != nil {
+		return "", nil, err
+	}
+	return keyID, wrapped, nil
+}
+
+// UnwrapKey recovers a DEK wrapped by an active or retired master key
+func (p *StaticKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	p.mu.RLock()
+	key, ok := p.keys[keyID]
+	status := p.status[keyID]
+	p.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown master key ID %q", keyID)
+	}
+	if status == MasterKeyRevoked {
+		return nil, fmt.Errorf("master key %q has been revoked", keyID)
+	}
+
+	dek, err := openWithKey(key, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key: invalid data or wrong master key")
+	}
+	return dek, nil
+}
+
+// IsCurrent reports whether the DEK is wrapped by the active master key
+func (p *StaticKeyProvider) IsCurrent(keyID string, wrapped []byte) bool {
+	return keyID == p.ActiveKeyID()
+}
+
+// Info returns diagnostic information
+func (p *StaticKeyProvider) Info() map[string]interface{} {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	keys := make(map[string]string, len(p.status))
+	for id, status := range p.status {
+		keys[id] = string(status)
+	}
+
+	return map[string]interface{}{
+		"provider":      p.name,
+		"active_key_id": p.activeID,
+		"master_keys":   keys,
+	}
+}
+
+// DecodeMasterKey parses a base64 encoded 256-bit master key
+func DecodeMasterKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("master key must be base64 encoded")
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("master key must be %d bytes", KeySize)
+	}
+	return key, nil
+}
@@ -0,0 +1,565 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemoryFilesystem keeps files in memory, so storage can run without
+// touching disk. Everything is lost when the process exits. Hard links
+// share contents like on disk, and Sync does nothing since nothing can be
+// lost in between.
+type MemoryFilesystem struct {
+	mu    sync.Mutex
+	nodes map[string]*memNode
+
+	// locks counts the holders of each lock, with -1 for an exclusive one
+	locks map[string]int
+}
+
+// memNode is a file or directory. Hard links are paths sharing a node.
+type memNode struct {
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+// NewMemoryFilesystem creates an empty in-memory filesystem
+func NewMemoryFilesystem() *MemoryFilesystem {
+	return &MemoryFilesystem{
+		nodes: make(map[string]*memNode),
+		locks: make(map[string]int),
+	}
+}
+
+// cleanPath normalizes a path into a key of the node map. The current and
+// root directory always exist and have no node.
+func cleanPath(name string) string {
+	return filepath.Clean(name)
+}
+
+func isRoot(name string) bool {
+	return name == "." || name == string(filepath.Separator)
+}
+
+// lookup returns the node at a clean path. The root is a directory
+// without a node.
+func (m *MemoryFilesystem) lookup(name string) (*memNode, bool) {
+	if isRoot(name) {
+		return &memNode{dir: true, mode: 0755}, true
+	}
+	node, ok := m.nodes[name]
+	return node, ok
+}
+
+// checkParent fails unless the parent of a clean path is a directory
+func (m *MemoryFilesystem) checkParent(op, name string) error {
+	parent, ok := m.lookup(filepath.Dir(name))
+	if !ok {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	if !parent.dir {
+		return &os.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// OpenFile opens a file, honoring O_CREATE, O_EXCL, O_TRUNC and O_APPEND
+func (m *MemoryFilesystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.openFile(name, cleanPath(name), flag, perm)
+}
+
+func (m *MemoryFilesystem) openFile(name, key string, flag int, perm os.FileMode) (File, error) {
+	node, exists := m.lookup(key)
+	switch {
+	case exists && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !exists && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !exists:
+		if err := m.checkParent("open", key); err != nil {
+			return nil, err
+		}
+		node = &memNode{mode: perm.Perm(), modTime: time.Now()}
+		m.nodes[key] = node
+	}
+
+	access := flag & (os.O_RDONLY | os.O_WRONLY | os.O_RDWR)
+	if node.dir && access != os.O_RDONLY {
+		return nil, &os.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if flag&os.O_TRUNC != 0 && access != os.O_RDONLY {
+		node.data = nil
+		node.modTime = time.Now()
+	}
+
+	return &memFile{
+		fs:       m,
+		node:     node,
+		name:     name,
+		readable: access != os.O_WRONLY,
+		writable: access != os.O_RDONLY,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+// CreateTemp creates a new file with a random name
+func (m *MemoryFilesystem) CreateTemp(dir, pattern string) (File, error) {
+	if dir == "" {
+		dir = "."
+	}
+	prefix, suffix := pattern, ""
+	if i := strings.LastIndex(pattern, "*"); i >= 0 {
+		prefix, suffix = pattern[:i], pattern[i+1:]
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for attempt := 0; attempt < 10000; attempt++ {
+		var random [4]byte
+		if _, err := rand.Read(random[:]); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(binary.BigEndian.Uint32(random[:])), 10)+suffix)
+		file, err := m.openFile(name, cleanPath(name), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			continue
+		}
+		return file, err
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern), Err: os.ErrExist}
+}
+
+// ReadFile returns a copy of a file's contents
+func (m *MemoryFilesystem) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.lookup(cleanPath(name))
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if node.dir {
+		return nil, &os.PathError{Op: "read", Path: name, Err: syscall.EISDIR}
+	}
+	return append([]byte{}, node.data...), nil
+}
+
+// ReadDir lists a directory sorted by name
+func (m *MemoryFilesystem) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := cleanPath(name)
+	node, ok := m.lookup(key)
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if !node.dir {
+		return nil, &os.PathError{Op: "readdirent", Path: name, Err: syscall.ENOTDIR}
+	}
+
+	entries := []os.DirEntry{}
+	for path, child := range m.nodes {
+		if filepath.Dir(path) == key && path != key {
+			entries = append(entries, fs.FileInfoToDirEntry(child.info(filepath.Base(path))))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Stat describes a file or directory
+func (m *MemoryFilesystem) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.lookup(cleanPath(name))
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return node.info(filepath.Base(name)), nil
+}
+
+// Mkdir creates a directory whose parent exists
+func (m *MemoryFilesystem) Mkdir(name string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := cleanPath(name)
+	if _, exists := m.lookup(key); exists {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if err := m.checkParent("mkdir", key); err != nil {
+		return err
+	}
+	m.nodes[key] = &memNode{dir: true, mode: perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+// MkdirAll creates a directory and any missing parents
+func (m *MemoryFilesystem) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := cleanPath(path)
+	var missing []string
+	for dir := key; !isRoot(dir); dir = filepath.Dir(dir) {
+		node, exists := m.nodes[dir]
+		if exists {
+			if !node.dir {
+				return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+			}
+			break
+		}
+		missing = append(missing, dir)
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		m.nodes[missing[i]] = &memNode{dir: true, mode: perm.Perm(), modTime: time.Now()}
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory
+func (m *MemoryFilesystem) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := cleanPath(name)
+	node, ok := m.nodes[key]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if node.dir && m.hasChildren(key) {
+		return &os.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+// Rename moves a file or directory, replacing a file at newpath
+func (m *MemoryFilesystem) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldKey, newKey := cleanPath(oldpath), cleanPath(newpath)
+	node, ok := m.nodes[oldKey]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	if err := m.checkParent("rename", newKey); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err.(*os.PathError).Err}
+	}
+	if target, exists := m.nodes[newKey]; exists && target.dir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EEXIST}
+	}
+	if oldKey == newKey {
+		return nil
+	}
+
+	delete(m.nodes, oldKey)
+	m.nodes[newKey] = node
+	if node.dir {
+		prefix := oldKey + string(filepath.Separator)
+		for path, child := range m.nodes {
+			if strings.HasPrefix(path, prefix) {
+				delete(m.nodes, path)
+				m.nodes[filepath.Join(newKey, strings.TrimPrefix(path, prefix))] = child
+			}
+		}
+	}
+	return nil
+}
+
+// Link gives a file a second name sharing its contents
+func (m *MemoryFilesystem) Link(oldname, newname string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldKey, newKey := cleanPath(oldname), cleanPath(newname)
+	node, ok := m.nodes[oldKey]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if node.dir {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: syscall.EPERM}
+	}
+	if _, exists := m.lookup(newKey); exists {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if err := m.checkParent("link", newKey); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err.(*os.PathError).Err}
+	}
+	m.nodes[newKey] = node
+	return nil
+}
+
+// SyncDir only checks that the directory exists
+func (m *MemoryFilesystem) SyncDir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	node, ok := m.lookup(cleanPath(name))
+	if !ok {
+		return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	if !node.dir {
+		return &os.PathError{Op: "sync", Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+// TryLock takes an exclusive lock named after a file, creating the file
+// like an flock would
+func (m *MemoryFilesystem) TryLock(name string) (FileLock, error) {
+	return m.tryLock(name, true)
+}
+
+// TryRLock takes a shared lock named after a file, creating the file like
+// an flock would
+func (m *MemoryFilesystem) TryRLock(name string) (FileLock, error) {
+	return m.tryLock(name, false)
+}
+
+func (m *MemoryFilesystem) tryLock(name string, exclusive bool) (FileLock, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := cleanPath(name)
+	if holders := m.locks[key]; holders < 0 || (exclusive && holders > 0) {
+		return nil, ErrLockHeld
+	}
+	if _, exists := m.lookup(key); !exists {
+		if err := m.checkParent("open", key); err != nil {
+			return nil, err
+		}
+		m.nodes[key] = &memNode{mode: 0644, modTime: time.Now()}
+	}
+
+	if exclusive {
+		m.locks[key] = -1
+	} else {
+		m.locks[key]++
+	}
+	return &memFileLock{fs: m, key: key}, nil
+}
+
+func (m *MemoryFilesystem) hasChildren(key string) bool {
+	for path := range m.nodes {
+		if filepath.Dir(path) == key && path != key {
+			return true
+		}
+	}
+	return false
+}
+
+// memFileLock is a held lock of a MemoryFilesystem
+type memFileLock struct {
+	fs  *MemoryFilesystem
+	key string
+}
+
+// Unlock releases the lock
+func (l *memFileLock) Unlock() error {
+	l.fs.mu.Lock()
+	defer l.fs.mu.Unlock()
+
+	if l.fs.locks[l.key] > 1 {
+		l.fs.locks[l.key]--
+	} else {
+		delete(l.fs.locks, l.key)
+	}
+	return nil
+}
+
+// info describes a node under the given name
+func (n *memNode) info(name string) os.FileInfo {
+	mode := n.mode
+	if n.dir {
+		mode |= os.ModeDir
+	}
+	return &memFileInfo{name: name, size: int64(len(n.data)), mode: mode, modTime: n.modTime}
+}
+
+// memFileInfo describes a node of a MemoryFilesystem
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+// memFile is an open file of a MemoryFilesystem
+type memFile struct {
+	fs       *MemoryFilesystem
+	node     *memNode
+	name     string
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+// Name returns the name the file was opened with
+func (f *memFile) Name() string {
+	return f.name
+}
+
+func (f *memFile) check(op string, write bool) error {
+	switch {
+	case f.closed:
+		return &os.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	case write && !f.writable, !write && !f.readable:
+		return &os.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	return nil
+}
+
+// Read reads from the current offset
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if f.node.dir {
+		return 0, &os.PathError{Op: "read", Path: f.name, Err: syscall.EISDIR}
+	}
+	if f.offset >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// Write writes at the current offset, or at the end in append mode
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	f.writeAt(p, f.offset)
+	f.offset += int64(len(p))
+	return len(p), nil
+}
+
+// WriteAt writes at an offset without moving the current one
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.writeAt(p, off)
+	return len(p), nil
+}
+
+func (f *memFile) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.node.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	copy(f.node.data[off:], p)
+	f.node.modTime = time.Now()
+}
+
+// Seek sets the offset of the next Read or Write
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+// Truncate changes the file's size, zero-filling if it grows
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size <= int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size:size]
+	} else {
+		grown := make([]byte, size)
+		copy(grown, f.node.data)
+		f.node.data = grown
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// Sync does nothing, as memory has no cache to flush
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+// Close closes the file
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.closed {
+		return &os.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
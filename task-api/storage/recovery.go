@@ -0,0 +1,417 @@
+package storage
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// RecoveryKeyFile holds the public half of the recovery key in the data
+	// directory
+	RecoveryKeyFile = "recovery.json"
+
+	// RecoveryProviderName is the provider of the recovery key slot
+	RecoveryProviderName = "recovery"
+
+	// recoveryShareVersion prefixes encoded recovery shares
+	recoveryShareVersion = "trs1"
+
+	// recoveryShareCheckSize is the length of the per-share checksum
+	recoveryShareCheckSize = 4
+
+	recoveryKeyFileVersion = 1
+	recoveryWrapInfo       = "task-api recovery key wrap"
+	recoveryBindingInfo    = "task-api recovery key binding"
+)
+
+// RecoveryKey is an escrow key that can unwrap every data key even when the
+// master key is lost. It is an X25519 key pair: data keys are wrapped with
+// the public key, which is kept in the data directory, while the private key
+// only exists split into Shamir shares held by different people.
+//
+// The recovery key file is bound to the master key so that nobody who can
+// only write the data directory can swap in a public key of their own.
+type RecoveryKey struct {
+	ID        string
+	Threshold int
+	Shares    int
+	CreatedAt string
+
+	publicKey *ecdh.PublicKey
+	binding   keySlot
+}
+
+// recoveryKeyFileData is the JSON layout of the recovery key file
+type recoveryKeyFileData struct {
+	Version   int    `json:"version"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Threshold int    `json:"threshold"`
+	Shares    int    `json:"shares"`
+	CreatedAt string `json:"created_at"`
+
+	BindingProvider string `json:"binding_provider,omitempty"`
+	BindingKeyID    string `json:"binding_key_id,omitempty"`
+	Binding         string `json:"binding,omitempty"`
+}
+
+// GenerateRecoveryKey creates a new recovery key and splits its private key
+// into shares, any threshold of which recover it. The shares are returned
+// encoded for handing out and are not stored anywhere.
+func GenerateRecoveryKey(shares, threshold int) (*RecoveryKey, []string, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, errors.New("failed to generate recovery key")
+	}
+
+	secret := privateKey.Bytes()
+	defer SecureWipe(secret)
+
+	split, err := SplitSecret(secret, shares, threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now().UTC()
+	key := &RecoveryKey{
+		ID:        "rk-" + now.Format("20060102-150405"),
+		Threshold: threshold,
+		Shares:    shares,
+		CreatedAt: now.Format(time.RFC3339),
+		publicKey: privateKey.PublicKey(),
+	}
+
+	encoded := make([]string, len(split))
+	for i, share := range split {
+		encoded[i] = key.encodeShare(share)
+		SecureWipe(share.Y)
+	}
+
+	return key, encoded, nil
+}
+
+// encodeShare formats a share as trs1.<key ID>.<threshold>.<index>.<hex>,
+// where the hex part ends with a checksum that catches typing mistakes
+func (k *RecoveryKey) encodeShare(share ShamirShare) string {
+	payload := append(append([]byte{}, share.Y...), k.shareChecksum(share)...)
+	return fmt.Sprintf("%s.%s.%d.%d.%s", recoveryShareVersion, k.ID, k.Threshold, share.X, hex.EncodeToString(payload))
+}
+
+func (k *RecoveryKey) shareChecksum(share ShamirShare) []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s.%d.%d.", k.ID, k.Threshold, share.X)
+	h.Write(share.Y)
+	return h.Sum(nil)[:recoveryShareCheckSize]
+}
+
+// decodeShare parses an encoded share of this recovery key
+func (k *RecoveryKey) decodeShare(encoded string) (ShamirShare, error) {
+	parts := strings.Split(strings.TrimSpace(encoded), ".")
+	if len(parts) != 5 || parts[0] != recoveryShareVersion {
+		return ShamirShare{}, errors.New("not a recovery share")
+	}
+	if parts[1] != k.ID {
+		return ShamirShare{}, fmt.Errorf("share belongs to recovery key %q, not %q", parts[1], k.ID)
+	}
+	if threshold, err := strconv.Atoi(parts[2]); err != nil || threshold != k.Threshold {
+		return ShamirShare{}, errors.New("share has a different threshold than the recovery key")
+	}
+	index, err := strconv.Atoi(parts[3])
+	if err != nil || index < 1 || index > MaxShamirShares {
+		return ShamirShare{}, errors.New("share has an invalid index")
+	}
+	payload, err := hex.DecodeString(parts[4])
+	if err != nil || len(payload) <= recoveryShareCheckSize {
+		return ShamirShare{}, fmt.Errorf("share %d is malformed", index)
+	}
+
+	share := ShamirShare{X: byte(index), Y: payload[:len(payload)-recoveryShareCheckSize]}
+	if subtle.ConstantTimeCompare(k.shareChecksum(share), payload[len(payload)-recoveryShareCheckSize:]) != 1 {
+		return ShamirShare{}, fmt.Errorf("share %d has a bad checksum, check it for typos", index)
+	}
+	return share, nil
+}
+
+// combineShares reconstructs the recovery private key and verifies it
+// against the public key
+func (k *RecoveryKey) combineShares(encoded []string) (*ecdh.PrivateKey, error) {
+	var shares []ShamirShare
+	for _, e := range encoded {
+		share, err := k.decodeShare(e)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+	if len(shares) < k.Threshold {
+		return nil, fmt.Errorf("%d of %d required recovery shares given", len(shares), k.Threshold)
+	}
+
+	secret, err := CombineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer SecureWipe(secret)
+
+	privateKey, err := ecdh.X25519().NewPrivateKey(secret)
+	if err != nil || !privateKey.PublicKey().Equal(k.publicKey) {
+		return nil, errors.New("recovery shares do not reconstruct the recovery key")
+	}
+	return privateKey, nil
+}
+
+// wrap wraps a data key for the recovery key holders
+//
+// Wrapped key layout: ephemeral public key (32) | iv (12) | ciphertext + tag
+func (k *RecoveryKey) wrap(dek []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.New("failed to generate ephemeral key")
+	}
+
+	kek, err := recoveryWrappingKey(ephemeral, k.publicKey, ephemeral.PublicKey())
+	if err != nil {
+		return nil, err
+	}
+	defer SecureWipe(kek)
+
+	sealed, err := sealWithKey(kek, dek, []byte(k.ID))
+	if err != nil {
+		return nil, err
+	}
+	return append(ephemeral.PublicKey().Bytes(), sealed...), nil
+}
+
+// unwrapRecoveryKey recovers a data key wrapped by RecoveryKey.wrap
+func unwrapRecoveryKey(privateKey *ecdh.PrivateKey, keyID string, wrapped []byte) ([]byte, error) {
+	const publicKeySize = 32
+	if len(wrapped) < publicKeySize {
+		return nil, errors.New("invalid recovery key slot")
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(wrapped[:publicKeySize])
+	if err != nil {
+		return nil, errors.New("invalid recovery key slot")
+	}
+
+	kek, err := recoveryWrappingKey(privateKey, ephemeral, ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	defer SecureWipe(kek)
+
+	dek, err := openWithKey(kek, wrapped[publicKeySize:], []byte(keyID))
+	if err != nil {
+		return nil, errors.New("failed to unwrap data key with the recovery key")
+	}
+	return dek, nil
+}
+
+// recoveryWrappingKey derives the key-encryption key from an X25519 shared
+// secret, bound to the ephemeral public key
+func recoveryWrappingKey(privateKey *ecdh.PrivateKey, peer, ephemeral *ecdh.PublicKey) ([]byte, error) {
+	shared, err := privateKey.ECDH(peer)
+	if err != nil {
+		return nil, errors.New("failed to derive recovery wrapping key")
+	}
+	defer SecureWipe(shared)
+
+	kek := make([]byte, KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, ephemeral.Bytes(), []byte(recoveryWrapInfo)), kek); err != nil {
+		return nil, errors.New("failed to derive recovery wrapping key")
+	}
+	return kek, nil
+}
+
+// bindingDigest is what the master key seals to vouch for the recovery key
+func (k *RecoveryKey) bindingDigest() []byte {
+	h := sha256.New()
+	h.Write([]byte(recoveryBindingInfo))
+	h.Write([]byte(k.ID))
+	h.Write(k.publicKey.Bytes())
+	var counts [8]byte
+	binary.BigEndian.PutUint32(counts[:4], uint32(k.Threshold))
+	binary.BigEndian.PutUint32(counts[4:], uint32(k.Shares))
+	h.Write(counts[:])
+	return h.Sum(nil)
+}
+
+// bind seals the recovery key's digest with the active master key
+func (k *RecoveryKey) bind(provider MasterKeyProvider) error {
+	keyID, wrapped, err := provider.WrapKey(k.bindingDigest())
+	if err != nil {
+		return fmt.Errorf("failed to bind recovery key: %w", err)
+	}
+	k.binding = keySlot{Provider: provider.Name(), KeyID: keyID, WrappedKey: wrapped}
+	return nil
+}
+
+// verifyBinding checks that the recovery key was set up by a holder of the
+// master key
+func (k *RecoveryKey) verifyBinding(cryptoService *CryptoService) error {
+	digest, err := cryptoService.unwrapSlot(&k.binding)
+	if err != nil {
+		return fmt.Errorf("failed to verify recovery key %q: %w", k.ID, err)
+	}
+	if subtle.ConstantTimeCompare(digest, k.bindingDigest()) != 1 {
+		return fmt.Errorf("recovery key %q does not match its binding", k.ID)
+	}
+	return nil
+}
+
+// bindingIsCurrent reports whether the binding uses the active master key
+func (k *RecoveryKey) bindingIsCurrent(provider MasterKeyProvider) bool {
+	return k.binding.Provider == provider.Name() && provider.IsCurrent(k.binding.KeyID, k.binding.WrappedKey)
+}
+
+// Info returns diagnostic information
+func (k *RecoveryKey) Info() map[string]interface{} {
+	return map[string]interface{}{
+		"key_id":     k.ID,
+		"threshold":  k.Threshold,
+		"shares":     k.Shares,
+		"created_at": k.CreatedAt,
+	}
+}
+
+func (k *RecoveryKey) marshal() ([]byte, error) {
+	return json.MarshalIndent(recoveryKeyFileData{
+		Version:         recoveryKeyFileVersion,
+		KeyID:           k.ID,
+		PublicKey:       base64.StdEncoding.EncodeToString(k.publicKey.Bytes()),
+		Threshold:       k.Threshold,
+		Shares:          k.Shares,
+		CreatedAt:       k.CreatedAt,
+		BindingProvider: k.binding.Provider,
+		BindingKeyID:    k.binding.KeyID,
+		Binding:         base64.StdEncoding.EncodeToString(k.binding.WrappedKey),
+	}, "", "  ")
+}
+
+func parseRecoveryKey(raw []byte) (*RecoveryKey, error) {
+	var data recoveryKeyFileData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, fmt.Errorf("failed to parse recovery key: %w", err)
+	}
+	if data.Version != recoveryKeyFileVersion {
+		return nil, fmt.Errorf("unsupported recovery key version %d", data.Version)
+	}
+	if !ValidKeyID(data.KeyID) {
+		return nil, fmt.Errorf("invalid recovery key ID %q", data.KeyID)
+	}
+
+	publicKeyBytes, err := base64.StdEncoding.DecodeString(data.PublicKey)
+	if err != nil {
+		return nil, errors.New("invalid recovery public key")
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(publicKeyBytes)
+	if err != nil {
+		return nil, errors.New("invalid recovery public key")
+	}
+
+	binding, err := base64.StdEncoding.DecodeString(data.Binding)
+	if err != nil {
+		return nil, errors.New("invalid recovery key binding")
+	}
+
+	return &RecoveryKey{
+		ID:        data.KeyID,
+		Threshold: data.Threshold,
+		Shares:    data.Shares,
+		CreatedAt: data.CreatedAt,
+		publicKey: publicKey,
+		binding:   keySlot{Provider: data.BindingProvider, KeyID: data.BindingKeyID, WrappedKey: binding},
+	}, nil
+}
+
+// ReadRecoveryKey reads the recovery key file from the data directory
+// without verifying it. It returns nil if recovery has not been set up.
+func (es *EncryptedStorage) ReadRecoveryKey() (*RecoveryKey, error) {
+	raw, err := es.fileManager.ReadFile(RecoveryKeyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read recovery key: %w", err)
+	}
+	return parseRecoveryKey(raw)
+}
+
+// SetupRecovery makes key the recovery key: it is bound to the active master
+// key, written to the data directory and used for all data written from now
+// on. Existing files get a recovery key slot at the next key rotation.
+func (es *EncryptedStorage) SetupRecovery(key *RecoveryKey) error {
+	if err := key.bind(es.cryptoService.Provider()); err != nil {
+		return err
+	}
+	if err := es.saveRecoveryKey(key); err != nil {
+		return err
+	}
+	es.cryptoService.setRecoveryKey(key)
+	return nil
+}
+
+// loadRecoveryKey enables the recovery key from the data directory, if any
+func (es *EncryptedStorage) loadRecoveryKey() error {
+	key, err := es.ReadRecoveryKey()
+	if err != nil || key == nil {
+		return err
+	}
+
+	if recovering := es.cryptoService.recoveryPrivateKey; recovering != nil {
+		// The master key may be new, so trust the key the shares matched
+		if key.ID != es.cryptoService.recoveryKey.ID {
+			return errors.New("recovery key file changed during recovery")
+		}
+		return nil
+	}
+
+	if err := key.verifyBinding(es.cryptoService); err != nil {
+		return fmt.Errorf("%w; if the master key was lost, use the recovery shares", err)
+	}
+	es.cryptoService.setRecoveryKey(key)
+	return nil
+}
+
+// rebindRecoveryKey re-seals the recovery key binding with the active master
+// key, reporting whether it was out of date
+func (es *EncryptedStorage) rebindRecoveryKey() (bool, error) {
+	key := es.cryptoService.recoveryKey
+	if key == nil {
+		return false, nil
+	}
+	if es.cryptoService.recoveryPrivateKey == nil && key.bindingIsCurrent(es.cryptoService.Provider()) {
+		return false, nil
+	}
+
+	if err := key.bind(es.cryptoService.Provider()); err != nil {
+		return false, err
+	}
+	return true, es.saveRecoveryKey(key)
+}
+
+func (es *EncryptedStorage) saveRecoveryKey(key *RecoveryKey) error {
+	raw, err := key.marshal()
+	if err != nil {
+		return fmt.Errorf("failed to serialize recovery key: %w", err)
+	}
+	if err := es.fileManager.WriteFile(RecoveryKeyFile, raw); err != nil {
+		return fmt.Errorf("failed to save recovery key: %w", err)
+	}
+	return nil
+}
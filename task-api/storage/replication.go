@@ -0,0 +1,530 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxReplicationRetryDelay caps the wait between upload attempts
+const maxReplicationRetryDelay = time.Minute
+
+// RemoteBackup is a backup in the replication target
+type RemoteBackup struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	HasManifest  bool      `json:"has_manifest"`
+	Local        bool      `json:"local"`
+}
+
+// ReplicationStatus reports the state of replication
+type ReplicationStatus struct {
+	Target      string            `json:"target"`
+	Pending     []string          `json:"pending"`
+	Failed      map[string]string `json:"failed"`
+	Uploaded    int               `json:"uploaded"`
+	Pruned      int               `json:"pruned"`
+	LastUpload  string            `json:"last_upload,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	LastErrorAt string            `json:"last_error_at,omitempty"`
+}
+
+// Replicator copies backups and their manifests to an object store in the
+// background, retrying failed uploads, and prunes the copies with the
+// local retention policy. Objects are named after the backups under a key
+// prefix; the wrapped manifest signing key is replicated too, so manifests
+// can be verified after the data directory is lost.
+type Replicator struct {
+	store       ObjectStore
+	target      string
+	prefix      string
+	maxAttempts int
+	retryDelay  time.Duration
+	storage     *EncryptedStorage
+
+	mu                sync.Mutex
+	pending           []string
+	failed            map[string]string
+	uploaded          int
+	pruned            int
+	lastUpload        time.Time
+	lastError         string
+	lastErrorAt       time.Time
+	manifestKeyDigest string
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewReplicator creates a replicator to store, with objects under prefix.
+// Each upload is tried maxAttempts times, waiting retryDelay after the
+// first failure and twice as long after each further one.
+func NewReplicator(store ObjectStore, prefix string, maxAttempts int, retryDelay time.Duration) *Replicator {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	target := fmt.Sprintf("%v", store)
+	if prefix != "" {
+		target += "/" + strings.TrimSuffix(prefix, "/")
+	}
+
+	return &Replicator{
+		store:       store,
+		target:      target,
+		prefix:      prefix,
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+		failed:      make(map[string]string),
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// SetReplicator replicates new backups with r. Call Start on the replicator
+// after Initialize.
+func (es *EncryptedStorage) SetReplicator(r *Replicator) {
+	es.replicator = r
+	r.storage = es
+}
+
+// Replicator returns the replicator, or nil if replication is off
+func (es *EncryptedStorage) Replicator() *Replicator {
+	return es.replicator
+}
+
+// replicateBackup queues a backup for upload if replication is on
+func (es *EncryptedStorage) replicateBackup(backupName string) {
+	if es.replicator != nil {
+		es.replicator.Enqueue(backupName)
+	}
+}
+
+// Start uploads in the background until Stop is called, beginning with the
+// local backups the target does not have yet
+func (r *Replicator) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.loop()
+	log.Printf("Backup replication to %s started", r.target)
+}
+
+// Stop stops replication, waiting for a running upload to finish. Backups
+// still pending are uploaded after the next start.
+func (r *Replicator) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// Enqueue queues a backup for upload, together with the backups whose
+// upload failed before
+func (r *Replicator) Enqueue(backupName string) {
+	r.mu.Lock()
+	for failed := range r.failed {
+		r.addPendingLocked(failed)
+	}
+	r.failed = make(map[string]string)
+	r.addPendingLocked(backupName)
+	r.mu.Unlock()
+
+	select {
+	case r.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Replicator) addPendingLocked(backupName string) {
+	for _, pending := range r.pending {
+		if pending == backupName {
+			return
+		}
+	}
+	r.pending = append(r.pending, backupName)
+}
+
+// next takes the next backup to upload off the queue
+func (r *Replicator) next() (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.pending) == 0 {
+		return "", false
+	}
+	backupName := r.pending[0]
+	r.pending = r.pending[1:]
+	return backupName, true
+}
+
+func (r *Replicator) loop() {
+	defer close(r.done)
+
+	if err := r.catchUp(); err != nil {
+		r.recordError(fmt.Errorf("failed to compare local and remote backups: %w", err))
+	}
+
+	for {
+		uploaded := false
+		for {
+			backupName, ok := r.next()
+			if !ok {
+				break
+			}
+			ok, stopped := r.uploadWithRetry(backupName)
+			if stopped {
+				return
+			}
+			uploaded = uploaded || ok
+		}
+
+		if uploaded {
+			if err := r.pruneRemote(); err != nil {
+				r.recordError(fmt.Errorf("failed to prune remote backups: %w", err))
+			}
+		}
+
+		select {
+		case <-r.stop:
+			return
+		case <-r.notify:
+		}
+	}
+}
+
+// catchUp uploads the manifest signing key and queues the local backups
+// missing from the target, oldest first
+func (r *Replicator) catchUp() error {
+	if err := r.uploadManifestKey(); err != nil {
+		return err
+	}
+
+	local, err := r.storage.fileManager.ListBackups()
+	if err != nil {
+		return err
+	}
+	remote, err := r.remoteBackups()
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(local)
+	missing := 0
+	for _, backupName := range local {
+		if backup, ok := remote[backupName]; !ok || !backup.HasManifest {
+			r.mu.Lock()
+			r.addPendingLocked(backupName)
+			r.mu.Unlock()
+			missing++
+		}
+	}
+	if missing > 0 {
+		log.Printf("Replicating %d local backups missing from %s", missing, r.target)
+		select {
+		case r.notify <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// uploadWithRetry uploads a backup, retrying with exponential backoff, and
+// reports whether it succeeded or replication was stopped while waiting
+func (r *Replicator) uploadWithRetry(backupName string) (uploaded, stopped bool) {
+	delay := r.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := r.upload(backupName)
+		if err == nil {
+			r.mu.Lock()
+			r.uploaded++
+			r.lastUpload = time.Now()
+			r.mu.Unlock()
+			return true, false
+		}
+
+		if attempt >= r.maxAttempts {
+			r.recordError(fmt.Errorf("giving up on backup %s after %d attempts: %w", backupName, attempt, err))
+			r.mu.Lock()
+			r.failed[backupName] = err.Error()
+			r.mu.Unlock()
+			return false, false
+		}
+
+		log.Printf("Warning: replicating backup %s failed (attempt %d of %d), retrying in %s: %v",
+			backupName, attempt, r.maxAttempts, delay, err)
+		select {
+		case <-r.stop:
+			r.mu.Lock()
+			r.addPendingLocked(backupName)
+			r.mu.Unlock()
+			return false, true
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxReplicationRetryDelay {
+			delay = maxReplicationRetryDelay
+		}
+	}
+}
+
+// upload copies a backup and then its manifest, so a remote manifest means
+// the backup is complete. A backup pruned locally in the meantime is
+// skipped.
+func (r *Replicator) upload(backupName string) error {
+	fm := r.storage.fileManager
+
+	data, err := fm.ReadFile(filepath.Join("backups", backupName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	manifest, err := fm.ReadFile(backupManifestPath(backupName))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := r.uploadManifestKey(); err != nil {
+		return err
+	}
+	if err := r.store.PutObject(r.prefix+backupName, data); err != nil {
+		return err
+	}
+	if manifest != nil {
+		if err := r.store.PutObject(r.prefix+backupName+backupManifestSuffix, manifest); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Replicated backup %s to %s", backupName, r.target)
+	return nil
+}
+
+// uploadManifestKey uploads the wrapped manifest signing key whenever it
+// changed, e.g. after a key rotation re-wrapped it
+func (r *Replicator) uploadManifestKey() error {
+	raw, err := r.storage.fileManager.ReadFile(BackupManifestKeyFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(raw)
+	digest := hex.EncodeToString(sum[:])
+	r.mu.Lock()
+	unchanged := digest == r.manifestKeyDigest
+	r.mu.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	if err := r.store.PutObject(r.prefix+BackupManifestKeyFile, raw); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.manifestKeyDigest = digest
+	r.mu.Unlock()
+	return nil
+}
+
+// remoteBackups lists the backups in the target by name
+func (r *Replicator) remoteBackups() (map[string]*RemoteBackup, error) {
+	objects, err := r.store.ListObjects(r.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make(map[string]*RemoteBackup)
+	manifests := make(map[string]bool)
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, r.prefix)
+		if strings.Contains(name, "/") {
+			continue
+		}
+		if backupName, ok := strings.CutSuffix(name, backupManifestSuffix); ok {
+			manifests[backupName] = true
+			continue
+		}
+		if validateBackupName(name) != nil {
+			continue
+		}
+		backups[name] = &RemoteBackup{Name: name, Size: object.Size, LastModified: object.LastModified}
+	}
+	for name, backup := range backups {
+		backup.HasManifest = manifests[name]
+	}
+	return backups, nil
+}
+
+// ListRemote returns the backups in the target, oldest first, marking those
+// that also exist locally
+func (r *Replicator) ListRemote() ([]RemoteBackup, error) {
+	remote, err := r.remoteBackups()
+	if err != nil {
+		return nil, err
+	}
+
+	backups := make([]RemoteBackup, 0, len(remote))
+	for _, backup := range remote {
+		backup.Local = r.storage.fileManager.FileExists(filepath.Join("backups", backup.Name))
+		backups = append(backups, *backup)
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name < backups[j].Name })
+	return backups, nil
+}
+
+// pruneRemote deletes the remote backups the local retention policy does
+// not keep, judged among the remote backups alone
+func (r *Replicator) pruneRemote() error {
+	remote, err := r.remoteBackups()
+	if err != nil {
+		return err
+	}
+
+	files := make([]BackupFile, 0, len(remote))
+	for _, backup := range remote {
+		files = append(files, BackupFile{Name: backup.Name, Size: backup.Size, ModTime: backup.LastModified})
+	}
+
+	pruned := 0
+	for _, decision := range r.storage.retention.Plan(files, time.Now()) {
+		if decision.Keep {
+			continue
+		}
+		if err := r.store.DeleteObject(r.prefix + decision.Backup); err != nil {
+			return err
+		}
+		if err := r.store.DeleteObject(r.prefix + decision.Backup + backupManifestSuffix); err != nil {
+			return err
+		}
+		log.Printf("Pruned remote backup %s: %s", decision.Backup, strings.Join(decision.Reasons, "; "))
+		pruned++
+	}
+
+	r.mu.Lock()
+	r.pruned += pruned
+	r.mu.Unlock()
+	return nil
+}
+
+// Fetch downloads a remote backup and its manifest into the local backups
+// so it can be restored like any other. The download is checked against
+// the manifest and must decrypt and validate before it is stored. A backup
+// that exists locally is left as is.
+func (r *Replicator) Fetch(backupName string) error {
+	if err := validateBackupName(backupName); err != nil {
+		return err
+	}
+	es := r.storage
+	if es.fileManager.FileExists(filepath.Join("backups", backupName)) {
+		log.Printf("Backup %s exists locally, using the local copy", backupName)
+		return nil
+	}
+
+	data, err := r.store.GetObject(r.prefix + backupName)
+	if errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("backup %s not found in %s", backupName, r.target)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to download backup %s: %w", backupName, err)
+	}
+
+	rawManifest, err := r.store.GetObject(r.prefix + backupName + backupManifestSuffix)
+	if err != nil && !errors.Is(err, ErrObjectNotFound) {
+		return fmt.Errorf("failed to download manifest of backup %s: %w", backupName, err)
+	}
+	if rawManifest != nil {
+		var manifest BackupManifest
+		if err := json.Unmarshal(rawManifest, &manifest); err != nil {
+			return fmt.Errorf("invalid manifest of remote backup %s: %w", backupName, err)
+		}
+		sum := sha256.Sum256(data)
+		if manifest.Backup != backupName || manifest.Size != int64(len(data)) || manifest.SHA256 != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("remote backup %s does not match its manifest", backupName)
+		}
+	}
+
+	plaintext, err := es.cryptoService.Decrypt(data)
+	if err != nil {
+		return fmt.Errorf("backup file is corrupted or encrypted with different key: %w", err)
+	}
+	validate := es.validateData
+	if validate == nil {
+		validate = countTasks
+	}
+	_, err = validate(plaintext)
+	SecureWipe(plaintext)
+	if err != nil {
+		return fmt.Errorf("remote backup %s contains invalid tasks: %w", backupName, err)
+	}
+
+	if err := es.fileManager.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+	defer func() {
+		if unlockErr := es.fileManager.Unlock(); unlockErr != nil {
+			log.Printf("Warning: failed to release lock: %v", unlockErr)
+		}
+	}()
+
+	if err := es.fileManager.WriteBackup(backupName, data); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("failed to store backup %s: %w", backupName, err)
+	}
+	if rawManifest != nil {
+		if err := es.fileManager.WriteFile(backupManifestPath(backupName), rawManifest); err != nil {
+			return fmt.Errorf("failed to store manifest of backup %s: %w", backupName, err)
+		}
+	}
+
+	log.Printf("Downloaded backup %s from %s", backupName, r.target)
+	return nil
+}
+
+// Status reports pending and failed uploads and the last error
+func (r *Replicator) Status() ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := ReplicationStatus{
+		Target:   r.target,
+		Pending:  append([]string{}, r.pending...),
+		Failed:   make(map[string]string, len(r.failed)),
+		Uploaded: r.uploaded,
+		Pruned:   r.pruned,
+	}
+	for backupName, err := range r.failed {
+		status.Failed[backupName] = err
+	}
+	if !r.lastUpload.IsZero() {
+		status.LastUpload = r.lastUpload.UTC().Format(time.RFC3339)
+	}
+	if r.lastError != "" {
+		status.LastError = r.lastError
+		status.LastErrorAt = r.lastErrorAt.UTC().Format(time.RFC3339)
+	}
+	return status
+}
+
+func (r *Replicator) recordError(err error) {
+	log.Printf("Warning: backup replication: %v", err)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastError = err.Error()
+	r.lastErrorAt = time.Now()
+}
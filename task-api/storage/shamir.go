@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// Shamir secret sharing over GF(2^8) with the AES reduction polynomial
+// x^8 + x^4 + x^3 + x + 1. Every byte of the secret is the constant term of
+// its own random polynomial of degree threshold-1; share i holds the
+// polynomials evaluated at x = i. Any threshold shares recover the secret by
+// Lagrange interpolation at x = 0, fewer reveal nothing about it.
+
+const (
+	// MaxShamirShares is the largest number of shares (x = 1..255)
+	MaxShamirShares = 255
+)
+
+// gf256Exp and gf256Log are exponent and logarithm tables for generator 3
+var gf256Exp, gf256Log = buildGF256Tables()
+
+func buildGF256Tables() (exp [510]byte, logTable [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		logTable[x] = byte(i)
+
+		// Multiply by the generator 3 = x + 1
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return exp, logTable
+}
+
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+int(gf256Log[b])]
+}
+
+func gf256Div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+255-int(gf256Log[b])]
+}
+
+// ShamirShare is one share of a split secret
+type ShamirShare struct {
+	X byte
+	Y []byte
+}
+
+// SplitSecret splits secret into n shares of which any threshold recover it
+func SplitSecret(secret []byte, n, threshold int) ([]ShamirShare, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("secret cannot be empty")
+	}
+	if threshold < 2 {
+		return nil, errors.New("threshold must be at least 2")
+	}
+	if n < threshold {
+		return nil, errors.New("number of shares cannot be less than the threshold")
+	}
+	if n > MaxShamirShares {
+		return nil, fmt.Errorf("number of shares cannot exceed %d", MaxShamirShares)
+	}
+
+	shares := make([]ShamirShare, n)
+	for i := range shares {
+		shares[i] = ShamirShare{X: byte(i + 1), Y: make([]byte, len(secret))}
+	}
+
+	coefficients := make([]byte, threshold)
+	defer SecureWipe(coefficients)
+
+	for b, value := range secret {
+		coefficients[0] = value
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, errors.New("failed to generate share coefficients")
+		}
+
+		for i := range shares {
+			// Horner's method, highest coefficient first
+			x := shares[i].X
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gf256Mul(y, x) ^ coefficients[c]
+			}
+			shares[i].Y[b] = y
+		}
+	}
+
+	return shares, nil
+}
+
+// CombineShares recovers a secret from at least threshold shares. It cannot
+// tell whether enough shares were given: too few produce a wrong secret, so
+// callers must verify the result.
+func CombineShares(shares []ShamirShare) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least two shares are required")
+	}
+
+	size := len(shares[0].Y)
+	seen := map[byte]bool{}
+	for _, share := range shares {
+		if share.X == 0 {
+			return nil, errors.New("invalid share index 0")
+		}
+		if seen[share.X] {
+			return nil, fmt.Errorf("share %d was given more than once", share.X)
+		}
+		seen[share.X] = true
+		if len(share.Y) != size {
+			return nil, errors.New("shares have different lengths")
+		}
+	}
+
+	secret := make([]byte, size)
+	for i, share := range shares {
+		// Lagrange basis polynomial for this share evaluated at x = 0;
+		// subtraction is XOR in GF(2^8)
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			basis = gf256Mul(basis, gf256Div(other.X, other.X^share.X))
+		}
+
+		for b := range secret {
+			secret[b] ^= gf256Mul(share.Y[b], basis)
+		}
+	}
+
+	return secret, nil
+}
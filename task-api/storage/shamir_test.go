@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestGF256DivInvertsMul(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gf256Div(gf256Mul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("(%d * %d) / %d = %d", a, b, b, got)
+			}
+		}
+	}
+}
+
+func TestSplitSecretRoundTrip(t *testing.T) {
+	secret := []byte("correct horse battery staple \x00\xff")
+
+	tests := []struct {
+		n, threshold int
+		use          []int // indexes of the shares to combine
+	}{
+		{2, 2, []int{0, 1}},
+		{5, 3, []int{0, 1, 2}},
+		{5, 3, []int{4, 2, 0}},
+		{5, 3, []int{1, 3, 4}},
+		{5, 3, []int{0, 1, 2, 3, 4}},
+		{255, 10, []int{254, 200, 150, 100, 50, 40, 30, 20, 10, 0}},
+	}
+
+	for _, tc := range tests {
+		shares, err := SplitSecret(secret, tc.n, tc.threshold)
+		if err != nil {
+			t.Fatalf("SplitSecret(%d, %d): %v", tc.n, tc.threshold, err)
+		}
+		if len(shares) != tc.n {
+			t.Fatalf("SplitSecret(%d, %d) returned %d shares", tc.n, tc.threshold, len(shares))
+		}
+
+		subset := make([]ShamirShare, 0, len(tc.use))
+		for _, i := range tc.use {
+			subset = append(subset, shares[i])
+		}
+		got, err := CombineShares(subset)
+		if err != nil {
+			t.Fatalf("%d of %d, shares %v: %v", tc.threshold, tc.n, tc.use, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("%d of %d, shares %v: recovered %q", tc.threshold, tc.n, tc.use, got)
+		}
+	}
+}
+
+func TestCombineSharesBelowThreshold(t *testing.T) {
+	secret := bytes.Repeat([]byte{0x42}, 32)
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two shares interpolate a line, not the degree 2 polynomials
+	got, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatalf("CombineShares: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("two of three shares recovered the secret")
+	}
+
+	if _, err := CombineShares(shares[:1]); err == nil {
+		t.Error("CombineShares accepted a single share")
+	}
+}
+
+func TestCombineSharesRejectsInvalidShares(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		shares []ShamirShare
+		want   string
+	}{
+		{"duplicate share", []ShamirShare{shares[0], shares[1], shares[0]}, "more than once"},
+		{"duplicate index", []ShamirShare{shares[0], {X: shares[0].X, Y: shares[1].Y}}, "more than once"},
+		{"index 0", []ShamirShare{shares[0], {X: 0, Y: shares[1].Y}}, "index 0"},
+		{"different lengths", []ShamirShare{shares[0], {X: shares[1].X, Y: shares[1].Y[:3]}}, "different lengths"},
+	}
+
+	for _, tc := range tests {
+		if _, err := CombineShares(tc.shares); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: got %v, want an error about %q", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestSplitSecretRejectsInvalidParameters(t *testing.T) {
+	tests := []struct {
+		name         string
+		secret       []byte
+		n, threshold int
+	}{
+		{"empty secret", nil, 3, 2},
+		{"threshold 1", []byte("s"), 3, 1},
+		{"fewer shares than threshold", []byte("s"), 2, 3},
+		{"too many shares", []byte("s"), MaxShamirShares + 1, 2},
+	}
+
+	for _, tc := range tests {
+		if _, err := SplitSecret(tc.secret, tc.n, tc.threshold); err == nil {
+			t.Errorf("%s: SplitSecret succeeded", tc.name)
+		}
+	}
+}
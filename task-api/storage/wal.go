@@ -0,0 +1,400 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultWALFile is the write-ahead log file name inside the data directory
+	DefaultWALFile = "tasks.wal"
+
+	walMagic   = "TWAL"
+	walVersion = 5
+
+	// walFrameHeader is the record length (uint32) followed by its sequence number (uint64)
+	walFrameHeader = 4 + 8
+
+	// walMaxRecordSize guards against reading a garbage length from a torn write
+	walMaxRecordSize = 64 << 20
+)
+
+// errWALHeaderIncomplete means the log was torn while its header was written
+var errWALHeaderIncomplete = errors.New("write-ahead log header is incomplete")
+
+// WALOp identifies the kind of mutation recorded in a WAL entry
+type WALOp string
+
+const (
+	WALOpCreate     WALOp = "create"
+	WALOpUpdate     WALOp = "update"
+	WALOpMove       WALOp = "move"
+	WALOpComplete   WALOp = "complete"
+	WALOpDelete     WALOp = "delete"
+	WALOpReplaceAll WALOp = "replace_all"
+)
+
+// WALEntry is a single mutation. Data holds the full task after the change
+// (or the full task array for replace_all) so replaying is idempotent.
+type WALEntry struct {
+	Op     WALOp           `json:"op"`
+	TaskID string          `json:"taskId,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// WALRecord groups the entries of one transaction so they replay atomically
+type WALRecord struct {
+	Seq       uint64     `json:"seq"`
+	Timestamp string     `json:"timestamp"`
+	Entries   []WALEntry `json:"entries"`
+}
+
+// WAL is an append-only log of encrypted mutation records.
+//
+// File layout: magic "TWAL" | version (1 byte) | key slots (as in the
+// container header), followed by frames of length (uint32 BE) | seq (uint64
+// BE) | iv + ciphertext + tag. The key slots hold the log's random data key
+// wrapped by a master key and, if set up, the recovery key.
+// Each frame is encrypted separately with the sequence number as additional
+// data, so a torn write only invalidates the final frame.
+type WAL struct {
+	mu            sync.Mutex
+	path          string
+	file          File
+	cryptoService *CryptoService
+	cipher        *RecordCipher
+	keyID         string
+	wrappedKey    *WrappedDataKey
+	headerSize    int64
+	nextSeq       uint64
+	records       int
+	size          int64
+}
+
+// OpenWAL opens or creates the write-ahead log and returns the records it
+// contains. A torn or corrupt tail is truncated so new records can be
+// appended after the last valid one.
+func (es *EncryptedStorage) OpenWAL() (*WAL, []WALRecord, error) {
+	if err := es.fileManager.ensureDataDir(); err != nil {
+		return nil, nil, err
+	}
+
+	path := filepath.Join(es.fileManager.dataDir, DefaultWALFile)
+	file, err := es.fileManager.fs.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+
+	wal := &WAL{path: path, file: file, cryptoService: es.cryptoService, nextSeq: 1}
+
+	records, err := wal.load()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return wal, records, nil
+}
+
+// load reads the header (writing one for a new log) and all valid records
+func (w *WAL) load() ([]WALRecord, error) {
+	data, err := io.ReadAll(w.file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write-ahead log: %w", err)
+	}
+
+	if len(data) == 0 {
+		return nil, w.writeHeader()
+	}
+
+	header, err := decodeWALHeader(data)
+	if err != nil {
+		if errors.Is(err, errWALHeaderIncomplete) {
+			log.Printf("Warning: write-ahead log header is incomplete, starting a new log")
+			return nil, w.writeHeader()
+		}
+		return nil, err
+	}
+
+	dek, err := w.cryptoService.UnwrapDataKey(header.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	w.cipher, err = NewRecordCipherFromKey(dek)
+	SecureWipe(dek)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	w.keyID = header.WrappedKey.KeyID()
+	w.wrappedKey = header.WrappedKey
+	w.headerSize = int64(header.Size)
+
+	var records []WALRecord
+	offset := header.Size
+	for offset < len(data) {
+		record, n, err := w.decodeFrame(data[offset:])
+		if err != nil {
+			log.Printf("Warning: discarding write-ahead log tail at offset %d: %v", offset, err)
+			break
+		}
+		records = append(records, record)
+		w.nextSeq = record.Seq + 1
+		offset += n
+	}
+
+	w.records = len(records)
+	w.size = int64(offset)
+
+	if offset < len(data) {
+		if err := w.file.Truncate(w.size); err != nil {
+			return nil, fmt.Errorf("failed to truncate write-ahead log: %w", err)
+		}
+		if err := w.file.Sync(); err != nil {
+			return nil, fmt.Errorf("failed to sync write-ahead log: %w", err)
+		}
+	}
+
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		return nil, fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	return records, nil
+}
+
+// walHeader is the decoded header of a write-ahead log
+type walHeader struct {
+	Version    uint8
+	Size       int
+	WrappedKey *WrappedDataKey
+}
+
+// decodeWALHeader parses the header and its key slots
+func decodeWALHeader(data []byte) (*walHeader, error) {
+	if len(data) < len(walMagic)+1 && strings.HasPrefix(walMagic, string(data)) {
+		return nil, errWALHeaderIncomplete
+	}
+	if len(data) < len(walMagic)+1 || string(data[:len(walMagic)]) != walMagic {
+		return nil, errors.New("write-ahead log has an invalid header")
+	}
+
+	header := &walHeader{Version: data[len(walMagic)]}
+	offset := len(walMagic) + 1
+
+	if header.Version != walVersion {
+		return nil, fmt.Errorf("unsupported write-ahead log version %d", header.Version)
+	}
+
+	slots, n, err := readKeySlots(data[offset:])
+	if errors.Is(err, errKeySlotsTruncated) {
+		return nil, errWALHeaderIncomplete
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid write-ahead log header: %w", err)
+	}
+	header.WrappedKey = &WrappedDataKey{slots: slots}
+	header.Size = offset + n
+
+	return header, nil
+}
+
+// writeHeader starts a new, empty log with a fresh data key wrapped by the
+// active master key and recovery key
+func (w *WAL) writeHeader() error {
+	dek, wrapped, err := w.cryptoService.GenerateDataKey()
+	if err != nil {
+		return err
+	}
+	w.cipher, err = NewRecordCipherFromKey(dek)
+	SecureWipe(dek)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, 256)
+	header = append(header, walMagic...)
+	header = append(header, walVersion)
+	header = appendKeySlots(header, wrapped.slots)
+
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to reset write-ahead log: %w", err)
+	}
+	if _, err := w.file.WriteAt(header, 0); err != nil {
+		return fmt.Errorf("failed to write write-ahead log header: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	if _, err := w.file.Seek(int64(len(header)), io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	w.keyID = wrapped.KeyID()
+	w.wrappedKey = wrapped
+	w.headerSize = int64(len(header))
+	w.nextSeq = 1
+	w.records = 0
+	w.size = w.headerSize
+	return nil
+}
+
+// decodeFrame decrypts the frame at the start of data and returns it with
+// its encoded length
+func (w *WAL) decodeFrame(data []byte) (WALRecord, int, error) {
+	var record WALRecord
+
+	if len(data) < walFrameHeader {
+		return record, 0, errors.New("incomplete frame header")
+	}
+
+	length := binary.BigEndian.Uint32(data[0:4])
+	seq := binary.BigEndian.Uint64(data[4:12])
+	if length > walMaxRecordSize || len(data) < walFrameHeader+int(length) {
+		return record, 0, errors.New("incomplete frame")
+	}
+	if seq != w.nextSeq {
+		return record, 0, fmt.Errorf("unexpected sequence number %d, want %d", seq, w.nextSeq)
+	}
+
+	plaintext, err := w.cipher.Open(data[walFrameHeader:walFrameHeader+int(length)], data[4:12])
+	if err != nil {
+		return record, 0, err
+	}
+
+	if err := json.Unmarshal(plaintext, &record); err != nil {
+		return record, 0, fmt.Errorf("invalid record: %w", err)
+	}
+	if record.Seq != seq {
+		return record, 0, errors.New("record sequence does not match frame")
+	}
+
+	return record, walFrameHeader + int(length), nil
+}
+
+// Append writes the entries as one record and syncs it to disk before
+// returning
+func (w *WAL) Append(entries ...WALEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	record := WALRecord{
+		Seq:       w.nextSeq,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Entries:   entries,
+	}
+
+	plaintext, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to serialize write-ahead log record: %w", err)
+	}
+
+	seqBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(seqBytes, record.Seq)
+
+	sealed, err := w.cipher.Seal(plaintext, seqBytes)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt write-ahead log record: %w", err)
+	}
+
+	var frame bytes.Buffer
+	frame.Grow(walFrameHeader + len(sealed))
+	binary.Write(&frame, binary.BigEndian, uint32(len(sealed)))
+	frame.Write(seqBytes)
+	frame.Write(sealed)
+
+	if _, err := w.file.Write(frame.Bytes()); err != nil {
+		w.dropPartialFrame()
+		return fmt.Errorf("failed to append write-ahead log record: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		// The record was not committed, so it must not be replayed, and the
+		// next record reuses its sequence number
+		w.dropPartialFrame()
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+
+	w.nextSeq++
+	w.records++
+	w.size += int64(frame.Len())
+	return nil
+}
+
+// dropPartialFrame removes whatever part of an uncommitted frame made it to
+// disk and moves back to where the next frame goes
+func (w *WAL) dropPartialFrame() {
+	if err := w.file.Truncate(w.size); err != nil {
+		log.Printf("Warning: failed to truncate write-ahead log after a failed append: %v", err)
+	}
+	if _, err := w.file.Seek(w.size, io.SeekStart); err != nil {
+		log.Printf("Warning: failed to seek write-ahead log after a failed append: %v", err)
+	}
+}
+
+// Reset discards all records. Call it only after their effects have been
+// written to a snapshot. If the log's data key is not wrapped by the active
+// master key and recovery key, a new header with a new data key is
+// written.
+func (w *WAL) Reset() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.cryptoService.DataKeyIsCurrent(w.wrappedKey) {
+		return w.writeHeader()
+	}
+
+	if err := w.file.Truncate(w.headerSize); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %w", err)
+	}
+	if _, err := w.file.Seek(w.headerSize, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek write-ahead log: %w", err)
+	}
+
+	w.nextSeq = 1
+	w.records = 0
+	w.size = w.headerSize
+	return nil
+}
+
+// KeyID returns the ID of the master key that wraps the log's data key
+func (w *WAL) KeyID() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.keyID
+}
+
+// Records returns the number of records currently in the log
+func (w *WAL) Records() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.records
+}
+
+// Size returns the size of the log file in bytes
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Close closes the log file
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
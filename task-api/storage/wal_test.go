@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"syscall"
+	"testing"
+)
+
+const testEncryptionKey = "test-encryption-key-0123456789abcdef"
+
+// newTestStorage returns initialized storage on an in-memory filesystem
+// that faults can be injected into
+func newTestStorage(t *testing.T) (*EncryptedStorage, *FaultyFilesystem) {
+	t.Helper()
+
+	fsys := NewFaultyFilesystem(NewMemoryFilesystem())
+	es := NewEncryptedStorage("/data", testEncryptionKey)
+	es.SetFilesystem(fsys)
+	if err := es.Initialize(); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return es, fsys
+}
+
+func walEntry(id string) WALEntry {
+	return WALEntry{Op: WALOpCreate, TaskID: id, Data: json.RawMessage(`{"id":"` + id + `"}`)}
+}
+
+func TestWALAppendDropsRecordWhenSyncFails(t *testing.T) {
+	es, fsys := newTestStorage(t)
+
+	wal, records, err := es.OpenWAL()
+	if err != nil {
+		t.Fatalf("OpenWAL: %v", err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("new log has %d records", len(records))
+	}
+
+	if err := wal.Append(walEntry("first")); err != nil {
+		t.Fatalf("Append first: %v", err)
+	}
+	size := wal.Size()
+
+	fsys.Inject(Fault{Op: FaultOpSync, Path: DefaultWALFile, Err: syscall.EIO, Count: 1})
+	if err := wal.Append(walEntry("failed")); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("Append with failing sync: got %v, want EIO", err)
+	}
+	if wal.Size() != size || wal.Records() != 1 {
+		t.Fatalf("failed append counted: size %d records %d, want %d and 1", wal.Size(), wal.Records(), size)
+	}
+
+	if err := wal.Append(walEntry("second")); err != nil {
+		t.Fatalf("Append second: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	_, records, err = es.OpenWAL()
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	var ids []string
+	for i, record := range records {
+		if record.Seq != uint64(i+1) {
+			t.Errorf("record %d has sequence number %d", i, record.Seq)
+		}
+		for _, entry := range record.Entries {
+			ids = append(ids, entry.TaskID)
+		}
+	}
+	if len(ids) != 2 || ids[0] != "first" || ids[1] != "second" {
+		t.Fatalf("replayed %v, want [first second]", ids)
+	}
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed cron expression. It accepts the standard five
+// fields (minute, hour, day of month, month, day of week) with lists,
+// ranges and steps, the descriptors @hourly, @daily, @midnight, @weekly,
+// @monthly, @yearly and @annually, and "@every <duration>".
+type CronSchedule struct {
+	expression string
+
+	// every is set for "@every" schedules, which ignore the fields below
+	every time.Duration
+
+	minute, hour, dayOfMonth, month, dayOfWeek uint64
+
+	// As in cron, when both day fields are restricted a day matches if
+	// either of them does
+	dayOfMonthAny, dayOfWeekAny bool
+}
+
+// cronField describes the allowed range of a cron field
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+var cronDescriptors = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// cronSearchLimit bounds the search for the next run of schedules that can
+// never fire, such as February 30th
+const cronSearchLimit = 5 * 366 * 24 * time.Hour
+
+// ParseCronSchedule parses a cron expression
+func ParseCronSchedule(expression string) (*CronSchedule, error) {
+	expression = strings.TrimSpace(expression)
+	schedule := &CronSchedule{expression: expression}
+
+	if strings.HasPrefix(expression, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expression, "@every ")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expression, err)
+		}
+		if every < time.Minute {
+			return nil, fmt.Errorf("invalid cron expression %q: interval must be at least 1m", expression)
+		}
+		schedule.every = every
+		return schedule, nil
+	}
+
+	spec := expression
+	if descriptor, ok := cronDescriptors[expression]; ok {
+		spec = descriptor
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expression)
+	}
+
+	sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %w", expression, err)
+		}
+		sets[i] = set
+	}
+
+	schedule.minute, schedule.hour, schedule.dayOfMonth, schedule.month = sets[0], sets[1], sets[2], sets[3]
+
+	// Sunday can be written as 0 or 7
+	schedule.dayOfWeek = sets[4]
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+
+	schedule.dayOfMonthAny = strings.HasPrefix(fields[2], "*")
+	schedule.dayOfWeekAny = strings.HasPrefix(fields[4], "*")
+
+	return schedule, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps
+// into a bit set
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			rangePart = part[:i]
+			step, err = strconv.Atoi(part[i+1:])
+			if err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %s field %q", spec.name, part)
+			}
+		}
+
+		low, high := spec.min, spec.max
+		switch {
+		case rangePart == "*":
+		case strings.Contains(rangePart, "-"):
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err1, err2 error
+			low, err1 = strconv.Atoi(bounds[0])
+			high, err2 = strconv.Atoi(bounds[1])
+			if err1 != nil || err2 != nil {
+				return 0, fmt.Errorf("invalid range in %s field %q", spec.name, part)
+			}
+		default:
+			value, err := strconv.Atoi(rangePart)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s field %q", spec.name, part)
+			}
+			low, high = value, value
+			if step > 1 {
+				// "5/15" means every 15 starting at 5
+				high = spec.max
+			}
+		}
+
+		if low < spec.min || high > spec.max || low > high {
+			return 0, fmt.Errorf("%s field %q is out of range %d-%d", spec.name, part, spec.min, spec.max)
+		}
+
+		for value := low; value <= high; value += step {
+			set |= 1 << uint(value)
+		}
+	}
+
+	if set == 0 {
+		return 0, errors.New("empty " + spec.name + " field")
+	}
+	return set, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *CronSchedule) String() string {
+	return s.expression
+}
+
+// Next returns the first time after t at which the schedule fires, or the
+// zero time if it never does. Fields are matched against the wall clock of
+// t's location: a time skipped when clocks go forward does not fire, and a
+// time repeated when they go back fires only the first time.
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	if s.every > 0 {
+		return t.Truncate(time.Second).Add(s.every)
+	}
+
+	limit := t.Add(cronSearchLimit)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = firstWallClock(time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = firstWallClock(time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = firstWallClock(time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location()))
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 || !firstWallClock(t).Equal(t) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// firstWallClock returns the first instant showing the same wall clock time
+// as t, which is earlier than t in the hour repeated when clocks go back.
+// time.Date may resolve such a time to either instant.
+func firstWallClock(t time.Time) time.Time {
+	_, offset := t.Zone()
+	_, before := t.Add(-3 * time.Hour).Zone()
+	if before <= offset {
+		return t
+	}
+
+	earlier := t.Add(-time.Duration(before-offset) * time.Second)
+	if _, earlierOffset := earlier.Zone(); earlierOffset != before {
+		return t
+	}
+	return earlier
+}
+
+// dayMatches applies the day of month and day of week fields to t
+func (s *CronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+
+	if s.dayOfMonthAny || s.dayOfWeekAny {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
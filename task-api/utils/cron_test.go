@@ -0,0 +1,146 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func loadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s is not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	utc := time.UTC
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, utc)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2024, 5, 1, 10, 0, 30, 0, utc), at(2024, 5, 1, 10, 1)},
+		{"strictly after", "0 * * * *", at(2024, 5, 1, 10, 0), at(2024, 5, 1, 11, 0)},
+		{"hourly", "@hourly", at(2024, 5, 1, 10, 15), at(2024, 5, 1, 11, 0)},
+		{"daily", "@daily", at(2024, 5, 1, 10, 15), at(2024, 5, 2, 0, 0)},
+		{"weekly on Sunday", "@weekly", at(2024, 5, 1, 10, 15), at(2024, 5, 5, 0, 0)},
+		{"Sunday as 7", "0 0 * * 7", at(2024, 5, 1, 10, 15), at(2024, 5, 5, 0, 0)},
+		{"list, range and step", "*/15 9-17 * * 1-5", at(2024, 5, 3, 17, 50), at(2024, 5, 6, 9, 0)},
+		{"step from a start", "5/20 * * * *", at(2024, 5, 1, 10, 45), at(2024, 5, 1, 11, 5)},
+		{"list", "0 8,20 * * *", at(2024, 5, 1, 8, 0), at(2024, 5, 1, 20, 0)},
+
+		// Month ends
+		{"monthly crosses a month end", "@monthly", at(2024, 1, 31, 10, 0), at(2024, 2, 1, 0, 0)},
+		{"31st skips short months", "0 12 31 * *", at(2024, 4, 1, 0, 0), at(2024, 5, 31, 12, 0)},
+		{"31st skips February", "0 12 31 * *", at(2024, 1, 31, 13, 0), at(2024, 3, 31, 12, 0)},
+		{"last minute of the year", "59 23 * * *", at(2024, 12, 31, 23, 58), at(2024, 12, 31, 23, 59)},
+		{"year end", "59 23 * * *", at(2024, 12, 31, 23, 59), at(2025, 1, 1, 23, 59)},
+		{"yearly", "@yearly", at(2024, 12, 31, 23, 59), at(2025, 1, 1, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(2023, 3, 1, 0, 0), at(2024, 2, 29, 0, 0)},
+		{"never", "0 0 30 2 *", at(2024, 1, 1, 0, 0), time.Time{}},
+
+		// With both day fields restricted either one matches
+		{"day of week before day of month", "0 0 13 * 5", at(2024, 9, 1, 0, 0), at(2024, 9, 6, 0, 0)},
+		{"day of month before day of week", "0 0 10 * 1", at(2024, 9, 9, 0, 0), at(2024, 9, 10, 0, 0)},
+		{"both day fields match", "0 0 13 * 5", at(2024, 9, 7, 0, 0), at(2024, 9, 13, 0, 0)},
+		{"day of week with any day of month", "0 0 * * 5", at(2024, 9, 7, 0, 0), at(2024, 9, 13, 0, 0)},
+		{"day of month with any day of week", "0 0 10 * *", at(2024, 9, 1, 0, 0), at(2024, 9, 10, 0, 0)},
+
+		// As in cron, a field starting with * counts as unrestricted even
+		// with a step, so both fields have to match
+		{"stepped star day of month", "0 0 */10 * 1", at(2024, 9, 1, 12, 0), at(2024, 10, 21, 0, 0)},
+		{"stepped star day of week", "0 0 15 * */2", at(2024, 9, 16, 0, 0), at(2024, 10, 15, 0, 0)},
+
+		{"every interval", "@every 90m", time.Date(2024, 5, 1, 10, 0, 30, 500, utc), time.Date(2024, 5, 1, 11, 30, 30, 0, utc)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := ParseCronSchedule(tc.expression)
+			if err != nil {
+				t.Fatalf("ParseCronSchedule(%q): %v", tc.expression, err)
+			}
+			if got := schedule.Next(tc.from); !got.Equal(tc.want) {
+				t.Errorf("Next(%s) = %s, want %s", tc.from, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestCronScheduleNextAcrossDST(t *testing.T) {
+	berlin := loadLocation(t, "Europe/Berlin")
+	newYork := loadLocation(t, "America/New_York")
+
+	// instant builds a time from its UTC offset, so both instants of a
+	// repeated wall clock time can be given
+	instant := func(loc *time.Location, year int, month time.Month, day, hour, min, offsetHours int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.FixedZone("", offsetHours*3600)).In(loc)
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		from       time.Time
+		want       time.Time
+	}{
+		// Berlin goes from 02:00 CET to 03:00 CEST on 2024-03-31
+		{"skipped time does not fire", "30 2 * * *", instant(berlin, 2024, 3, 30, 3, 0, 1), instant(berlin, 2024, 4, 1, 2, 30, 2)},
+		{"hourly across the gap", "0 * * * *", instant(berlin, 2024, 3, 31, 1, 30, 1), instant(berlin, 2024, 3, 31, 3, 0, 2)},
+		{"daily after the gap", "0 12 * * *", instant(berlin, 2024, 3, 30, 12, 0, 1), instant(berlin, 2024, 3, 31, 12, 0, 2)},
+
+		// Berlin goes from 03:00 CEST back to 02:00 CET on 2024-10-27
+		{"repeated time fires the first time", "30 2 * * *", instant(berlin, 2024, 10, 26, 12, 0, 2), instant(berlin, 2024, 10, 27, 2, 30, 2)},
+		{"repeated time does not fire again", "30 2 * * *", instant(berlin, 2024, 10, 27, 2, 30, 2), instant(berlin, 2024, 10, 28, 2, 30, 1)},
+		{"hourly skips the repeated hour", "0 * * * *", instant(berlin, 2024, 10, 27, 2, 0, 2), instant(berlin, 2024, 10, 27, 3, 0, 1)},
+		{"inside the repeated hour", "45 * * * *", instant(berlin, 2024, 10, 27, 2, 50, 2), instant(berlin, 2024, 10, 27, 3, 45, 1)},
+		{"from the repeated hour", "*/30 * * * *", instant(berlin, 2024, 10, 27, 2, 10, 1), instant(berlin, 2024, 10, 27, 3, 0, 1)},
+
+		// New York goes from 02:00 EDT back to 01:00 EST on 2024-11-03
+		{"repeated time fires once in New York", "30 1 * * *", instant(newYork, 2024, 11, 3, 1, 30, -4), instant(newYork, 2024, 11, 4, 1, 30, -5)},
+		{"first of the repeated time in New York", "30 1 * * *", instant(newYork, 2024, 11, 2, 12, 0, -4), instant(newYork, 2024, 11, 3, 1, 30, -4)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			schedule, err := ParseCronSchedule(tc.expression)
+			if err != nil {
+				t.Fatalf("ParseCronSchedule(%q): %v", tc.expression, err)
+			}
+			if got := schedule.Next(tc.from); !got.Equal(tc.want) {
+				t.Errorf("Next(%s) = %s, want %s", tc.from, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseCronScheduleInvalid(t *testing.T) {
+	for _, expression := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"a * * * *",
+		"1-a * * * *",
+		"@every 30s",
+		"@every often",
+		"@fortnightly",
+	} {
+		if _, err := ParseCronSchedule(expression); err == nil {
+			t.Errorf("ParseCronSchedule(%q) succeeded", expression)
+		}
+	}
+}
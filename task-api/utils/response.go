@@ -97,7 +97,12 @@ func ForbiddenResponse(c *gin.Context) {
 	ErrorResponseJSON(c, http.StatusForbidden, "Forbidden")
 }
 
-// ConflictResponse sends a 409 conflict response
-func ConflictResponse(c *gin.Context, errorMsg string) {
-	ErrorResponseJSON(c, http.StatusConflict, errorMsg)
+// ConflictResponse sends a 409 conflict response with the current state of
+// the resource, so the client can merge its change and retry
+func ConflictResponse(c *gin.Context, errorMsg string, current interface{}) {
+	c.JSON(http.StatusConflict, APIResponse{
+		Success: false,
+		Data:    current,
+		Error:   errorMsg,
+	})
 }
\ No newline at end of file